@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/nyaruka/gocommon/urns"
@@ -32,6 +33,12 @@ type Backend interface {
 	// NewIncomingMsg creates a new message from the given params
 	NewIncomingMsg(channel Channel, urn urns.URN, text string) Msg
 
+	// NewOutgoingMsg creates a new outgoing message from the given params, which courier can queue to be sent itself
+	NewOutgoingMsg(channel Channel, urn urns.URN, text string) Msg
+
+	// QueueOutgoingMsg writes the passed in outgoing message to our backend and queues it to be sent like any other
+	QueueOutgoingMsg(context.Context, Msg) error
+
 	// WriteMsg writes the passed in message to our backend
 	WriteMsg(context.Context, Msg) error
 
@@ -44,6 +51,10 @@ type Backend interface {
 	// WriteMsgStatus writes the passed in status update to our backend
 	WriteMsgStatus(context.Context, MsgStatus) error
 
+	// WriteMsgReadWatermark marks all the outgoing messages sent to the passed in URN on the passed in channel at or
+	// before the watermark as read
+	WriteMsgReadWatermark(ctx context.Context, channel Channel, urn urns.URN, watermark time.Time) error
+
 	// NewChannelEvent creates a new channel event for the given channel and event type
 	NewChannelEvent(Channel, ChannelEventType, urns.URN) ChannelEvent
 
@@ -53,8 +64,13 @@ type Backend interface {
 	// WriteChannelLogs writes the passed in channel logs to our backend
 	WriteChannelLogs(context.Context, []*ChannelLog) error
 
+	// SaveMedia saves the passed in media for the passed in channel, returning an attachment for it, that is the URL it
+	// can be fetched from prefixed by its content type
+	SaveMedia(ctx context.Context, channel Channel, contentType string, data []byte) (string, error)
+
 	// PopNextOutgoingMsg returns the next message that needs to be sent, callers should call MarkOutgoingMsgComplete with the
-	// returned message when they have dealt with the message (regardless of whether it was sent or not)
+	// returned message when they have dealt with the message (regardless of whether it was sent or not). Messages to the same
+	// URN on a channel are returned in order, the next one only once the previous one has been marked complete.
 	PopNextOutgoingMsg(context.Context) (Msg, error)
 
 	// WasMsgSent returns whether the backend thinks the passed in message was already sent. This can be used in cases where
@@ -66,6 +82,26 @@ type Backend interface {
 	// used to determine any sort of deduping of msg sends
 	MarkOutgoingMsgComplete(context.Context, Msg, MsgStatus)
 
+	// RequeueRateLimitedMsg puts the passed in message back on its queue because the channel's provider told us we are
+	// sending too fast, without counting it as a failed attempt. The channel is paused for retryAfter if it is non-zero,
+	// and then sends at a reduced rate which recovers gradually. The worker and URN the message held are released, so
+	// callers shouldn't call MarkOutgoingMsgComplete as the message hasn't been sent.
+	RequeueRateLimitedMsg(ctx context.Context, msg Msg, retryAfter time.Duration) error
+
+	// RerouteOutgoingMsg moves the passed in message to the passed in channel, so it is sent through and its statuses are
+	// recorded against that channel instead of its own, returning the message on its new channel
+	RerouteOutgoingMsg(ctx context.Context, msg Msg, channel Channel) (Msg, error)
+
+	// StartsConversation returns whether the passed in message is the first sent to its contact on its channel within
+	// the passed in window, starting a new conversation window if it is
+	StartsConversation(ctx context.Context, msg Msg, window time.Duration) (bool, error)
+
+	// SaveShortLink saves the passed in short link so that it can be looked up by its key when clicked
+	SaveShortLink(ctx context.Context, link *ShortLink) error
+
+	// GetShortLink returns the short link with the passed in key, or ErrShortLinkNotFound if it doesn't exist or has expired
+	GetShortLink(ctx context.Context, key string) (*ShortLink, error)
+
 	// StopMsgContact marks the contact for the passed in msg as stopped
 	StopMsgContact(context.Context, Msg)
 
@@ -3,8 +3,11 @@ package rapidpro
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"mime"
 	"net/url"
 	"path"
 	"strings"
@@ -32,6 +35,9 @@ const msgQueueName = "msgs"
 // the name of our set for tracking sends
 const sentSetName = "msgs_sent_%s"
 
+// the key of the short links in outgoing messages
+const shortLinkKey = "short_link:%s"
+
 // constants used in org configs for chatbase
 const chatbaseAPIKey = "CHATBASE_API_KEY"
 const chatbaseVersion = "CHATBASE_VERSION"
@@ -84,18 +90,26 @@ func (b *backend) NewOutgoingMsg(channel courier.Channel, urn urns.URN, text str
 	return newMsg(MsgOutgoing, channel, urn, text)
 }
 
+// the most msgs we skip or defer in one call to PopNextOutgoingMsg, so that one call never works through a whole queue
+// of msgs which can't be sent yet
+const maxPopSkips = 10
+
 // PopNextOutgoingMsg pops the next message that needs to be sent
 func (b *backend) PopNextOutgoingMsg(ctx context.Context) (courier.Msg, error) {
 	// pop the next message off our queue
 	rc := b.redisPool.Get()
 	defer rc.Close()
 
-	token, msgJSON, err := queue.PopFromQueue(rc, msgQueueName)
-	for token == queue.Retry {
-		token, msgJSON, err = queue.PopFromQueue(rc, msgQueueName)
-	}
+	for skipped := 0; skipped < maxPopSkips; skipped++ {
+		token, msgJSON, err := queue.PopFromPriorityQueue(rc, msgQueueName, b.priorityLevels(), b.priorityAging(), urnLockTTL)
+		for token == queue.Retry {
+			token, msgJSON, err = queue.PopFromPriorityQueue(rc, msgQueueName, b.priorityLevels(), b.priorityAging(), urnLockTTL)
+		}
+
+		if msgJSON == "" {
+			return nil, nil
+		}
 
-	if msgJSON != "" {
 		dbMsg := &DBMsg{}
 		err = json.Unmarshal([]byte(msgJSON), dbMsg)
 		if err != nil {
@@ -110,12 +124,138 @@ func (b *backend) PopNextOutgoingMsg(ctx context.Context) (courier.Msg, error) {
 		}
 		dbMsg.channel = channel.(*DBChannel)
 		dbMsg.workerToken = token
+
+		// keep the rate limit bucket our channel's queue shares with other queues up to date
+		bucket, bucketTPS := tpsBucket(dbMsg.channel)
+		err = queue.SetQueueBucket(rc, msgQueueName, token, bucket, bucketTPS)
+		if err != nil {
+			logrus.WithError(err).WithField("channel_uuid", dbMsg.channel.UUID()).Error("error setting tps bucket")
+		}
+
+		// msgs we can't send now are completed without being sent, and we move on to the next one
+		if b.skipIfContactStopped(ctx, rc, dbMsg) || b.deferIfOutsideSendWindow(rc, dbMsg, msgJSON) {
+			queue.MarkComplete(rc, msgQueueName, token)
+			continue
+		}
+
 		return dbMsg, nil
 	}
 
+	// we've skipped as many msgs as we will in one call, our caller will call us again
 	return nil, nil
 }
 
+// skipIfContactStopped fails the passed in popped msg instead of sending it if its contact opted out after it was queued,
+// returning whether it did
+func (b *backend) skipIfContactStopped(ctx context.Context, rc redis.Conn, msg *DBMsg) bool {
+	stopped, err := isMsgContactStopped(rc, msg)
+	if err != nil {
+		logrus.WithError(err).WithField("msg_id", msg.ID_.String()).Error("error checking whether contact is stopped")
+	}
+	if stopped {
+		b.skipStoppedMsg(ctx, msg)
+	}
+	return stopped
+}
+
+// deferIfOutsideSendWindow puts the passed in popped msg back on our queue until its channel's send window opens if we
+// are outside of it, returning whether it did
+func (b *backend) deferIfOutsideSendWindow(rc redis.Conn, msg *DBMsg, msgJSON string) bool {
+	deferUntil := b.sendWindowOpens(msg)
+	if deferUntil.IsZero() {
+		return false
+	}
+
+	levels := b.priorityLevels()
+	err := queue.DeferToQueue(rc, msgQueueName, msg.workerToken, "["+msgJSON+"]", msg.queuePriority(levels), levels, deferUntil)
+	if err != nil {
+		logrus.WithError(err).WithField("msg_id", msg.ID_.String()).Error("error deferring msg")
+	}
+	return true
+}
+
+// tpsBucket returns the name and limit of the rate limit bucket the passed in channel shares with other channels, from
+// its own config or its org's, or an empty name if it doesn't share one
+func tpsBucket(channel *DBChannel) (string, int) {
+	limit := channel.IntConfigForKey(courier.ConfigTPSBucketLimit, 0)
+	if limit <= 0 {
+		switch orgLimit := channel.OrgConfigForKey(courier.ConfigTPSBucketLimit, 0).(type) {
+		case float64:
+			limit = int(orgLimit)
+		case int:
+			limit = orgLimit
+		}
+	}
+	if limit <= 0 {
+		return "", 0
+	}
+
+	bucket := channel.StringConfigForKey(courier.ConfigTPSBucket, "")
+	if bucket == "" {
+		bucket, _ = channel.OrgConfigForKey(courier.ConfigTPSBucket, "").(string)
+	}
+	if bucket == "" {
+		bucket = fmt.Sprintf("org:%d", channel.OrgID().Int64)
+	}
+	return bucket, limit
+}
+
+// priorityLevels returns the number of priority levels we pop outgoing msgs from
+func (b *backend) priorityLevels() int {
+	if b.config.PriorityLevels <= 0 {
+		return queue.DefaultPriorityLevels
+	}
+	return b.config.PriorityLevels
+}
+
+// how long the URN of a popped msg stays locked for if its sender never marks it as complete, longer than a sender can
+// take so the next msg to the URN is never sent first, but messages to the URN stall for this long if a sender crashes
+const urnLockTTL = courier.MaxSendDuration + time.Second*30
+
+// priorityAging returns how long a queued msg waits before it is treated as one priority level higher, zero if never
+func (b *backend) priorityAging() time.Duration {
+	return time.Duration(b.config.PriorityAging) * time.Second
+}
+
+// sendWindowOpens returns when the send window of the passed in msg's channel next opens if the msg can't be sent now
+// because of it, otherwise the zero time
+func (b *backend) sendWindowOpens(msg *DBMsg) time.Time {
+	window, err := courier.SendWindowForChannel(msg.channel)
+	if err != nil {
+		logrus.WithError(err).WithField("channel_uuid", msg.channel.UUID()).Error("invalid send window, ignoring")
+		return time.Time{}
+	}
+	if window == nil || !window.AppliesTo(msg.HighPriority()) {
+		return time.Time{}
+	}
+
+	now := time.Now()
+	opens := window.NextOpen(now)
+	if opens.After(now) {
+		return opens
+	}
+	return time.Time{}
+}
+
+// skipStoppedMsg fails the passed in msg because its contact has opted out
+func (b *backend) skipStoppedMsg(ctx context.Context, msg *DBMsg) {
+	log := courier.NewChannelLogFromError("Message Skipped", msg.channel, msg.ID_, time.Duration(0), fmt.Errorf("contact has opted out"))
+
+	status := newMsgStatus(msg.channel, msg.ID_, "", courier.MsgFailed)
+	status.SetError(courier.MsgErrorOptedOut, "")
+	status.AddLog(log)
+
+	err := b.WriteMsgStatus(ctx, status)
+	if err != nil {
+		logrus.WithError(err).WithField("msg_id", msg.ID_.String()).Error("error writing status for skipped msg")
+	}
+
+	err = b.WriteChannelLogs(ctx, status.Logs())
+	if err != nil {
+		logrus.WithError(err).WithField("msg_id", msg.ID_.String()).Error("error writing logs for skipped msg")
+	}
+}
+
 var luaSent = redis.NewScript(3,
 	`-- KEYS: [TodayKey, YesterdayKey, MsgId]
      local found = redis.call("sismember", KEYS[1], KEYS[3])
@@ -136,6 +276,48 @@ func (b *backend) WasMsgSent(ctx context.Context, msg courier.Msg) (bool, error)
 	return redis.Bool(luaSent.Do(rc, todayKey, yesterdayKey, msg.ID().String()))
 }
 
+const updateMsgChannel = `
+UPDATE msgs_msg SET channel_id = $2, modified_on = NOW() WHERE id = $1
+`
+
+// RerouteOutgoingMsg moves the passed in msg to the passed in channel, returning a copy of the msg on that channel
+func (b *backend) RerouteOutgoingMsg(ctx context.Context, msg courier.Msg, channel courier.Channel) (courier.Msg, error) {
+	dbChannel := channel.(*DBChannel)
+
+	_, err := b.db.ExecContext(ctx, updateMsgChannel, msg.ID(), dbChannel.ID())
+	if err != nil {
+		return nil, err
+	}
+
+	rerouted := *msg.(*DBMsg)
+	rerouted.channel = dbChannel
+	rerouted.ChannelID_ = dbChannel.ID()
+	rerouted.ChannelUUID_ = dbChannel.UUID()
+	return &rerouted, nil
+}
+
+// RequeueRateLimitedMsg puts the passed in msg back at the front of its queue and slows down its channel, because its
+// provider told us we are sending too fast, releasing the worker and URN lock it held
+func (b *backend) RequeueRateLimitedMsg(ctx context.Context, msg courier.Msg, retryAfter time.Duration) error {
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	dbMsg := msg.(*DBMsg)
+	msgJSON, err := json.Marshal(dbMsg)
+	if err != nil {
+		return err
+	}
+
+	err = queue.RateLimitQueue(rc, msgQueueName, dbMsg.workerToken, "["+string(msgJSON)+"]", dbMsg.queuePriority(b.priorityLevels()), b.priorityLevels(), retryAfter)
+	if err != nil {
+		return err
+	}
+
+	// release our worker and the URN lock without completing the msg, it will be sent when it is popped again
+	clearMsgSeen(rc, dbMsg)
+	return queue.MarkComplete(rc, msgQueueName, dbMsg.workerToken)
+}
+
 // MarkOutgoingMsgComplete marks the passed in message as having completed processing, freeing up a worker for that channel
 func (b *backend) MarkOutgoingMsgComplete(ctx context.Context, msg courier.Msg, status courier.MsgStatus) {
 	rc := b.redisPool.Get()
@@ -168,6 +350,52 @@ func (b *backend) MarkOutgoingMsgComplete(ctx context.Context, msg courier.Msg,
 	}
 }
 
+// StartsConversation returns whether the passed in msg is the first sent to its contact on its channel in the passed in window
+func (b *backend) StartsConversation(ctx context.Context, msg courier.Msg, window time.Duration) (bool, error) {
+	return startsConversation(b, msg.(*DBMsg), window)
+}
+
+// SaveShortLink saves the passed in short link to redis, where it expires after our configured number of days, or never
+// if that is zero
+func (b *backend) SaveShortLink(ctx context.Context, link *courier.ShortLink) error {
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	linkJSON, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+
+	if b.config.ShortLinkExpiration <= 0 {
+		_, err = rc.Do("set", fmt.Sprintf(shortLinkKey, link.Key), linkJSON)
+		return err
+	}
+
+	_, err = rc.Do("set", fmt.Sprintf(shortLinkKey, link.Key), linkJSON, "ex", b.config.ShortLinkExpiration*60*60*24)
+	return err
+}
+
+// GetShortLink returns the short link with the passed in key from redis
+func (b *backend) GetShortLink(ctx context.Context, key string) (*courier.ShortLink, error) {
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	linkJSON, err := redis.Bytes(rc.Do("get", fmt.Sprintf(shortLinkKey, key)))
+	if err == redis.ErrNil {
+		return nil, courier.ErrShortLinkNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	link := &courier.ShortLink{}
+	err = json.Unmarshal(linkJSON, link)
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
 // StopMsgContact marks the contact for the passed in msg as stopped, that is they no longer want to receive messages
 func (b *backend) StopMsgContact(ctx context.Context, m courier.Msg) {
 	rc := b.redisPool.Get()
@@ -175,6 +403,12 @@ func (b *backend) StopMsgContact(ctx context.Context, m courier.Msg) {
 
 	dbMsg := m.(*DBMsg)
 	queueStopContact(rc, dbMsg.OrgID_, dbMsg.ContactID_)
+
+	// skip any other msgs to this contact which are still queued
+	err := markContactStopped(rc, dbMsg.ContactID_, time.Now())
+	if err != nil {
+		logrus.WithError(err).WithField("contact_id", dbMsg.ContactID_.Int64).Error("error marking contact as stopped")
+	}
 }
 
 // WriteMsg writes the passed in message to our store
@@ -185,6 +419,14 @@ func (b *backend) WriteMsg(ctx context.Context, m courier.Msg) error {
 	return writeMsg(timeout, b, m)
 }
 
+// QueueOutgoingMsg writes the passed in outgoing msg to our store and queues it to be sent
+func (b *backend) QueueOutgoingMsg(ctx context.Context, m courier.Msg) error {
+	timeout, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+
+	return queueOutgoingMsg(timeout, b, m.(*DBMsg))
+}
+
 // NewStatusUpdateForID creates a new Status object for the given message id
 func (b *backend) NewMsgStatusForID(channel courier.Channel, id courier.MsgID, status courier.MsgStatusValue) courier.MsgStatus {
 	return newMsgStatus(channel, id, "", status)
@@ -225,6 +467,14 @@ func (b *backend) WriteMsgStatus(ctx context.Context, status courier.MsgStatus)
 	return nil
 }
 
+// WriteMsgReadWatermark marks all the outgoing msgs sent to the passed in URN at or before the watermark as read
+func (b *backend) WriteMsgReadWatermark(ctx context.Context, channel courier.Channel, urn urns.URN, watermark time.Time) error {
+	timeout, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+
+	return writeMsgReadWatermark(timeout, b, channel, urn, watermark)
+}
+
 // NewChannelEvent creates a new channel event with the passed in parameters
 func (b *backend) NewChannelEvent(channel courier.Channel, eventType courier.ChannelEventType, urn urns.URN) courier.ChannelEvent {
 	return newChannelEvent(channel, eventType, urn)
@@ -252,6 +502,24 @@ func (b *backend) WriteChannelLogs(ctx context.Context, logs []*courier.ChannelL
 	return nil
 }
 
+// SaveMedia saves the passed in media to S3 for the org of the passed in channel, returning the attachment for it
+func (b *backend) SaveMedia(ctx context.Context, channel courier.Channel, contentType string, data []byte) (string, error) {
+	dbChannel, isDBChannel := channel.(*DBChannel)
+	if !isDBChannel {
+		return "", fmt.Errorf("unable to save media for channel of type %T", channel)
+	}
+
+	hash := sha256.Sum256(data)
+
+	extension := ""
+	extensions, err := mime.ExtensionsByType(contentType)
+	if extensions != nil && err == nil {
+		extension = extensions[0][1:]
+	}
+
+	return storeMedia(b, channel, dbChannel.OrgID(), hex.EncodeToString(hash[:]), int64(len(data)), contentType, extension, bytes.NewReader(data))
+}
+
 // Health returns the health of this backend as a string, returning "" if all is well
 func (b *backend) Health() string {
 	// test redis
@@ -280,10 +548,18 @@ func (b *backend) Status() string {
 	rc := b.redisPool.Get()
 	defer rc.Close()
 
+	// we show the size of each priority level, highest first
+	levels := b.priorityLevels()
+	header := bytes.Buffer{}
+	for priority := levels - 1; priority >= 0; priority-- {
+		header.WriteString(fmt.Sprintf("% 9s | ", fmt.Sprintf("Size/%d", priority)))
+	}
+	divider := strings.Repeat("-", 72+header.Len()) + "\n"
+
 	status := bytes.Buffer{}
-	status.WriteString("------------------------------------------------------------------------------------\n")
-	status.WriteString("     Size | Bulk Size | Workers | TPS | Type | Channel              \n")
-	status.WriteString("------------------------------------------------------------------------------------\n")
+	status.WriteString(divider)
+	status.WriteString(header.String() + " Deferred | Workers | TPS | Type | Channel              \n")
+	status.WriteString(divider)
 
 	var queue string
 	var workers float64
@@ -291,6 +567,7 @@ func (b *backend) Status() string {
 	// get all our queues
 	rc.Send("zrevrangebyscore", fmt.Sprintf("%s:active", msgQueueName), "+inf", "-inf", "withscores")
 	rc.Send("zrevrangebyscore", fmt.Sprintf("%s:throttled", msgQueueName), "+inf", "-inf", "withscores")
+	rc.Send("zrevrangebyscore", fmt.Sprintf("%s:future", msgQueueName), "+inf", "-inf", "withscores")
 	rc.Flush()
 
 	active, err := redis.Values(rc.Receive())
@@ -301,14 +578,26 @@ func (b *backend) Status() string {
 	if err != nil {
 		return fmt.Sprintf("unable to read throttled queues: %v", err)
 	}
-	values := append(active, throttled...)
+	future, err := redis.Values(rc.Receive())
+	if err != nil {
+		return fmt.Sprintf("unable to read future queues: %v", err)
+	}
+	values := append(append(active, throttled...), future...)
+	now := fmt.Sprintf("(%f", float64(time.Now().UnixNano())/float64(time.Second))
 
+	seen := make(map[string]bool)
 	for len(values) > 0 {
 		values, err = redis.Scan(values, &queue, &workers)
 		if err != nil {
 			return fmt.Sprintf("error reading active queues: %v", err)
 		}
 
+		// a queue can be both active and have items in the future
+		if seen[queue] {
+			continue
+		}
+		seen[queue] = true
+
 		// our queue name is in the format msgs:uuid|tps, break it apart
 		queue = strings.TrimPrefix(queue, "msgs:")
 		parts := strings.Split(queue, "|")
@@ -326,19 +615,25 @@ func (b *backend) Status() string {
 			channelType = channel.ChannelType().String()
 		}
 
-		// get # of items in our normal queue
-		size, err := redis.Int64(rc.Do("zcard", fmt.Sprintf("%s:%s/1", msgQueueName, queue)))
-		if err != nil {
-			return fmt.Sprintf("error reading queue size: %v", err)
-		}
+		// get # of items in each priority level, and # of items which can't be sent until later, such as those deferred
+		// until their send window opens
+		deferred := int64(0)
+		for priority := levels - 1; priority >= 0; priority-- {
+			priorityQueue := fmt.Sprintf("%s:%s/%d", msgQueueName, queue, priority)
+			size, err := redis.Int64(rc.Do("zcard", priorityQueue))
+			if err != nil {
+				return fmt.Sprintf("error reading queue size: %v", err)
+			}
+			status.WriteString(fmt.Sprintf("% 9d   ", size))
 
-		// get # of items in the bulk queue
-		bulkSize, err := redis.Int64(rc.Do("zcard", fmt.Sprintf("%s:%s/0", msgQueueName, queue)))
-		if err != nil {
-			return fmt.Sprintf("error reading bulk queue size: %v", err)
+			count, err := redis.Int64(rc.Do("zcount", priorityQueue, now, "+inf"))
+			if err != nil {
+				return fmt.Sprintf("error reading deferred size: %v", err)
+			}
+			deferred += count
 		}
 
-		status.WriteString(fmt.Sprintf("% 9d   % 9d   % 7d   % 3s   % 4s   %s\n", size, bulkSize, int(workers), tps, channelType, uuid))
+		status.WriteString(fmt.Sprintf("% 9d   % 7d   % 3s   % 4s   %s\n", deferred, int(workers), tps, channelType, uuid))
 	}
 
 	return status.String()
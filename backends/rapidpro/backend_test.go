@@ -17,11 +17,15 @@ import (
 
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/buger/jsonparser"
+	"github.com/garyburd/redigo/redis"
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/queue"
+	"github.com/nyaruka/courier/utils"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/suite"
+	null "gopkg.in/guregu/null.v3"
 )
 
 type BackendTestSuite struct {
@@ -31,9 +35,11 @@ type BackendTestSuite struct {
 
 type mockS3Client struct {
 	s3iface.S3API
+	puts int
 }
 
 func (m *mockS3Client) PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	m.puts++
 	return nil, nil
 }
 
@@ -457,6 +463,219 @@ func (ts *BackendTestSuite) TestMsgStatus() {
 	ts.Equal(m.ErrorCount_, 3)
 }
 
+func (ts *BackendTestSuite) TestMsgRead() {
+	ctx := context.Background()
+	channel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	// mark our msg as read
+	status := ts.b.NewMsgStatusForID(channel, courier.NewMsgID(10001), courier.MsgRead)
+	err := ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+	m, err := readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.NoError(err)
+	ts.Equal(courier.MsgRead, m.Status_)
+
+	// a late delivery report doesn't take us backwards
+	status = ts.b.NewMsgStatusForID(channel, courier.NewMsgID(10001), courier.MsgDelivered)
+	err = ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+	m, err = readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.NoError(err)
+	ts.Equal(courier.MsgRead, m.Status_)
+
+	// a read watermark marks everything sent to the contact before it as read
+	status = ts.b.NewMsgStatusForID(channel, courier.NewMsgID(10000), courier.MsgSent)
+	err = ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+
+	err = ts.b.WriteMsgReadWatermark(ctx, channel, urns.URN("tel:+12067799192"), time.Now().Add(-time.Hour))
+	ts.NoError(err)
+	m, err = readMsgFromDB(ts.b, courier.NewMsgID(10000))
+	ts.NoError(err)
+	ts.Equal(courier.MsgSent, m.Status_)
+
+	err = ts.b.WriteMsgReadWatermark(ctx, channel, urns.URN("tel:+12067799192"), time.Now().Add(time.Minute))
+	ts.NoError(err)
+	m, err = readMsgFromDB(ts.b, courier.NewMsgID(10000))
+	ts.NoError(err)
+	ts.Equal(courier.MsgRead, m.Status_)
+}
+
+func (ts *BackendTestSuite) TestMsgStatusError() {
+	ctx := context.Background()
+	channel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	// fail our msg because the contact opted out
+	status := ts.b.NewMsgStatusForID(channel, courier.NewMsgID(10001), courier.MsgFailed)
+	status.SetError(courier.MsgErrorOptedOut, "21610")
+	err := ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+
+	m, err := readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.NoError(err)
+	ts.Equal(courier.MsgFailed, m.Status_)
+
+	category, _ := jsonparser.GetString(m.Metadata_, "error_category")
+	code, _ := jsonparser.GetString(m.Metadata_, "error_code")
+	ts.Equal("opted_out", category)
+	ts.Equal("21610", code)
+}
+
+func (ts *BackendTestSuite) TestMsgStatusHistory() {
+	ctx := context.Background()
+	channel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	ts.b.config.StatusHistory = true
+	defer func() { ts.b.config.StatusHistory = false }()
+
+	ts.b.db.MustExec(`UPDATE msgs_msg SET status = 'Q' WHERE id = $1`, 10000)
+
+	// our msg is wired by the sender
+	status := ts.b.NewMsgStatusForID(channel, courier.NewMsgID(10000), courier.MsgWired)
+	status.SetSource(courier.MsgStatusSourceSend)
+	err := ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+
+	// then delivered
+	status = ts.b.NewMsgStatusForID(channel, courier.NewMsgID(10000), courier.MsgDelivered)
+	status.SetRawStatus("delivered")
+	err = ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+
+	// and then a late sent report arrives, which doesn't take us backwards
+	status = ts.b.NewMsgStatusForID(channel, courier.NewMsgID(10000), courier.MsgSent)
+	status.SetRawStatus("sent")
+	err = ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+
+	m, err := readMsgFromDB(ts.b, courier.NewMsgID(10000))
+	ts.NoError(err)
+	ts.Equal(courier.MsgDelivered, m.Status_)
+
+	// then a read watermark from the contact covers it
+	err = ts.b.WriteMsgReadWatermark(ctx, channel, urns.URN("tel:+12067799192"), time.Now().Add(time.Minute))
+	ts.NoError(err)
+
+	// but every report is in our history
+	type historyRow struct {
+		Status         courier.MsgStatusValue  `db:"status"`
+		PreviousStatus courier.MsgStatusValue  `db:"previous_status"`
+		CurrentStatus  courier.MsgStatusValue  `db:"current_status"`
+		Source         courier.MsgStatusSource `db:"source"`
+		RawStatus      string                  `db:"raw_status"`
+	}
+	history := []historyRow{}
+	err = ts.b.db.Select(&history, `SELECT status, previous_status, current_status, source, raw_status FROM msgs_msgstatushistory WHERE msg_id = $1 ORDER BY id`, 10000)
+	ts.NoError(err)
+	ts.Equal([]historyRow{
+		{courier.MsgWired, courier.MsgQueued, courier.MsgWired, courier.MsgStatusSourceSend, ""},
+		{courier.MsgDelivered, courier.MsgWired, courier.MsgDelivered, courier.MsgStatusSourceCallback, "delivered"},
+		{courier.MsgSent, courier.MsgDelivered, courier.MsgDelivered, courier.MsgStatusSourceCallback, "sent"},
+		{courier.MsgRead, courier.MsgDelivered, courier.MsgRead, courier.MsgStatusSourceCallback, ""},
+	}, history)
+}
+
+func (ts *BackendTestSuite) TestMsgStatusLateCallbacks() {
+	ctx := context.Background()
+	channel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	ts.b.db.MustExec(`UPDATE msgs_msg SET status = 'Q' WHERE id = $1`, 10000)
+
+	writeStatus := func(value courier.MsgStatusValue, source courier.MsgStatusSource) courier.MsgStatusValue {
+		status := ts.b.NewMsgStatusForID(channel, courier.NewMsgID(10000), value)
+		status.SetSource(source)
+		ts.NoError(ts.b.WriteMsgStatus(ctx, status))
+
+		m, err := readMsgFromDB(ts.b, courier.NewMsgID(10000))
+		ts.NoError(err)
+		return m.Status_
+	}
+
+	// our msg is wired, then the provider tells us it failed
+	ts.Equal(courier.MsgWired, writeStatus(courier.MsgWired, courier.MsgStatusSourceSend))
+	ts.Equal(courier.MsgFailed, writeStatus(courier.MsgFailed, courier.MsgStatusSourceCallback))
+
+	// late sent and delivered reports don't undo that failure
+	ts.Equal(courier.MsgFailed, writeStatus(courier.MsgSent, courier.MsgStatusSourceCallback))
+	ts.Equal(courier.MsgFailed, writeStatus(courier.MsgDelivered, courier.MsgStatusSourceCallback))
+	ts.Equal(courier.MsgFailed, writeStatus(courier.MsgErrored, courier.MsgStatusSourceCallback))
+
+	// but sending it again does
+	ts.Equal(courier.MsgWired, writeStatus(courier.MsgWired, courier.MsgStatusSourceSend))
+	ts.Equal(courier.MsgDelivered, writeStatus(courier.MsgDelivered, courier.MsgStatusSourceCallback))
+
+	// and a late sent report doesn't take a delivered msg backwards
+	ts.Equal(courier.MsgDelivered, writeStatus(courier.MsgSent, courier.MsgStatusSourceCallback))
+}
+
+func (ts *BackendTestSuite) TestMultipartMsgStatus() {
+	ctx := context.Background()
+	channel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	// our msg was sent in two parts
+	status := ts.b.NewMsgStatusForID(channel, courier.NewMsgID(10001), courier.MsgWired)
+	status.AddExternalID("part1")
+	status.AddExternalID("part2")
+	err := ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+	m, err := readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.NoError(err)
+	ts.Equal(courier.MsgWired, m.Status_)
+	ts.Equal("part1", m.ExternalID_.String)
+
+	// first part is delivered, but our msg isn't until both are
+	status = ts.b.NewMsgStatusForExternalID(channel, "part1", courier.MsgDelivered)
+	err = ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+	m, err = readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.NoError(err)
+	ts.Equal(courier.MsgWired, m.Status_)
+
+	// second part is sent, so our msg is sent
+	status = ts.b.NewMsgStatusForExternalID(channel, "part2", courier.MsgSent)
+	err = ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+	m, err = readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.NoError(err)
+	ts.Equal(courier.MsgSent, m.Status_)
+
+	// a late sent status for the first part doesn't undo its delivery
+	status = ts.b.NewMsgStatusForExternalID(channel, "part1", courier.MsgSent)
+	err = ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+
+	// both delivered, our msg is delivered
+	status = ts.b.NewMsgStatusForExternalID(channel, "part2", courier.MsgDelivered)
+	err = ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+	m, err = readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.NoError(err)
+	ts.Equal(courier.MsgDelivered, m.Status_)
+
+	// a part of another msg fails, our msg fails with the error of that part
+	status = ts.b.NewMsgStatusForID(channel, courier.NewMsgID(10000), courier.MsgWired)
+	status.AddExternalID("part3")
+	status.AddExternalID("part4")
+	err = ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+
+	status = ts.b.NewMsgStatusForExternalID(channel, "part4", courier.MsgFailed)
+	status.SetError(courier.MsgErrorContentRejected, "30007")
+	err = ts.b.WriteMsgStatus(ctx, status)
+	ts.NoError(err)
+	m, err = readMsgFromDB(ts.b, courier.NewMsgID(10000))
+	ts.NoError(err)
+	ts.Equal(courier.MsgFailed, m.Status_)
+	category, _ := jsonparser.GetString(m.Metadata_, "error_category")
+	code, _ := jsonparser.GetString(m.Metadata_, "error_code")
+	ts.Equal("content_rejected", category)
+	ts.Equal("30007", code)
+
+	ts.Equal(courier.MsgFailed, combinePartStatuses([]courier.MsgStatusValue{courier.MsgDelivered, courier.MsgFailed}))
+	ts.Equal(courier.MsgErrored, combinePartStatuses([]courier.MsgStatusValue{courier.MsgErrored, courier.MsgSent}))
+	ts.Equal(courier.MsgWired, combinePartStatuses([]courier.MsgStatusValue{courier.MsgDelivered, courier.MsgWired}))
+}
+
 func (ts *BackendTestSuite) TestHealth() {
 	// all should be well in test land
 	ts.Equal(ts.b.Health(), "")
@@ -505,6 +724,48 @@ func (ts *BackendTestSuite) TestDupes() {
 	ts.NotEqual(uuid2, msg.UUID().String())
 }
 
+func (ts *BackendTestSuite) TestExternalIDDupes() {
+	ctx := context.Background()
+	knChannel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	urn, _ := urns.NewTelURNForCountry("12065551216", knChannel.Country())
+
+	// our window is disabled by default
+	window := ts.b.config.DedupeWindow
+	ts.b.config.DedupeWindow = 60 * 60 * 24
+	defer func() { ts.b.config.DedupeWindow = window }()
+
+	msg := ts.b.NewIncomingMsg(knChannel, urn, "yes").WithExternalID("ext-dupe-1").(*DBMsg)
+	err := ts.b.WriteMsg(ctx, msg)
+	ts.NoError(err)
+	uuid1 := msg.UUID()
+
+	// a retry of the same external id, even much later, gets the original UUID and isn't written again
+	msg = ts.b.NewIncomingMsg(knChannel, urn, "yes").WithExternalID("ext-dupe-1").(*DBMsg)
+	err = ts.b.WriteMsg(ctx, msg)
+	ts.NoError(err)
+	ts.Equal(uuid1, msg.UUID())
+	ts.True(msg.alreadyWritten)
+	ts.Equal(courier.NilMsgID, msg.ID())
+
+	// the same text with a new external id is a new msg
+	msg = ts.b.NewIncomingMsg(knChannel, urn, "yes").WithExternalID("ext-dupe-2").(*DBMsg)
+	err = ts.b.WriteMsg(ctx, msg)
+	ts.NoError(err)
+	ts.NotEqual(uuid1, msg.UUID())
+	ts.False(msg.alreadyWritten)
+	ts.NotEqual(courier.NilMsgID, msg.ID())
+	uuid2 := msg.UUID()
+
+	// with our window disabled we fall back to deduping by text
+	ts.b.config.DedupeWindow = 0
+
+	msg = ts.b.NewIncomingMsg(knChannel, urn, "yes").WithExternalID("ext-dupe-3").(*DBMsg)
+	err = ts.b.WriteMsg(ctx, msg)
+	ts.NoError(err)
+	ts.Equal(uuid2, msg.UUID())
+	ts.True(msg.alreadyWritten)
+}
+
 func (ts *BackendTestSuite) TestStatus() {
 	// our health should just contain the header
 	ts.True(strings.Contains(ts.b.Status(), "Channel"), ts.b.Status())
@@ -588,6 +849,367 @@ func (ts *BackendTestSuite) TestOutgoingQueue() {
 	ts.False(sent)
 }
 
+func (ts *BackendTestSuite) TestQueueOutgoingMsg() {
+	ctx := context.Background()
+	knChannel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	urn, _ := urns.NewTelURNForCountry("12065551212", knChannel.Country())
+
+	// our channel shares a rate limit bucket with the rest of our org
+	knChannel.Config_.Map[courier.ConfigTPSBucketLimit] = float64(20)
+	defer delete(knChannel.Config_.Map, courier.ConfigTPSBucketLimit)
+
+	// queue a msg of our own
+	err := ts.b.QueueOutgoingMsg(ctx, ts.b.NewOutgoingMsg(knChannel, urn, "You have been unsubscribed"))
+	ts.NoError(err)
+
+	// the bucket of our channel's queue is set before it is first popped from
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+	bucket, err := redis.String(r.Do("hget", "msgs:buckets", "msgs:dbc126ed-66bc-4e28-b67b-81dc3327c95d|10"))
+	ts.NoError(err)
+	ts.Equal(fmt.Sprintf("org:%d|20", knChannel.OrgID().Int64), bucket)
+
+	// it's written to our db as queued
+	msg, err := ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	if ts.NotNil(msg) {
+		ts.NotEqual(courier.NilMsgID, msg.ID())
+		ts.Equal("You have been unsubscribed", msg.Text())
+		ts.True(msg.HighPriority())
+
+		m, err := readMsgFromDB(ts.b, msg.ID())
+		ts.NoError(err)
+		ts.Equal(MsgOutgoing, m.Direction_)
+		ts.Equal(courier.MsgQueued, m.Status_)
+
+		ts.b.MarkOutgoingMsgComplete(ctx, msg, nil)
+	}
+}
+
+func (ts *BackendTestSuite) TestStoppedContactQueue() {
+	ctx := context.Background()
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+
+	dbMsg, err := readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.NoError(err)
+	dbMsg.ChannelUUID_, _ = courier.NewChannelUUID("dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	dbMsg.channel = ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	msgJSON, err := json.Marshal([]interface{}{dbMsg})
+	ts.NoError(err)
+
+	err = queue.PushOntoQueue(r, msgQueueName, "dbc126ed-66bc-4e28-b67b-81dc3327c95d", 10, string(msgJSON), queue.HighPriority)
+	ts.NoError(err)
+
+	// our contact opts out while their msg is still queued
+	ts.b.StopMsgContact(ctx, dbMsg)
+
+	// so it is skipped instead of popped
+	msg, err := ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.Nil(msg)
+
+	m, err := readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.NoError(err)
+	ts.Equal(courier.MsgFailed, m.Status_)
+
+	category, _ := jsonparser.GetString(m.Metadata_, "error_category")
+	ts.Equal("opted_out", category)
+
+	// msgs created after they opted out are still sent
+	dbMsg.CreatedOn_ = time.Now()
+	msgJSON, err = json.Marshal([]interface{}{dbMsg})
+	ts.NoError(err)
+
+	err = queue.PushOntoQueue(r, msgQueueName, "dbc126ed-66bc-4e28-b67b-81dc3327c95d", 10, string(msgJSON), queue.HighPriority)
+	ts.NoError(err)
+
+	msg, err = ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.NotNil(msg)
+	ts.b.MarkOutgoingMsgComplete(ctx, msg, nil)
+}
+
+func (ts *BackendTestSuite) TestSendWindowQueue() {
+	ctx := context.Background()
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+
+	// give our channel a send window which isn't open now
+	channel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	opens := time.Now().UTC().Add(time.Hour * 2)
+	channel.Config_.Map[courier.ConfigSendWindowHours] = fmt.Sprintf("%02d:00-%02d:00", opens.Hour(), (opens.Hour()+1)%24)
+	defer delete(channel.Config_.Map, courier.ConfigSendWindowHours)
+
+	dbMsg, err := readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.NoError(err)
+	dbMsg.ChannelUUID_, _ = courier.NewChannelUUID("dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	dbMsg.CreatedOn_ = time.Now()
+
+	msgJSON, err := json.Marshal([]interface{}{dbMsg})
+	ts.NoError(err)
+
+	err = queue.PushOntoQueue(r, msgQueueName, "dbc126ed-66bc-4e28-b67b-81dc3327c95d", 10, string(msgJSON), queue.LowPriority)
+	ts.NoError(err)
+
+	// our bulk msg is deferred instead of popped
+	msg, err := ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.Nil(msg)
+
+	// it is still queued, until the hour the window opens
+	count, err := redis.Int(r.Do("zcount", "msgs:dbc126ed-66bc-4e28-b67b-81dc3327c95d|10/0", time.Now().Add(time.Hour).Unix(), "+inf"))
+	ts.NoError(err)
+	ts.Equal(1, count)
+	ts.Contains(ts.b.Status(), "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	// high priority msgs aren't affected by the window
+	dbMsg.HighPriority_ = null.BoolFrom(true)
+	msgJSON, err = json.Marshal([]interface{}{dbMsg})
+	ts.NoError(err)
+
+	err = queue.PushOntoQueue(r, msgQueueName, "dbc126ed-66bc-4e28-b67b-81dc3327c95d", 10, string(msgJSON), queue.HighPriority)
+	ts.NoError(err)
+
+	msg, err = ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.NotNil(msg)
+	ts.b.MarkOutgoingMsgComplete(ctx, msg, nil)
+
+	// we only defer so many msgs in one call, the rest wait for the next
+	dbMsg.HighPriority_ = null.BoolFrom(false)
+	for i := 0; i < maxPopSkips+5; i++ {
+		dbMsg.URN_ = urns.URN(fmt.Sprintf("tel:+2507883%05d", i))
+		msgJSON, err = json.Marshal([]interface{}{dbMsg})
+		ts.NoError(err)
+
+		err = queue.PushOntoQueue(r, msgQueueName, "dbc126ed-66bc-4e28-b67b-81dc3327c95d", 10, string(msgJSON), queue.LowPriority)
+		ts.NoError(err)
+	}
+
+	msg, err = ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.Nil(msg)
+
+	count, err = redis.Int(r.Do("zcount", "msgs:dbc126ed-66bc-4e28-b67b-81dc3327c95d|10/0", time.Now().Add(time.Hour).Unix(), "+inf"))
+	ts.NoError(err)
+	ts.Equal(1+maxPopSkips, count)
+
+	r.Do("del", "msgs:dbc126ed-66bc-4e28-b67b-81dc3327c95d|10/0")
+}
+
+func (ts *BackendTestSuite) TestMsgExpiresOn() {
+	channel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	createdOn := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	msg := &DBMsg{channel: channel, CreatedOn_: createdOn}
+
+	// no expiry by default
+	ts.Nil(msg.ExpiresOn())
+
+	// our channel's default TTL applies from when the msg was created
+	channel.Config_.Map[courier.ConfigMsgTTL] = float64(300)
+	defer delete(channel.Config_.Map, courier.ConfigMsgTTL)
+	ts.Equal(createdOn.Add(time.Minute*5), *msg.ExpiresOn())
+
+	// but an expiry on the msg takes precedence
+	msgJSON := `{"id": 10, "channel_uuid": "dbc126ed-66bc-4e28-b67b-81dc3327c95d", "created_on": "2018-03-01T12:00:00Z", "expires_on": "2018-03-01T12:01:00Z"}`
+	msg = &DBMsg{}
+	ts.NoError(json.Unmarshal([]byte(msgJSON), msg))
+	msg.channel = channel
+	ts.Equal(createdOn.Add(time.Minute), *msg.ExpiresOn())
+}
+
+func (ts *BackendTestSuite) TestMsgQueuePriority() {
+	msg := &DBMsg{}
+	ts.Equal(queue.Priority(queue.LowPriority), msg.queuePriority(3))
+
+	msg.HighPriority_ = null.BoolFrom(true)
+	ts.Equal(queue.Priority(queue.HighPriority), msg.queuePriority(3))
+
+	ts.NoError(json.Unmarshal([]byte(`{"id": 10, "high_priority": true, "priority": 2}`), msg))
+	ts.Equal(queue.Priority(queue.TransactionalPriority), msg.queuePriority(3))
+
+	// priorities beyond the levels we pop from are clamped to them
+	ts.NoError(json.Unmarshal([]byte(`{"id": 10, "priority": 7}`), msg))
+	ts.Equal(queue.Priority(4), msg.queuePriority(5))
+	ts.Equal(queue.Priority(queue.TransactionalPriority), msg.queuePriority(3))
+
+	ts.NoError(json.Unmarshal([]byte(`{"id": 10, "priority": -1}`), msg))
+	ts.Equal(queue.Priority(queue.LowPriority), msg.queuePriority(3))
+}
+
+func (ts *BackendTestSuite) TestRateLimitedQueue() {
+	ctx := context.Background()
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+
+	dbMsg, err := readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.NoError(err)
+	dbMsg.ChannelUUID_, _ = courier.NewChannelUUID("dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	dbMsg.CreatedOn_ = time.Now()
+
+	msgJSON, err := json.Marshal([]interface{}{dbMsg})
+	ts.NoError(err)
+
+	err = queue.PushOntoQueue(r, msgQueueName, "dbc126ed-66bc-4e28-b67b-81dc3327c95d", 10, string(msgJSON), queue.HighPriority)
+	ts.NoError(err)
+
+	msg, err := ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.NotNil(msg)
+
+	// our provider tells us to slow down, so our msg goes back on the queue
+	ts.NoError(ts.b.RequeueRateLimitedMsg(ctx, msg, time.Minute))
+
+	// which releases its URN but doesn't mark it as sent
+	locked, err := redis.Int(r.Do("exists", "msgs:dbc126ed-66bc-4e28-b67b-81dc3327c95d|10:urn:"+msg.URN().String()))
+	ts.NoError(err)
+	ts.Equal(0, locked)
+	sent, err := ts.b.WasMsgSent(ctx, msg)
+	ts.NoError(err)
+	ts.False(sent)
+
+	count, err := redis.Int(r.Do("zcard", "msgs:dbc126ed-66bc-4e28-b67b-81dc3327c95d|10/1"))
+	ts.NoError(err)
+	ts.Equal(1, count)
+
+	// but can't be popped until our channel's pause is over
+	msg, err = ts.b.PopNextOutgoingMsg(ctx)
+	ts.NoError(err)
+	ts.Nil(msg)
+
+	r.Do("del", "msgs:dbc126ed-66bc-4e28-b67b-81dc3327c95d|10/1", "msgs:dbc126ed-66bc-4e28-b67b-81dc3327c95d|10:paused", "msgs:rates")
+}
+
+func (ts *BackendTestSuite) TestTPSBucket() {
+	channel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	// no bucket by default
+	bucket, tps := tpsBucket(channel)
+	ts.Equal("", bucket)
+	ts.Equal(0, tps)
+
+	// a limit in our channel config without a bucket name shares it with the rest of our org
+	channel.Config_.Map[courier.ConfigTPSBucketLimit] = float64(20)
+	defer delete(channel.Config_.Map, courier.ConfigTPSBucketLimit)
+
+	bucket, tps = tpsBucket(channel)
+	ts.Equal(fmt.Sprintf("org:%d", channel.OrgID().Int64), bucket)
+	ts.Equal(20, tps)
+
+	// or it can be named
+	channel.Config_.Map[courier.ConfigTPSBucket] = "account1"
+	defer delete(channel.Config_.Map, courier.ConfigTPSBucket)
+
+	bucket, tps = tpsBucket(channel)
+	ts.Equal("account1", bucket)
+	ts.Equal(20, tps)
+}
+
+func (ts *BackendTestSuite) TestRerouteOutgoingMsg() {
+	ctx := context.Background()
+	knChannel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	twChannel := ts.getChannel("TW", "dbc126ed-66bc-4e28-b67b-81dc3327c96a")
+
+	msg, err := readMsgFromDB(ts.b, courier.NewMsgID(10000))
+	ts.NoError(err)
+	msg.channel = knChannel
+
+	rerouted, err := ts.b.RerouteOutgoingMsg(ctx, msg, twChannel)
+	ts.NoError(err)
+	ts.Equal(twChannel, rerouted.Channel())
+	ts.Equal(knChannel, msg.Channel())
+
+	// our msg now belongs to its new channel, so statuses for it are written against that channel
+	m, err := readMsgFromDB(ts.b, courier.NewMsgID(10000))
+	ts.NoError(err)
+	ts.Equal(twChannel.ID(), m.ChannelID_)
+
+	// move it back for other tests
+	_, err = ts.b.RerouteOutgoingMsg(ctx, m, knChannel)
+	ts.NoError(err)
+}
+
+func (ts *BackendTestSuite) TestStartsConversation() {
+	ctx := context.Background()
+
+	msg, err := readMsgFromDB(ts.b, courier.NewMsgID(10000))
+	ts.NoError(err)
+	msg.channel = ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	other, err := readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.NoError(err)
+	other.channel = msg.channel
+	other.ChannelUUID_ = msg.ChannelUUID_
+	other.URN_ = msg.URN_
+
+	// our first msg starts a conversation, and still does if it is resent
+	starts, err := ts.b.StartsConversation(ctx, msg, time.Hour)
+	ts.NoError(err)
+	ts.True(starts)
+
+	starts, err = ts.b.StartsConversation(ctx, msg, time.Hour)
+	ts.NoError(err)
+	ts.True(starts)
+
+	// but other msgs to the same contact don't until the window is over
+	starts, err = ts.b.StartsConversation(ctx, other, time.Hour)
+	ts.NoError(err)
+	ts.False(starts)
+
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+	r.Do("del", fmt.Sprintf("conversation:%s:%s", msg.ChannelUUID_, msg.URN_.Identity()))
+
+	starts, err = ts.b.StartsConversation(ctx, other, time.Hour)
+	ts.NoError(err)
+	ts.True(starts)
+}
+
+func (ts *BackendTestSuite) TestShortLinks() {
+	ctx := context.Background()
+	knChannel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+
+	link := &courier.ShortLink{
+		Key:         "Ab3dE6gH",
+		URL:         "https://example.com/news",
+		ChannelUUID: knChannel.UUID(),
+		ChannelType: knChannel.ChannelType(),
+		URN:         "tel:+12065551212",
+		MsgID:       courier.NewMsgID(10000),
+	}
+	err := ts.b.SaveShortLink(ctx, link)
+	ts.NoError(err)
+
+	saved, err := ts.b.GetShortLink(ctx, "Ab3dE6gH")
+	ts.NoError(err)
+	ts.Equal(link, saved)
+
+	// our link expires after our configured number of days
+	r := ts.b.redisPool.Get()
+	defer r.Close()
+	ttl, err := redis.Int(r.Do("ttl", "short_link:Ab3dE6gH"))
+	ts.NoError(err)
+	ts.Equal(60*60*24*30, ttl)
+
+	// or never if our expiration is zero
+	expiration := ts.b.config.ShortLinkExpiration
+	ts.b.config.ShortLinkExpiration = 0
+	defer func() { ts.b.config.ShortLinkExpiration = expiration }()
+
+	link.Key = "Zx9yW8vU"
+	err = ts.b.SaveShortLink(ctx, link)
+	ts.NoError(err)
+
+	ttl, err = redis.Int(r.Do("ttl", "short_link:Zx9yW8vU"))
+	ts.NoError(err)
+	ts.Equal(-1, ttl)
+
+	_, err = ts.b.GetShortLink(ctx, "notthere")
+	ts.Equal(courier.ErrShortLinkNotFound, err)
+}
+
 func (ts *BackendTestSuite) TestChannel() {
 	knChannel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
 
@@ -697,6 +1319,25 @@ func (ts *BackendTestSuite) TestWriteAttachment() {
 		ts.True(strings.HasSuffix(msg.Attachments()[0], ".gif"))
 	}
 
+	// the same content again is deduped, resolving to the same attachment without another upload
+	s3Client := ts.b.s3Client.(*mockS3Client)
+	puts := s3Client.puts
+	gifAttachment := msg.Attachments()[0]
+
+	msg = ts.b.NewIncomingMsg(knChannel, urn, "same gif attachment").(*DBMsg)
+	msg.WithAttachment(testServer.URL + "/giffy?again=true")
+
+	err = ts.b.WriteMsg(ctx, msg)
+	ts.NoError(err)
+	ts.Equal([]string{gifAttachment}, msg.Attachments())
+	ts.Equal(puts, s3Client.puts)
+
+	rc := ts.b.redisPool.Get()
+	defer rc.Close()
+	refs, err := redis.Int(rc.Do("hget", "media_dedupe:1:8d6e5d16375222bcfbfb06f41c92e8e0a062ebe52e395da56caa6f5d3a5f010c", "refs"))
+	ts.NoError(err)
+	ts.Equal(2, refs)
+
 	// finally from our header
 	msg = ts.b.NewIncomingMsg(knChannel, urn, "png attachment").(*DBMsg)
 	msg.WithAttachment(testServer.URL + "/header")
@@ -715,6 +1356,17 @@ func (ts *BackendTestSuite) TestWriteAttachment() {
 		ts.True(strings.HasPrefix(m.Attachments()[0], "image/png:"))
 		ts.True(strings.HasSuffix(m.Attachments()[0], ".png"))
 	}
+
+	// media larger than our max size isn't downloaded
+	maxMediaSize := ts.b.config.MaxMediaSize
+	ts.b.config.MaxMediaSize = 5
+	defer func() { ts.b.config.MaxMediaSize = maxMediaSize }()
+
+	msg = ts.b.NewIncomingMsg(knChannel, urn, "large attachment").(*DBMsg)
+	msg.WithAttachment(testServer.URL + "/giffy")
+
+	err = ts.b.WriteMsg(ctx, msg)
+	ts.Equal(utils.ErrMediaTooLarge, err)
 }
 
 func (ts *BackendTestSuite) TestWriteMsg() {
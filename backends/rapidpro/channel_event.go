@@ -96,6 +96,14 @@ func writeChannelEventToDB(ctx context.Context, b *backend, e *DBChannelEvent) e
 	rc := b.redisPool.Get()
 	defer rc.Close()
 
+	// if the contact opted out, skip any msgs to them which are still queued
+	if e.EventType_ == courier.StopContact {
+		err = markContactStopped(rc, e.ContactID_, time.Now())
+		if err != nil {
+			logrus.WithError(err).WithField("contact_id", e.ContactID_.Int64).Error("error marking contact as stopped")
+		}
+	}
+
 	// if we had a problem queueing the event, log it
 	err = queueChannelEvent(rc, e.OrgID_, e.ContactID_, e.ID_)
 	if err != nil {
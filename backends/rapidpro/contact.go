@@ -2,6 +2,7 @@ package rapidpro
 
 import (
 	"context"
+	"fmt"
 	"strconv"
 	"time"
 	"unicode/utf8"
@@ -10,6 +11,7 @@ import (
 
 	"database/sql"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	"github.com/nyaruka/courier"
@@ -193,3 +195,27 @@ type DBContact struct {
 
 // UUID returns the UUID for this contact
 func (c *DBContact) UUID() courier.ContactUUID { return c.UUID_ }
+
+// how long we remember that a contact was stopped, any msgs queued for them before then will have been sent or skipped
+const stoppedContactTTL = 60 * 60 * 24 * 7
+
+const stoppedContactKey = "stopped_contact:%d"
+
+// markContactStopped records that the passed in contact was stopped at the passed in time, so that any msgs to them which
+// were created before then and are still queued are skipped rather than sent
+func markContactStopped(rc redis.Conn, contactID ContactID, stoppedOn time.Time) error {
+	_, err := rc.Do("setex", fmt.Sprintf(stoppedContactKey, contactID.Int64), stoppedContactTTL, stoppedOn.UnixNano())
+	return err
+}
+
+// isMsgContactStopped returns whether the contact of the passed in msg was stopped after the msg was created
+func isMsgContactStopped(rc redis.Conn, msg *DBMsg) (bool, error) {
+	stoppedOn, err := redis.Int64(rc.Do("get", fmt.Sprintf(stoppedContactKey, msg.ContactID_.Int64)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return msg.CreatedOn_.UnixNano() <= stoppedOn, nil
+}
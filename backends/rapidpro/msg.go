@@ -4,7 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -53,6 +53,29 @@ const (
 func writeMsg(ctx context.Context, b *backend, msg courier.Msg) error {
 	m := msg.(*DBMsg)
 
+	// if we have an external id, that decides whether we've seen this msg before rather than its text
+	claimedExternalID := false
+	if m.ExternalID_.String != "" {
+		window := dedupeWindow(b, m.channel)
+		if window > 0 {
+			// a repeat of the text of a recent msg with a new external id is a new msg
+			if m.alreadyWritten {
+				m.UUID_ = courier.NewMsgUUID()
+				m.alreadyWritten = false
+			}
+
+			prevUUID, err := checkExternalIDSeen(b, m, window)
+			if err != nil {
+				logrus.WithError(err).WithField("msg", m.UUID().String()).Error("error checking external id seen")
+			} else if prevUUID != courier.NilMsgUUID {
+				m.UUID_ = prevUUID
+				m.alreadyWritten = true
+			} else {
+				claimedExternalID = true
+			}
+		}
+	}
+
 	// this msg has already been written (we received it twice), we are a no op
 	if m.alreadyWritten {
 		return nil
@@ -63,8 +86,12 @@ func writeMsg(ctx context.Context, b *backend, msg courier.Msg) error {
 	// if we have media, go download it to S3
 	for i, attachment := range m.Attachments_ {
 		if strings.HasPrefix(attachment, "http") {
-			url, err := downloadMediaToS3(ctx, b, channel, m.OrgID_, m.UUID_, attachment)
+			url, err := downloadMediaToS3(ctx, b, channel, m.OrgID_, attachment)
 			if err != nil {
+				// we didn't write this msg, so a retry of it shouldn't be ignored
+				if claimedExternalID {
+					clearExternalIDSeen(b, m)
+				}
 				return err
 			}
 			m.Attachments_[i] = url
@@ -163,6 +190,61 @@ func writeMsgToDB(ctx context.Context, b *backend, m *DBMsg) error {
 	return nil
 }
 
+const insertOutgoingMsgSQL = `
+INSERT INTO msgs_msg(org_id, uuid, direction, text, attachments, msg_count, error_count, high_priority, status,
+                     visibility, channel_id, contact_id, contact_urn_id, created_on, modified_on, next_attempt, queued_on)
+              VALUES(:org_id, :uuid, :direction, :text, :attachments, :msg_count, :error_count, :high_priority, :status,
+                     :visibility, :channel_id, :contact_id, :contact_urn_id, :created_on, :modified_on, :next_attempt, :queued_on)
+RETURNING id
+`
+
+// the TPS of the queues we push msgs courier creates itself onto, the same as RapidPro queues msgs for channels with
+const outgoingQueueTPS = 10
+
+// queueOutgoingMsg writes the passed in outgoing msg to our db as queued, and pushes it onto the queue of its channel
+// as a high priority msg, so it is sent like the msgs RapidPro queues
+func queueOutgoingMsg(ctx context.Context, b *backend, m *DBMsg) error {
+	contact, err := contactForURN(ctx, b, m.OrgID_, m.channel, m.URN_, m.URNAuth_, m.ContactName_)
+	if err != nil {
+		return err
+	}
+
+	m.ContactID_ = contact.ID_
+	m.ContactURNID_ = contact.URNID_
+	m.Status_ = courier.MsgQueued
+	m.HighPriority_ = null.BoolFrom(true)
+
+	rows, err := b.db.NamedQueryContext(ctx, insertOutgoingMsgSQL, m)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	rows.Next()
+	err = rows.Scan(&m.ID_)
+	if err != nil {
+		return err
+	}
+
+	msgJSON, err := json.Marshal([]interface{}{m})
+	if err != nil {
+		return err
+	}
+
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	// set the rate limit bucket of our channel's queue before pushing so our msg is counted against it when popped
+	bucket, bucketTPS := tpsBucket(m.channel)
+	err = queue.SetBucket(rc, msgQueueName, m.ChannelUUID_.String(), outgoingQueueTPS, bucket, bucketTPS)
+	if err != nil {
+		return err
+	}
+
+	levels := b.priorityLevels()
+	return queue.PushOntoPriorityQueue(rc, msgQueueName, m.ChannelUUID_.String(), outgoingQueueTPS, string(msgJSON), m.queuePriority(levels), levels)
+}
+
 const selectMsgSQL = `
 SELECT org_id, direction, text, attachments, msg_count, error_count, high_priority, status,
        visibility, external_id, channel_id, contact_id, contact_urn_id, created_on, modified_on, next_attempt, queued_on, sent_on
@@ -183,7 +265,9 @@ func readMsgFromDB(b *backend, id courier.MsgID) (*DBMsg, error) {
 // Media download and classification
 //-----------------------------------------------------------------------------
 
-func downloadMediaToS3(ctx context.Context, b *backend, channel courier.Channel, orgID OrgID, msgUUID courier.MsgUUID, mediaURL string) (string, error) {
+// downloadMediaToS3 downloads the passed in media to S3, storing it under a key derived from the hash of its content so
+// that media we have already seen for an org resolves to the existing object instead of being uploaded again
+func downloadMediaToS3(ctx context.Context, b *backend, channel courier.Channel, orgID OrgID, mediaURL string) (string, error) {
 
 	parsedURL, err := url.Parse(mediaURL)
 	if err != nil {
@@ -213,71 +297,129 @@ func downloadMediaToS3(ctx context.Context, b *backend, channel courier.Channel,
 		}
 	}
 
-	resp, err := utils.GetHTTPClient().Do(req)
-	if err != nil {
-		return "", err
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
+	// open a stream to our media, this only reads the first bytes of the body so we can sniff its type
+	maxSize := courier.MaxMediaSize(b.config, channel)
+	rr, stream, err := utils.OpenMediaStream(req.WithContext(ctx), maxSize)
 	if err != nil {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("media_url", mediaURL).WithField("status_code", rr.StatusCode).WithError(err).Error("unable to download media")
 		return "", err
 	}
+	defer stream.Close()
 
-	mimeType := ""
-	extension := filepath.Ext(parsedURL.Path)
-	logrus.WithField("file path extension guess", extension).WithField("mediaURL", mediaURL).Debug("S3 debugging")
-	if extension != "" {
-		extension = extension[1:]
-	}
-
-	// first try getting our mime type from the first 300 bytes of our body
-	fileType, err := filetype.Match(body[:300])
-	if fileType != filetype.Unknown {
-		logrus.WithField("fileType guess", fileType.MIME.Value).WithField("extension", fileType.Extension).WithField("mediaURL", mediaURL).Debug("S3 debugging")
-		mimeType = fileType.MIME.Value
-		extension = fileType.Extension
-	} else {
-		// if that didn't work, try from our extension
-		fileType = filetype.GetType(extension)
+	mimeType := stream.ContentType
+	extension := stream.Extension
+
+	// if we didn't sniff an extension, try from our URL, then from our mime type
+	if extension == "" {
+		extension = filepath.Ext(parsedURL.Path)
+		if extension != "" {
+			extension = extension[1:]
+		}
+
+		fileType := filetype.GetType(extension)
 		if fileType != filetype.Unknown {
-			logrus.WithField("extension guess", fileType.MIME.Value).WithField("extension", fileType.Extension).WithField("mediaURL", mediaURL).Debug("S3 debugging")
 			mimeType = fileType.MIME.Value
 			extension = fileType.Extension
-		}
-	}
-
-	// we still don't know our mime type, use our content header instead
-	if mimeType == "" {
-		mimeType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
-		logrus.WithField("Content-Type header guessing", mimeType).WithField("Content-Type", resp.Header.Get("Content-Type")).WithField("mediaURL", mediaURL).Debug("S3 debugging")
-		if extension == "" {
+		} else if extension == "" && mimeType != "" {
 			extensions, err := mime.ExtensionsByType(mimeType)
-			logrus.WithField("extensions mimetype guessing", mimeType).WithField("extensions", extensions).WithField("mediaURL", mediaURL).Debug("S3 debugging")
-			if extensions == nil || err != nil {
-				extension = ""
-			} else {
+			if extensions != nil && err == nil {
 				extension = extensions[0][1:]
 			}
 		}
 	}
 
-	// create our filename
-	filename := msgUUID.String()
+	// S3 needs to be able to seek in what it uploads, so spool our stream to disk rather than memory, hashing it as we go
+	file, err := utils.SpoolMediaStream(stream)
+	if err != nil {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("media_url", mediaURL).WithField("max_size", maxSize).WithError(err).Error("unable to download media")
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	logrus.WithField("channel_uuid", channel.UUID()).WithField("media_url", mediaURL).WithField("content_type", mimeType).WithField("size", stream.BytesRead()).WithField("elapsed", rr.Elapsed).Debug("media downloaded")
+
+	return storeMedia(b, channel, orgID, stream.SHA256(), stream.BytesRead(), mimeType, extension, file)
+}
+
+// storeMedia stores the passed in media to S3 under a key derived from the hash of its content, returning the attachment
+// for it. If we have already stored the same content for the org, the existing attachment is returned instead.
+func storeMedia(b *backend, channel courier.Channel, orgID OrgID, contentHash string, size int64, mimeType string, extension string, body io.ReadSeeker) (string, error) {
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	// have we already stored this content for this org? if so, just use that
+	attachment, err := lookupMediaDedupe(rc, orgID, contentHash)
+	if err != nil {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("media_hash", contentHash).WithError(err).Error("error looking up media dedupe")
+	}
+	if attachment != "" {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("media_hash", contentHash).Debug("media deduped")
+		return attachment, nil
+	}
+
+	// create our filename from our hash
+	filename := contentHash
 	if extension != "" {
-		filename = fmt.Sprintf("%s.%s", msgUUID, extension)
+		filename = fmt.Sprintf("%s.%s", contentHash, extension)
 	}
 	path := filepath.Join(b.config.S3MediaPrefix, strconv.FormatInt(orgID.Int64, 10), filename[:4], filename[4:8], filename)
 	if !strings.HasPrefix(path, "/") {
 		path = fmt.Sprintf("/%s", path)
 	}
 
-	s3URL, err := utils.PutS3File(b.s3Client, b.config.S3MediaBucket, path, mimeType, body)
+	s3URL, err := utils.PutS3Stream(b.s3Client, b.config.S3MediaBucket, path, mimeType, body)
 	if err != nil {
 		return "", err
 	}
 
-	// return our new media URL, which is prefixed by our content type
-	return fmt.Sprintf("%s:%s", mimeType, s3URL), nil
+	// our new media URL is prefixed by our content type
+	attachment = fmt.Sprintf("%s:%s", mimeType, s3URL)
+
+	err = writeMediaDedupe(rc, orgID, contentHash, attachment, size)
+	if err != nil {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("media_hash", contentHash).WithError(err).Error("error writing media dedupe")
+	}
+
+	return attachment, nil
+}
+
+// media we've stored is indexed by org and content hash for a week after it was last seen
+const mediaDedupeKey = "media_dedupe:%d:%s"
+const mediaDedupeTTL = 60 * 60 * 24 * 7
+
+var luaMediaDedupe = redis.NewScript(3, `-- KEYS: [DedupeKey, TTL, Now]
+	local attachment = redis.call("hget", KEYS[1], "attachment")
+
+	-- if found, add a reference and push back our expiration
+	if attachment then
+		redis.call("hincrby", KEYS[1], "refs", 1)
+		redis.call("hset", KEYS[1], "last_seen", KEYS[3])
+		redis.call("expire", KEYS[1], KEYS[2])
+	end
+
+	return attachment
+`)
+
+// lookupMediaDedupe returns the attachment previously stored for the passed in org and content hash, empty string if none
+func lookupMediaDedupe(rc redis.Conn, orgID OrgID, contentHash string) (string, error) {
+	attachment, err := redis.String(luaMediaDedupe.Do(rc, fmt.Sprintf(mediaDedupeKey, orgID.Int64, contentHash), mediaDedupeTTL, time.Now().Unix()))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return attachment, err
+}
+
+// writeMediaDedupe records that the passed in attachment holds the content with the passed in hash for the org
+func writeMediaDedupe(rc redis.Conn, orgID OrgID, contentHash string, attachment string, size int64) error {
+	dedupeKey := fmt.Sprintf(mediaDedupeKey, orgID.Int64, contentHash)
+	now := time.Now().Unix()
+
+	rc.Send("multi")
+	rc.Send("hmset", dedupeKey, "attachment", attachment, "size", size, "first_seen", now, "last_seen", now, "refs", 1)
+	rc.Send("expire", dedupeKey, mediaDedupeTTL)
+	_, err := rc.Do("exec")
+	return err
 }
 
 //-----------------------------------------------------------------------------
@@ -387,6 +529,78 @@ func clearMsgSeen(rc redis.Conn, msg *DBMsg) {
 	rc.Do("hdel", prevWindowKey, urnFingerprint)
 }
 
+// dedupeWindow returns the number of seconds we remember the external ids of incoming msgs on the passed in channel for
+func dedupeWindow(b *backend, channel *DBChannel) int {
+	window := channel.IntConfigForKey(courier.ConfigDedupeWindow, 0)
+	if window != 0 {
+		return window
+	}
+	return b.config.DedupeWindow
+}
+
+var luaExternalIDSeen = redis.NewScript(3, `-- KEYS: [Key, UUID, Window]
+	local found = redis.call("get", KEYS[1])
+	if found then
+		return found
+	end
+
+	redis.call("set", KEYS[1], KEYS[2], "EX", KEYS[3])
+	return ""
+`)
+
+func externalIDSeenKey(msg *DBMsg) string {
+	return fmt.Sprintf("seen:external:%s:%s", msg.ChannelUUID_.String(), msg.ExternalID_.String)
+}
+
+// checkExternalIDSeen looks up whether a msg with the same channel and external id as the passed in msg was seen in the
+// passed in window. If found returns the UUID of that msg, if not records the passed in msg as seen and returns NilMsgUUID
+func checkExternalIDSeen(b *backend, msg *DBMsg, window int) (courier.MsgUUID, error) {
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	found, err := redis.String(luaExternalIDSeen.Do(rc, externalIDSeenKey(msg), msg.UUID().String(), window))
+	if err != nil || found == "" || found == msg.UUID().String() {
+		return courier.NilMsgUUID, err
+	}
+	return courier.NewMsgUUIDFromString(found), nil
+}
+
+// clearExternalIDSeen clears that we've seen the external id of the passed in msg
+func clearExternalIDSeen(b *backend, msg *DBMsg) {
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	rc.Do("del", externalIDSeenKey(msg))
+}
+
+var luaStartsConversation = redis.NewScript(3, `-- KEYS: [Key, MsgID, Window]
+	local found = redis.call("get", KEYS[1])
+	if found then
+		-- a msg which is being resent still starts the conversation it started the first time
+		if found == KEYS[2] then
+			return 1
+		end
+		return 0
+	end
+
+	redis.call("set", KEYS[1], KEYS[2], "EX", KEYS[3])
+	return 1
+`)
+
+// startsConversation returns whether the passed in msg is the first sent to its contact on its channel in the passed
+// in window, recording that a conversation was started by it if so
+func startsConversation(b *backend, msg *DBMsg, window time.Duration) (bool, error) {
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	key := fmt.Sprintf("conversation:%s:%s", msg.ChannelUUID_.String(), msg.URN_.Identity())
+	starts, err := redis.Bool(luaStartsConversation.Do(rc, key, msg.ID_.String(), int(window/time.Second)))
+	if err != nil {
+		return false, err
+	}
+	return starts, nil
+}
+
 //-----------------------------------------------------------------------------
 // Our implementation of Msg interface
 //-----------------------------------------------------------------------------
@@ -400,6 +614,7 @@ type DBMsg struct {
 	Status_               courier.MsgStatusValue `json:"status"          db:"status"`
 	Visibility_           MsgVisibility          `json:"visibility"      db:"visibility"`
 	HighPriority_         null.Bool              `json:"high_priority"   db:"high_priority"`
+	Priority_             null.Int               `json:"priority"`
 	URN_                  urns.URN               `json:"urn"`
 	URNAuth_              string                 `json:"urn_auth"`
 	Text_                 string                 `json:"text"            db:"text"`
@@ -419,11 +634,12 @@ type DBMsg struct {
 	ChannelUUID_ courier.ChannelUUID `json:"channel_uuid"`
 	ContactName_ string              `json:"contact_name"`
 
-	NextAttempt_ time.Time `json:"next_attempt"  db:"next_attempt"`
-	CreatedOn_   time.Time `json:"created_on"    db:"created_on"`
-	ModifiedOn_  time.Time `json:"modified_on"   db:"modified_on"`
-	QueuedOn_    time.Time `json:"queued_on"     db:"queued_on"`
-	SentOn_      time.Time `json:"sent_on"       db:"sent_on"`
+	NextAttempt_ time.Time  `json:"next_attempt"  db:"next_attempt"`
+	CreatedOn_   time.Time  `json:"created_on"    db:"created_on"`
+	ModifiedOn_  time.Time  `json:"modified_on"   db:"modified_on"`
+	QueuedOn_    time.Time  `json:"queued_on"     db:"queued_on"`
+	SentOn_      time.Time  `json:"sent_on"       db:"sent_on"`
+	ExpiresOn_   *time.Time `json:"expires_on,omitempty"`
 
 	channel        *DBChannel
 	workerToken    queue.WorkerToken
@@ -448,6 +664,35 @@ func (m *DBMsg) ResponseToExternalID() string { return m.ResponseToExternalID_ }
 
 func (m *DBMsg) Channel() courier.Channel { return m.channel }
 
+// queuePriority returns the priority level of the queue this msg is sent from, out of the passed in number of levels.
+// Msgs which weren't queued with an explicit priority level are high or low priority.
+func (m *DBMsg) queuePriority(levels int) queue.Priority {
+	if m.Priority_.Valid {
+		return queue.Priority(m.Priority_.Int64).Clamp(levels)
+	}
+	if m.HighPriority() {
+		return queue.HighPriority
+	}
+	return queue.LowPriority
+}
+
+// ExpiresOn returns when this msg expires if it hasn't been sent, either as set on the msg or from our channel's default TTL
+func (m *DBMsg) ExpiresOn() *time.Time {
+	if m.ExpiresOn_ != nil {
+		return m.ExpiresOn_
+	}
+	if m.channel == nil {
+		return nil
+	}
+
+	ttl := m.channel.IntConfigForKey(courier.ConfigMsgTTL, 0)
+	if ttl <= 0 {
+		return nil
+	}
+	expiresOn := m.CreatedOn_.Add(time.Duration(ttl) * time.Second)
+	return &expiresOn
+}
+
 func (m *DBMsg) QuickReplies() []string {
 	if m.quickReplies != nil {
 		return m.quickReplies
@@ -487,12 +732,25 @@ func (m *DBMsg) WithID(id courier.MsgID) courier.Msg { m.ID_ = id; return m }
 // WithUUID can be used to set the id on a msg in a chained call
 func (m *DBMsg) WithUUID(uuid courier.MsgUUID) courier.Msg { m.UUID_ = uuid; return m }
 
+// WithText can be used to replace the text of a message in a chained call
+func (m *DBMsg) WithText(text string) courier.Msg { m.Text_ = text; return m }
+
 // WithAttachment can be used to append to the media urls for a message
 func (m *DBMsg) WithAttachment(url string) courier.Msg {
 	m.Attachments_ = append(m.Attachments_, url)
 	return m
 }
 
+// ReplaceAttachment can be used to swap one of the media urls for a message for another
+func (m *DBMsg) ReplaceAttachment(original string, replacement string) courier.Msg {
+	for i := range m.Attachments_ {
+		if m.Attachments_[i] == original {
+			m.Attachments_[i] = replacement
+		}
+	}
+	return m
+}
+
 // WithURNAuth can be used to add a URN auth setting to a message
 func (m *DBMsg) WithURNAuth(auth string) courier.Msg {
 	m.URNAuth_ = auth
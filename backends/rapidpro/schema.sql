@@ -82,6 +82,19 @@ CREATE TABLE msgs_msg (
     topup_id integer
 );
 
+DROP TABLE IF EXISTS msgs_msgstatushistory CASCADE;
+CREATE TABLE msgs_msgstatushistory (
+    id serial primary key,
+    msg_id integer NOT NULL references msgs_msg(id) on delete cascade,
+    status character varying(1) NOT NULL,
+    previous_status character varying(1) NOT NULL,
+    current_status character varying(1) NOT NULL,
+    source character varying(8) NOT NULL,
+    external_id character varying(255),
+    raw_status character varying(64),
+    created_on timestamp with time zone NOT NULL
+);
+
 DROP TABLE IF EXISTS channels_channellog CASCADE;
 CREATE TABLE channels_channellog (
     id serial primary key,
@@ -9,8 +9,11 @@ import (
 	"os"
 	"time"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/courier"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/sirupsen/logrus"
 )
 
 // newMsgStatus creates a new DBMsgStatus for the passed in parameters
@@ -20,6 +23,7 @@ func newMsgStatus(channel courier.Channel, id courier.MsgID, externalID string,
 		ID_:          id,
 		ExternalID_:  externalID,
 		Status_:      status,
+		Source_:      courier.MsgStatusSourceCallback,
 		ModifiedOn_:  time.Now().In(time.UTC),
 	}
 }
@@ -28,6 +32,31 @@ func newMsgStatus(channel courier.Channel, id courier.MsgID, externalID string,
 func writeMsgStatus(ctx context.Context, b *backend, status courier.MsgStatus) error {
 	dbStatus := status.(*DBMsgStatus)
 
+	// a msg sent in multiple parts, remember which msg each part belongs to so we can combine their statuses later
+	if dbStatus.ID_ != courier.NilMsgID && len(dbStatus.ExternalIDs_) > 1 {
+		err := writeMsgParts(b, dbStatus)
+		if err != nil {
+			logrus.WithError(err).WithField("msg_id", dbStatus.ID_.String()).Error("error writing msg parts")
+		}
+	}
+
+	// a status for one part of a multipart msg, update the status of that part and write the combined status of all parts
+	if dbStatus.ID_ == courier.NilMsgID && dbStatus.ExternalID_ != "" {
+		combined, err := updateMsgPartStatus(b, dbStatus)
+		if err != nil {
+			logrus.WithError(err).WithField("external_id", dbStatus.ExternalID_).Error("error updating msg part status")
+		}
+		if combined != nil {
+			dbStatus.ID_ = combined.ID_
+
+			// nothing to write until our parts progress past wired
+			if combined.Status_ == courier.MsgWired {
+				return nil
+			}
+			dbStatus = combined
+		}
+	}
+
 	err := writeMsgStatusToDB(ctx, b, dbStatus)
 	if err == courier.ErrMsgNotFound {
 		return err
@@ -64,36 +93,59 @@ func checkMsgExists(b *backend, status courier.MsgStatus) (err error) {
 	return err
 }
 
-// the craziness below lets us update our status to 'F' and schedule retries without knowing anything about the message
+// the craziness below lets us update our status to 'F' and schedule retries without knowing anything about the message,
+// msgs which have been delivered or read are never moved back to wired or sent by a late status report, and msgs which
+// have failed stay failed unless we are sending them again
 const updateMsgID = `
 UPDATE msgs_msg SET 
-	status = CASE WHEN :status = 'E' THEN CASE WHEN error_count >= 2 OR status = 'F' THEN 'F' ELSE 'E' END ELSE :status END,
+	status = CASE
+		WHEN :status = 'E' THEN CASE WHEN error_count >= 2 OR status = 'F' THEN 'F' ELSE 'E' END
+		WHEN status = 'F' AND :status != 'F' AND :source != 'send' THEN 'F'
+		WHEN status IN ('D', 'R') AND :status IN ('W', 'S') THEN status
+		WHEN status = 'R' AND :status = 'D' THEN 'R'
+		ELSE :status END,
 	error_count = CASE WHEN :status = 'E' THEN error_count + 1 ELSE error_count END,
 	next_attempt = CASE WHEN :status = 'E' THEN NOW() + (5 * (error_count+1) * interval '1 minutes') ELSE next_attempt END,
 	external_id = CASE WHEN :external_id != '' THEN :external_id ELSE external_id END,
-	sent_on = CASE WHEN :status = 'W' THEN NOW() ELSE sent_on END,
+	msg_count = CASE WHEN :msg_count > 0 THEN :msg_count ELSE msg_count END,
+	sent_on = CASE WHEN :status = 'W' AND status NOT IN ('D', 'R') AND (status != 'F' OR :source = 'send') THEN NOW() ELSE sent_on END,
+	metadata = CASE WHEN :error_category != '' THEN CAST(CAST(COALESCE(NULLIF(metadata, ''), '{}') AS jsonb) ||
+		jsonb_build_object('error_category', CAST(:error_category AS text), 'error_code', CAST(:error_code AS text)) AS text)
+		ELSE metadata END,
 	modified_on = :modified_on
 
-	WHERE msgs_msg.id IN
-		(SELECT msgs_msg.id 
-			FROM msgs_msg INNER JOIN channels_channel ON (msgs_msg.channel_id = channels_channel.id) 
-			WHERE (msgs_msg.id = :msg_id AND channels_channel.uuid = :channel_uuid)) 
-			RETURNING msgs_msg.id
+	FROM
+		(SELECT msgs_msg.id AS prev_id, msgs_msg.status AS prev_status
+			FROM msgs_msg INNER JOIN channels_channel ON (msgs_msg.channel_id = channels_channel.id)
+			WHERE (msgs_msg.id = :msg_id AND channels_channel.uuid = :channel_uuid)
+			FOR UPDATE OF msgs_msg) AS prev
+	WHERE msgs_msg.id = prev.prev_id
+	RETURNING msgs_msg.id, prev.prev_status, msgs_msg.status
 `
 
 const updateMsgExternalID = `
 UPDATE msgs_msg SET 
-	status = CASE WHEN :status = 'E' THEN CASE WHEN error_count >= 2 OR status = 'F' THEN 'F' ELSE 'E' END ELSE :status END,
+	status = CASE
+		WHEN :status = 'E' THEN CASE WHEN error_count >= 2 OR status = 'F' THEN 'F' ELSE 'E' END
+		WHEN status = 'F' AND :status != 'F' AND :source != 'send' THEN 'F'
+		WHEN status IN ('D', 'R') AND :status IN ('W', 'S') THEN status
+		WHEN status = 'R' AND :status = 'D' THEN 'R'
+		ELSE :status END,
 	error_count = CASE WHEN :status = 'E' THEN error_count + 1 ELSE error_count END,
 	next_attempt = CASE WHEN :status = 'E' THEN NOW() + (5 * (error_count+1) * interval '1 minutes') ELSE next_attempt END,
-	sent_on = CASE WHEN :status = 'W' THEN NOW() ELSE sent_on END,
+	sent_on = CASE WHEN :status = 'W' AND status NOT IN ('D', 'R') AND (status != 'F' OR :source = 'send') THEN NOW() ELSE sent_on END,
+	metadata = CASE WHEN :error_category != '' THEN CAST(CAST(COALESCE(NULLIF(metadata, ''), '{}') AS jsonb) ||
+		jsonb_build_object('error_category', CAST(:error_category AS text), 'error_code', CAST(:error_code AS text)) AS text)
+		ELSE metadata END,
 	modified_on = :modified_on
 
-WHERE msgs_msg.id IN
-	(SELECT msgs_msg.id 
-		FROM msgs_msg INNER JOIN channels_channel ON (msgs_msg.channel_id = channels_channel.id) 
-		WHERE (msgs_msg.external_id = :external_id AND channels_channel.uuid = :channel_uuid)) 
-		RETURNING msgs_msg.id
+FROM
+	(SELECT msgs_msg.id AS prev_id, msgs_msg.status AS prev_status
+		FROM msgs_msg INNER JOIN channels_channel ON (msgs_msg.channel_id = channels_channel.id)
+		WHERE (msgs_msg.external_id = :external_id AND channels_channel.uuid = :channel_uuid)
+		FOR UPDATE OF msgs_msg) AS prev
+WHERE msgs_msg.id = prev.prev_id
+RETURNING msgs_msg.id, prev.prev_status, msgs_msg.status
 `
 
 // writeMsgStatusToDB writes the passed in msg status to our db
@@ -113,16 +165,206 @@ func writeMsgStatusToDB(ctx context.Context, b *backend, status *DBMsgStatus) er
 	}
 	defer rows.Close()
 
-	// scan and read the id of the msg that was updated
+	// scan and read the id of the msg that was updated and its status before and after
+	var prevStatus, newStatus courier.MsgStatusValue
 	if rows.Next() {
-		rows.Scan(&status.ID_)
+		rows.Scan(&status.ID_, &prevStatus, &newStatus)
 	} else {
 		return courier.ErrMsgNotFound
 	}
+	rows.Close()
+
+	if b.config.StatusHistory {
+		err = writeMsgStatusHistory(ctx, b, status, prevStatus, newStatus)
+		if err != nil {
+			logrus.WithError(err).WithField("msg_id", status.ID_.String()).Error("error writing msg status history")
+		}
+	}
+
+	return nil
+}
+
+const insertMsgStatusHistory = `
+INSERT INTO msgs_msgstatushistory(msg_id, status, previous_status, current_status, source, external_id, raw_status, created_on)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+`
+
+// writeMsgStatusHistory records the passed in status update for a msg, along with what its status was before and after
+// the update was applied. The status is always what was reported, so late or out of order reports can be seen even when
+// they didn't change the status of the msg.
+func writeMsgStatusHistory(ctx context.Context, b *backend, status *DBMsgStatus, prevStatus courier.MsgStatusValue, newStatus courier.MsgStatusValue) error {
+	source := status.Source_
+	if source == "" {
+		source = courier.MsgStatusSourceCallback
+	}
+
+	_, err := b.db.ExecContext(ctx, insertMsgStatusHistory, status.ID_, status.Status_, prevStatus, newStatus, source,
+		status.ExternalID_, status.RawStatus_, status.ModifiedOn_)
+	return err
+}
+
+const updateMsgReadWatermark = `
+UPDATE msgs_msg SET
+	status = 'R',
+	modified_on = NOW()
+
+FROM
+	(SELECT msgs_msg.id AS prev_id, msgs_msg.status AS prev_status
+		FROM msgs_msg
+		INNER JOIN channels_channel ON (msgs_msg.channel_id = channels_channel.id)
+		INNER JOIN contacts_contacturn ON (msgs_msg.contact_urn_id = contacts_contacturn.id)
+		WHERE channels_channel.uuid = $1 AND contacts_contacturn.identity = $2 AND msgs_msg.direction = 'O' AND
+			msgs_msg.sent_on <= $3 AND msgs_msg.status IN ('W', 'S', 'D')
+		FOR UPDATE OF msgs_msg) AS prev
+WHERE msgs_msg.id = prev.prev_id
+RETURNING msgs_msg.id, prev.prev_status
+`
+
+// writeMsgReadWatermark marks all the outgoing msgs sent to the passed in URN on the passed in channel at or before
+// the watermark as read, recording each in our status history like any other read status
+func writeMsgReadWatermark(ctx context.Context, b *backend, channel courier.Channel, urn urns.URN, watermark time.Time) error {
+	rows, err := b.db.QueryxContext(ctx, updateMsgReadWatermark, channel.UUID().String(), urn.Identity(), watermark)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	statuses := make([]*DBMsgStatus, 0)
+	prevStatuses := make([]courier.MsgStatusValue, 0)
+	for rows.Next() {
+		status := newMsgStatus(channel, courier.NilMsgID, "", courier.MsgRead)
+		var prevStatus courier.MsgStatusValue
+		err = rows.Scan(&status.ID_, &prevStatus)
+		if err != nil {
+			return err
+		}
+		statuses = append(statuses, status)
+		prevStatuses = append(prevStatuses, prevStatus)
+	}
+	rows.Close()
+
+	if b.config.StatusHistory {
+		for i, status := range statuses {
+			err = writeMsgStatusHistory(ctx, b, status, prevStatuses[i], courier.MsgRead)
+			if err != nil {
+				logrus.WithError(err).WithField("msg_id", status.ID_.String()).Error("error writing msg status history")
+			}
+		}
+	}
 
 	return nil
 }
 
+// how long we remember the parts of multipart msgs for, we don't expect status reports for them after this
+const msgPartsTTL = 60 * 60 * 24 * 7
+
+// each part's external id maps to its msg, and each msg has a hash of the current status of each of its parts
+const msgPartKey = "msg_part:%s:%s"
+const msgPartsKeyPrefix = "msg_parts:"
+const msgPartsKey = msgPartsKeyPrefix + "%d"
+
+// writeMsgParts records the external ids of each of the parts of the msg the passed in status is for
+func writeMsgParts(b *backend, status *DBMsgStatus) error {
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	partsKey := fmt.Sprintf(msgPartsKey, status.ID_.Int64)
+
+	rc.Send("multi")
+	for _, externalID := range status.ExternalIDs_ {
+		partKey := fmt.Sprintf(msgPartKey, status.ChannelUUID_.String(), externalID)
+		rc.Send("setex", partKey, msgPartsTTL, status.ID_.Int64)
+		rc.Send("hsetnx", partsKey, externalID, string(courier.MsgWired))
+	}
+	rc.Send("expire", partsKey, msgPartsTTL)
+	_, err := rc.Do("exec")
+	return err
+}
+
+var luaUpdateMsgPart = redis.NewScript(4, `-- KEYS: [PartKey, PartsKeyPrefix, ExternalID, Status]
+	local msgID = redis.call("get", KEYS[1])
+	if not msgID then
+		return nil
+	end
+
+	-- parts which have reached a final status stay there, delivered parts can still be read
+	local partsKey = KEYS[2] .. msgID
+	local prev = redis.call("hget", partsKey, KEYS[3])
+	if prev ~= "R" and prev ~= "F" and (prev ~= "D" or KEYS[4] == "R") then
+		redis.call("hset", partsKey, KEYS[3], KEYS[4])
+	end
+
+	return {msgID, redis.call("hvals", partsKey)}
+`)
+
+// updateMsgPartStatus updates the status of the msg part with the external id of the passed in status, if it is one,
+// returning a status for the msg it belongs to with the combined status of all its parts. Returns nil if the external
+// id isn't for a part of a multipart msg.
+func updateMsgPartStatus(b *backend, status *DBMsgStatus) (*DBMsgStatus, error) {
+	rc := b.redisPool.Get()
+	defer rc.Close()
+
+	partKey := fmt.Sprintf(msgPartKey, status.ChannelUUID_.String(), status.ExternalID_)
+	values, err := redis.Values(luaUpdateMsgPart.Do(rc, partKey, msgPartsKeyPrefix, status.ExternalID_, string(status.Status_)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var msgID int64
+	var partStatuses []string
+	_, err = redis.Scan(values, &msgID, &partStatuses)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]courier.MsgStatusValue, len(partStatuses))
+	for i := range partStatuses {
+		statuses[i] = courier.MsgStatusValue(partStatuses[i])
+	}
+
+	// the error of the reporting part is the error of our msg
+	return &DBMsgStatus{
+		ChannelUUID_:   status.ChannelUUID_,
+		ID_:            courier.NewMsgID(msgID),
+		Status_:        combinePartStatuses(statuses),
+		Source_:        status.Source_,
+		RawStatus_:     status.RawStatus_,
+		ErrorCategory_: status.ErrorCategory_,
+		ErrorCode_:     status.ErrorCode_,
+		ModifiedOn_:    status.ModifiedOn_,
+		logs:           status.logs,
+	}, nil
+}
+
+// combinePartStatuses returns the status of a msg given the statuses of its parts. A msg has failed if any part has
+// failed and is only delivered or read once all its parts are, otherwise it has the status of its least progressed part.
+func combinePartStatuses(statuses []courier.MsgStatusValue) courier.MsgStatusValue {
+	progress := map[courier.MsgStatusValue]int{
+		courier.MsgWired:     1,
+		courier.MsgSent:      2,
+		courier.MsgDelivered: 3,
+		courier.MsgRead:      4,
+	}
+
+	combined := courier.MsgRead
+	for _, status := range statuses {
+		if status == courier.MsgFailed {
+			return courier.MsgFailed
+		}
+		if status == courier.MsgErrored {
+			combined = courier.MsgErrored
+			continue
+		}
+		if combined != courier.MsgErrored && progress[status] < progress[combined] {
+			combined = status
+		}
+	}
+	return combined
+}
+
 func (b *backend) flushStatusFile(filename string, contents []byte) error {
 	status := &DBMsgStatus{}
 	err := json.Unmarshal(contents, status)
@@ -154,11 +396,17 @@ func (b *backend) flushStatusFile(filename string, contents []byte) error {
 
 // DBMsgStatus represents a status update on a message
 type DBMsgStatus struct {
-	ChannelUUID_ courier.ChannelUUID    `json:"channel_uuid"             db:"channel_uuid"`
-	ID_          courier.MsgID          `json:"msg_id,omitempty"         db:"msg_id"`
-	ExternalID_  string                 `json:"external_id,omitempty"    db:"external_id"`
-	Status_      courier.MsgStatusValue `json:"status"                   db:"status"`
-	ModifiedOn_  time.Time              `json:"modified_on"              db:"modified_on"`
+	ChannelUUID_   courier.ChannelUUID      `json:"channel_uuid"             db:"channel_uuid"`
+	ID_            courier.MsgID            `json:"msg_id,omitempty"         db:"msg_id"`
+	ExternalID_    string                   `json:"external_id,omitempty"    db:"external_id"`
+	ExternalIDs_   []string                 `json:"external_ids,omitempty"   db:"-"`
+	MsgCount_      int                      `json:"msg_count,omitempty"      db:"msg_count"`
+	Status_        courier.MsgStatusValue   `json:"status"                   db:"status"`
+	Source_        courier.MsgStatusSource  `json:"source,omitempty"         db:"source"`
+	RawStatus_     string                   `json:"raw_status,omitempty"     db:"raw_status"`
+	ErrorCategory_ courier.MsgErrorCategory `json:"error_category,omitempty" db:"error_category"`
+	ErrorCode_     string                   `json:"error_code,omitempty"     db:"error_code"`
+	ModifiedOn_    time.Time                `json:"modified_on"              db:"modified_on"`
 
 	logs []*courier.ChannelLog
 }
@@ -171,6 +419,30 @@ func (s *DBMsgStatus) ID() courier.MsgID                { return s.ID_ }
 func (s *DBMsgStatus) ExternalID() string      { return s.ExternalID_ }
 func (s *DBMsgStatus) SetExternalID(id string) { s.ExternalID_ = id }
 
+func (s *DBMsgStatus) ExternalIDs() []string { return s.ExternalIDs_ }
+func (s *DBMsgStatus) AddExternalID(id string) {
+	if s.ExternalID_ == "" {
+		s.ExternalID_ = id
+	}
+	s.ExternalIDs_ = append(s.ExternalIDs_, id)
+}
+
+func (s *DBMsgStatus) MsgCount() int         { return s.MsgCount_ }
+func (s *DBMsgStatus) SetMsgCount(count int) { s.MsgCount_ = count }
+
+func (s *DBMsgStatus) Source() courier.MsgStatusSource          { return s.Source_ }
+func (s *DBMsgStatus) SetSource(source courier.MsgStatusSource) { s.Source_ = source }
+
+func (s *DBMsgStatus) RawStatus() string          { return s.RawStatus_ }
+func (s *DBMsgStatus) SetRawStatus(status string) { s.RawStatus_ = status }
+
+func (s *DBMsgStatus) ErrorCategory() courier.MsgErrorCategory { return s.ErrorCategory_ }
+func (s *DBMsgStatus) ErrorCode() string                       { return s.ErrorCode_ }
+func (s *DBMsgStatus) SetError(category courier.MsgErrorCategory, code string) {
+	s.ErrorCategory_ = category
+	s.ErrorCode_ = code
+}
+
 func (s *DBMsgStatus) Logs() []*courier.ChannelLog    { return s.logs }
 func (s *DBMsgStatus) AddLog(log *courier.ChannelLog) { s.logs = append(s.logs, log) }
 
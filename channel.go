@@ -2,6 +2,7 @@ package courier
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 
 	null "gopkg.in/guregu/null.v3"
@@ -22,18 +23,81 @@ const (
 	// ConfigCallbackDomain is the domain that should be used for this channel when registering callbacks
 	ConfigCallbackDomain = "callback_domain"
 
+	// ConfigComplianceApplies is which outgoing messages get a channel's compliance text, one of bulk (the default) or
+	// conversation_start, the first message to a contact in a conversation window
+	ConfigComplianceApplies = "compliance_applies"
+
+	// ConfigCompliancePrefix is the text added to the start of outgoing messages, such as the name of the sender
+	ConfigCompliancePrefix = "compliance_prefix"
+
+	// ConfigComplianceSuffix is the text added to the end of outgoing messages, such as how to opt out
+	ConfigComplianceSuffix = "compliance_suffix"
+
+	// ConfigComplianceWindow is the number of hours a conversation window lasts for after its first message, defaults to 24
+	ConfigComplianceWindow = "compliance_window"
+
 	// ConfigContentType is a constant key for channel configs
 	ConfigContentType = "content_type"
 
+	// ConfigDedupeWindow is the number of seconds we remember the external ids of incoming messages for, negative disables
+	ConfigDedupeWindow = "dedupe_window"
+
+	// ConfigEncodingPolicy is how we change the text of outgoing messages so they can be sent more cheaply, one of none,
+	// smart or transliterate
+	ConfigEncodingPolicy = "encoding_policy"
+
+	// ConfigFallbackChannelUUID is the UUID of the channel outgoing messages are sent through if they can't be sent through
+	// this channel, it must support the schemes of the URNs we send to
+	ConfigFallbackChannelUUID = "fallback_channel_uuid"
+
 	// ConfigMaxLength is the maximum size of a message in characters
 	ConfigMaxLength = "max_length"
 
+	// ConfigMaxMediaSize is the maximum size in bytes of media we will transfer for a channel
+	ConfigMaxMediaSize = "max_media_size"
+
+	// ConfigMsgTTL is the default number of seconds an outgoing message can wait to be sent before it expires and is failed
+	ConfigMsgTTL = "msg_ttl"
+
+	// ConfigOptInKeywords is the list of keywords, in addition to the defaults for our opt out languages, that re-enable a
+	// contact who opted out
+	ConfigOptInKeywords = "opt_in_keywords"
+
+	// ConfigOptInReply is the text we reply with when a contact opts back in, no reply is sent if it isn't set
+	ConfigOptInReply = "opt_in_reply"
+
+	// ConfigOptOutKeywords is the list of keywords, in addition to the defaults for our opt out languages, that opt a
+	// contact out of receiving messages
+	ConfigOptOutKeywords = "opt_out_keywords"
+
+	// ConfigOptOutLanguages is the list of languages whose default opt out and opt in keywords we use
+	ConfigOptOutLanguages = "opt_out_languages"
+
+	// ConfigOptOutReply is the text we reply with when a contact opts out, no reply is sent if it isn't set
+	ConfigOptOutReply = "opt_out_reply"
+
 	// ConfigPassword is a constant key for channel configs
 	ConfigPassword = "password"
 
+	// ConfigSandbox is whether a channel is sandboxed, recording the requests its messages would be sent with instead of
+	// sending them and reporting synthetic statuses for them
+	ConfigSandbox = "sandbox"
+
 	// ConfigSecret is the secret used for signing commands by the channel
 	ConfigSecret = "secret"
 
+	// ConfigSendWindowAllPriorities is whether a channel's send window applies to high priority messages as well as bulk ones
+	ConfigSendWindowAllPriorities = "send_window_all_priorities"
+
+	// ConfigSendWindowDays is the list of weekdays a channel is allowed to send on, e.g. mon,tue,wed,thu,fri
+	ConfigSendWindowDays = "send_window_days"
+
+	// ConfigSendWindowHours is the hours of the day a channel is allowed to send in, e.g. 08:00-20:00
+	ConfigSendWindowHours = "send_window_hours"
+
+	// ConfigSendWindowTimezone is the timezone of a channel's send window, defaults to UTC
+	ConfigSendWindowTimezone = "send_window_timezone"
+
 	// ConfigSendAuthorization is a constant key for channel configs
 	ConfigSendAuthorization = "send_authorization"
 
@@ -46,6 +110,21 @@ const (
 	// ConfigSendURL is a constant key for channel configs
 	ConfigSendURL = "send_url"
 
+	// ConfigShortenLinks is whether links in messages sent through a channel are replaced with short links to us, so that
+	// clicks on them are recorded as channel events
+	ConfigShortenLinks = "shorten_links"
+
+	// ConfigTPSBucket is the name of the rate limit bucket a channel shares with other channels, such as those on the
+	// same provider account. Can also be set in org config.
+	ConfigTPSBucket = "tps_bucket"
+
+	// ConfigTPSBucketLimit is the maximum number of messages per second all the channels in a rate limit bucket can send
+	// together. Can also be set in org config, in which case channels without a bucket share one for their org.
+	ConfigTPSBucketLimit = "tps_bucket_limit"
+
+	// ConfigTransliterateScripts is the list of scripts we transliterate to Latin with the transliterate encoding policy
+	ConfigTransliterateScripts = "transliterate_scripts"
+
 	// ConfigUsername is a constant key for channel configs
 	ConfigUsername = "username"
 )
@@ -120,3 +199,28 @@ type Channel interface {
 	IntConfigForKey(key string, defaultValue int) int
 	OrgConfigForKey(key string, defaultValue interface{}) interface{}
 }
+
+// ConfigStringsForKey returns the list of strings for the passed in config key of the passed in channel, which can be
+// configured as a list or a comma separated string
+func ConfigStringsForKey(channel Channel, key string) []string {
+	var values []string
+	switch value := channel.ConfigForKey(key, nil).(type) {
+	case []string:
+		values = value
+	case []interface{}:
+		for _, v := range value {
+			values = append(values, fmt.Sprintf("%v", v))
+		}
+	case string:
+		values = strings.Split(value, ",")
+	}
+
+	trimmed := make([]string, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			trimmed = append(trimmed, v)
+		}
+	}
+	return trimmed
+}
@@ -11,6 +11,7 @@ type ChannelEventType string
 
 // Possible values for ChannelEventTypes
 const (
+	LinkClicked     ChannelEventType = "link_clicked"
 	NewConversation ChannelEventType = "new_conversation"
 	Referral        ChannelEventType = "referral"
 	StopContact     ChannelEventType = "stop_contact"
@@ -0,0 +1,52 @@
+package courier
+
+import (
+	"sync"
+	"time"
+)
+
+// how many sends in a row need to fail on a channel before we open its circuit
+const circuitFailureThreshold = 5
+
+// how long a channel's circuit stays open for before we try sending through it again
+const circuitOpenDuration = time.Minute
+
+// circuitBreaker keeps track of channels whose sends keep failing, so we can stop trying to send through them for a while
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	failures  map[ChannelUUID]int
+	openUntil map[ChannelUUID]time.Time
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{
+		failures:  make(map[ChannelUUID]int),
+		openUntil: make(map[ChannelUUID]time.Time),
+	}
+}
+
+// IsOpen returns whether the circuit for the passed in channel is open, that is we shouldn't send through it
+func (c *circuitBreaker) IsOpen(uuid ChannelUUID) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return time.Now().Before(c.openUntil[uuid])
+}
+
+// RecordSend records whether a send through the passed in channel failed, opening its circuit if too many have in a row
+func (c *circuitBreaker) RecordSend(uuid ChannelUUID, failed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !failed {
+		delete(c.failures, uuid)
+		delete(c.openUntil, uuid)
+		return
+	}
+
+	c.failures[uuid]++
+	if c.failures[uuid] >= circuitFailureThreshold {
+		c.openUntil[uuid] = time.Now().Add(circuitOpenDuration)
+		delete(c.failures, uuid)
+	}
+}
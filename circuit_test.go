@@ -0,0 +1,32 @@
+package courier
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	circuits := newCircuitBreaker()
+	channel1, _ := NewChannelUUID("e4bb1578-29da-4fa5-a214-9da19dd24230")
+	channel2, _ := NewChannelUUID("b0c4e8f6-cd8b-4a53-9d7d-3b8ee2c8b6c1")
+
+	// a success resets our count of failures
+	for i := 0; i < circuitFailureThreshold-1; i++ {
+		circuits.RecordSend(channel1, true)
+	}
+	circuits.RecordSend(channel1, false)
+	circuits.RecordSend(channel1, true)
+	assert.False(t, circuits.IsOpen(channel1))
+
+	// too many failures in a row opens our circuit
+	for i := 0; i < circuitFailureThreshold-1; i++ {
+		circuits.RecordSend(channel1, true)
+	}
+	assert.True(t, circuits.IsOpen(channel1))
+	assert.False(t, circuits.IsOpen(channel2))
+
+	// and a successful send closes it again
+	circuits.RecordSend(channel1, false)
+	assert.False(t, circuits.IsOpen(channel1))
+}
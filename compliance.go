@@ -0,0 +1,86 @@
+package courier
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the msgs a channel's compliance text is added to
+const (
+	complianceTextBulk              = "bulk"
+	complianceTextConversationStart = "conversation_start"
+)
+
+// the default number of hours a conversation lasts for after the first msg in it
+const defaultComplianceWindow = 24
+
+// addComplianceText adds the compliance prefix and suffix of the passed in msg's channel to its text, if it has any and
+// the msg is one they apply to. This happens before the msg is split into parts for sending, so the added text is
+// counted in its segments and only appears once even if it is sent as several parts.
+func addComplianceText(ctx context.Context, server Server, msg Msg) (Msg, error) {
+	channel := msg.Channel()
+	prefix := complianceTemplate(channel, ConfigCompliancePrefix)
+	suffix := complianceTemplate(channel, ConfigComplianceSuffix)
+	text := msg.Text()
+
+	if (prefix == "" && suffix == "") || text == "" {
+		return msg, nil
+	}
+
+	// msgs which were requeued after we added our text to them already have it
+	hasPrefix := prefix == "" || strings.HasPrefix(text, prefix+" ")
+	hasSuffix := suffix == "" || strings.HasSuffix(text, "\n"+suffix)
+	if hasPrefix && hasSuffix {
+		return msg, nil
+	}
+
+	// if we can't tell whether our text applies we add it anyway, repeating it is better than leaving it out
+	applies, err := complianceTextApplies(ctx, server, msg)
+	if err == nil && !applies {
+		return msg, nil
+	}
+
+	if !hasPrefix {
+		text = prefix + " " + text
+	}
+	if !hasSuffix {
+		text = text + "\n" + suffix
+	}
+	return msg.WithText(text), err
+}
+
+// complianceTextApplies returns whether the compliance text of the passed in msg's channel should be added to it, by
+// default only bulk msgs get it
+func complianceTextApplies(ctx context.Context, server Server, msg Msg) (bool, error) {
+	applies := msg.Channel().StringConfigForKey(ConfigComplianceApplies, complianceTextBulk)
+
+	switch applies {
+	case complianceTextBulk:
+		return !msg.HighPriority(), nil
+	case complianceTextConversationStart:
+		window := msg.Channel().IntConfigForKey(ConfigComplianceWindow, defaultComplianceWindow)
+		return server.Backend().StartsConversation(ctx, msg, time.Duration(window)*time.Hour)
+	default:
+		return false, fmt.Errorf("unknown value for %s: %s", ConfigComplianceApplies, applies)
+	}
+}
+
+// complianceTemplate returns the compliance template with the passed in config key of the passed in channel, with its
+// variables replaced
+func complianceTemplate(channel Channel, key string) string {
+	template := strings.TrimSpace(channel.StringConfigForKey(key, ""))
+	if template == "" {
+		return ""
+	}
+
+	variables := map[string]string{
+		"channel_name":    channel.Name(),
+		"channel_address": channel.Address(),
+	}
+	for k, v := range variables {
+		template = strings.Replace(template, fmt.Sprintf("{{%s}}", k), v, -1)
+	}
+	return template
+}
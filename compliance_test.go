@@ -0,0 +1,71 @@
+package courier
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddComplianceText(t *testing.T) {
+	mb := NewMockBackend()
+	s := NewServer(testConfig(), mb)
+	ctx := context.Background()
+
+	bulkChannel := NewMockChannel("e4bb1578-29da-4fa5-a214-9da19dd24230", "DM", "2020", "US", map[string]interface{}{
+		ConfigCompliancePrefix: "{{channel_address}}:",
+		ConfigComplianceSuffix: "Reply STOP to opt out",
+	})
+	conversationChannel := NewMockChannel("53e5aafa-8155-449d-9009-fcb30d54bd26", "DM", "2021", "US", map[string]interface{}{
+		ConfigComplianceSuffix:  "Reply STOP to opt out",
+		ConfigComplianceApplies: "conversation_start",
+		ConfigComplianceWindow:  1,
+	})
+	plainChannel := NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c568c", "DM", "2022", "US", map[string]interface{}{})
+
+	tcs := []struct {
+		msg      *mockMsg
+		expected string
+	}{
+		// bulk msgs get our text, high priority ones don't
+		{&mockMsg{channel: bulkChannel, id: NewMsgID(1001), urn: "tel:+250788383383", text: "Big sale!"}, "2020: Big sale!\nReply STOP to opt out"},
+		{&mockMsg{channel: bulkChannel, id: NewMsgID(1002), urn: "tel:+250788383383", text: "Your code is 1234", highPriority: true}, "Your code is 1234"},
+
+		// msgs which already have our text don't get it again
+		{&mockMsg{channel: bulkChannel, id: NewMsgID(1003), urn: "tel:+250788383383", text: "2020: Big sale!\nReply STOP to opt out"}, "2020: Big sale!\nReply STOP to opt out"},
+
+		// nor do msgs without text
+		{&mockMsg{channel: bulkChannel, id: NewMsgID(1004), urn: "tel:+250788383383", attachments: []string{"image/jpeg:https://foo.bar/image.jpg"}}, ""},
+
+		// only the first msg to a contact in a conversation gets our text, whatever its priority
+		{&mockMsg{channel: conversationChannel, id: NewMsgID(1005), urn: "tel:+250788383383", text: "Hi!", highPriority: true}, "Hi!\nReply STOP to opt out"},
+		{&mockMsg{channel: conversationChannel, id: NewMsgID(1006), urn: "tel:+250788383383", text: "How are you?"}, "How are you?"},
+		{&mockMsg{channel: conversationChannel, id: NewMsgID(1005), urn: "tel:+250788383383", text: "Hi!"}, "Hi!\nReply STOP to opt out"},
+		{&mockMsg{channel: conversationChannel, id: NewMsgID(1007), urn: "tel:+250788383384", text: "Hi!"}, "Hi!\nReply STOP to opt out"},
+
+		// channels without compliance text leave msgs alone
+		{&mockMsg{channel: plainChannel, id: NewMsgID(1008), urn: "tel:+250788383383", text: "Big sale!"}, "Big sale!"},
+	}
+
+	for _, tc := range tcs {
+		msg, err := addComplianceText(ctx, s, tc.msg)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, msg.Text(), "unexpected text for msg %s", tc.msg.id)
+	}
+
+	// once our conversation window is over, the next msg starts a new conversation
+	mb.conversations[sendingURNKey(tcs[4].msg)] = mockConversation{msgID: NewMsgID(1005), until: time.Now().Add(-time.Second)}
+	msg, err := addComplianceText(ctx, s, &mockMsg{channel: conversationChannel, id: NewMsgID(1009), urn: "tel:+250788383383", text: "Back again"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Back again\nReply STOP to opt out", msg.Text())
+
+	// channels with an unknown value for when their text applies always add it
+	badChannel := NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c568c", "DM", "2022", "US", map[string]interface{}{
+		ConfigComplianceSuffix:  "Reply STOP to opt out",
+		ConfigComplianceApplies: "sometimes",
+	})
+	msg, err = addComplianceText(ctx, s, &mockMsg{channel: badChannel, id: NewMsgID(1010), urn: "tel:+250788383383", text: "Big sale!"})
+	assert.EqualError(t, err, "unknown value for compliance_applies: sometimes")
+	assert.Equal(t, "Big sale!\nReply STOP to opt out", msg.Text())
+}
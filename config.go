@@ -21,12 +21,21 @@ type Config struct {
 	AWSAccessKeyID        string `help:"the access key id to use when authenticating S3"`
 	AWSSecretAccessKey    string `help:"the secret access key id to use when authenticating S3"`
 	MaxWorkers            int    `help:"the maximum number of go routines that will be used for sending (set to 0 to disable sending)"`
+	MaxMediaSize          int    `help:"the maximum size in bytes of media courier will download or upload, unless a channel type declares its own"`
+	DedupeWindow          int    `help:"the number of seconds we remember the external ids of incoming messages for to ignore provider retries (set to 0 to disable)"`
+	PriorityLevels        int    `help:"the number of priority levels outgoing messages are queued with, from bulk (0) up to transactional"`
+	PriorityAging         int    `help:"the number of seconds after which a queued message is treated as one priority level higher (set to 0 to disable)"`
+	ShortLinkExpiration   int    `help:"the number of days the short links in outgoing messages keep redirecting for (set to 0 to never expire)"`
 	LibratoUsername       string `help:"the username that will be used to authenticate to Librato"`
 	LibratoToken          string `help:"the token that will be used to authenticate to Librato"`
 	StatusUsername        string `help:"the username that is needed to authenticate against the /status endpoint"`
 	StatusPassword        string `help:"the password that is needed to authenticate against the /status endpoint"`
 	LogLevel              string `help:"the logging level courier should use"`
 	IgnoreDeliveryReports bool   `help:"whether we ignore delivered status reports (errors will still be handled)"`
+	StatusHistory         bool   `help:"whether we record every status update of outgoing messages in a history table"`
+	Sandbox               bool   `help:"whether all channels are sandboxed, recording the requests messages would be sent with instead of sending them"`
+	SandboxSentDelay      int    `help:"the number of seconds after a sandboxed message is wired that we mark it as sent (set to -1 to disable)"`
+	SandboxDeliveredDelay int    `help:"the number of seconds after a sandboxed message is wired that we mark it as delivered (set to -1 to disable)"`
 	Version               string `help:"the version that will be used in request and response headers"`
 
 	// IncludeChannels is the list of channels to enable, empty means include all
@@ -39,24 +48,31 @@ type Config struct {
 // NewConfig returns a new default configuration object
 func NewConfig() *Config {
 	return &Config{
-		Backend:            "rapidpro",
-		Domain:             "localhost",
-		Address:            "",
-		Port:               8080,
-		DB:                 "postgres://courier@localhost/courier?sslmode=disable",
-		Redis:              "redis://localhost:6379/0",
-		SpoolDir:           "/var/spool/courier",
-		S3Endpoint:         "https://s3.amazonaws.com",
-		S3Region:           "us-east-1",
-		S3MediaBucket:      "courier-media",
-		S3MediaPrefix:      "/media/",
-		S3DisableSSL:       false,
-		S3ForcePathStyle:   false,
-		AWSAccessKeyID:     "missing_aws_access_key_id",
-		AWSSecretAccessKey: "missing_aws_secret_access_key",
-		MaxWorkers:         32,
-		LogLevel:           "error",
-		Version:            "Dev",
+		Backend:               "rapidpro",
+		Domain:                "localhost",
+		Address:               "",
+		Port:                  8080,
+		DB:                    "postgres://courier@localhost/courier?sslmode=disable",
+		Redis:                 "redis://localhost:6379/0",
+		SpoolDir:              "/var/spool/courier",
+		S3Endpoint:            "https://s3.amazonaws.com",
+		S3Region:              "us-east-1",
+		S3MediaBucket:         "courier-media",
+		S3MediaPrefix:         "/media/",
+		S3DisableSSL:          false,
+		S3ForcePathStyle:      false,
+		AWSAccessKeyID:        "missing_aws_access_key_id",
+		AWSSecretAccessKey:    "missing_aws_secret_access_key",
+		MaxWorkers:            32,
+		MaxMediaSize:          20 * 1024 * 1024,
+		DedupeWindow:          0,
+		PriorityLevels:        3,
+		PriorityAging:         0,
+		SandboxSentDelay:      1,
+		SandboxDeliveredDelay: 5,
+		ShortLinkExpiration:   30,
+		LogLevel:              "error",
+		Version:               "Dev",
 	}
 }
 
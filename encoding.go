@@ -0,0 +1,88 @@
+package courier
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/courier/gsm7"
+	"github.com/nyaruka/courier/utils"
+)
+
+// the encoding policies a channel can have for outgoing messages
+const (
+	EncodingPolicyNone          = "none"
+	EncodingPolicySmart         = "smart"
+	EncodingPolicyTransliterate = "transliterate"
+)
+
+// applyEncodingPolicy changes the text of the passed in msg according to the encoding policy of its channel, returning a
+// log of what was changed or nil if nothing was. Text is only changed if that makes it entirely GSM7, as otherwise it
+// would still need to be sent as UCS2 and we would have changed it for nothing.
+func applyEncodingPolicy(handler ChannelHandler, msg Msg) *ChannelLog {
+	start := time.Now()
+	channel := msg.Channel()
+
+	policy := encodingPolicy(handler, channel)
+	if policy == EncodingPolicyNone || msg.Text() == "" {
+		return nil
+	}
+
+	original := msg.Text()
+	text := original
+
+	switch policy {
+	case EncodingPolicyTransliterate:
+		text = gsm7.ReplaceSubstitutions(utils.Transliterate(text, transliterateScripts(channel)))
+	case EncodingPolicySmart:
+		text = gsm7.ReplaceSubstitutions(text)
+	default:
+		return NewChannelLog("Text Encoding Error", channel, msg.ID(), "", "", NilStatusCode, original, "", time.Now().Sub(start),
+			fmt.Errorf("unknown encoding policy: %s", policy))
+	}
+
+	if text == original || !gsm7.IsValid(text) {
+		return nil
+	}
+
+	msg.WithText(text)
+
+	return NewChannelLog("Text Encoded", channel, msg.ID(), "", "", NilStatusCode, original,
+		fmt.Sprintf("encoding policy: %s\nchanged: %s\n\n%s", policy, describeChanges(original, text), text), time.Now().Sub(start), nil)
+}
+
+// encodingPolicy returns the encoding policy of the passed in channel, if it doesn't have one that is the default of its
+// handler if it has one, otherwise none
+func encodingPolicy(handler ChannelHandler, channel Channel) string {
+	defaultPolicy := EncodingPolicyNone
+	if defaulter, isDefaulter := handler.(EncodingPolicyDefaulter); isDefaulter {
+		defaultPolicy = defaulter.DefaultEncodingPolicy(channel)
+	}
+	return channel.StringConfigForKey(ConfigEncodingPolicy, defaultPolicy)
+}
+
+// transliterateScripts returns the scripts configured for the passed in channel, either as a list or a comma separated
+// string, defaulting to all the scripts we support
+func transliterateScripts(channel Channel) []utils.Script {
+	names := ConfigStringsForKey(channel, ConfigTransliterateScripts)
+	scripts := make([]utils.Script, len(names))
+	for i, name := range names {
+		scripts[i] = utils.Script(strings.ToLower(name))
+	}
+	if len(scripts) == 0 {
+		return utils.AllScripts
+	}
+	return scripts
+}
+
+// describeChanges returns the characters in original which were replaced in changed
+func describeChanges(original string, changed string) string {
+	replaced := make([]string, 0)
+	for _, r := range original {
+		c := string(r)
+		if !strings.ContainsRune(changed, r) && !utils.StringArrayContains(replaced, c) {
+			replaced = append(replaced, c)
+		}
+	}
+	return strings.Join(replaced, " ")
+}
@@ -0,0 +1,69 @@
+package courier
+
+import (
+	"testing"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyEncodingPolicy(t *testing.T) {
+	mb := NewMockBackend()
+
+	tcs := []struct {
+		config      map[string]interface{}
+		text        string
+		encoded     string
+		description string
+		changed     string
+	}{
+		{map[string]interface{}{}, "“Привет”", "“Привет”", "", ""},
+		{map[string]interface{}{ConfigEncodingPolicy: EncodingPolicyNone}, "“Привет”", "“Привет”", "", ""},
+		{map[string]interface{}{ConfigEncodingPolicy: EncodingPolicySmart}, "plain", "plain", "", ""},
+		{map[string]interface{}{ConfigEncodingPolicy: EncodingPolicySmart}, "“Hola” á", `"Hola" a`, "Text Encoded", "changed: “ ” á"},
+		{map[string]interface{}{ConfigEncodingPolicy: EncodingPolicySmart}, "“Привет” á", "“Привет” á", "", ""},
+		{map[string]interface{}{ConfigEncodingPolicy: EncodingPolicyTransliterate}, "“Привет” Γειά", `"Privet" Geia`, "Text Encoded", "changed: “ П р и в е т ” Γ ε ι ά"},
+		{map[string]interface{}{ConfigEncodingPolicy: EncodingPolicyTransliterate, ConfigTransliterateScripts: []interface{}{"greek"}}, "Γειά", "Geia", "Text Encoded", "changed: Γ ε ι ά"},
+		{map[string]interface{}{ConfigEncodingPolicy: EncodingPolicyTransliterate, ConfigTransliterateScripts: "cyrillic"}, "Привет Γειά", "Привет Γειά", "", ""},
+		{map[string]interface{}{ConfigEncodingPolicy: "foo"}, "Привет", "Привет", "Text Encoding Error", ""},
+	}
+
+	for _, tc := range tcs {
+		channel := NewMockChannel("53e5aafa-8155-449d-9009-fcb30d54bd26", "XX", "2020", "US", tc.config)
+		msg := mb.NewTestOutgoingMsg(channel, NewMsgID(10), urns.URN("tel:+250788383383"), tc.text, false, nil, 0, "")
+
+		log := applyEncodingPolicy(nil, msg)
+		assert.Equal(t, tc.encoded, msg.Text(), tc.text)
+
+		if tc.description == "" {
+			assert.Nil(t, log, tc.text)
+		} else if assert.NotNil(t, log, tc.text) {
+			assert.Equal(t, tc.description, log.Description)
+			assert.Equal(t, tc.text, log.Request)
+			assert.Contains(t, log.Response, tc.changed)
+		}
+	}
+}
+
+// smartHandler is a handler whose channels default to the smart encoding policy
+type smartHandler struct {
+	ChannelHandler
+}
+
+func (h *smartHandler) DefaultEncodingPolicy(Channel) string { return EncodingPolicySmart }
+
+func TestDefaultEncodingPolicy(t *testing.T) {
+	mb := NewMockBackend()
+
+	// channels without a policy get the default of their handler
+	channel := NewMockChannel("53e5aafa-8155-449d-9009-fcb30d54bd26", "XX", "2020", "US", map[string]interface{}{})
+	msg := mb.NewTestOutgoingMsg(channel, NewMsgID(10), urns.URN("tel:+250788383383"), "“Hola”", false, nil, 0, "")
+	assert.NotNil(t, applyEncodingPolicy(&smartHandler{}, msg))
+	assert.Equal(t, `"Hola"`, msg.Text())
+
+	// but a policy of their own wins
+	channel = NewMockChannel("53e5aafa-8155-449d-9009-fcb30d54bd26", "XX", "2020", "US", map[string]interface{}{ConfigEncodingPolicy: EncodingPolicyNone})
+	msg = mb.NewTestOutgoingMsg(channel, NewMsgID(10), urns.URN("tel:+250788383383"), "“Hola”", false, nil, 0, "")
+	assert.Nil(t, applyEncodingPolicy(&smartHandler{}, msg))
+	assert.Equal(t, "“Hola”", msg.Text())
+}
@@ -295,3 +295,40 @@ func Decode(gsm7 []byte) (str string) {
 	}
 	return str
 }
+
+// Pack packs the passed in GSM7 bytes into octets as they are sent in the user data of an SMS, following a UDH of the
+// passed in number of octets, including its length octet. The first septet is padded with fill bits to start on a
+// septet boundary after the UDH.
+func Pack(septets []byte, udhLength int) []byte {
+	fill := (7 - (udhLength*8)%7) % 7
+	packed := make([]byte, (fill+len(septets)*7+7)/8)
+
+	for i, s := range septets {
+		bit := fill + i*7
+		packed[bit/8] |= (s & 0x7F) << uint(bit%8)
+		if bit%8 > 1 {
+			packed[bit/8+1] |= (s & 0x7F) >> uint(8-bit%8)
+		}
+	}
+	return packed
+}
+
+// Unpack unpacks the passed in number of GSM7 bytes from the passed in octets, the reverse of Pack
+func Unpack(packed []byte, udhLength int, count int) []byte {
+	fill := (7 - (udhLength*8)%7) % 7
+	septets := make([]byte, 0, count)
+
+	for i := 0; i < count; i++ {
+		bit := fill + i*7
+		if bit/8 >= len(packed) {
+			break
+		}
+
+		s := packed[bit/8] >> uint(bit%8)
+		if bit%8 > 1 && bit/8+1 < len(packed) {
+			s |= packed[bit/8+1] << uint(8-bit%8)
+		}
+		septets = append(septets, s&0x7F)
+	}
+	return septets
+}
@@ -27,6 +27,23 @@ func TestEncodeDecode(t *testing.T) {
 	assert.Equal(t, []byte("hi!\x20\x3F"), Encode("hi! ☺"))
 }
 
+func TestPackUnpack(t *testing.T) {
+	tcs := []struct {
+		septets   string
+		udhLength int
+		packed    []byte
+	}{
+		{"hellohello", 0, []byte{0xE8, 0x32, 0x9B, 0xFD, 0x46, 0x97, 0xD9, 0xEC, 0x37}},
+		{"hello", 6, []byte{0xD0, 0x65, 0x36, 0xFB, 0x0D}},
+		{"hi", 4, []byte{0x40, 0xA7, 0x01}},
+		{"", 0, []byte{}},
+	}
+	for _, tc := range tcs {
+		assert.Equal(t, tc.packed, Pack([]byte(tc.septets), tc.udhLength), "packed mismatch for '%s'", tc.septets)
+		assert.Equal(t, []byte(tc.septets), Unpack(tc.packed, tc.udhLength, len(tc.septets)), "unpacked mismatch for '%s'", tc.septets)
+	}
+}
+
 func TestValid(t *testing.T) {
 	tcs := []struct {
 		str   string
@@ -55,3 +72,74 @@ func TestSubstitutions(t *testing.T) {
 		assert.Equal(t, tc.exp, ReplaceSubstitutions(tc.str), tc.str)
 	}
 }
+
+func TestNationalTables(t *testing.T) {
+	turkish := Table{Turkish, Turkish}
+	portuguese := Table{Portuguese, Portuguese}
+
+	tcs := []struct {
+		str     string
+		table   Table
+		encoded string
+	}{
+		{"basic", DefaultTable, "basic"},
+		{"Iğdır", turkish, "I\x0Cd\x07r"},
+		{"İstanbul €", turkish, "\x40stanbul \x04"},
+		{"ş{x}", turkish, "\x1D\x1B\x28x\x1B\x29"},
+		{"Ç na mão", Table{Default, Portuguese}, "\x09 na m\x1B\x7Bo"},
+		{"ação", portuguese, "a\x09\x7Bo"},
+		{"canción", Table{Default, Spanish}, "canci\x1B\x6Fn"},
+		{"नमस्ते 2", Table{Hindi, Default}, "\x2F\x42\x4C\x5F\x27\x59 2"},
+		{"ॐ", Table{Hindi, Default}, "\x60"},
+		{"নমস্কার", Table{Bengali, Default}, "\x2F\x42\x4C\x5F\x15\x50\x44"},
+		{"வணக்கம்", Table{Tamil, Default}, "\x49\x26\x15\x5F\x15\x42\x5F"},
+	}
+	for _, tc := range tcs {
+		assert.True(t, IsValidForTable(tc.str, tc.table), tc.str)
+		assert.Equal(t, []byte(tc.encoded), EncodeWithTable(tc.str, tc.table), tc.str)
+		assert.Equal(t, tc.str, DecodeWithTable([]byte(tc.encoded), tc.table), tc.str)
+	}
+
+	assert.False(t, IsValid("Iğdır"))
+	assert.False(t, IsValidForTable("Iğdır", DefaultTable))
+	assert.False(t, IsValidForTable("Iğdır", portuguese))
+	assert.False(t, IsValidForTable("hi! ☺", turkish))
+	assert.Equal(t, []byte("hi!\x20\x3F"), EncodeWithTable("hi! ☺", turkish))
+
+	// Indian tables don't include characters their script doesn't have, or which were added to it since
+	assert.False(t, IsValidForTable("নমস্কার", Table{Hindi, Default}))
+	assert.False(t, IsValidForTable("\u0b96", Table{Tamil, Default}))
+	assert.False(t, IsValidForTable("\u0d29", Table{Malayalam, Default}))
+	assert.True(t, IsValidForTable("\u0d28", Table{Malayalam, Default}))
+
+	assert.Equal(t, []byte{}, DefaultTable.UDH())
+	assert.Equal(t, []byte{0x24, 0x01, 0x02}, Table{Default, Spanish}.UDH())
+	assert.Equal(t, []byte{0x24, 0x01, 0x01, 0x25, 0x01, 0x01}, turkish.UDH())
+	assert.Equal(t, 0, UDHSeptets(DefaultTable))
+	assert.Equal(t, 5, UDHSeptets(Table{Default, Spanish}))
+	assert.Equal(t, 8, UDHSeptets(turkish))
+}
+
+func TestChooseTable(t *testing.T) {
+	tcs := []struct {
+		str   string
+		table Table
+		valid bool
+	}{
+		{"basic text", DefaultTable, true},
+		{"{extended} €", DefaultTable, true},
+		{"¿Dónde está él?", Table{Default, Spanish}, true},
+		{"Iğdır", Table{Turkish, Default}, true},
+		{"Şişli'de ığdır ağaçlığı görüşürüz", Table{Turkish, Default}, true},
+		{"Não há ação sem emoção", Table{Portuguese, Default}, true},
+		{"Não há ação, ¿é?", Table{Default, Portuguese}, true},
+		{"नमस्ते", Table{Hindi, Default}, true},
+		{"வணக்கம்", Table{Tamil, Default}, true},
+		{"hi! ☺", Table{}, false},
+	}
+	for _, tc := range tcs {
+		table, valid := ChooseTable(tc.str)
+		assert.Equal(t, tc.valid, valid, tc.str)
+		assert.Equal(t, tc.table, table, tc.str)
+	}
+}
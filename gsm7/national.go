@@ -0,0 +1,320 @@
+package gsm7
+
+import (
+	"bytes"
+	"unicode"
+)
+
+// Language is a national language as identified by GSM 03.38, its value is what is used in the UDH to select its tables
+type Language byte
+
+// The national languages we have tables for. Not every language defines both a locking and single shift table, Spanish
+// only has a single shift table for example. For the Indian languages we only have the locking shift tables, and Urdu,
+// which unlike the others isn't laid out like ISCII, isn't included.
+const (
+	Default    Language = 0x00
+	Turkish    Language = 0x01
+	Spanish    Language = 0x02
+	Portuguese Language = 0x03
+	Bengali    Language = 0x04
+	Gujarati   Language = 0x05
+	Hindi      Language = 0x06
+	Kannada    Language = 0x07
+	Malayalam  Language = 0x08
+	Oriya      Language = 0x09
+	Punjabi    Language = 0x0A
+	Tamil      Language = 0x0B
+	Telugu     Language = 0x0C
+)
+
+// the UDH information element identifiers for national language shift tables
+const (
+	udhSingleShift  byte = 0x24
+	udhLockingShift byte = 0x25
+)
+
+// Table is the pairing of the locking shift table a text is encoded with and the single shift table used for any
+// escaped characters
+type Table struct {
+	Locking Language
+	Shift   Language
+}
+
+// DefaultTable is the default alphabet with its extension table, which needs no UDH
+var DefaultTable = Table{Default, Default}
+
+// UDH returns the UDH information elements which need to be sent with a text encoded with this table, this will be
+// empty for the default table
+func (t Table) UDH() []byte {
+	udh := make([]byte, 0, 6)
+	if t.Shift != Default {
+		udh = append(udh, udhSingleShift, 0x01, byte(t.Shift))
+	}
+	if t.Locking != Default {
+		udh = append(udh, udhLockingShift, 0x01, byte(t.Locking))
+	}
+	return udh
+}
+
+// charset maps between runes and gsm7 bytes for a single table
+type charset struct {
+	toRune   map[byte]rune
+	fromRune map[rune]byte
+}
+
+func newCharset(toRune map[byte]rune) *charset {
+	c := &charset{toRune: toRune, fromRune: make(map[rune]byte, len(toRune))}
+	for b, r := range toRune {
+		c.fromRune[r] = b
+	}
+	return c
+}
+
+// newDefaultCharset creates a charset from one of our default rune to byte mappings
+func newDefaultCharset(fromRune map[rune]byte) *charset {
+	toRune := make(map[byte]rune, len(fromRune))
+	for r, b := range fromRune {
+		toRune[b] = r
+	}
+	return newCharset(toRune)
+}
+
+// newLockingCharset creates a locking shift charset which is the default alphabet with the passed in differences
+func newLockingCharset(differences map[byte]rune) *charset {
+	toRune := make(map[byte]rune, len(baseGSM7))
+	for r, b := range baseGSM7 {
+		toRune[b] = r
+	}
+	for b, r := range differences {
+		toRune[b] = r
+	}
+	return newCharset(toRune)
+}
+
+// the characters every national single shift table has in common
+var commonShift = map[byte]rune{
+	0x0A: '\f',
+	0x14: '^',
+	0x28: '{',
+	0x29: '}',
+	0x2F: '\\',
+	0x3C: '[',
+	0x3D: '~',
+	0x3E: ']',
+	0x40: '|',
+	0x65: '€',
+}
+
+// newShiftCharset creates a single shift charset from the common shift characters and the passed in additions
+func newShiftCharset(additions map[byte]rune) *charset {
+	toRune := make(map[byte]rune, len(commonShift)+len(additions))
+	for b, r := range commonShift {
+		toRune[b] = r
+	}
+	for b, r := range additions {
+		toRune[b] = r
+	}
+	return newCharset(toRune)
+}
+
+// the Hindi locking shift table, which the other Indian locking shift tables share their layout with as their scripts
+// follow ISCII, 0 is our escape
+var hindiLocking = [128]rune{
+	0x0901, 0x0902, 0x0903, 0x0905, 0x0906, 0x0907, 0x0908, 0x0909, 0x090A, 0x090B, '\n', 0x090C, 0x090D, '\r', 0x090E, 0x090F,
+	0x0910, 0x0911, 0x0912, 0x0913, 0x0914, 0x0915, 0x0916, 0x0917, 0x0918, 0x0919, 0x091A, 0, 0x091B, 0x091C, 0x091D, 0x091E,
+	' ', '!', 0x091F, 0x0920, 0x0921, 0x0922, 0x0923, 0x0924, ')', '(', 0x0925, 0x0926, ',', 0x0927, '.', 0x0928,
+	'0', '1', '2', '3', '4', '5', '6', '7', '8', '9', ':', ';', 0x0929, 0x092A, 0x092B, '?',
+	0x092C, 0x092D, 0x092E, 0x092F, 0x0930, 0x0931, 0x0932, 0x0933, 0x0934, 0x0935, 0x0936, 0x0937, 0x0938, 0x0939, 0x093C, 0x093D,
+	0x093E, 0x093F, 0x0940, 0x0941, 0x0942, 0x0943, 0x0944, 0x0945, 0x0946, 0x0947, 0x0948, 0x0949, 0x094A, 0x094B, 0x094C, 0x094D,
+	0x0950, 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o',
+	'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', 0x0972, 0x097B, 0x097C, 0x097E, 0x097F,
+}
+
+// the start of the Devanagari block, which the Hindi table uses
+const devanagariBlock rune = 0x0900
+
+// the positions in the Indian locking shift tables whose characters aren't ISCII aligned, so differ by language
+var indicUnalignedPositions = []byte{0x60, 0x7B, 0x7C, 0x7D, 0x7E, 0x7F}
+
+// characters which Unicode added to the Indian scripts after GSM 03.38 defined its tables, their positions are empty
+var indicLaterAdditions = map[rune]bool{
+	0x0C34: true, 0x0C3C: true, 0x0C81: true, 0x0D01: true, 0x0D29: true, 0x0D3C: true,
+}
+
+// newIndicLockingCharset creates the locking shift charset for an Indian language by moving the Devanagari characters
+// of the Hindi table to the passed in script's block, leaving empty the positions the script has no character for. The
+// positions which aren't ISCII aligned are only filled by the passed in unaligned characters for other scripts.
+func newIndicLockingCharset(block rune, script *unicode.RangeTable, unaligned map[byte]rune) *charset {
+	toRune := make(map[byte]rune, len(hindiLocking))
+	for b, r := range hindiLocking {
+		if r == 0 || (block != devanagariBlock && bytes.IndexByte(indicUnalignedPositions, byte(b)) >= 0) {
+			continue
+		}
+		if r >= devanagariBlock && r < devanagariBlock+0x80 {
+			r = r - devanagariBlock + block
+			if !unicode.Is(script, r) || indicLaterAdditions[r] {
+				continue
+			}
+		}
+		toRune[byte(b)] = r
+	}
+	for b, r := range unaligned {
+		toRune[b] = r
+	}
+	return newCharset(toRune)
+}
+
+var lockingCharsets map[Language]*charset
+var shiftCharsets map[Language]*charset
+
+// the order we consider tables in when choosing one, simplest first so they win ties
+var lockingLanguages = []Language{Default, Turkish, Portuguese, Bengali, Gujarati, Hindi, Kannada, Malayalam, Oriya, Punjabi, Tamil, Telugu}
+var shiftLanguages = []Language{Default, Turkish, Spanish, Portuguese}
+
+func init() {
+	lockingCharsets = map[Language]*charset{
+		Default: newDefaultCharset(baseGSM7),
+		Turkish: newLockingCharset(map[byte]rune{
+			0x04: '€', 0x07: 'ı', 0x0B: 'Ğ', 0x0C: 'ğ', 0x1C: 'Ş', 0x1D: 'ş', 0x40: 'İ', 0x60: 'ç',
+		}),
+		Portuguese: newLockingCharset(map[byte]rune{
+			0x04: 'ê', 0x06: 'ú', 0x07: 'í', 0x08: 'ó', 0x09: 'ç', 0x0B: 'Ô', 0x0C: 'ô', 0x0E: 'Á', 0x0F: 'á',
+			0x12: 'ª', 0x13: 'Ç', 0x14: 'À', 0x15: '∞', 0x16: '^', 0x17: '\\', 0x18: '€', 0x19: 'Ó', 0x1A: '|',
+			0x1C: 'Â', 0x1D: 'â', 0x1E: 'Ê', 0x24: 'º', 0x40: 'Í', 0x5B: 'Ã', 0x5C: 'Õ', 0x5D: 'Ú', 0x60: '~',
+			0x7B: 'ã', 0x7C: 'õ', 0x7D: '`',
+		}),
+		Bengali: newIndicLockingCharset(0x0980, unicode.Bengali, map[byte]rune{
+			0x60: 0x09CE, 0x7B: 0x09D7, 0x7C: 0x09DC, 0x7D: 0x09DD, 0x7E: 0x09F0, 0x7F: 0x09F1,
+		}),
+		Gujarati:  newIndicLockingCharset(0x0A80, unicode.Gujarati, nil),
+		Hindi:     newIndicLockingCharset(devanagariBlock, unicode.Devanagari, nil),
+		Kannada:   newIndicLockingCharset(0x0C80, unicode.Kannada, nil),
+		Malayalam: newIndicLockingCharset(0x0D00, unicode.Malayalam, nil),
+		Oriya:     newIndicLockingCharset(0x0B00, unicode.Oriya, nil),
+		Punjabi:   newIndicLockingCharset(0x0A00, unicode.Gurmukhi, nil),
+		Tamil:     newIndicLockingCharset(0x0B80, unicode.Tamil, nil),
+		Telugu:    newIndicLockingCharset(0x0C00, unicode.Telugu, nil),
+	}
+
+	shiftCharsets = map[Language]*charset{
+		Default: newDefaultCharset(extendedGSM7),
+		Turkish: newShiftCharset(map[byte]rune{
+			0x47: 'Ğ', 0x49: 'İ', 0x53: 'Ş', 0x63: 'ç', 0x67: 'ğ', 0x69: 'ı', 0x73: 'ş',
+		}),
+		Spanish: newShiftCharset(map[byte]rune{
+			0x09: 'ç', 0x41: 'Á', 0x49: 'Í', 0x4F: 'Ó', 0x55: 'Ú', 0x61: 'á', 0x69: 'í', 0x6F: 'ó', 0x75: 'ú',
+		}),
+		Portuguese: newShiftCharset(map[byte]rune{
+			0x05: 'ê', 0x09: 'ç', 0x0B: 'Ô', 0x0C: 'ô', 0x0E: 'Á', 0x0F: 'á', 0x12: 'Φ', 0x13: 'Γ', 0x15: 'Ω',
+			0x16: 'Π', 0x17: 'Ψ', 0x18: 'Σ', 0x19: 'Θ', 0x1F: 'Ê', 0x41: 'À', 0x49: 'Í', 0x4F: 'Ó', 0x55: 'Ú',
+			0x5B: 'Ã', 0x5C: 'Õ', 0x61: 'Â', 0x69: 'í', 0x6F: 'ó', 0x75: 'ú', 0x7B: 'ã', 0x7C: 'õ', 0x7F: 'â',
+		}),
+	}
+}
+
+// charsets returns the locking and single shift charsets for the passed in table, falling back to the default tables
+// for languages we don't know
+func (t Table) charsets() (*charset, *charset) {
+	locking, found := lockingCharsets[t.Locking]
+	if !found {
+		locking = lockingCharsets[Default]
+	}
+	shift, found := shiftCharsets[t.Shift]
+	if !found {
+		shift = shiftCharsets[Default]
+	}
+	return locking, shift
+}
+
+// IsValidForTable returns whether the passed in string can be encoded entirely using the passed in table
+func IsValidForTable(text string, table Table) bool {
+	locking, shift := table.charsets()
+	for _, r := range text {
+		if _, found := locking.fromRune[r]; found {
+			continue
+		}
+		if _, found := shift.fromRune[r]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// EncodeWithTable encodes the given UTF-8 text into GSM7 bytes using the passed in table. Characters from the single
+// shift table are preceded by our escape and characters which can't be encoded are output as ?
+func EncodeWithTable(str string, table Table) []byte {
+	locking, shift := table.charsets()
+	buffer := bytes.Buffer{}
+	for _, r := range str {
+		if b, found := locking.fromRune[r]; found {
+			buffer.WriteByte(b)
+			continue
+		}
+		if b, found := shift.fromRune[r]; found {
+			buffer.Write([]byte{esc, b})
+			continue
+		}
+		buffer.WriteByte(unknown)
+	}
+	return buffer.Bytes()
+}
+
+// DecodeWithTable decodes the passed in GSM7 bytes using the passed in table
+func DecodeWithTable(gsm7 []byte, table Table) string {
+	locking, shift := table.charsets()
+	buffer := bytes.Buffer{}
+	escaped := false
+
+	for _, b := range gsm7 {
+		r := '?'
+		if b > max {
+			escaped = false
+		} else if escaped {
+			if sr, found := shift.toRune[b]; found {
+				r = sr
+			}
+			escaped = false
+		} else if b == esc {
+			escaped = true
+			continue
+		} else if lr, found := locking.toRune[b]; found {
+			r = lr
+		}
+		buffer.WriteRune(r)
+	}
+	return buffer.String()
+}
+
+// ChooseTable returns the table which encodes the passed in text most cheaply, taking into account the UDH space any
+// national language tables take up. Returns false if no table can encode the text.
+func ChooseTable(text string) (Table, bool) {
+	var best Table
+	bestCost := -1
+
+	for _, lockingLanguage := range lockingLanguages {
+		for _, shiftLanguage := range shiftLanguages {
+			table := Table{lockingLanguage, shiftLanguage}
+			if !IsValidForTable(text, table) {
+				continue
+			}
+
+			cost := len(EncodeWithTable(text, table)) + UDHSeptets(table)
+			if bestCost < 0 || cost < bestCost {
+				best, bestCost = table, cost
+			}
+		}
+	}
+
+	return best, bestCost >= 0
+}
+
+// UDHSeptets returns the number of septets the UDH for the passed in table takes up in a message, including the UDH
+// length octet, or 0 if the table needs no UDH
+func UDHSeptets(table Table) int {
+	udh := table.UDH()
+	if len(udh) == 0 {
+		return 0
+	}
+	octets := len(udh) + 1
+	return (octets*8 + 6) / 7
+}
@@ -36,6 +36,44 @@ type MediaDownloadRequestBuilder interface {
 	BuildDownloadMediaRequest(context.Context, Backend, Channel, string) (*http.Request, error)
 }
 
+// MediaSizeLimiter is the interface handlers whose channel type restricts the size of the media they can transfer should satisfy
+type MediaSizeLimiter interface {
+	MaxMediaSize() int64
+}
+
+// MediaConstraints are the limits a channel type places on the images it sends, zero values meaning no limit
+type MediaConstraints struct {
+	MaxImageBytes  int64
+	MaxImageWidth  int
+	MaxImageHeight int
+}
+
+// MediaConstrainer is the interface handlers whose channel type restricts the images it can send should satisfy. Outgoing
+// images which break these constraints are resized or recompressed before being sent.
+type MediaConstrainer interface {
+	MediaConstraints(Channel) MediaConstraints
+}
+
+// EncodingPolicyDefaulter is the interface handlers whose channels have a default encoding policy other than none should
+// satisfy, such as those which had their own config for it before channels had an encoding policy
+type EncodingPolicyDefaulter interface {
+	DefaultEncodingPolicy(Channel) string
+}
+
+// MaxMediaSize returns the maximum size of media we will download or upload for the passed in channel. A size set in the
+// channel's config takes precedence, then any limit declared by the handler for the channel type, then our global config.
+func MaxMediaSize(config *Config, channel Channel) int64 {
+	if size := channel.IntConfigForKey(ConfigMaxMediaSize, 0); size > 0 {
+		return int64(size)
+	}
+
+	if limiter, isLimiter := GetHandler(channel.ChannelType()).(MediaSizeLimiter); isLimiter {
+		return limiter.MaxMediaSize()
+	}
+
+	return int64(config.MaxMediaSize)
+}
+
 // RegisterHandler adds a new handler for a channel type, this is called by individual handlers when they are initialized
 func RegisterHandler(handler ChannelHandler) {
 	registeredHandlers[handler.ChannelType()] = handler
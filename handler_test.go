@@ -1,6 +1,14 @@
 package courier
 
-import "context"
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/courier/utils"
+)
 
 func init() {
 	RegisterHandler(NewHandler())
@@ -28,5 +36,35 @@ func (h *dummyHandler) Initialize(s Server) error {
 
 // SendMsg sends the passed in message, returning any error
 func (h *dummyHandler) SendMsg(ctx context.Context, msg Msg) (MsgStatus, error) {
+	// the provider of our dummy channel rate limits msgs asking it to
+	if msg.Text() == "rate limit me" {
+		return h.backend.NewMsgStatusForID(msg.Channel(), msg.ID(), MsgErrored), &RateLimitedError{RetryAfter: time.Second}
+	}
+
+	// and fails all msgs sent through channels which are down
+	if msg.Channel().Address() == "down" {
+		return h.backend.NewMsgStatusForID(msg.Channel(), msg.ID(), MsgFailed), errors.New("channel is down")
+	}
+
+	// channels with a send URL have their msgs posted to it
+	sendURL := msg.Channel().StringConfigForKey(ConfigSendURL, "")
+	if sendURL != "" {
+		status := h.backend.NewMsgStatusForID(msg.Channel(), msg.ID(), MsgErrored)
+		req, _ := http.NewRequest(http.MethodPost, sendURL, strings.NewReader(msg.Text()))
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
+		status.AddLog(NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err))
+		if err != nil {
+			return status, nil
+		}
+
+		// our provider replies with the id of the msg it sent
+		if !strings.HasPrefix(string(rr.Body), "id:") {
+			return status, errors.New("no id in response")
+		}
+		status.SetStatus(MsgWired)
+		status.SetExternalID(strings.TrimPrefix(string(rr.Body), "id:"))
+		return status, nil
+	}
+
 	return h.backend.NewMsgStatusForID(msg.Channel(), msg.ID(), MsgSent), nil
 }
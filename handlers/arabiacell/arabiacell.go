@@ -55,7 +55,7 @@ type mtResponse struct {
 }
 
 // SendMsg sends the passed in message, returning any error
-func (h *handler) SendMsg(_ context.Context, msg courier.Msg) (courier.MsgStatus, error) {
+func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
 	username := msg.Channel().StringConfigForKey(courier.ConfigUsername, "")
 	if username == "" {
 		return nil, fmt.Errorf("no username set for AC channel")
@@ -77,21 +77,23 @@ func (h *handler) SendMsg(_ context.Context, msg courier.Msg) (courier.MsgStatus
 	}
 
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	for _, part := range handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxMsgLength) {
+	parts := handlers.SplitSMS(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
+	for _, part := range parts {
 		form := url.Values{
 			"userName":      []string{username},
 			"password":      []string{password},
 			"handlerType":   []string{"send_msg"},
 			"serviceId":     []string{serviceID},
 			"msisdn":        []string{msg.URN().Path()},
-			"messageBody":   []string{part},
+			"messageBody":   []string{part.Text},
 			"chargingLevel": []string{chargingLevel},
 		}
 
 		req, _ := http.NewRequest(http.MethodPost, sendURL, strings.NewReader(form.Encode()))
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		req.Header.Set("Accept", "application/xml")
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 		// record our status and log
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
@@ -117,7 +117,8 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	}
 
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	parts := handlers.SplitSMS(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
 	for _, part := range parts {
 		// build our request
 		form := url.Values{
@@ -125,7 +126,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 			"mobile_number": []string{strings.TrimLeft(msg.URN().Path(), "+")},
 			"shortcode":     []string{strings.TrimLeft(msg.Channel().Address(), "+")},
 			"message_id":    []string{msg.ID().String()},
-			"message":       []string{part},
+			"message":       []string{part.Text},
 			"request_cost":  []string{"FREE"},
 			"client_id":     []string{username},
 			"secret_key":    []string{password},
@@ -137,7 +138,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 
 		req, _ := http.NewRequest(http.MethodPost, sendURL, strings.NewReader(form.Encode()))
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 		if rr.StatusCode == 400 {
 			message, _ := jsonparser.GetString([]byte(rr.Body), "message")
@@ -149,7 +150,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 
 				req, _ = http.NewRequest(http.MethodPost, sendURL, strings.NewReader(form.Encode()))
 				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-				rr, err = utils.MakeHTTPRequest(req)
+				rr, err = utils.MakeHTTPRequest(req.WithContext(ctx))
 
 			}
 
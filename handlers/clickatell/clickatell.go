@@ -176,13 +176,14 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	}
 
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	parts := handlers.SplitSMS(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
 	for _, part := range parts {
 		form := url.Values{
 			"apiKey":  []string{apiKey},
 			"from":    []string{strings.TrimPrefix(msg.Channel().Address(), "+")},
 			"to":      []string{strings.TrimPrefix(msg.URN().Path(), "+")},
-			"content": []string{part},
+			"content": []string{part.Text},
 		}
 
 		partSendURL, _ := url.Parse(sendURL)
@@ -191,7 +192,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		req, _ := http.NewRequest(http.MethodGet, partSendURL.String(), nil)
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		req.Header.Set("Accept", "application/json")
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 		// record our status and log
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Send Error", err)
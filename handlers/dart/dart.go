@@ -152,7 +152,8 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	}
 
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(handlers.GetTextAndAttachments(msg), h.maxLength)
+	parts := handlers.SplitSMS(handlers.GetTextAndAttachments(msg), h.maxLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
 	for i, part := range parts {
 		form := url.Values{
 			"userid":   []string{username},
@@ -161,7 +162,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 			"original": []string{strings.TrimPrefix(msg.Channel().Address(), "+")},
 			"udhl":     []string{"0"},
 			"dcs":      []string{"0"},
-			"message":  []string{part},
+			"message":  []string{part.Text},
 		}
 
 		messageid := msg.ID().String()
@@ -175,7 +176,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 
 		req, _ := http.NewRequest(http.MethodGet, partSendURL.String(), nil)
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 		// record our status and log
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Send Error", err)
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/nyaruka/courier"
+)
+
+// ErrorCategoryForHTTPStatus returns the error category implied by the HTTP status code of a failed request to a
+// provider, for use when the provider doesn't give us anything more specific
+func ErrorCategoryForHTTPStatus(statusCode int) courier.MsgErrorCategory {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return courier.MsgErrorAuthFailure
+	case http.StatusTooManyRequests:
+		return courier.MsgErrorRateLimited
+	default:
+		return courier.MsgErrorProvider
+	}
+}
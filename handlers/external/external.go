@@ -14,7 +14,6 @@ import (
 	"strings"
 
 	"github.com/nyaruka/courier"
-	"github.com/nyaruka/courier/gsm7"
 	"github.com/nyaruka/courier/handlers"
 	"github.com/nyaruka/courier/utils"
 	"github.com/nyaruka/gocommon/urns"
@@ -163,6 +162,15 @@ func (h *handler) receiveStatus(ctx context.Context, statusString string, channe
 	return handlers.WriteMsgStatusAndResponse(ctx, h, channel, status, w, r)
 }
 
+// DefaultEncodingPolicy returns the encoding policy of channels without one, which is smart if they have their own
+// encoding set to smart
+func (h *handler) DefaultEncodingPolicy(channel courier.Channel) string {
+	if channel.StringConfigForKey(configEncoding, encodingDefault) == encodingSmart {
+		return courier.EncodingPolicySmart
+	}
+	return courier.EncodingPolicyNone
+}
+
 // SendMsg sends the passed in message, returning any error
 func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
 	sendURL := msg.Channel().StringConfigForKey(courier.ConfigSendURL, "")
@@ -170,8 +178,6 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		return nil, fmt.Errorf("no send url set for EX channel")
 	}
 
-	// figure out what encoding to tell kannel to send as
-	encoding := msg.Channel().StringConfigForKey(configEncoding, encodingDefault)
 	sendMethod := msg.Channel().StringConfigForKey(courier.ConfigSendMethod, http.MethodPost)
 	sendBody := msg.Channel().StringConfigForKey(courier.ConfigSendBody, "")
 	contentType := msg.Channel().StringConfigForKey(courier.ConfigContentType, contentURLEncoded)
@@ -181,12 +187,13 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 
 	maxLength := msg.Channel().IntConfigForKey(courier.ConfigMaxLength, 160)
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxLength)
+	parts := handlers.SplitSMS(handlers.GetTextAndAttachments(msg), maxLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
 	for _, part := range parts {
 		// build our request
 		form := map[string]string{
 			"id":           msg.ID().String(),
-			"text":         part,
+			"text":         part.Text,
 			"to":           msg.URN().Path(),
 			"to_no_plus":   strings.TrimPrefix(msg.URN().Path(), "+"),
 			"from":         msg.Channel().Address(),
@@ -194,14 +201,6 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 			"channel":      msg.Channel().UUID().String(),
 		}
 
-		// if we are smart, first try to convert to GSM7 chars
-		if encoding == encodingSmart {
-			replaced := gsm7.ReplaceSubstitutions(part)
-			if gsm7.IsValid(replaced) {
-				form["text"] = replaced
-			}
-		}
-
 		url := replaceVariables(sendURL, form, contentURLEncoded)
 		var body io.Reader
 		if sendMethod == http.MethodPost || sendMethod == http.MethodPut {
@@ -219,7 +218,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 			req.Header.Set("Authorization", authorization)
 		}
 
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 		// record our status and log
 		status.AddLog(courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err))
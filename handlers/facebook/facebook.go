@@ -30,6 +30,9 @@ var (
 
 	// Facebook API says 640 is max for the body
 	maxMsgLength = 640
+
+	// How long we reuse the attachment ids Facebook gives us for reusable attachments
+	attachmentIDExpiry = time.Hour * 24 * 30
 )
 
 // keys for extra in channel events
@@ -177,6 +180,11 @@ type moPayload struct {
 				Watermark int64    `json:"watermark"`
 				Seq       int      `json:"seq"`
 			} `json:"delivery"`
+
+			Read *struct {
+				Watermark int64 `json:"watermark"`
+				Seq       int   `json:"seq"`
+			} `json:"read"`
 		} `json:"messaging"`
 	} `json:"entry"`
 }
@@ -337,13 +345,17 @@ func (h *handler) receiveEvent(ctx context.Context, channel courier.Channel, w h
 				}
 			}
 
-			err := h.Backend().WriteMsg(ctx, event)
+			written, err := handlers.WriteMsg(ctx, h, event)
 			if err != nil {
 				return nil, err
 			}
 
-			events = append(events, event)
-			data = append(data, courier.NewMsgReceiveData(event))
+			events = append(events, written)
+			if stop, isStop := written.(courier.ChannelEvent); isStop {
+				data = append(data, courier.NewEventReceiveData(stop))
+			} else {
+				data = append(data, courier.NewMsgReceiveData(event))
+			}
 
 		} else if msg.Delivery != nil {
 			// this is a delivery report
@@ -365,6 +377,16 @@ func (h *handler) receiveEvent(ctx context.Context, channel courier.Channel, w h
 				data = append(data, courier.NewStatusData(event))
 			}
 
+		} else if msg.Read != nil {
+			// this is a read receipt, every msg we sent before the watermark has been read
+			watermark := time.Unix(0, msg.Read.Watermark*1000000).UTC()
+			err := h.Backend().WriteMsgReadWatermark(ctx, channel, urn, watermark)
+			if err != nil {
+				return nil, err
+			}
+
+			data = append(data, courier.NewInfoData("msgs before watermark marked as read"))
+
 		} else {
 			data = append(data, courier.NewInfoData("ignoring unknown entry type"))
 		}
@@ -386,6 +408,7 @@ func (h *handler) receiveEvent(ctx context.Context, channel courier.Channel, w h
 //                 "url":"http://www.messenger-rocks.com/image.jpg",
 //                 "is_reusable":true
 //             }
+//             (or once uploaded, "payload":{"attachment_id":"1857777774821032"})
 //         }
 //     }
 // }
@@ -405,8 +428,9 @@ type mtPayload struct {
 type mtAttachment struct {
 	Type    string `json:"type"`
 	Payload struct {
-		URL        string `json:"url"`
-		IsReusable bool   `json:"is_reusable"`
+		URL          string `json:"url,omitempty"`
+		IsReusable   bool   `json:"is_reusable,omitempty"`
+		AttachmentID string `json:"attachment_id,omitempty"`
 	} `json:"payload"`
 }
 
@@ -453,6 +477,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 
 	// send each part and each attachment separately
 	for i := 0; i < len(msgParts)+len(msg.Attachments()); i++ {
+		attURL := ""
 		if i < len(msgParts) {
 			// this is still a msg part
 			payload.Message.Text = msgParts[i]
@@ -460,12 +485,23 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		} else {
 			// this is an attachment
 			payload.Message.Attachment = &mtAttachment{}
-			attType, attURL := handlers.SplitAttachment(msg.Attachments()[i-len(msgParts)])
+			attType, url := handlers.SplitAttachment(msg.Attachments()[i-len(msgParts)])
 			attType = strings.Split(attType, "/")[0]
+			attURL = url
 			payload.Message.Attachment.Type = attType
-			payload.Message.Attachment.Payload.URL = attURL
-			payload.Message.Attachment.Payload.IsReusable = true
 			payload.Message.Text = ""
+
+			// if Facebook already has this attachment, refer to it by id, otherwise have them fetch and keep it
+			attachmentID, err := handlers.GetCachedMediaID(h.Backend(), msg.Channel(), attURL)
+			if err != nil {
+				logrus.WithField("channel_uuid", msg.Channel().UUID().String()).WithError(err).Error("error looking up cached attachment id")
+			}
+			if attachmentID != "" {
+				payload.Message.Attachment.Payload.AttachmentID = attachmentID
+			} else {
+				payload.Message.Attachment.Payload.URL = attURL
+				payload.Message.Attachment.Payload.IsReusable = true
+			}
 		}
 
 		// include any quick replies on the first piece we send
@@ -485,7 +521,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		req, _ := http.NewRequest(http.MethodPost, msgURL.String(), bytes.NewReader(jsonBody))
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("Accept", "application/json")
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 		// record our status and log
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
@@ -500,9 +536,18 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 			return status, nil
 		}
 
-		// if this is our first message, record the external id
-		if i == 0 {
-			status.SetExternalID(externalID)
+		// record the external id of each part we send
+		status.AddExternalID(externalID)
+
+		// if we uploaded a reusable attachment, remember its id for next time
+		if attURL != "" && payload.Message.Attachment.Payload.AttachmentID == "" {
+			attachmentID, _ := jsonparser.GetString(rr.Body, "attachment_id")
+			if attachmentID != "" {
+				err = handlers.SetCachedMediaID(h.Backend(), msg.Channel(), attURL, attachmentID, attachmentIDExpiry)
+				if err != nil {
+					logrus.WithField("channel_uuid", msg.Channel().UUID().String()).WithError(err).Error("error caching attachment id")
+				}
+			}
 		}
 
 		// this was wired successfully
@@ -290,6 +290,27 @@ var dlr = `{
 	}]
 }`
 
+var read = `{
+	"object":"page",
+	"entry": [{
+	  "id": "208685479508187",
+	  "messaging": [{
+		"read":{
+			"watermark":1458668856253,
+			"seq":38
+		},
+		"recipient": {
+		  "id": "1234"
+		},
+		"sender": {
+		  "id": "5678"
+		},
+		"timestamp": 1459991487970
+	  }],
+	  "time": 1459991487970
+	}]
+}`
+
 var notPage = `{
 	"object":"notpage",
 	"entry": [{}]
@@ -353,6 +374,9 @@ var testCases = []ChannelHandleTestCase{
 	{Label: "Receive DLR", URL: "/c/fb/8eb23e93-5ecb-45ba-b726-3b064e0c568c/receive", Data: dlr, Status: 200, Response: "Handled",
 		Date: Tp(time.Date(2016, 4, 7, 1, 11, 27, 970000000, time.UTC)), MsgStatus: Sp(courier.MsgDelivered), ExternalID: Sp("mid.1458668856218:ed81099e15d3f4f233")},
 
+	{Label: "Receive Read", URL: "/c/fb/8eb23e93-5ecb-45ba-b726-3b064e0c568c/receive", Data: read, Status: 200, Response: "msgs before watermark marked as read",
+		URN: Sp("facebook:5678"), ReadWatermark: Tp(time.Date(2016, 3, 22, 17, 47, 36, 253000000, time.UTC))},
+
 	{Label: "Different Page", URL: "/c/fb/8eb23e93-5ecb-45ba-b726-3b064e0c568c/receive", Data: differentPage, Status: 200, Response: `"data":[]`},
 	{Label: "Echo", URL: "/c/fb/8eb23e93-5ecb-45ba-b726-3b064e0c568c/receive", Data: echo, Status: 200, Response: `ignoring echo`},
 	{Label: "Not Page", URL: "/c/fb/8eb23e93-5ecb-45ba-b726-3b064e0c568c/receive", Data: notPage, Status: 200, Response: "ignoring"},
@@ -410,6 +434,20 @@ func TestHandler(t *testing.T) {
 	RunChannelTestCases(t, testChannels, newHandler(), testCases)
 }
 
+func TestOptOut(t *testing.T) {
+	optOutChannels := []courier.Channel{
+		courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c568c", "FB", "1234", "",
+			map[string]interface{}{courier.ConfigAuthToken: "a123", courier.ConfigSecret: "mysecret", courier.ConfigOptOutLanguages: "eng"}),
+	}
+
+	RunChannelTestCases(t, optOutChannels, newHandler(), []ChannelHandleTestCase{
+		{Label: "Receive Message", URL: "/c/fb/8eb23e93-5ecb-45ba-b726-3b064e0c568c/receive", Data: helloMsg, Status: 200, Response: "Handled",
+			Text: Sp("Hello World"), URN: Sp("facebook:5678")},
+		{Label: "Receive Opt Out", URL: "/c/fb/8eb23e93-5ecb-45ba-b726-3b064e0c568c/receive", Data: strings.Replace(helloMsg, "Hello World", "Stop", 1),
+			Status: 200, Response: `"type":"event"`, URN: Sp("facebook:5678"), ChannelEvent: Sp(courier.StopContact)},
+	})
+}
+
 func BenchmarkHandler(b *testing.B) {
 	fbService := buildMockFBGraph(testCases)
 	defer fbService.Close()
@@ -460,6 +498,12 @@ func setSendURL(s *httptest.Server, h courier.ChannelHandler, c courier.Channel,
 	sendURL = s.URL
 }
 
+// setCachedAttachmentID sets our send_url and caches the attachment id of our photo, as if it had already been sent
+func setCachedAttachmentID(s *httptest.Server, h courier.ChannelHandler, c courier.Channel, m courier.Msg) {
+	setSendURL(s, h, c, m)
+	SetCachedMediaID(h.(*handler).Backend(), c, "https://foo.bar/image.jpg", "1857777774821032", time.Hour)
+}
+
 var defaultSendTestCases = []ChannelSendTestCase{
 	{Label: "Plain Send",
 		Text: "Simple Message", URN: "facebook:12345",
@@ -483,9 +527,15 @@ var defaultSendTestCases = []ChannelSendTestCase{
 	{Label: "Send Photo",
 		URN: "facebook:12345", Attachments: []string{"image/jpeg:https://foo.bar/image.jpg"},
 		Status: "W", ExternalID: "mid.133",
-		ResponseBody: `{"message_id": "mid.133"}`, ResponseStatus: 200,
+		ResponseBody: `{"message_id": "mid.133", "attachment_id": "1857777774821032"}`, ResponseStatus: 200,
 		RequestBody: `{"messaging_type":"NON_PROMOTIONAL_SUBSCRIPTION","recipient":{"id":"12345"},"message":{"attachment":{"type":"image","payload":{"url":"https://foo.bar/image.jpg","is_reusable":true}}}}`,
 		SendPrep:    setSendURL},
+	{Label: "Send Cached Photo",
+		URN: "facebook:12345", Attachments: []string{"image/jpeg:https://foo.bar/image.jpg"},
+		Status: "W", ExternalID: "mid.133",
+		ResponseBody: `{"message_id": "mid.133"}`, ResponseStatus: 200,
+		RequestBody: `{"messaging_type":"NON_PROMOTIONAL_SUBSCRIPTION","recipient":{"id":"12345"},"message":{"attachment":{"type":"image","payload":{"attachment_id":"1857777774821032"}}}}`,
+		SendPrep:    setCachedAttachmentID},
 	{Label: "ID Error",
 		Text: "ID Error", URN: "facebook:12345",
 		Status:       "E",
@@ -54,6 +54,7 @@ func NewExternalIDStatusHandler(h *BaseHandler, statuses map[string]courier.MsgS
 
 		// create our status
 		status := h.Backend().NewMsgStatusForExternalID(c, externalID, sValue)
+		status.SetRawStatus(s)
 		return WriteMsgStatusAndResponse(ctx, h, c, status, w, r)
 	}
 }
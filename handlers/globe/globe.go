@@ -144,11 +144,12 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	}
 
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	parts := handlers.SplitSMS(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
 	for _, part := range parts {
 		payload := &mtPayload{}
 		payload.Address = strings.TrimPrefix(msg.URN().Path(), "+")
-		payload.Message = part
+		payload.Message = part.Text
 		payload.Passphrase = passphrase
 		payload.AppID = appID
 		payload.AppSecret = appSecret
@@ -161,7 +162,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("Accept", "application/json")
 
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
 		status.AddLog(log)
 		if err != nil {
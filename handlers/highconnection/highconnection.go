@@ -125,13 +125,14 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	receiveURL := fmt.Sprintf("https://%s/c/hx/%s/receive", callbackDomain, msg.Channel().UUID())
 
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	parts := handlers.SplitSMS(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
 	for _, part := range parts {
 
 		form := url.Values{
 			"accountid":  []string{username},
 			"password":   []string{password},
-			"text":       []string{part},
+			"text":       []string{part.Text},
 			"to":         []string{msg.URN().Path()},
 			"ret_id":     []string{msg.ID().String()},
 			"datacoding": []string{"8"},
@@ -144,7 +145,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		msgURL.RawQuery = form.Encode()
 
 		req, _ := http.NewRequest(http.MethodPost, msgURL.String(), nil)
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 		// record our status and log
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
@@ -187,7 +187,11 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		return nil, fmt.Errorf("no password set for IB channel")
 	}
 
-	transliteration := msg.Channel().StringConfigForKey(configTransliteration, "")
+	// channels with an encoding policy have already had their text changed by it, otherwise infobip can transliterate
+	transliteration := ""
+	if msg.Channel().StringConfigForKey(courier.ConfigEncodingPolicy, courier.EncodingPolicyNone) == courier.EncodingPolicyNone {
+		transliteration = msg.Channel().StringConfigForKey(configTransliteration, "")
+	}
 
 	callbackDomain := msg.Channel().CallbackDomain(h.Server().Config().Domain)
 	statusURL := fmt.Sprintf("https://%s%s%s/delivered", callbackDomain, "/c/ib/", msg.Channel().UUID())
@@ -222,7 +226,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 	req.SetBasicAuth(username, password)
-	rr, err := utils.MakeHTTPRequest(req)
+	rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 	// record our status and log
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
@@ -307,4 +307,15 @@ func TestSending(t *testing.T) {
 		})
 
 	RunChannelSendTestCases(t, transChannel, newHandler(), transSendTestCases, nil)
+
+	// channels with an encoding policy don't have infobip transliterate too
+	var policyChannel = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "IB", "2020", "US",
+		map[string]interface{}{
+			courier.ConfigPassword:       "Password",
+			courier.ConfigUsername:       "Username",
+			courier.ConfigEncodingPolicy: courier.EncodingPolicyTransliterate,
+			configTransliteration:        "COLOMBIAN",
+		})
+
+	RunChannelSendTestCases(t, policyChannel, newHandler(), defaultSendTestCases[:1], nil)
 }
@@ -2,6 +2,7 @@ package jasmin
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -36,6 +37,7 @@ func (h *handler) Initialize(s courier.Server) error {
 	h.SetServer(s)
 	s.AddHandlerRoute(h, http.MethodPost, "receive", h.receiveMessage)
 	s.AddHandlerRoute(h, http.MethodPost, "status", h.receiveStatus)
+	handlers.StartMultipartFlusher(s)
 	return nil
 }
 
@@ -73,6 +75,7 @@ type moForm struct {
 	From    string `name:"from"     validate:"required"`
 	To      string `name:"to"       validate:"required"`
 	ID      string `name:"id"       validate:"required"`
+	UDH     string `name:"udh"`
 }
 
 // receiveMessage is our HTTP handler function for incoming messages
@@ -96,11 +99,37 @@ func (h *handler) receiveMessage(ctx context.Context, c courier.Channel, w http.
 		text = gsm7.Decode([]byte(form.Content))
 	}
 
+	// if this is a part of a concatenated message, as identified by its hex encoded UDH, we don't write the message
+	// until we have all parts
+	multipartRef := ""
+	if form.UDH != "" {
+		udh, err := hex.DecodeString(form.UDH)
+		if err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, c, w, r, fmt.Errorf("invalid udh: %s", form.UDH))
+		}
+
+		if ref, part, total, found := handlers.ParseConcatUDH(udh); found {
+			fullText, complete, err := handlers.ReassembleMultipart(h.Backend(), c, urn, ref, part, total, text)
+			if err != nil {
+				return nil, handlers.WriteAndLogRequestError(ctx, h, c, w, r, err)
+			}
+			if !complete {
+				return nil, handlers.WriteAndLogRequestIgnored(ctx, h, c, w, r, "Message part received")
+			}
+			text = fullText
+			multipartRef = ref
+		}
+	}
+
 	// build our msg
 	msg := h.Backend().NewIncomingMsg(c, urn, text).WithExternalID(form.ID).WithReceivedOn(time.Now().UTC())
 
-	// and finally queue our message
-	return handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+	// and finally queue our message, we only get events back if it was written
+	events, err := handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+	if multipartRef != "" {
+		handlers.CompleteMultipart(h.Backend(), c, urn, multipartRef, events != nil)
+	}
+	return events, err
 }
 
 func (h *handler) WriteMsgSuccessResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, msgs []courier.Msg) error {
@@ -159,7 +188,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	fullURL.RawQuery = form.Encode()
 
 	req, _ := http.NewRequest(http.MethodGet, fullURL.String(), nil)
-	rr, err := utils.MakeHTTPRequest(req)
+	rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 	// record our status and log
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
@@ -13,6 +13,9 @@ var (
 	receiveURL          = "/c/js/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive/"
 	receiveValidMessage = "content=%05v%05nement&coding=0&From=2349067554729&To=2349067554711&id=1001"
 	receiveMissingTo    = "content=%05v%05nement&coding=0&From=2349067554729&id=1001"
+	receiveConcatPart2  = "content=World&coding=0&From=2349067554729&To=2349067554711&id=1003&udh=0500032a0202"
+	receiveConcatPart1  = "content=Hello+&coding=0&From=2349067554729&To=2349067554711&id=1002&udh=0500032a0201"
+	receiveInvalidUDH   = "content=Hello+&coding=0&From=2349067554729&To=2349067554711&id=1002&udh=zz"
 	invalidURN          = "content=%05v%05nement&coding=0&From=MTN&To=2349067554711&id=1001"
 
 	statusURL       = "/c/js/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/status/"
@@ -28,6 +31,10 @@ var testChannels = []courier.Channel{
 var handleTestCases = []ChannelHandleTestCase{
 	{Label: "Receive Valid Message", URL: receiveURL, Data: receiveValidMessage, Status: 200, Response: "ACK/Jasmin",
 		Text: Sp("événement"), URN: Sp("tel:+2349067554729"), ExternalID: Sp("1001")},
+	{Label: "Receive Concat Part 2", URL: receiveURL, Data: receiveConcatPart2, Status: 200, Response: "ACK/Jasmin"},
+	{Label: "Receive Concat Part 1", URL: receiveURL, Data: receiveConcatPart1, Status: 200, Response: "ACK/Jasmin",
+		Text: Sp("Hello World"), URN: Sp("tel:+2349067554729"), ExternalID: Sp("1002")},
+	{Label: "Receive Invalid UDH", URL: receiveURL, Data: receiveInvalidUDH, Status: 400, Response: "invalid udh: zz"},
 	{Label: "Receive Missing To", URL: receiveURL, Data: receiveMissingTo, Status: 400,
 		Response: "field 'to' required"},
 	{Label: "Invalid URN", URL: receiveURL, Data: invalidURN, Status: 400,
@@ -3,6 +3,7 @@ package kannel
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"time"
@@ -16,13 +17,19 @@ import (
 )
 
 const (
-	configUseNational = "use_national"
-	configEncoding    = "encoding"
-	configVerifySSL   = "verify_ssl"
+	configUseNational    = "use_national"
+	configEncoding       = "encoding"
+	configVerifySSL      = "verify_ssl"
+	configNationalTables = "national_tables"
 
 	encodingDefault = "D"
 	encodingUnicode = "U"
 	encodingSmart   = "S"
+
+	// national language table parts are sent as single SMS as we give kannel their UDH, and parts of longer msgs leave
+	// room for their concatenation UDH
+	maxMsgLength  = 160
+	maxPartLength = 153
 )
 
 func init() {
@@ -42,6 +49,7 @@ func (h *handler) Initialize(s courier.Server) error {
 	h.SetServer(s)
 	s.AddHandlerRoute(h, http.MethodPost, "receive", h.receiveMessage)
 	s.AddHandlerRoute(h, http.MethodGet, "status", h.receiveStatus)
+	handlers.StartMultipartFlusher(s)
 	return nil
 }
 
@@ -50,6 +58,16 @@ type moForm struct {
 	TS      int64  `validate:"required" name:"ts"`
 	Message string `name:"message"`
 	Sender  string `validate:"required" name:"sender"`
+	UDH     string `name:"udh"`
+}
+
+// DefaultEncodingPolicy returns the encoding policy of channels without one, which is smart unless they have their own
+// encoding set to something else
+func (h *handler) DefaultEncodingPolicy(channel courier.Channel) string {
+	if channel.StringConfigForKey(configEncoding, encodingSmart) == encodingSmart {
+		return courier.EncodingPolicySmart
+	}
+	return courier.EncodingPolicyNone
 }
 
 // receiveMessage is our HTTP handler function for incoming messages
@@ -70,11 +88,29 @@ func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w
 		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
 	}
 
+	// if kannel gave us the UDH of a part of a concatenated message, we don't write the message until we have all parts
+	text := form.Message
+	ref, part, total, multipart := handlers.ParseConcatUDH([]byte(form.UDH))
+	if multipart {
+		fullText, complete, err := handlers.ReassembleMultipart(h.Backend(), channel, urn, ref, part, total, text)
+		if err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+		}
+		if !complete {
+			return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Message part received")
+		}
+		text = fullText
+	}
+
 	// build our msg
-	msg := h.Backend().NewIncomingMsg(channel, urn, form.Message).WithExternalID(form.ID).WithReceivedOn(date)
+	msg := h.Backend().NewIncomingMsg(channel, urn, text).WithExternalID(form.ID).WithReceivedOn(date)
 
-	// and finally write our message
-	return handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+	// and finally write our message, we only get events back if it was written
+	events, err := handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+	if multipart {
+		handlers.CompleteMultipart(h.Backend(), channel, urn, ref, events != nil)
+	}
+	return events, err
 }
 
 var statusMapping = map[int]courier.MsgStatusValue{
@@ -154,45 +190,35 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		form["to"] = []string{nationalTo.Path()}
 	}
 
+	// ignore SSL warnings if they ask
+	verifySSLStr := msg.Channel().ConfigForKey(configVerifySSL, true)
+	verifySSL, _ := verifySSLStr.(bool)
+
 	// figure out what encoding to tell kannel to send as
 	encoding := msg.Channel().StringConfigForKey(configEncoding, encodingSmart)
 
-	// if we are smart, first try to convert to GSM7 chars
-	if encoding == encodingSmart {
-		replaced := gsm7.ReplaceSubstitutions(handlers.GetTextAndAttachments(msg))
-		if gsm7.IsValid(replaced) {
-			form["text"] = []string{replaced}
-		} else {
-			encoding = encodingUnicode
+	// text which isn't GSM7 may be with one of the national language tables, if this channel can send their UDH
+	text := handlers.GetTextAndAttachments(msg)
+	nationalTables, _ := msg.Channel().ConfigForKey(configNationalTables, false).(bool)
+	if nationalTables && encoding != encodingUnicode && !gsm7.IsValid(text) {
+		if _, valid := gsm7.ChooseTable(text); valid {
+			return h.sendNationalParts(ctx, msg, sendURL, form, verifySSL)
 		}
 	}
 
+	// if we are smart, our encoding policy has already replaced what it could so send anything which still isn't GSM7
+	// as unicode
+	if encoding == encodingSmart && !gsm7.IsValid(text) {
+		encoding = encodingUnicode
+	}
+
 	// if we are UTF8, set our coding appropriately
 	if encoding == encodingUnicode {
 		form["coding"] = []string{"2"}
 		form["charset"] = []string{"utf8"}
 	}
 
-	// our send URL may have form parameters in it already, append our own afterwards
-	encodedForm := form.Encode()
-	if strings.Contains(sendURL, "?") {
-		sendURL = fmt.Sprintf("%s&%s", sendURL, encodedForm)
-	} else {
-		sendURL = fmt.Sprintf("%s?%s", sendURL, encodedForm)
-	}
-
-	// ignore SSL warnings if they ask
-	verifySSLStr := msg.Channel().ConfigForKey(configVerifySSL, true)
-	verifySSL, _ := verifySSLStr.(bool)
-
-	req, err := http.NewRequest(http.MethodGet, sendURL, nil)
-	var rr *utils.RequestResponse
-
-	if verifySSL {
-		rr, err = utils.MakeHTTPRequest(req)
-	} else {
-		rr, err = utils.MakeInsecureHTTPRequest(req)
-	}
+	rr, err := makeSendRequest(ctx, sendURL, form, verifySSL)
 
 	// record our status and log
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
@@ -208,3 +234,79 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 
 	return status, nil
 }
+
+// sendNationalParts sends the text of the passed in msg split into parts which each use the national language table
+// that encodes them best. Parts of a longer msg are given a concatenation UDH with a reference they all share. Parts
+// which need a national language table are sent as binary with the UDH for that table, as their septets are already
+// encoded and packed, otherwise Kannel would encode them again.
+func (h *handler) sendNationalParts(ctx context.Context, msg courier.Msg, sendURL string, form url.Values, verifySSL bool) (courier.MsgStatus, error) {
+	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
+	text := handlers.GetTextAndAttachments(msg)
+	parts := handlers.SplitNationalSMS(text, maxMsgLength)
+	if len(parts) > 1 {
+		parts = handlers.SplitNationalSMS(text, maxPartLength)
+	}
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
+
+	ref := byte(rand.Intn(256))
+	for i, part := range parts {
+		partForm := url.Values{}
+		for k, v := range form {
+			partForm[k] = v
+		}
+		partForm["coding"] = []string{"0"}
+		partForm["text"] = []string{part.Text}
+
+		udh := []byte{}
+		if len(parts) > 1 {
+			udh = append(udh, 0x00, 0x03, ref, byte(len(parts)), byte(i+1))
+		}
+
+		if part.Encoding == handlers.SMSEncodingUCS2 {
+			partForm["coding"] = []string{"2"}
+			partForm["charset"] = []string{"utf8"}
+		} else if tableUDH := part.Table.UDH(); len(tableUDH) > 0 {
+			udh = append(udh, tableUDH...)
+			partForm["coding"] = []string{"1"}
+			partForm["text"] = []string{string(gsm7.Pack(gsm7.EncodeWithTable(part.Text, part.Table), len(udh)+1))}
+		}
+
+		if len(udh) > 0 {
+			partForm["udh"] = []string{string(append([]byte{byte(len(udh))}, udh...))}
+		}
+
+		rr, err := makeSendRequest(ctx, sendURL, partForm, verifySSL)
+		status.AddLog(courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err))
+
+		// kannel will respond with a 403 for non-routable numbers, fail permanently in these cases
+		if rr.StatusCode == 403 {
+			status.SetStatus(courier.MsgFailed)
+			return status, nil
+		}
+		if err != nil {
+			return status, nil
+		}
+	}
+
+	status.SetStatus(courier.MsgWired)
+	return status, nil
+}
+
+// makeSendRequest makes a send request to kannel with the passed in form
+func makeSendRequest(ctx context.Context, sendURL string, form url.Values, verifySSL bool) (*utils.RequestResponse, error) {
+	// our send URL may have form parameters in it already, append our own afterwards
+	encodedForm := form.Encode()
+	if strings.Contains(sendURL, "?") {
+		sendURL = fmt.Sprintf("%s&%s", sendURL, encodedForm)
+	} else {
+		sendURL = fmt.Sprintf("%s?%s", sendURL, encodedForm)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, sendURL, nil)
+
+	// ignore SSL warnings if they ask
+	if verifySSL {
+		return utils.MakeHTTPRequest(req.WithContext(ctx))
+	}
+	return utils.MakeInsecureHTTPRequest(req.WithContext(ctx))
+}
@@ -1,12 +1,17 @@
 package kannel
 
 import (
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/gsm7"
 	. "github.com/nyaruka/courier/handlers"
+	"github.com/stretchr/testify/assert"
 )
 
 var (
@@ -15,6 +20,9 @@ var (
 	receiveKIMessage    = "/c/kn/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive/?backend=NIG_MTN&sender=%2B68673076228&message=Join&ts=1493735509&id=asdf-asdf&to=24453"
 	receiveInvalidURN   = "/c/kn/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive/?backend=NIG_MTN&sender=MTN&message=Join&ts=1493735509&id=asdf-asdf&to=24453"
 	receiveEmptyMessage = "/c/kn/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive/?backend=NIG_MTN&sender=%2B2349067554729&message=&ts=1493735509&id=asdf-asdf&to=24453"
+	receiveConcatPart2  = "/c/kn/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive/?backend=NIG_MTN&sender=%2B2349067554729&message=World&ts=1493735509&id=asdf-2&to=24453&udh=%05%00%03%2A%02%02"
+	receiveConcatPart1  = "/c/kn/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive/?backend=NIG_MTN&sender=%2B2349067554729&message=Hello+&ts=1493735509&id=asdf-1&to=24453&udh=%05%00%03%2A%02%01"
+	receiveConcatBad    = "/c/kn/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive/?backend=NIG_MTN&sender=%2B2349067554729&message=Hello+&ts=1493735509&id=asdf-1&to=24453&udh=%05%00%03%2A%02%03"
 	statusNoParams      = "/c/kn/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/status/"
 	statusInvalidStatus = "/c/kn/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/status/?id=12345&status=66"
 	statusValid         = "/c/kn/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/status/?id=12345&status=4"
@@ -31,6 +39,10 @@ var handleTestCases = []ChannelHandleTestCase{
 		Text: Sp("Join"), URN: Sp("tel:+68673076228"), ExternalID: Sp("asdf-asdf"), Date: Tp(time.Date(2017, 5, 2, 14, 31, 49, 0, time.UTC))},
 	{Label: "Receive Empty Message", URL: receiveEmptyMessage, Data: "empty", Status: 200, Response: "Accepted",
 		Text: Sp(""), URN: Sp("tel:+2349067554729"), ExternalID: Sp("asdf-asdf"), Date: Tp(time.Date(2017, 5, 2, 14, 31, 49, 0, time.UTC))},
+	{Label: "Receive Concat Part 2", URL: receiveConcatPart2, Data: "empty", Status: 200, Response: "Message part received"},
+	{Label: "Receive Concat Part 1", URL: receiveConcatPart1, Data: "empty", Status: 200, Response: "Accepted",
+		Text: Sp("Hello World"), URN: Sp("tel:+2349067554729"), ExternalID: Sp("asdf-1"), Date: Tp(time.Date(2017, 5, 2, 14, 31, 49, 0, time.UTC))},
+	{Label: "Receive Concat Invalid Part", URL: receiveConcatBad, Data: "empty", Status: 400, Response: "invalid multipart part 3 of 2"},
 	{Label: "Receive No Params", URL: receiveNoParams, Data: "empty", Status: 400, Response: "field 'sender' required"},
 	{Label: "Invalid URN", URL: receiveInvalidURN, Data: "empty", Status: 400, Response: "phone number supplied is not a number"},
 	{Label: "Status No Params", URL: statusNoParams, Status: 400, Response: "field 'status' required"},
@@ -71,7 +83,7 @@ var defaultSendTestCases = []ChannelSendTestCase{
 		URLParams: map[string]string{"text": "☺", "to": "+250788383383", "coding": "2", "charset": "utf8", "priority": ""},
 		SendPrep:  setSendURL},
 	{Label: "Smart Encoding",
-		Text: "Fancy “Smart” Quotes", URN: "tel:+250788383383", HighPriority: false,
+		Text: `Fancy "Smart" Quotes`, URN: "tel:+250788383383", HighPriority: false,
 		Status:       "W",
 		ResponseBody: "0: Accepted for delivery", ResponseStatus: 200,
 		URLParams: map[string]string{"text": `Fancy "Smart" Quotes`, "to": "+250788383383", "coding": "", "priority": ""},
@@ -111,6 +123,33 @@ var nationalSendTestCases = []ChannelSendTestCase{
 		SendPrep:  setSendURL},
 }
 
+var nationalTablesSendTestCases = []ChannelSendTestCase{
+	{Label: "National Table Send",
+		Text: "Iğdır", URN: "tel:+250788383383",
+		Status:       "W",
+		ResponseBody: "0: Accepted for delivery", ResponseStatus: 200,
+		URLParams: map[string]string{"text": "\x48\x32\xC8\x07\x39", "udh": "\x03\x25\x01\x01", "coding": "1", "charset": ""},
+		SendPrep:  setSendURL},
+	{Label: "Plain Send",
+		Text: "Simple Message", URN: "tel:+250788383383",
+		Status:       "W",
+		ResponseBody: "0: Accepted for delivery", ResponseStatus: 200,
+		URLParams: map[string]string{"text": "Simple Message", "udh": "", "coding": ""},
+		SendPrep:  setSendURL},
+	{Label: "Unicode Send",
+		Text: "Iğdır ☺", URN: "tel:+250788383383",
+		Status:       "W",
+		ResponseBody: "0: Accepted for delivery", ResponseStatus: 200,
+		URLParams: map[string]string{"text": "Iğdır ☺", "udh": "", "coding": "2", "charset": "utf8"},
+		SendPrep:  setSendURL},
+	{Label: "Not Routable",
+		Text: "Iğdır", URN: "tel:+250788383383",
+		Status:       "F",
+		ResponseBody: "Not routable. Do not try again.", ResponseStatus: 403,
+		URLParams: map[string]string{"text": "\x48\x32\xC8\x07\x39", "udh": "\x03\x25\x01\x01", "coding": "1"},
+		SendPrep:  setSendURL},
+}
+
 func TestSending(t *testing.T) {
 	var defaultChannel = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "KN", "2020", "US",
 		map[string]interface{}{
@@ -125,6 +164,92 @@ func TestSending(t *testing.T) {
 			"verify_ssl":   false,
 		})
 
+	var nationalTablesChannel = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "KN", "2020", "US",
+		map[string]interface{}{
+			"password":        "Password",
+			"username":        "Username",
+			"national_tables": true,
+		})
+
 	RunChannelSendTestCases(t, defaultChannel, newHandler(), defaultSendTestCases, nil)
 	RunChannelSendTestCases(t, nationalChannel, newHandler(), nationalSendTestCases, nil)
+	RunChannelSendTestCases(t, nationalTablesChannel, newHandler(), nationalTablesSendTestCases, nil)
+}
+
+func TestSendingNationalParts(t *testing.T) {
+	var requests []url.Values
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Query())
+		w.Write([]byte("0: Accepted for delivery"))
+	}))
+	defer provider.Close()
+
+	setProviderURL := func(s *httptest.Server, h courier.ChannelHandler, c courier.Channel, m courier.Msg) {
+		requests = nil
+		c.(*courier.MockChannel).SetConfig("send_url", provider.URL)
+	}
+
+	var nationalTablesChannel = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "KN", "2020", "US",
+		map[string]interface{}{
+			"password":        "Password",
+			"username":        "Username",
+			"national_tables": true,
+		})
+
+	turkish := strings.TrimSpace(strings.Repeat("Iğdır ", 40))
+	RunChannelSendTestCases(t, nationalTablesChannel, newHandler(), []ChannelSendTestCase{
+		{Label: "Long National Table Send", Text: turkish, URN: "tel:+250788383383", Status: "W", MsgCount: 2, SendPrep: setProviderURL},
+	}, nil)
+
+	// each part is sent as binary, with the concatenation UDH of our msg and the UDH of its table
+	parts := SplitNationalSMS(turkish, 153)
+	if assert.Equal(t, 2, len(requests)) {
+		refs := make(map[string]bool)
+		for i, request := range requests {
+			udh := []byte(request.Get("udh"))
+			ref, part, total, found := ParseConcatUDH(udh)
+			assert.True(t, found)
+			assert.Equal(t, i+1, part)
+			assert.Equal(t, 2, total)
+			assert.Contains(t, string(udh), "\x25\x01\x01")
+			refs[ref] = true
+
+			assert.Equal(t, "1", request.Get("coding"))
+			septets := gsm7.Unpack([]byte(request.Get("text")), len(udh), len(gsm7.EncodeWithTable(parts[i].Text, parts[i].Table)))
+			assert.Equal(t, parts[i].Text, gsm7.DecodeWithTable(septets, parts[i].Table))
+		}
+		assert.Equal(t, 1, len(refs))
+	}
+
+	// parts which don't need a national table are sent as text with just the concatenation UDH
+	mixed := strings.Repeat("Simple ", 25) + "Iğdır"
+	RunChannelSendTestCases(t, nationalTablesChannel, newHandler(), []ChannelSendTestCase{
+		{Label: "Long Mixed Send", Text: mixed, URN: "tel:+250788383383", Status: "W", SendPrep: setProviderURL},
+	}, nil)
+
+	parts = SplitNationalSMS(mixed, 153)
+	if assert.Equal(t, 2, len(requests)) {
+		ref1, part, total, found := ParseConcatUDH([]byte(requests[0].Get("udh")))
+		assert.True(t, found)
+		assert.Equal(t, 1, part)
+		assert.Equal(t, 2, total)
+		assert.Equal(t, 6, len(requests[0].Get("udh")))
+		assert.Equal(t, "0", requests[0].Get("coding"))
+		assert.Equal(t, parts[0].Text, requests[0].Get("text"))
+
+		ref2, part, _, _ := ParseConcatUDH([]byte(requests[1].Get("udh")))
+		assert.Equal(t, 2, part)
+		assert.Equal(t, ref1, ref2)
+		assert.Equal(t, "1", requests[1].Get("coding"))
+	}
+}
+
+func TestDefaultEncodingPolicy(t *testing.T) {
+	h := newHandler().(courier.EncodingPolicyDefaulter)
+
+	smartChannel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "KN", "2020", "US", map[string]interface{}{configEncoding: encodingSmart})
+	assert.Equal(t, courier.EncodingPolicySmart, h.DefaultEncodingPolicy(smartChannel))
+
+	defaultChannel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "KN", "2020", "US", map[string]interface{}{configEncoding: encodingDefault})
+	assert.Equal(t, courier.EncodingPolicyNone, h.DefaultEncodingPolicy(defaultChannel))
 }
@@ -82,22 +82,25 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		return nil, fmt.Errorf("no password set for M3 channel")
 	}
 
-	// figure out if we need to send as unicode (encoding 7)
 	text := gsm7.ReplaceSubstitutions(handlers.GetTextAndAttachments(msg))
-	encoding := "0"
-	if !gsm7.IsValid(text) {
-		encoding = "7"
-	}
 
 	// send our message
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	for _, part := range handlers.SplitMsg(text, maxMsgLength) {
+	parts := handlers.SplitSMS(text, maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
+	for _, part := range parts {
+		// figure out if we need to send as unicode (encoding 7)
+		encoding := "0"
+		if part.Encoding == handlers.SMSEncodingUCS2 {
+			encoding = "7"
+		}
+
 		// build our request
 		params := url.Values{
 			"AuthKey":     []string{"m3-Tech"},
 			"UserId":      []string{username},
 			"Password":    []string{password},
-			"SMS":         []string{part},
+			"SMS":         []string{part.Text},
 			"SMSType":     []string{encoding},
 			"MobileNo":    []string{strings.TrimPrefix(msg.URN().Path(), "+")},
 			"MsgId":       []string{msg.ID().String()},
@@ -111,7 +114,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		msgURL.RawQuery = params.Encode()
 		req, _ := http.NewRequest(http.MethodGet, msgURL.String(), nil)
 
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 		status.AddLog(courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err))
 		if err != nil {
 			break
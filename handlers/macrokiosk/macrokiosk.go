@@ -161,21 +161,23 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		return nil, fmt.Errorf("missing username, password, serviceID or senderID for MK channel")
 	}
 
-	// figure out if we need to send as unicode (encoding 5)
 	text := gsm7.ReplaceSubstitutions(handlers.GetTextAndAttachments(msg))
-	encoding := "0"
-	if !gsm7.IsValid(text) {
-		encoding = "5"
-	}
 
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(text, maxMsgLength)
-	for i, part := range parts {
+	parts := handlers.SplitSMS(text, maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
+	for _, part := range parts {
+		// figure out if we need to send as unicode (encoding 5)
+		encoding := "0"
+		if part.Encoding == handlers.SMSEncodingUCS2 {
+			encoding = "5"
+		}
+
 		payload := &mtPayload{
 			From:   senderID,
 			ServID: servID,
 			To:     strings.TrimPrefix(msg.URN().Path(), "+"),
-			Text:   part,
+			Text:   part.Text,
 			User:   username,
 			Pass:   password,
 			Type:   encoding,
@@ -188,7 +190,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("Accept", "application/json")
 
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
 		status.AddLog(log)
 		if err != nil {
@@ -200,10 +202,8 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 			return status, fmt.Errorf("unable to parse response body from Macrokiosk")
 		}
 
-		// set the external id if this is our first part
-		if i == 0 {
-			status.SetExternalID(externalID)
-		}
+		// record the external id of each part we send
+		status.AddExternalID(externalID)
 	}
 	status.SetStatus(courier.MsgWired)
 	return status, nil
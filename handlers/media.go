@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/nyaruka/courier"
+)
+
+// media ids are cached per channel and attachment URL, the URL is hashed to keep our keys a sane length
+const mediaIDCacheKey = "media_id:%s:%s"
+
+func mediaIDKey(channel courier.Channel, attachmentURL string) string {
+	hash := sha256.Sum256([]byte(attachmentURL))
+	return fmt.Sprintf(mediaIDCacheKey, channel.UUID().String(), hex.EncodeToString(hash[:]))
+}
+
+// GetCachedMediaID returns the id a provider previously assigned to the passed in attachment URL when it was
+// uploaded for the passed in channel, returning an empty string if there is none
+func GetCachedMediaID(b courier.Backend, channel courier.Channel, attachmentURL string) (string, error) {
+	rc := b.RedisPool().Get()
+	defer rc.Close()
+
+	mediaID, err := redis.String(rc.Do("get", mediaIDKey(channel, attachmentURL)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return mediaID, err
+}
+
+// SetCachedMediaID caches the id a provider assigned to the passed in attachment URL for the passed in channel.
+// The expiry should be no longer than the provider keeps the media around for.
+func SetCachedMediaID(b courier.Backend, channel courier.Channel, attachmentURL string, mediaID string, expiry time.Duration) error {
+	rc := b.RedisPool().Get()
+	defer rc.Close()
+
+	_, err := rc.Do("setex", mediaIDKey(channel, attachmentURL), int(expiry/time.Second), mediaID)
+	return err
+}
+
+// ClearCachedMediaID removes any cached media id for the passed in attachment URL and channel, used when a provider
+// no longer recognizes a media id we cached
+func ClearCachedMediaID(b courier.Backend, channel courier.Channel, attachmentURL string) error {
+	rc := b.RedisPool().Get()
+	defer rc.Close()
+
+	_, err := rc.Do("del", mediaIDKey(channel, attachmentURL))
+	return err
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachedMediaID(t *testing.T) {
+	mb := courier.NewMockBackend()
+	channel1 := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "WA", "250788383383", "RW", nil)
+	channel2 := courier.NewMockChannel("dbc126ed-66bc-4e28-b67b-81dc3327c95d", "WA", "250788383384", "RW", nil)
+
+	mediaID, err := GetCachedMediaID(mb, channel1, "https://foo.bar/image.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "", mediaID)
+
+	err = SetCachedMediaID(mb, channel1, "https://foo.bar/image.jpg", "media-id", time.Hour)
+	assert.NoError(t, err)
+
+	mediaID, err = GetCachedMediaID(mb, channel1, "https://foo.bar/image.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "media-id", mediaID)
+
+	// ids are per channel and per URL
+	mediaID, err = GetCachedMediaID(mb, channel2, "https://foo.bar/image.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "", mediaID)
+
+	mediaID, err = GetCachedMediaID(mb, channel1, "https://foo.bar/other.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "", mediaID)
+
+	// and they expire
+	rc := mb.RedisPool().Get()
+	defer rc.Close()
+	ttl, _ := rc.Do("ttl", mediaIDKey(channel1, "https://foo.bar/image.jpg"))
+	assert.Equal(t, int64(3600), ttl)
+
+	err = ClearCachedMediaID(mb, channel1, "https://foo.bar/image.jpg")
+	assert.NoError(t, err)
+
+	mediaID, err = GetCachedMediaID(mb, channel1, "https://foo.bar/image.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "", mediaID)
+}
@@ -79,17 +79,18 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	}
 
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	parts := handlers.SplitSMS(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
 	for _, part := range parts {
 		shortcode  := strings.TrimPrefix(msg.Channel().Address(), "+")
 		to         := strings.TrimPrefix(msg.URN().Path(), "+")
-		textBase64 := base64.RawURLEncoding.EncodeToString([]byte(part))
+		textBase64 := base64.RawURLEncoding.EncodeToString([]byte(part.Text))
 		params     := fmt.Sprintf("%d/%s/%d/%s/%s", instanceId, shortcode, carrierId, to, textBase64)
 		signature  := utils.SignHMAC256(privateKey, params)
 		fullURL    := fmt.Sprintf("%s/%s/%s/%s", sendURL, params, publicKey, signature)
 
 		req, _ := http.NewRequest(http.MethodGet, fullURL, nil)
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 		// record our status and log
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
@@ -6,11 +6,9 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/buger/jsonparser"
-	"github.com/garyburd/redigo/redis"
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/handlers"
 	"github.com/nyaruka/courier/utils"
@@ -46,6 +44,7 @@ var statusMapping = map[string]courier.MsgStatusValue{
 func (h *handler) Initialize(s courier.Server) error {
 	h.SetServer(s)
 	s.AddHandlerRoute(h, http.MethodPost, "receive", h.receiveMsg)
+	handlers.StartMultipartFlusher(s)
 
 	statusHandler := handlers.NewExternalIDStatusHandler(&h.BaseHandler, statusMapping, "MsgId", "Status")
 	s.AddHandlerRoute(h, http.MethodPost, "status", statusHandler)
@@ -67,8 +66,14 @@ func (h *handler) receiveMsg(ctx context.Context, c courier.Channel, w http.Resp
 		return nil, handlers.WriteAndLogRequestError(ctx, h, c, w, r, fmt.Errorf("missing required field 'Msisdn'"))
 	}
 
+	// create our URN
+	urn, err := handlers.StrictTelForCountry(from, c.Country())
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, c, w, r, err)
+	}
+
 	// if we have a long message id, then this is part of a multipart message, we don't write the message until
-	// we have received all parts, which we buffer in Redis
+	// we have received all parts
 	longID := r.Form.Get("msglong.id")
 	if longID != "" {
 		longCount, _ := strconv.Atoi(r.Form.Get("msglong.msgcount"))
@@ -82,60 +87,25 @@ func (h *handler) receiveMsg(ctx context.Context, c courier.Channel, w http.Resp
 			return nil, handlers.WriteAndLogRequestError(ctx, h, c, w, r, fmt.Errorf("'msglong.msgref' needs to be between 1 and 'msglong.msgcount' inclusive"))
 		}
 
-		rc := h.Backend().RedisPool().Get()
-		defer rc.Close()
-
-		// first things first, populate the new part we just received
-		mapKey := fmt.Sprintf("%s:%s", c.UUID().String(), longID)
-		rc.Send("MULTI")
-		rc.Send("HSET", mapKey, longRef, text)
-		rc.Send("EXPIRE", mapKey, 300)
-		_, err := rc.Do("EXEC")
-		if err != nil {
-			return nil, err
-		}
-
-		// see if we have all the parts we need
-		count, err := redis.Int(rc.Do("HLEN", mapKey))
+		fullText, complete, err := handlers.ReassembleMultipart(h.Backend(), c, urn, longID, longRef, longCount, text)
 		if err != nil {
 			return nil, err
 		}
 
 		// we don't have all the parts yet, say we received the message
-		if count != longCount {
+		if !complete {
 			return nil, handlers.WriteAndLogRequestIgnored(ctx, h, c, w, r, "Message part received")
 		}
-
-		// we have all our parts, grab them and put them together
-		// build up the list of keys we are looking up
-		keys := make([]interface{}, longCount+1)
-		keys[0] = mapKey
-		for i := 1; i < longCount+1; i++ {
-			keys[i] = fmt.Sprintf("%d", i)
-		}
-
-		segments, err := redis.Strings(rc.Do("HMGET", keys...))
-		if err != nil {
-			return nil, err
-		}
-
-		// join our segments in our text
-		text = strings.Join(segments, "")
-
-		// finally delete our key, we are done with this message
-		rc.Do("DEL", mapKey)
-	}
-
-	// create our URN
-	urn, err := handlers.StrictTelForCountry(from, c.Country())
-	if err != nil {
-		return nil, handlers.WriteAndLogRequestError(ctx, h, c, w, r, err)
+		text = fullText
 	}
 
 	// if this a stop command, shortcut stopping that contact
 	if keyword == "Stop" {
 		stop := h.Backend().NewChannelEvent(c, courier.StopContact, urn)
 		err := h.Backend().WriteChannelEvent(ctx, stop)
+		if longID != "" {
+			handlers.CompleteMultipart(h.Backend(), c, urn, longID, err == nil)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -144,8 +114,12 @@ func (h *handler) receiveMsg(ctx context.Context, c courier.Channel, w http.Resp
 
 	// otherwise, create our incoming message and write that
 	msg := h.Backend().NewIncomingMsg(c, urn, text).WithReceivedOn(time.Now().UTC())
-	// and finally write our message
-	return handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+	// and finally write our message, we only get events back if it was written
+	events, err := handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+	if longID != "" {
+		handlers.CompleteMultipart(h.Backend(), c, urn, longID, events != nil)
+	}
+	return events, err
 }
 
 // SendMsg sends the passed in message, returning any error
@@ -162,13 +136,15 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 
 	// send our message
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	for _, part := range handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxMsgLength) {
+	parts := handlers.SplitSMS(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
+	for _, part := range parts {
 		// build our request
 		params := url.Values{
 			"username":     []string{username},
 			"password":     []string{password},
 			"msisdn":       []string{msg.URN().Path()},
-			"msg":          []string{part},
+			"msg":          []string{part.Text},
 			"serviceid":    []string{msg.Channel().Address()},
 			"allowunicode": []string{"true"},
 		}
@@ -177,7 +153,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		msgURL.RawQuery = params.Encode()
 		req, _ := http.NewRequest(http.MethodPost, msgURL.String(), nil)
 
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
 		status.AddLog(log)
 		if err != nil {
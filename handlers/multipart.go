@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/librato"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/sirupsen/logrus"
+)
+
+// MultipartTimeout is how long we wait for all the parts of a multipart message before writing what we have
+var MultipartTimeout = time.Minute * 5
+
+// how often we check for multipart messages which have timed out
+var multipartFlushInterval = time.Second * 15
+
+// parts are stored in a hash per message, and the hashes we are waiting on in a sorted set scored by when they time out
+const multipartKey = "multipart:%s:%s:%s"
+const multipartPendingKey = "multipart_pending"
+
+// the prefix of the hash fields holding our parts, the rest are metadata
+const multipartPartPrefix = "p:"
+
+var luaMultipartAdd = redis.NewScript(10, `-- KEYS: [PartsKey, PendingKey, Part, Total, Text, ChannelUUID, URN, Now, Deadline, Expiry]
+	local partsKey = KEYS[1]
+
+	redis.call("hset", partsKey, "p:" .. KEYS[3], KEYS[5])
+	redis.call("hsetnx", partsKey, "total", KEYS[4])
+	redis.call("hsetnx", partsKey, "channel_uuid", KEYS[6])
+	redis.call("hsetnx", partsKey, "urn", KEYS[7])
+	redis.call("hsetnx", partsKey, "started_on", KEYS[8])
+
+	local total = tonumber(redis.call("hget", partsKey, "total"))
+	local received = redis.call("hlen", partsKey) - 4
+
+	-- not complete yet, make sure we time out eventually
+	if received < total then
+		redis.call("zadd", KEYS[2], KEYS[9], partsKey)
+		redis.call("expire", partsKey, KEYS[10])
+		return nil
+	end
+
+	-- complete, claim it so the flusher leaves it alone and return everything we have, our parts are only removed
+	-- once our msg has been written
+	redis.call("zrem", KEYS[2], partsKey)
+	redis.call("expire", partsKey, KEYS[10])
+	return redis.call("hgetall", partsKey)
+`)
+
+// claiming a msg leaves its parts in place until it has been written, so they aren't lost if writing it fails
+var luaMultipartClaim = redis.NewScript(2, `-- KEYS: [PartsKey, PendingKey]
+	-- someone else already claimed or completed this msg
+	if redis.call("zrem", KEYS[2], KEYS[1]) == 0 then
+		return nil
+	end
+
+	return redis.call("hgetall", KEYS[1])
+`)
+
+// releasing a msg we failed to write makes it due to be flushed, if we still have its parts
+var luaMultipartRelease = redis.NewScript(3, `-- KEYS: [PartsKey, PendingKey, Now]
+	if redis.call("exists", KEYS[1]) == 1 then
+		redis.call("zadd", KEYS[2], KEYS[3], KEYS[1])
+	end
+`)
+
+// multipart is a multipart message as read back from redis
+type multipart struct {
+	channelUUID string
+	urn         urns.URN
+	total       int
+	startedOn   time.Time
+	parts       map[int]string
+}
+
+// text returns the text of our parts joined in order, skipping any we are missing
+func (m *multipart) text() string {
+	numbers := make([]int, 0, len(m.parts))
+	for n := range m.parts {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	texts := make([]string, len(numbers))
+	for i, n := range numbers {
+		texts[i] = m.parts[n]
+	}
+	return strings.Join(texts, "")
+}
+
+func newMultipartFromHash(values []string) *multipart {
+	m := &multipart{parts: make(map[int]string)}
+	for i := 0; i+1 < len(values); i += 2 {
+		field, value := values[i], values[i+1]
+		switch {
+		case strings.HasPrefix(field, multipartPartPrefix):
+			n, _ := strconv.Atoi(field[len(multipartPartPrefix):])
+			m.parts[n] = value
+		case field == "total":
+			m.total, _ = strconv.Atoi(value)
+		case field == "channel_uuid":
+			m.channelUUID = value
+		case field == "urn":
+			m.urn = urns.URN(value)
+		case field == "started_on":
+			startedOn, _ := strconv.ParseInt(value, 10, 64)
+			m.startedOn = time.Unix(startedOn, 0)
+		}
+	}
+	return m
+}
+
+// ReassembleMultipart adds the passed in part of a multipart message to those we have received so far. The reference
+// identifies the message for the channel and URN, and parts are numbered from 1 to total. If this completes our
+// message, its full text is returned and true, otherwise empty string and false. Callers should call CompleteMultipart
+// once they have tried to write a completed message.
+//
+// Messages which haven't received all their parts within MultipartTimeout are written with the parts we do have by
+// handlers which have called StartMultipartFlusher.
+func ReassembleMultipart(b courier.Backend, channel courier.Channel, urn urns.URN, ref string, part int, total int, text string) (string, bool, error) {
+	if total < 1 || part < 1 || part > total {
+		return "", false, fmt.Errorf("invalid multipart part %d of %d", part, total)
+	}
+
+	librato.Default.AddGauge(fmt.Sprintf("courier.multipart_part_%s", channel.ChannelType()), 1)
+
+	// single part messages are already complete
+	if total == 1 {
+		return text, true, nil
+	}
+
+	rc := b.RedisPool().Get()
+	defer rc.Close()
+
+	now := time.Now()
+	partsKey := fmt.Sprintf(multipartKey, channel.UUID().String(), urn.Identity(), ref)
+	deadline := now.Add(MultipartTimeout).Unix()
+
+	// our hash outlives our deadline by an hour so the flusher has time to find it
+	expiry := int((MultipartTimeout + time.Hour) / time.Second)
+
+	values, err := redis.Strings(luaMultipartAdd.Do(rc,
+		partsKey, multipartPendingKey, part, total, text, channel.UUID().String(), urn.String(), now.Unix(),
+		deadline, expiry,
+	))
+	if err == redis.ErrNil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	m := newMultipartFromHash(values)
+	librato.Default.AddGauge(fmt.Sprintf("courier.multipart_complete_%s", channel.ChannelType()), float64(now.Sub(m.startedOn))/float64(time.Second))
+
+	return m.text(), true, nil
+}
+
+// CompleteMultipart should be called with whether the message completed by the passed in part of a multipart message
+// was written. Its parts are kept until it has been, so if it wasn't they are written by the flusher instead.
+func CompleteMultipart(b courier.Backend, channel courier.Channel, urn urns.URN, ref string, written bool) {
+	rc := b.RedisPool().Get()
+	defer rc.Close()
+
+	var err error
+	partsKey := fmt.Sprintf(multipartKey, channel.UUID().String(), urn.Identity(), ref)
+	if written {
+		_, err = rc.Do("del", partsKey)
+	} else {
+		_, err = luaMultipartRelease.Do(rc, partsKey, multipartPendingKey, time.Now().Unix())
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("multipart_key", partsKey).Error("error completing multipart msg")
+	}
+}
+
+// the UDH information elements which identify parts of a concatenated message, with 8 and 16 bit references
+const (
+	udhConcat8Bit  byte = 0x00
+	udhConcat16Bit byte = 0x08
+)
+
+// ParseConcatUDH returns the reference, part number and total number of parts in the concatenation information element
+// of the passed in UDH, which may start with its length octet. Returns false if it doesn't have one.
+func ParseConcatUDH(udh []byte) (string, int, int, bool) {
+	if len(udh) > 0 && int(udh[0]) == len(udh)-1 {
+		udh = udh[1:]
+	}
+
+	for i := 0; i+1 < len(udh); {
+		iei, length := udh[i], int(udh[i+1])
+		data := udh[i+2:]
+		if len(data) < length {
+			break
+		}
+
+		switch {
+		case iei == udhConcat8Bit && length == 3:
+			return strconv.Itoa(int(data[0])), int(data[2]), int(data[1]), true
+		case iei == udhConcat16Bit && length == 4:
+			return strconv.Itoa(int(data[0])<<8 | int(data[1])), int(data[3]), int(data[2]), true
+		}
+		i += 2 + length
+	}
+	return "", 0, 0, false
+}
+
+// FlushExpiredMultiparts writes any multipart messages which have timed out waiting for their parts with the text of
+// the parts we did receive, in order. It returns the messages written.
+func FlushExpiredMultiparts(ctx context.Context, b courier.Backend) ([]courier.Msg, error) {
+	rc := b.RedisPool().Get()
+	defer rc.Close()
+
+	expired, err := redis.Strings(rc.Do("zrangebyscore", multipartPendingKey, "-inf", time.Now().Unix(), "LIMIT", 0, 100))
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]courier.Msg, 0, len(expired))
+	for _, partsKey := range expired {
+		values, err := redis.Strings(luaMultipartClaim.Do(rc, partsKey, multipartPendingKey))
+		if err == redis.ErrNil || (err == nil && len(values) == 0) {
+			continue
+		}
+		if err != nil {
+			return msgs, err
+		}
+
+		m := newMultipartFromHash(values)
+		log := logrus.WithField("multipart_key", partsKey).WithField("parts", len(m.parts)).WithField("total", m.total)
+
+		channelUUID, err := courier.NewChannelUUID(m.channelUUID)
+		if err != nil {
+			log.WithError(err).Error("invalid channel uuid for multipart msg, dropping")
+			rc.Do("del", partsKey)
+			continue
+		}
+
+		channel, err := b.GetChannel(ctx, courier.AnyChannelType, channelUUID)
+		if err != nil {
+			log.WithError(err).Error("unable to find channel for multipart msg, dropping")
+			rc.Do("del", partsKey)
+			continue
+		}
+
+		msg := b.NewIncomingMsg(channel, m.urn, m.text()).WithReceivedOn(m.startedOn.UTC())
+		err = b.WriteMsg(ctx, msg)
+		if err != nil {
+			// put our msg back so we try again on our next flush
+			log.WithError(err).Error("error writing timed out multipart msg")
+			rc.Do("zadd", multipartPendingKey, time.Now().Unix(), partsKey)
+			continue
+		}
+		rc.Do("del", partsKey)
+
+		log.WithField("msg_uuid", msg.UUID().String()).Warning("multipart msg timed out, wrote received parts")
+		librato.Default.AddGauge(fmt.Sprintf("courier.multipart_timeout_%s", channel.ChannelType()), float64(m.total-len(m.parts)))
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+var multipartFlushers = make(map[courier.Server]bool)
+var multipartFlushersMutex sync.Mutex
+
+// StartMultipartFlusher starts a goroutine which periodically writes multipart messages which have timed out, handlers
+// which use ReassembleMultipart should call this when they are initialized. Only one flusher is started per server.
+func StartMultipartFlusher(s courier.Server) {
+	multipartFlushersMutex.Lock()
+	defer multipartFlushersMutex.Unlock()
+
+	if multipartFlushers[s] {
+		return
+	}
+	multipartFlushers[s] = true
+
+	s.WaitGroup().Add(1)
+	go func() {
+		defer s.WaitGroup().Done()
+
+		for {
+			select {
+			case <-s.StopChan():
+				return
+			case <-time.After(multipartFlushInterval):
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				_, err := FlushExpiredMultiparts(ctx, s.Backend())
+				cancel()
+				if err != nil {
+					logrus.WithError(err).Error("error flushing timed out multipart msgs")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReassembleMultipart(t *testing.T) {
+	mb := courier.NewMockBackend()
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "NX", "2020", "US", nil)
+	mb.AddChannel(channel)
+	urn := urns.URN("tel:+12065551212")
+
+	// parts can arrive in any order, we only get our text once we have them all
+	text, complete, err := ReassembleMultipart(mb, channel, urn, "ref1", 3, 3, "!")
+	assert.NoError(t, err)
+	assert.False(t, complete)
+	assert.Equal(t, "", text)
+
+	// a different reference is a different message
+	text, complete, err = ReassembleMultipart(mb, channel, urn, "ref2", 1, 2, "Other ")
+	assert.NoError(t, err)
+	assert.False(t, complete)
+
+	text, complete, err = ReassembleMultipart(mb, channel, urn, "ref1", 1, 3, "Hello ")
+	assert.NoError(t, err)
+	assert.False(t, complete)
+
+	text, complete, err = ReassembleMultipart(mb, channel, urn, "ref1", 2, 3, "World")
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, "Hello World!", text)
+
+	// once our msg is written its parts are gone, so there's nothing left to release
+	CompleteMultipart(mb, channel, urn, "ref1", true)
+	CompleteMultipart(mb, channel, urn, "ref1", false)
+
+	// single part messages are complete right away
+	text, complete, err = ReassembleMultipart(mb, channel, urn, "ref3", 1, 1, "Single")
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, "Single", text)
+
+	// invalid parts are errors
+	_, _, err = ReassembleMultipart(mb, channel, urn, "ref1", 4, 3, "Extra")
+	assert.EqualError(t, err, "invalid multipart part 4 of 3")
+
+	// nothing has timed out yet
+	msgs, err := FlushExpiredMultiparts(context.Background(), mb)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(msgs))
+
+	// now have parts time out immediately
+	defer func(timeout time.Duration) { MultipartTimeout = timeout }(MultipartTimeout)
+	MultipartTimeout = -time.Second
+
+	_, complete, err = ReassembleMultipart(mb, channel, urn, "ref4", 3, 3, "parts")
+	assert.NoError(t, err)
+	assert.False(t, complete)
+	_, complete, err = ReassembleMultipart(mb, channel, urn, "ref4", 1, 3, "some ")
+	assert.NoError(t, err)
+	assert.False(t, complete)
+
+	// we write what we have in order, messages still within their timeout are left alone
+	msgs, err = FlushExpiredMultiparts(context.Background(), mb)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(msgs)) {
+		assert.Equal(t, "some parts", msgs[0].Text())
+		assert.Equal(t, urn, msgs[0].URN())
+		assert.Equal(t, channel, msgs[0].Channel())
+	}
+
+	// and only once
+	msgs, err = FlushExpiredMultiparts(context.Background(), mb)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(msgs))
+
+	// messages we fail to write keep their parts until we can
+	_, _, err = ReassembleMultipart(mb, channel, urn, "ref5", 1, 2, "kept")
+	assert.NoError(t, err)
+
+	mb.SetErrorOnQueue(true)
+	msgs, err = FlushExpiredMultiparts(context.Background(), mb)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(msgs))
+
+	mb.SetErrorOnQueue(false)
+	msgs, err = FlushExpiredMultiparts(context.Background(), mb)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(msgs)) {
+		assert.Equal(t, "kept", msgs[0].Text())
+	}
+
+	// completed messages are left to whoever completed them, unless they fail to write them
+	_, _, err = ReassembleMultipart(mb, channel, urn, "ref6", 1, 2, "Hello ")
+	assert.NoError(t, err)
+	text, complete, err = ReassembleMultipart(mb, channel, urn, "ref6", 2, 2, "again")
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, "Hello again", text)
+
+	msgs, err = FlushExpiredMultiparts(context.Background(), mb)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(msgs))
+
+	CompleteMultipart(mb, channel, urn, "ref6", false)
+	msgs, err = FlushExpiredMultiparts(context.Background(), mb)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(msgs)) {
+		assert.Equal(t, "Hello again", msgs[0].Text())
+	}
+}
+
+func TestParseConcatUDH(t *testing.T) {
+	tcs := []struct {
+		udh   []byte
+		ref   string
+		part  int
+		total int
+		found bool
+	}{
+		{[]byte{0x05, 0x00, 0x03, 0x2A, 0x03, 0x02}, "42", 2, 3, true},
+		{[]byte{0x00, 0x03, 0x2A, 0x03, 0x01}, "42", 1, 3, true},
+		{[]byte{0x06, 0x08, 0x04, 0x01, 0x02, 0x02, 0x02}, "258", 2, 2, true},
+		{[]byte{0x08, 0x24, 0x01, 0x01, 0x00, 0x03, 0x07, 0x02, 0x01}, "7", 1, 2, true},
+		{[]byte{0x03, 0x24, 0x01, 0x01}, "", 0, 0, false},
+		{[]byte{0x05, 0x00, 0x03, 0x2A}, "", 0, 0, false},
+		{[]byte{}, "", 0, 0, false},
+	}
+
+	for _, tc := range tcs {
+		ref, part, total, found := ParseConcatUDH(tc.udh)
+		assert.Equal(t, tc.found, found, "found mismatch for %x", tc.udh)
+		assert.Equal(t, tc.ref, ref, "ref mismatch for %x", tc.udh)
+		assert.Equal(t, tc.part, part, "part mismatch for %x", tc.udh)
+		assert.Equal(t, tc.total, total, "total mismatch for %x", tc.udh)
+	}
+}
@@ -10,8 +10,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/nyaruka/courier/gsm7"
-
 	"github.com/buger/jsonparser"
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/handlers"
@@ -51,6 +49,7 @@ func (h *handler) Initialize(s courier.Server) error {
 	s.AddHandlerRoute(h, http.MethodPost, "receive", h.receiveMessage)
 	s.AddHandlerRoute(h, http.MethodPost, "status", h.receiveStatus)
 	s.AddHandlerRoute(h, http.MethodGet, "status", h.receiveStatus)
+	handlers.StartMultipartFlusher(s)
 	return nil
 }
 
@@ -90,10 +89,14 @@ func (h *handler) receiveStatus(ctx context.Context, channel courier.Channel, w
 }
 
 type moForm struct {
-	To        string `name:"to"`
-	From      string `name:"msisdn"`
-	Text      string `name:"text"`
-	MessageID string `name:"messageId"`
+	To          string `name:"to"`
+	From        string `name:"msisdn"`
+	Text        string `name:"text"`
+	MessageID   string `name:"messageId"`
+	Concat      string `name:"concat"`
+	ConcatRef   string `name:"concat-ref"`
+	ConcatTotal int    `name:"concat-total"`
+	ConcatPart  int    `name:"concat-part"`
 }
 
 // receiveMessage is our HTTP handler function for incoming messages
@@ -111,10 +114,27 @@ func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w
 		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
 	}
 
+	// parts of concatenated messages are buffered until we have them all
+	text := form.Text
+	if form.Concat == "true" {
+		fullText, complete, err := handlers.ReassembleMultipart(h.Backend(), channel, urn, form.ConcatRef, form.ConcatPart, form.ConcatTotal, form.Text)
+		if err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+		}
+		if !complete {
+			return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "message part received")
+		}
+		text = fullText
+	}
+
 	// build our msg
-	msg := h.Backend().NewIncomingMsg(channel, urn, form.Text)
-	// and finally write our message
-	return handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+	msg := h.Backend().NewIncomingMsg(channel, urn, text)
+	// and finally write our message, we only get events back if it was written
+	events, err := handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+	if form.Concat == "true" {
+		handlers.CompleteMultipart(h.Backend(), channel, urn, form.ConcatRef, events != nil)
+	}
+	return events, err
 }
 
 // SendMsg sends the passed in message, returning any error
@@ -134,20 +154,21 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 
 	text := handlers.GetTextAndAttachments(msg)
 
-	textType := "text"
-	if !gsm7.IsValid(text) {
-		textType = "unicode"
-	}
-
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(text, maxMsgLength)
+	parts := handlers.SplitSMS(text, maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
 	for _, part := range parts {
+		textType := "text"
+		if part.Encoding == handlers.SMSEncodingUCS2 {
+			textType = "unicode"
+		}
+
 		form := url.Values{
 			"api_key":           []string{nexmoAPIKey},
 			"api_secret":        []string{nexmoAPISecret},
 			"from":              []string{strings.TrimPrefix(msg.Channel().Address(), "+")},
 			"to":                []string{strings.TrimPrefix(msg.URN().Path(), "+")},
-			"text":              []string{part},
+			"text":              []string{part.Text},
 			"status-report-req": []string{"1"},
 			"callback":          []string{callbackURL},
 			"type":              []string{textType},
@@ -159,7 +180,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 			req, _ := http.NewRequest(http.MethodPost, sendURL, strings.NewReader(form.Encode()))
 			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-			rr, requestErr = utils.MakeHTTPRequest(req)
+			rr, requestErr = utils.MakeHTTPRequest(req.WithContext(ctx))
 			matched := throttledRE.FindAllStringSubmatch(string([]byte(rr.Body)), -1)
 			if len(matched) > 0 && len(matched[0]) > 0 {
 				sleepTime, _ := strconv.Atoi(matched[0][1])
@@ -19,6 +19,9 @@ var (
 	receiveValidMessage     = "/c/nx/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive?to=2020&msisdn=2349067554729&text=Join&messageId=external1"
 	receiveInvalidURN       = "/c/nx/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive?to=2020&msisdn=MTN&text=Join&messageId=external1"
 	receiveValidMessageBody = "to=2020&msisdn=2349067554729&text=Join&messageId=external1"
+	receiveConcatPart2      = "/c/nx/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive?to=2020&msisdn=2349067554729&text=World&messageId=external3&concat=true&concat-ref=12&concat-total=2&concat-part=2"
+	receiveConcatPart1      = "/c/nx/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive?to=2020&msisdn=2349067554729&text=Hello+&messageId=external2&concat=true&concat-ref=12&concat-total=2&concat-part=1"
+	receiveConcatInvalid    = "/c/nx/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive?to=2020&msisdn=2349067554729&text=Hello+&messageId=external2&concat=true&concat-ref=12&concat-total=2&concat-part=3"
 
 	statusDelivered  = "/c/nx/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/status?to=2020&messageId=external1&status=delivered"
 	statusExpired    = "/c/nx/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/status?to=2020&messageId=external1&status=expired"
@@ -35,6 +38,10 @@ var testCases = []ChannelHandleTestCase{
 	{Label: "Valid Receive Post", URL: receiveURL, Status: 200, Response: "Accepted", Data: receiveValidMessageBody,
 		Text: Sp("Join"), URN: Sp("tel:+2349067554729")},
 	{Label: "Receive URL check", URL: receiveURL, Status: 200, Response: "no to parameter, ignored"},
+	{Label: "Receive Concat Part 2", URL: receiveConcatPart2, Status: 200, Response: "message part received"},
+	{Label: "Receive Concat Part 1", URL: receiveConcatPart1, Status: 200, Response: "Accepted",
+		Text: Sp("Hello World"), URN: Sp("tel:+2349067554729")},
+	{Label: "Receive Concat Invalid Part", URL: receiveConcatInvalid, Status: 400, Response: "invalid multipart part 3 of 2"},
 	{Label: "Status URL check", URL: statusURL, Status: 200, Response: "no messageId parameter, ignored"},
 
 	{Label: "Status delivered", URL: statusDelivered, Status: 200, Response: `"status":"D"`, ExternalID: Sp("external1")},
@@ -67,14 +74,14 @@ var defaultSendTestCases = []ChannelSendTestCase{
 		SendPrep: setSendURL},
 	{Label: "Unicode Send",
 		Text: "Unicode ☺", URN: "tel:+250788383383",
-		Status: "W", ExternalID: "1002",
+		Status: "W", ExternalID: "1002", MsgCount: 1,
 		PostParams:   map[string]string{"text": "Unicode ☺", "to": "250788383383", "from": "2020", "api_key": "nexmo-api-key", "api_secret": "nexmo-api-secret", "status-report-req": "1", "type": "unicode"},
 		ResponseBody: `{"messages":[{"status":"0","message-id":"1002"}]}`, ResponseStatus: 200,
 		SendPrep: setSendURL},
 	{Label: "Long Send",
 		Text:   "This is a longer message than 160 characters and will cause us to split it into two separate parts, isn't that right but it is even longer than before I say, I need to keep adding more things to make it work",
 		URN:    "tel:+250788383383",
-		Status: "W", ExternalID: "1002",
+		Status: "W", ExternalID: "1002", MsgCount: 2,
 		PostParams:   map[string]string{"text": "I need to keep adding more things to make it work", "to": "250788383383", "from": "2020", "api_key": "nexmo-api-key", "api_secret": "nexmo-api-secret", "status-report-req": "1", "type": "text"},
 		ResponseBody: `{"messages":[{"status":"0","message-id":"1002"}]}`, ResponseStatus: 200,
 		SendPrep: setSendURL},
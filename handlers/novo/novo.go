@@ -56,7 +56,8 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	}
 
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	parts := handlers.SplitSMS(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
 	for _, part := range parts {
 		from := strings.TrimPrefix(msg.Channel().Address(), "+")
 		to   := strings.TrimPrefix(msg.URN().Path(), "+")
@@ -64,15 +65,15 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		form := url.Values{
 			"from": []string{from},
 			"to":   []string{to},
-			"msg":  []string{part},
+			"msg":  []string{part.Text},
 		}
-		form["signature"] = []string{utils.SignHMAC256(merchantSecret, fmt.Sprintf("%s;%s;%s;", from, to, part))}
+		form["signature"] = []string{utils.SignHMAC256(merchantSecret, fmt.Sprintf("%s;%s;%s;", from, to, part.Text))}
 
 		partSendURL, _ := url.Parse(fmt.Sprintf(sendURL, merchantId))
 		partSendURL.RawQuery = form.Encode()
 
 		req, _ := http.NewRequest(http.MethodGet, partSendURL.String(), nil)
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 		// record our status and log
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"github.com/nyaruka/courier"
+	"github.com/sirupsen/logrus"
+)
+
+// the default opt out keywords for each language a channel can have
+var defaultOptOutKeywords = map[string][]string{
+	"eng": {"STOP", "STOPALL", "UNSUBSCRIBE", "CANCEL", "END", "QUIT"},
+	"fra": {"STOP", "ARRET", "ARRÊT", "DESABONNER", "DÉSABONNER"},
+	"spa": {"STOP", "ALTO", "BAJA", "PARAR", "CANCELAR"},
+	"por": {"STOP", "PARAR", "SAIR", "CANCELAR"},
+}
+
+// the default opt in keywords for each language a channel can have
+var defaultOptInKeywords = map[string][]string{
+	"eng": {"START", "UNSTOP"},
+	"fra": {"START", "DEMARRER", "DÉMARRER"},
+	"spa": {"START", "ALTA", "INICIAR"},
+	"por": {"START", "INICIAR", "VOLTAR"},
+}
+
+// optKeyword is the kind of opt out keyword a message is
+type optKeyword int
+
+const (
+	noKeyword optKeyword = iota
+	optOutKeyword
+	optInKeyword
+)
+
+// matchOptKeyword returns whether the passed in text is one of the opt out or opt in keywords of the passed in channel.
+// Channels only have keywords if they have opt out languages, opt out keywords or opt in keywords configured.
+func matchOptKeyword(channel courier.Channel, text string) optKeyword {
+	languages := courier.ConfigStringsForKey(channel, courier.ConfigOptOutLanguages)
+	optOuts := courier.ConfigStringsForKey(channel, courier.ConfigOptOutKeywords)
+	optIns := courier.ConfigStringsForKey(channel, courier.ConfigOptInKeywords)
+
+	if len(languages) == 0 && len(optOuts) == 0 && len(optIns) == 0 {
+		return noKeyword
+	}
+
+	for _, language := range languages {
+		optOuts = append(optOuts, defaultOptOutKeywords[strings.ToLower(language)]...)
+		optIns = append(optIns, defaultOptInKeywords[strings.ToLower(language)]...)
+	}
+
+	keyword := normalizeKeyword(text)
+	if keyword == "" {
+		return noKeyword
+	}
+
+	for _, k := range optOuts {
+		if normalizeKeyword(k) == keyword {
+			return optOutKeyword
+		}
+	}
+	for _, k := range optIns {
+		if normalizeKeyword(k) == keyword {
+			return optInKeyword
+		}
+	}
+	return noKeyword
+}
+
+// normalizeKeyword uppercases the passed in text and strips any surrounding whitespace and punctuation, so "Stop." matches
+func normalizeKeyword(text string) string {
+	return strings.ToUpper(strings.TrimFunc(text, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsPunct(r) }))
+}
+
+// writeOptOut writes a stop contact event for the sender of the passed in opt out msg and queues them our confirmation
+func writeOptOut(ctx context.Context, h ResponseWriter, msg courier.Msg) (courier.ChannelEvent, error) {
+	stop := h.Backend().NewChannelEvent(msg.Channel(), courier.StopContact, msg.URN())
+	if msg.ReceivedOn() != nil {
+		stop = stop.WithOccurredOn(*msg.ReceivedOn())
+	}
+
+	err := h.Backend().WriteChannelEvent(ctx, stop)
+	if err != nil {
+		return nil, err
+	}
+
+	queueOptReply(ctx, h, msg, courier.ConfigOptOutReply)
+	return stop, nil
+}
+
+// queueOptReply queues the reply configured for the passed in key to the sender of the passed in msg, if there is one.
+// The reply is created after any stop contact event is written, so it isn't skipped for being to a stopped contact.
+func queueOptReply(ctx context.Context, h ResponseWriter, msg courier.Msg, configKey string) {
+	text := msg.Channel().StringConfigForKey(configKey, "")
+	if text == "" {
+		return
+	}
+
+	reply := h.Backend().NewOutgoingMsg(msg.Channel(), msg.URN(), text)
+	err := h.Backend().QueueOutgoingMsg(ctx, reply)
+	if err != nil {
+		logrus.WithError(err).WithField("channel_uuid", msg.Channel().UUID()).Error("error queueing opt reply")
+	}
+}
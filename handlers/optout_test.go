@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nyaruka/courier"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchOptKeyword(t *testing.T) {
+	noKeywords := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "EX", "2020", "US", nil)
+	english := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "EX", "2020", "US",
+		map[string]interface{}{courier.ConfigOptOutLanguages: "eng"})
+	french := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "EX", "2020", "FR",
+		map[string]interface{}{courier.ConfigOptOutLanguages: []interface{}{"fra"}})
+	custom := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "EX", "2020", "US",
+		map[string]interface{}{courier.ConfigOptOutKeywords: "halt, leave me alone", courier.ConfigOptInKeywords: "resume"})
+	optInsOnly := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "EX", "2020", "US",
+		map[string]interface{}{courier.ConfigOptInKeywords: "resume"})
+
+	tcs := []struct {
+		channel  courier.Channel
+		text     string
+		expected optKeyword
+	}{
+		{noKeywords, "STOP", noKeyword},
+		{english, "STOP", optOutKeyword},
+		{english, " stop! ", optOutKeyword},
+		{english, "Unsubscribe", optOutKeyword},
+		{english, "please stop", noKeyword},
+		{english, "ARRET", noKeyword},
+		{english, "start", optInKeyword},
+		{english, "", noKeyword},
+		{french, "Arrêt", optOutKeyword},
+		{french, "arret", optOutKeyword},
+		{french, "démarrer", optInKeyword},
+		{custom, "HALT", optOutKeyword},
+		{custom, "leave me alone.", optOutKeyword},
+		{custom, "stop", noKeyword},
+		{custom, "Resume", optInKeyword},
+		{optInsOnly, "resume", optInKeyword},
+		{optInsOnly, "stop", noKeyword},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.expected, matchOptKeyword(tc.channel, tc.text), "unexpected match for '%s'", tc.text)
+	}
+}
+
+func TestWriteOptOut(t *testing.T) {
+	mb := courier.NewMockBackend()
+	h := NewBaseHandler(courier.ChannelType("EX"), "External")
+	h.SetServer(newServer(mb))
+
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "EX", "2020", "US",
+		map[string]interface{}{
+			courier.ConfigOptOutLanguages: "eng",
+			courier.ConfigOptOutReply:     "You have been unsubscribed",
+			courier.ConfigOptInReply:      "Welcome back",
+		})
+
+	// an opt out is written as a stop contact event instead of a msg
+	msg := mb.NewIncomingMsg(channel, "tel:+250788383383", "Stop")
+	events, err := WriteMsgsAndResponse(context.Background(), &h, []courier.Msg{msg}, httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, mb.LenQueuedMsgs())
+
+	event, err := mb.GetLastChannelEvent()
+	assert.NoError(t, err)
+	assert.Equal(t, courier.StopContact, event.EventType())
+	assert.Equal(t, "tel:+250788383383", string(event.URN()))
+	assert.Equal(t, []courier.Event{event}, events)
+
+	// and our confirmation is queued to be sent like any other msg
+	reply, err := mb.PopNextOutgoingMsg(context.Background())
+	assert.NoError(t, err)
+	if assert.NotNil(t, reply) {
+		assert.Equal(t, "You have been unsubscribed", reply.Text())
+		assert.Equal(t, "tel:+250788383383", string(reply.URN()))
+		mb.MarkOutgoingMsgComplete(context.Background(), reply, nil)
+	}
+
+	// an opt in is written as a normal msg
+	msg = mb.NewIncomingMsg(channel, "tel:+250788383383", "START")
+	_, err = WriteMsgsAndResponse(context.Background(), &h, []courier.Msg{msg}, httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, mb.LenQueuedMsgs())
+
+	reply, err = mb.PopNextOutgoingMsg(context.Background())
+	assert.NoError(t, err)
+	if assert.NotNil(t, reply) {
+		assert.Equal(t, "Welcome back", reply.Text())
+	}
+}
@@ -149,12 +149,13 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	statusURL := fmt.Sprintf("https://%s/c/pl/%s/status", callbackDomain, msg.Channel().UUID())
 
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxMsgLength)
-	for i, part := range parts {
+	parts := handlers.SplitSMS(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
+	for _, part := range parts {
 		payload := &mtPayload{
 			Src:    strings.TrimPrefix(msg.Channel().Address(), "+"),
 			Dst:    strings.TrimPrefix(msg.URN().Path(), "+"),
-			Text:   part,
+			Text:   part.Text,
 			URL:    statusURL,
 			Method: "POST",
 		}
@@ -168,7 +169,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		req.Header.Set("Accept", "application/json")
 		req.SetBasicAuth(authID, authToken)
 
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
 		status.AddLog(log)
 		if err != nil {
@@ -180,10 +181,8 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 			return status, fmt.Errorf("unable to parse response body from Plivo")
 		}
 
-		// set external id on first part
-		if i == 0 {
-			status.SetExternalID(externalID)
-		}
+		// record the external id of each part we send
+		status.AddExternalID(externalID)
 	}
 
 	status.SetStatus(courier.MsgWired)
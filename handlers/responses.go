@@ -16,20 +16,42 @@ type ResponseWriter interface {
 	WriteRequestIgnored(ctx context.Context, w http.ResponseWriter, r *http.Request, msg string) error
 }
 
-// WriteMsgsAndResponse writes the passed in message to our backend
+// WriteMsgsAndResponse writes the passed in message to our backend. Messages which are opt out keywords for their channel
+// are written as stop contact events instead.
 func WriteMsgsAndResponse(ctx context.Context, h ResponseWriter, msgs []courier.Msg, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
 	events := make([]courier.Event, len(msgs), len(msgs))
 	for i, m := range msgs {
-		err := h.Backend().WriteMsg(ctx, m)
+		event, err := WriteMsg(ctx, h, m)
 		if err != nil {
 			return nil, err
 		}
-		events[i] = m
+		events[i] = event
 	}
 
 	return events, h.WriteMsgSuccessResponse(ctx, w, r, msgs)
 }
 
+// WriteMsg writes the passed in message to our backend, returning the event written for it. Messages which are opt out
+// keywords for their channel are written as stop contact events instead. Handlers which don't write their messages with
+// WriteMsgsAndResponse should write them with this.
+func WriteMsg(ctx context.Context, h ResponseWriter, msg courier.Msg) (courier.Event, error) {
+	keyword := matchOptKeyword(msg.Channel(), msg.Text())
+	if keyword == optOutKeyword {
+		return writeOptOut(ctx, h, msg)
+	}
+
+	err := h.Backend().WriteMsg(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// opt ins are written like any other message, which is enough to re-enable the contact, but get a confirmation
+	if keyword == optInKeyword {
+		queueOptReply(ctx, h, msg, courier.ConfigOptInReply)
+	}
+	return msg, nil
+}
+
 // WriteMsgStatusAndResponse write the passed in status to our backend
 func WriteMsgStatusAndResponse(ctx context.Context, h ResponseWriter, channel courier.Channel, status courier.MsgStatus, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
 	err := h.Backend().WriteMsgStatus(ctx, status)
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/nyaruka/courier/gsm7"
+)
+
+// SMSEncoding is the encoding an SMS will be sent with
+type SMSEncoding string
+
+// the encodings an SMS can be sent with
+const (
+	SMSEncodingGSM7 SMSEncoding = "gsm7"
+	SMSEncodingUCS2 SMSEncoding = "ucs2"
+)
+
+// the number of characters that fit in a single SMS, and in each segment of a concatenated SMS, by encoding
+const (
+	gsm7SingleLength  = 160
+	gsm7SegmentLength = 153
+	ucs2SingleLength  = 70
+	ucs2SegmentLength = 67
+)
+
+// the number of octets the UDH of a concatenated SMS takes up, including its length octet
+const concatUDHLength = 6
+
+// SMSPart is a single part of a msg split to be sent as SMS, GSM7 parts may need a national language table whose UDH
+// must be sent with them
+type SMSPart struct {
+	Text     string
+	Encoding SMSEncoding
+	Table    gsm7.Table
+	Segments int
+}
+
+// SMSEncodingFor returns the encoding the passed in text needs to be sent with
+func SMSEncodingFor(text string) SMSEncoding {
+	if gsm7.IsValid(text) {
+		return SMSEncodingGSM7
+	}
+	return SMSEncodingUCS2
+}
+
+// SMSLength returns the length of the passed in text in the passed in encoding. In GSM7, characters from the extension
+// table are escaped so count as two, and in UCS2 characters outside the basic multilingual plane take two code units.
+func SMSLength(text string, encoding SMSEncoding) int {
+	if encoding == SMSEncodingGSM7 {
+		return len(gsm7.Encode(text))
+	}
+
+	length := 0
+	for _, r := range text {
+		length += ucs2RuneLength(r)
+	}
+	return length
+}
+
+// SMSSegments returns the number of SMS segments a text of the passed in length and encoding will be billed as
+func SMSSegments(length int, encoding SMSEncoding) int {
+	single, segment := gsm7SingleLength, gsm7SegmentLength
+	if encoding == SMSEncodingUCS2 {
+		single, segment = ucs2SingleLength, ucs2SegmentLength
+	}
+
+	if length <= single {
+		return 1
+	}
+	return (length + segment - 1) / segment
+}
+
+// CountSMSSegments returns the total number of SMS segments the passed in parts will be billed as
+func CountSMSSegments(parts []SMSPart) int {
+	count := 0
+	for _, part := range parts {
+		count += part.Segments
+	}
+	return count
+}
+
+// SplitSMS splits the passed in text into parts that can each be sent as a single SMS request. The max length is in
+// GSM7 characters, if the text needs to be sent as UCS2 parts are limited to the same number of segments instead.
+// National language tables are never used as most providers have no way of sending their UDH, see SplitNationalSMS.
+func SplitSMS(text string, max int) []SMSPart {
+	return splitSMS(text, max, false)
+}
+
+// SplitNationalSMS splits the passed in text like SplitSMS, except that text which can be encoded in GSM7 using one
+// of the national language tables is, rather than being sent as UCS2. Parts are shortened to leave space for their
+// table's UDH, so this should only be used by handlers which send each part's UDH.
+func SplitNationalSMS(text string, max int) []SMSPart {
+	return splitSMS(text, max, true)
+}
+
+func splitSMS(text string, max int, national bool) []SMSPart {
+	encoding, table := smsEncodingFor(text, national)
+	limit := smsPartLimit(max, encoding, table)
+
+	// smaller than our max, just return it
+	if smsLength(text, encoding, table) <= limit {
+		return []SMSPart{newSMSPart(text, national)}
+	}
+
+	parts := make([]SMSPart, 0, 2)
+	part := bytes.Buffer{}
+	length := 0
+
+	for _, r := range text {
+		runeLength := smsRuneLength(r, encoding, table)
+
+		// an escaped character can't be split across parts
+		if length > 0 && length+runeLength > limit {
+			parts = append(parts, newSMSPart(strings.TrimSpace(part.String()), national))
+			part.Reset()
+			length = 0
+		}
+
+		part.WriteRune(r)
+		length += runeLength
+
+		if length == limit || (length > limit-6 && r == ' ') {
+			parts = append(parts, newSMSPart(strings.TrimSpace(part.String()), national))
+			part.Reset()
+			length = 0
+		}
+	}
+	if part.Len() > 0 {
+		parts = append(parts, newSMSPart(strings.TrimSpace(part.String()), national))
+	}
+
+	return parts
+}
+
+// newSMSPart creates a new part for the passed in text, each part gets its own encoding and table as it may not need
+// UCS2 or the same national language table
+func newSMSPart(text string, national bool) SMSPart {
+	encoding, table := smsEncodingFor(text, national)
+	return SMSPart{
+		Text:     text,
+		Encoding: encoding,
+		Table:    table,
+		Segments: smsSegments(smsLength(text, encoding, table), encoding, table),
+	}
+}
+
+// smsEncodingFor returns the encoding and table the passed in text needs to be sent with, only considering national
+// language tables if asked to
+func smsEncodingFor(text string, national bool) (SMSEncoding, gsm7.Table) {
+	if gsm7.IsValid(text) {
+		return SMSEncodingGSM7, gsm7.DefaultTable
+	}
+	if national {
+		if table, valid := gsm7.ChooseTable(text); valid {
+			return SMSEncodingGSM7, table
+		}
+	}
+	return SMSEncodingUCS2, gsm7.DefaultTable
+}
+
+// smsLength returns the length of the passed in text in the passed in encoding and table
+func smsLength(text string, encoding SMSEncoding, table gsm7.Table) int {
+	if encoding == SMSEncodingGSM7 && table != gsm7.DefaultTable {
+		return len(gsm7.EncodeWithTable(text, table))
+	}
+	return SMSLength(text, encoding)
+}
+
+// smsSegments returns the number of SMS segments a text of the passed in length, encoding and table will be billed as
+func smsSegments(length int, encoding SMSEncoding, table gsm7.Table) int {
+	if encoding == SMSEncodingUCS2 || table == gsm7.DefaultTable {
+		return SMSSegments(length, encoding)
+	}
+
+	single, segment := gsm7TableLengths(table)
+	if length <= single {
+		return 1
+	}
+	return (length + segment - 1) / segment
+}
+
+// gsm7TableLengths returns the number of characters that fit in a single SMS, and in each segment of a concatenated
+// SMS, sent with the passed in table. National language tables take up space with their UDH.
+func gsm7TableLengths(table gsm7.Table) (int, int) {
+	udh := len(table.UDH())
+	if udh == 0 {
+		return gsm7SingleLength, gsm7SegmentLength
+	}
+	return gsm7SingleLength - gsm7.UDHSeptets(table), gsm7SingleLength - (((concatUDHLength+udh)*8 + 6) / 7)
+}
+
+// smsPartLimit returns the max length of a part in the passed in encoding and table given a max length in GSM7
+// characters
+func smsPartLimit(max int, encoding SMSEncoding, table gsm7.Table) int {
+	if encoding == SMSEncodingGSM7 {
+		if table == gsm7.DefaultTable {
+			return max
+		}
+
+		// take the space of the table's UDH out of every segment
+		single, segment := gsm7TableLengths(table)
+		if max <= gsm7SingleLength {
+			return max - (gsm7SingleLength - single)
+		}
+		return max - SMSSegments(max, SMSEncodingGSM7)*(gsm7SegmentLength-segment)
+	}
+
+	// shorter than a single SMS, scale our limit down
+	if max <= gsm7SingleLength {
+		return max * ucs2SingleLength / gsm7SingleLength
+	}
+
+	return SMSSegments(max, SMSEncodingGSM7) * ucs2SegmentLength
+}
+
+func smsRuneLength(r rune, encoding SMSEncoding, table gsm7.Table) int {
+	if encoding == SMSEncodingGSM7 {
+		return len(gsm7.EncodeWithTable(string(r), table))
+	}
+	return ucs2RuneLength(r)
+}
+
+func ucs2RuneLength(r rune) int {
+	if r > 0xFFFF {
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/courier/gsm7"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSMSLength(t *testing.T) {
+	tcs := []struct {
+		text     string
+		encoding SMSEncoding
+		length   int
+		segments int
+	}{
+		{"", SMSEncodingGSM7, 0, 1},
+		{"hello", SMSEncodingGSM7, 5, 1},
+		{"price: 10€ [approx]", SMSEncodingGSM7, 22, 1},
+		{strings.Repeat("a", 160), SMSEncodingGSM7, 160, 1},
+		{strings.Repeat("a", 161), SMSEncodingGSM7, 161, 2},
+		{strings.Repeat("€", 80), SMSEncodingGSM7, 160, 1},
+		{strings.Repeat("a", 307), SMSEncodingGSM7, 307, 3},
+		{"привет", SMSEncodingUCS2, 6, 1},
+		{strings.Repeat("я", 70), SMSEncodingUCS2, 70, 1},
+		{strings.Repeat("я", 71), SMSEncodingUCS2, 71, 2},
+		{"hi 😀", SMSEncodingUCS2, 5, 1},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.encoding, SMSEncodingFor(tc.text), "encoding mismatch for: %s", tc.text)
+		length := SMSLength(tc.text, tc.encoding)
+		assert.Equal(t, tc.length, length, "length mismatch for: %s", tc.text)
+		assert.Equal(t, tc.segments, SMSSegments(length, tc.encoding), "segments mismatch for: %s", tc.text)
+	}
+}
+
+func TestSplitSMS(t *testing.T) {
+	tcs := []struct {
+		text      string
+		max       int
+		parts     []string
+		encodings []SMSEncoding
+		segments  int
+	}{
+		{"hello world", 160, []string{"hello world"}, []SMSEncoding{SMSEncodingGSM7}, 1},
+		{"This is a long message that should be split", 20, []string{"This is a long", "message that should", "be split"}, []SMSEncoding{SMSEncodingGSM7, SMSEncodingGSM7, SMSEncodingGSM7}, 3},
+
+		// extension characters count as two and are never split
+		{strings.Repeat("€", 81), 160, []string{strings.Repeat("€", 80), "€"}, []SMSEncoding{SMSEncodingGSM7, SMSEncodingGSM7}, 2},
+
+		// UCS2 text gets the same number of segments as our GSM7 max
+		{strings.Repeat("я", 71), 160, []string{strings.Repeat("я", 70), "я"}, []SMSEncoding{SMSEncodingUCS2, SMSEncodingUCS2}, 2},
+		{strings.Repeat("я", 300), 1600, []string{strings.Repeat("я", 300)}, []SMSEncoding{SMSEncodingUCS2}, 5},
+		{strings.Repeat("я", 800), 1600, []string{strings.Repeat("я", 737), strings.Repeat("я", 63)}, []SMSEncoding{SMSEncodingUCS2, SMSEncodingUCS2}, 12},
+
+		// parts which don't need UCS2 are sent as GSM7
+		{strings.Repeat("a", 70) + " я", 160, []string{strings.Repeat("a", 70), "я"}, []SMSEncoding{SMSEncodingGSM7, SMSEncodingUCS2}, 2},
+	}
+
+	for _, tc := range tcs {
+		parts := SplitSMS(tc.text, tc.max)
+
+		texts := make([]string, len(parts))
+		encodings := make([]SMSEncoding, len(parts))
+		for i := range parts {
+			texts[i] = parts[i].Text
+			encodings[i] = parts[i].Encoding
+		}
+
+		assert.Equal(t, tc.parts, texts, "parts mismatch for: %s", tc.text)
+		assert.Equal(t, tc.encodings, encodings, "encodings mismatch for: %s", tc.text)
+		assert.Equal(t, tc.segments, CountSMSSegments(parts), "segments mismatch for: %s", tc.text)
+	}
+}
+
+func TestSplitNationalSMS(t *testing.T) {
+	tcs := []struct {
+		text     string
+		max      int
+		parts    []string
+		tables   []gsm7.Table
+		segments int
+	}{
+		{"hello world", 160, []string{"hello world"}, []gsm7.Table{gsm7.DefaultTable}, 1},
+		{"Şişli'de ığdır", 160, []string{"Şişli'de ığdır"}, []gsm7.Table{{Locking: gsm7.Turkish, Shift: gsm7.Default}}, 1},
+
+		// the space taken up by the UDH of our table leaves less space for text
+		{strings.Repeat("ó", 156), 160, []string{strings.Repeat("ó", 155), "ó"}, []gsm7.Table{{Locking: gsm7.Portuguese, Shift: gsm7.Default}, {Locking: gsm7.Portuguese, Shift: gsm7.Default}}, 2},
+		{strings.Repeat("ğ", 300), 1600, []string{strings.Repeat("ğ", 300)}, []gsm7.Table{{Locking: gsm7.Turkish, Shift: gsm7.Default}}, 3},
+
+		// text no table can encode is still sent as UCS2
+		{"hi! ☺", 160, []string{"hi! ☺"}, []gsm7.Table{gsm7.DefaultTable}, 1},
+	}
+
+	for _, tc := range tcs {
+		parts := SplitNationalSMS(tc.text, tc.max)
+
+		texts := make([]string, len(parts))
+		tables := make([]gsm7.Table, len(parts))
+		for i := range parts {
+			texts[i] = parts[i].Text
+			tables[i] = parts[i].Table
+		}
+
+		assert.Equal(t, tc.parts, texts, "parts mismatch for: %s", tc.text)
+		assert.Equal(t, tc.tables, tables, "tables mismatch for: %s", tc.text)
+		assert.Equal(t, tc.segments, CountSMSSegments(parts), "segments mismatch for: %s", tc.text)
+	}
+
+	// without national tables the same text needs UCS2
+	parts := SplitSMS("Şişli'de ığdır", 160)
+	assert.Equal(t, SMSEncodingUCS2, parts[0].Encoding)
+	assert.Equal(t, SMSEncodingGSM7, SplitNationalSMS("Şişli'de ığdır", 160)[0].Encoding)
+}
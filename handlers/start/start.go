@@ -134,8 +134,9 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	}
 
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxMsgLength)
-	for i, part := range parts {
+	parts := handlers.SplitSMS(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
+	for _, part := range parts {
 
 		payload := mtPayload{
 			Service: mtService{
@@ -147,7 +148,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 			Body: mtBody{
 				ContentType: "plain/text",
 				Encoding:    "plain",
-				Text:        part,
+				Text:        part.Text,
 			},
 		}
 
@@ -161,7 +162,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		req, _ := http.NewRequest(http.MethodPost, sendURL, requestBody)
 		req.Header.Set("Content-Type", "application/xml; charset=utf8")
 		req.SetBasicAuth(username, password)
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr)
 		status.AddLog(log)
@@ -174,9 +175,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		err = xml.Unmarshal(rr.Body, response)
 		if err == nil {
 			status.SetStatus(courier.MsgWired)
-			if i == 0 {
-				status.SetExternalID(response.ID)
-			}
+			status.AddExternalID(response.ID)
 		}
 	}
 
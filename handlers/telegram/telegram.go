@@ -32,6 +32,13 @@ func newHandler() courier.ChannelHandler {
 	return &handler{handlers.NewBaseHandler(courier.ChannelType("TG"), "Telegram")}
 }
 
+// MediaConstraints returns the limits Telegram places on photos, at most 10MB and 10000 pixels of width plus height. We
+// can only limit each side, so we cap both at 5000 pixels which keeps any photo within that sum, at the cost of also
+// resizing some long photos Telegram would have taken as they were.
+func (h *handler) MediaConstraints(channel courier.Channel) courier.MediaConstraints {
+	return courier.MediaConstraints{MaxImageBytes: 10 * 1024 * 1024, MaxImageWidth: 5000, MaxImageHeight: 5000}
+}
+
 // Initialize is called by the engine once everything is loaded
 func (h *handler) Initialize(s courier.Server) error {
 	h.SetServer(s)
@@ -131,7 +138,59 @@ func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w
 	return handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
 }
 
-func (h *handler) sendMsgPart(msg courier.Msg, token string, path string, form url.Values, replies string) (string, *courier.ChannelLog, error) {
+// sendError is an error returned by the Telegram API when sending a message
+type sendError struct {
+	code        int64
+	description string
+	statusCode  int
+	retryAfter  int64
+}
+
+func (e *sendError) Error() string {
+	return "response not 'ok'"
+}
+
+// setStatusError records the category and code of the passed in error on our status if it came from the Telegram API
+func setStatusError(status courier.MsgStatus, err error) {
+	sendErr, isSendErr := err.(*sendError)
+	if !isSendErr {
+		return
+	}
+
+	description := strings.ToLower(sendErr.description)
+	category := courier.MsgErrorProvider
+
+	switch {
+	case sendErr.code == 403 && (strings.Contains(description, "blocked") || strings.Contains(description, "deactivated")):
+		category = courier.MsgErrorOptedOut
+	case sendErr.code == 400 && strings.Contains(description, "chat not found"):
+		category = courier.MsgErrorInvalidURN
+	case sendErr.code == 401:
+		category = courier.MsgErrorAuthFailure
+	case sendErr.code == 429:
+		category = courier.MsgErrorRateLimited
+	case sendErr.code == 0:
+		category = handlers.ErrorCategoryForHTTPStatus(sendErr.statusCode)
+	}
+
+	code := ""
+	if sendErr.code != 0 {
+		code = strconv.FormatInt(sendErr.code, 10)
+	}
+	status.SetError(category, code)
+}
+
+// rateLimitedError returns a rate limited error if the passed in error is Telegram telling us we are sending too fast
+// before any part of our msg was sent, so the whole msg can be retried later, otherwise nil
+func rateLimitedError(sentPart bool, err error) error {
+	sendErr, isSendErr := err.(*sendError)
+	if !isSendErr || sendErr.code != 429 || sentPart {
+		return nil
+	}
+	return &courier.RateLimitedError{RetryAfter: time.Duration(sendErr.retryAfter) * time.Second}
+}
+
+func (h *handler) sendMsgPart(ctx context.Context, msg courier.Msg, token string, path string, form url.Values, replies string) (string, *courier.ChannelLog, error) {
 	// either include or remove our keyboard depending on whether we have quick replies
 	if replies == "" {
 		form.Add("reply_markup", `{"remove_keyboard":true}`)
@@ -143,7 +202,7 @@ func (h *handler) sendMsgPart(msg courier.Msg, token string, path string, form u
 	req, _ := http.NewRequest(http.MethodPost, sendURL, strings.NewReader(form.Encode()))
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	rr, err := utils.MakeHTTPRequest(req)
+	rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 	// build our channel log
 	log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
@@ -151,7 +210,10 @@ func (h *handler) sendMsgPart(msg courier.Msg, token string, path string, form u
 	// was this request successful?
 	ok, err := jsonparser.GetBoolean([]byte(rr.Body), "ok")
 	if err != nil || !ok {
-		return "", log, errors.Errorf("response not 'ok'")
+		errorCode, _ := jsonparser.GetInt([]byte(rr.Body), "error_code")
+		description, _ := jsonparser.GetString([]byte(rr.Body), "description")
+		retryAfter, _ := jsonparser.GetInt([]byte(rr.Body), "parameters", "retry_after")
+		return "", log, &sendError{code: errorCode, description: description, statusCode: rr.StatusCode, retryAfter: retryAfter}
 	}
 
 	// grab our message id
@@ -180,8 +242,9 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	// the status that will be written for this message
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
 
-	// whether we encountered any errors sending any parts
+	// whether we encountered any errors sending any parts, and whether we sent any parts
 	hasError := true
+	sentPart := false
 
 	// figure out whether we have a keyboard to send as well
 	qrs := msg.QuickReplies()
@@ -208,10 +271,15 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 			"text":    []string{msg.Text()},
 		}
 
-		externalID, log, err := h.sendMsgPart(msg, authToken, "sendMessage", form, replies)
+		externalID, log, err := h.sendMsgPart(ctx, msg, authToken, "sendMessage", form, replies)
 		status.SetExternalID(externalID)
 		hasError = err != nil
 		status.AddLog(log)
+		setStatusError(status, err)
+		if rateLimitErr := rateLimitedError(sentPart, err); rateLimitErr != nil {
+			return status, rateLimitErr
+		}
+		sentPart = err == nil
 
 		// clear our replies, they've been sent
 		replies = ""
@@ -227,10 +295,15 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 				"photo":   []string{mediaURL},
 				"caption": []string{caption},
 			}
-			externalID, log, err := h.sendMsgPart(msg, authToken, "sendPhoto", form, replies)
+			externalID, log, err := h.sendMsgPart(ctx, msg, authToken, "sendPhoto", form, replies)
 			status.SetExternalID(externalID)
 			hasError = err != nil
 			status.AddLog(log)
+			setStatusError(status, err)
+			if rateLimitErr := rateLimitedError(sentPart, err); rateLimitErr != nil {
+				return status, rateLimitErr
+			}
+			sentPart = sentPart || err == nil
 
 		case "video":
 			form := url.Values{
@@ -238,10 +311,15 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 				"video":   []string{mediaURL},
 				"caption": []string{caption},
 			}
-			externalID, log, err := h.sendMsgPart(msg, authToken, "sendVideo", form, replies)
+			externalID, log, err := h.sendMsgPart(ctx, msg, authToken, "sendVideo", form, replies)
 			status.SetExternalID(externalID)
 			hasError = err != nil
 			status.AddLog(log)
+			setStatusError(status, err)
+			if rateLimitErr := rateLimitedError(sentPart, err); rateLimitErr != nil {
+				return status, rateLimitErr
+			}
+			sentPart = sentPart || err == nil
 
 		case "audio":
 			form := url.Values{
@@ -249,10 +327,15 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 				"audio":   []string{mediaURL},
 				"caption": []string{caption},
 			}
-			externalID, log, err := h.sendMsgPart(msg, authToken, "sendAudio", form, replies)
+			externalID, log, err := h.sendMsgPart(ctx, msg, authToken, "sendAudio", form, replies)
 			status.SetExternalID(externalID)
 			hasError = err != nil
 			status.AddLog(log)
+			setStatusError(status, err)
+			if rateLimitErr := rateLimitedError(sentPart, err); rateLimitErr != nil {
+				return status, rateLimitErr
+			}
+			sentPart = sentPart || err == nil
 
 		default:
 			status.AddLog(courier.NewChannelLog("Unknown media type: "+mediaType, msg.Channel(), msg.ID(), "", "", courier.NilStatusCode,
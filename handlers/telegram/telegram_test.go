@@ -594,8 +594,34 @@ var defaultSendTestCases = []ChannelSendTestCase{
 		Text: "Error", URN: "telegram:12345",
 		Status:       "E",
 		ResponseBody: `{ "ok": false }`, ResponseStatus: 403,
-		PostParams: map[string]string{"text": `Error`, "chat_id": "12345"},
-		SendPrep:   setSendURL},
+		PostParams:    map[string]string{"text": `Error`, "chat_id": "12345"},
+		ErrorCategory: courier.MsgErrorAuthFailure,
+		SendPrep:      setSendURL},
+	{Label: "Blocked By User",
+		Text: "Error", URN: "telegram:12345",
+		Status:       "E",
+		ResponseBody: `{ "ok": false, "error_code": 403, "description": "Forbidden: bot was blocked by the user" }`, ResponseStatus: 403,
+		PostParams:    map[string]string{"text": `Error`, "chat_id": "12345"},
+		ErrorCategory: courier.MsgErrorOptedOut,
+		ErrorCode:     "403",
+		SendPrep:      setSendURL},
+	{Label: "Chat Not Found",
+		Text: "Error", URN: "telegram:12345",
+		Status:       "E",
+		ResponseBody: `{ "ok": false, "error_code": 400, "description": "Bad Request: chat not found" }`, ResponseStatus: 400,
+		PostParams:    map[string]string{"text": `Error`, "chat_id": "12345"},
+		ErrorCategory: courier.MsgErrorInvalidURN,
+		ErrorCode:     "400",
+		SendPrep:      setSendURL},
+	{Label: "Rate Limited",
+		Text: "Error", URN: "telegram:12345",
+		Status:       "E",
+		ResponseBody: `{ "ok": false, "error_code": 429, "description": "Too Many Requests: retry after 5", "parameters": { "retry_after": 5 } }`, ResponseStatus: 429,
+		PostParams:    map[string]string{"text": `Error`, "chat_id": "12345"},
+		Error:         "rate limited by provider, retry after 5s",
+		ErrorCategory: courier.MsgErrorRateLimited,
+		ErrorCode:     "429",
+		SendPrep:      setSendURL},
 	{Label: "Send Photo",
 		Text: "My pic!", URN: "telegram:12345", Attachments: []string{"image/jpeg:https://foo.bar/image.jpg"},
 		Status:       "W",
@@ -40,7 +40,8 @@ type ChannelHandleTestCase struct {
 	Attachments []string
 	Date        *time.Time
 
-	MsgStatus *string
+	MsgStatus     *string
+	ReadWatermark *time.Time
 
 	ChannelEvent      *string
 	ChannelEventExtra map[string]interface{}
@@ -93,6 +94,10 @@ type ChannelSendTestCase struct {
 	Error      string
 	Status     string
 	ExternalID string
+	MsgCount   int
+
+	ErrorCategory courier.MsgErrorCategory
+	ErrorCode     string
 
 	Stopped bool
 
@@ -187,7 +192,7 @@ func RunChannelSendTestCases(t *testing.T, channel courier.Channel, handler cour
 		t.Run(testCase.Label, func(t *testing.T) {
 			require := require.New(t)
 
-			msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN(testCase.URN), testCase.Text, testCase.HighPriority, testCase.QuickReplies, testCase.ResponseToID, testCase.ResponseToExternalID)
+			msg := mb.NewTestOutgoingMsg(channel, courier.NewMsgID(10), urns.URN(testCase.URN), testCase.Text, testCase.HighPriority, testCase.QuickReplies, testCase.ResponseToID, testCase.ResponseToExternalID)
 
 			for _, a := range testCase.Attachments {
 				msg.WithAttachment(a)
@@ -281,6 +286,15 @@ func RunChannelSendTestCases(t *testing.T, channel courier.Channel, handler cour
 				require.Equal(testCase.Status, string(status.Status()))
 			}
 
+			if testCase.MsgCount != 0 {
+				require.Equal(testCase.MsgCount, status.MsgCount())
+			}
+
+			if testCase.ErrorCategory != courier.NilMsgErrorCategory {
+				require.Equal(testCase.ErrorCategory, status.ErrorCategory())
+				require.Equal(testCase.ErrorCode, status.ErrorCode())
+			}
+
 			if testCase.Stopped {
 				require.Equal(msg, mb.GetLastStoppedMsgContact())
 			}
@@ -355,6 +369,10 @@ func RunChannelTestCases(t *testing.T, channels []courier.Channel, handler couri
 					require.NotNil(status)
 					require.Equal(*testCase.MsgStatus, string(status.Status()))
 				}
+				if testCase.ReadWatermark != nil {
+					require.NotNil(testCase.URN)
+					require.Equal(*testCase.ReadWatermark, mb.GetReadWatermark(urns.URN(*testCase.URN)))
+				}
 				if testCase.ID != 0 {
 					if status != nil {
 						require.Equal(testCase.ID, status.ID().Int64)
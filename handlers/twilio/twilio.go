@@ -44,6 +44,19 @@ var (
 // error code twilio returns when a contact has sent "stop"
 const errorStopped = 21610
 
+// the error codes twilio returns which we can categorize, see https://www.twilio.com/docs/api/errors
+var errorCategories = map[int64]courier.MsgErrorCategory{
+	14107:        courier.MsgErrorRateLimited,
+	20003:        courier.MsgErrorAuthFailure,
+	20429:        courier.MsgErrorRateLimited,
+	21211:        courier.MsgErrorInvalidURN,
+	21612:        courier.MsgErrorInvalidURN,
+	21614:        courier.MsgErrorInvalidURN,
+	21617:        courier.MsgErrorContentRejected,
+	30007:        courier.MsgErrorContentRejected,
+	errorStopped: courier.MsgErrorOptedOut,
+}
+
 type handler struct {
 	handlers.BaseHandler
 	ignoreDeliveryReports bool
@@ -59,6 +72,11 @@ func init() {
 	courier.RegisterHandler(newHandler("TW", "TwiML API"))
 }
 
+// MediaConstraints returns the limits on images we send as MMS, many carriers reject anything larger
+func (h *handler) MediaConstraints(channel courier.Channel) courier.MediaConstraints {
+	return courier.MediaConstraints{MaxImageBytes: 500 * 1024}
+}
+
 // Initialize is called by the engine once everything is loaded
 func (h *handler) Initialize(s courier.Server) error {
 	h.SetServer(s)
@@ -172,6 +190,8 @@ func (h *handler) receiveStatus(ctx context.Context, channel courier.Channel, w
 	if status == nil {
 		status = h.Backend().NewMsgStatusForExternalID(channel, form.MessageSID, msgStatus)
 	}
+	status.SetRawStatus(form.MessageStatus)
+
 	return handlers.WriteMsgStatusAndResponse(ctx, h, channel, status, w, r)
 }
 
@@ -192,12 +212,13 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	}
 
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(msg.Text(), maxMsgLength)
+	parts := handlers.SplitSMS(msg.Text(), maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
 	for i, part := range parts {
 		// build our request
 		form := url.Values{
 			"To":             []string{msg.URN().Path()},
-			"Body":           []string{part},
+			"Body":           []string{part.Text},
 			"StatusCallback": []string{callbackURL},
 		}
 
@@ -225,7 +246,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		req.SetBasicAuth(accountSID, accountToken)
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		req.Header.Set("Accept", "application/json")
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 		// record our status and log
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
@@ -235,6 +256,12 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		if err != nil && rr.Body != nil {
 			errorCode, _ := jsonparser.GetInt([]byte(rr.Body), "code")
 			if errorCode != 0 {
+				category, found := errorCategories[errorCode]
+				if !found {
+					category = handlers.ErrorCategoryForHTTPStatus(rr.StatusCode)
+				}
+				status.SetError(category, strconv.FormatInt(errorCode, 10))
+
 				if errorCode == errorStopped {
 					status.SetStatus(courier.MsgFailed)
 					h.Backend().StopMsgContact(ctx, msg)
@@ -246,6 +273,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 
 		// fail if we received an error
 		if err != nil {
+			status.SetError(handlers.ErrorCategoryForHTTPStatus(rr.StatusCode), "")
 			return status, nil
 		}
 
@@ -258,10 +286,8 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 
 		status.SetStatus(courier.MsgWired)
 
-		// only save the first external id
-		if i == 0 {
-			status.SetExternalID(externalID)
-		}
+		// record the external id of each part we send
+		status.AddExternalID(externalID)
 	}
 
 	return status, nil
@@ -202,7 +202,7 @@ var defaultSendTestCases = []ChannelSendTestCase{
 	{Label: "Long Send",
 		Text:   "This is a longer message than 160 characters and will cause us to split it into two separate parts, isn't that right but it is even longer than before I say, I need to keep adding more things to make it work",
 		URN:    "tel:+250788383383",
-		Status: "W", ExternalID: "1002",
+		Status: "W", ExternalID: "1002", MsgCount: 2,
 		ResponseBody: `{ "sid": "1002" }`, ResponseStatus: 200,
 		PostParams: map[string]string{"Body": "I need to keep adding more things to make it work", "To": "+250788383383", "From": "2020", "StatusCallback": "https://localhost/c/t/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/status?id=10&action=callback"},
 		Path:       "/Account/accountSID/Messages.json",
@@ -212,8 +212,9 @@ var defaultSendTestCases = []ChannelSendTestCase{
 		Text: "Error Message", URN: "tel:+250788383383",
 		Status:       "E",
 		ResponseBody: `{ "error": "out of credits" }`, ResponseStatus: 401,
-		PostParams: map[string]string{"Body": "Error Message", "To": "+250788383383", "From": "2020", "StatusCallback": "https://localhost/c/t/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/status?id=10&action=callback"},
-		SendPrep:   setSendURL},
+		ErrorCategory: courier.MsgErrorAuthFailure,
+		PostParams:    map[string]string{"Body": "Error Message", "To": "+250788383383", "From": "2020", "StatusCallback": "https://localhost/c/t/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/status?id=10&action=callback"},
+		SendPrep:      setSendURL},
 	{Label: "Error Code",
 		Text: "Error Code", URN: "tel:+250788383383",
 		Status:       "E",
@@ -224,6 +225,7 @@ var defaultSendTestCases = []ChannelSendTestCase{
 		Text: "Stopped Contact", URN: "tel:+250788383383",
 		Status:       "F",
 		ResponseBody: `{ "code": 21610 }`, ResponseStatus: 400,
+		ErrorCategory: courier.MsgErrorOptedOut, ErrorCode: "21610",
 		PostParams: map[string]string{"Body": "Stopped Contact", "To": "+250788383383", "From": "2020", "StatusCallback": "https://localhost/c/t/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/status?id=10&action=callback"},
 		SendPrep:   setSendURL,
 		Stopped:    true},
@@ -263,8 +265,9 @@ var tmsDefaultSendTestCases = []ChannelSendTestCase{
 		Text: "Error Message", URN: "tel:+250788383383",
 		Status:       "E",
 		ResponseBody: `{ "error": "out of credits" }`, ResponseStatus: 401,
-		PostParams: map[string]string{"Body": "Error Message", "To": "+250788383383", "MessagingServiceSid": "messageServiceSID", "StatusCallback": "https://localhost/c/tms/8eb23e93-5ecb-45ba-b726-3b064e0c56cd/status?id=10&action=callback"},
-		SendPrep:   setSendURL},
+		ErrorCategory: courier.MsgErrorAuthFailure,
+		PostParams:    map[string]string{"Body": "Error Message", "To": "+250788383383", "MessagingServiceSid": "messageServiceSID", "StatusCallback": "https://localhost/c/tms/8eb23e93-5ecb-45ba-b726-3b064e0c56cd/status?id=10&action=callback"},
+		SendPrep:      setSendURL},
 	{Label: "Error Code",
 		Text: "Error Code", URN: "tel:+250788383383",
 		Status:       "E",
@@ -275,6 +278,7 @@ var tmsDefaultSendTestCases = []ChannelSendTestCase{
 		Text: "Stopped Contact", URN: "tel:+250788383383",
 		Status:       "F",
 		ResponseBody: `{ "code": 21610 }`, ResponseStatus: 400,
+		ErrorCategory: courier.MsgErrorOptedOut, ErrorCode: "21610",
 		PostParams: map[string]string{"Body": "Stopped Contact", "To": "+250788383383", "MessagingServiceSid": "messageServiceSID", "StatusCallback": "https://localhost/c/tms/8eb23e93-5ecb-45ba-b726-3b064e0c56cd/status?id=10&action=callback"},
 		SendPrep:   setSendURL,
 		Stopped:    true},
@@ -314,8 +318,9 @@ var twDefaultSendTestCases = []ChannelSendTestCase{
 		Text: "Error Message", URN: "tel:+250788383383",
 		Status:       "E",
 		ResponseBody: `{ "error": "out of credits" }`, ResponseStatus: 401,
-		PostParams: map[string]string{"Body": "Error Message", "To": "+250788383383", "From": "2020", "StatusCallback": "https://localhost/c/tw/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/status?id=10&action=callback"},
-		SendPrep:   setSendURL},
+		ErrorCategory: courier.MsgErrorAuthFailure,
+		PostParams:    map[string]string{"Body": "Error Message", "To": "+250788383383", "From": "2020", "StatusCallback": "https://localhost/c/tw/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/status?id=10&action=callback"},
+		SendPrep:      setSendURL},
 	{Label: "Error Code",
 		Text: "Error Code", URN: "tel:+250788383383",
 		Status:       "E",
@@ -326,6 +331,7 @@ var twDefaultSendTestCases = []ChannelSendTestCase{
 		Text: "Stopped Contact", URN: "tel:+250788383383",
 		Status:       "F",
 		ResponseBody: `{ "code": 21610 }`, ResponseStatus: 400,
+		ErrorCategory: courier.MsgErrorOptedOut, ErrorCode: "21610",
 		PostParams: map[string]string{"Body": "Stopped Contact", "To": "+250788383383", "From": "2020", "StatusCallback": "https://localhost/c/tw/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/status?id=10&action=callback"},
 		SendPrep:   setSendURL,
 		Stopped:    true},
@@ -40,6 +40,11 @@ func newHandler() courier.ChannelHandler {
 	return &handler{handlers.NewBaseHandler(courier.ChannelType("VP"), "Viber")}
 }
 
+// MediaConstraints returns the limits Viber places on pictures
+func (h *handler) MediaConstraints(channel courier.Channel) courier.MediaConstraints {
+	return courier.MediaConstraints{MaxImageBytes: 1024 * 1024}
+}
+
 // Initialize is called by the engine once everything is loaded
 func (h *handler) Initialize(s courier.Server) error {
 	h.SetServer(s)
@@ -145,6 +150,10 @@ func (h *handler) receiveEvent(ctx context.Context, channel courier.Channel, w h
 		err = h.Backend().WriteMsgStatus(ctx, msgStatus)
 		return handlers.WriteMsgStatusAndResponse(ctx, h, channel, msgStatus, w, r)
 
+	case "seen":
+		msgStatus := h.Backend().NewMsgStatusForExternalID(channel, fmt.Sprintf("%d", payload.MessageToken), courier.MsgRead)
+		return handlers.WriteMsgStatusAndResponse(ctx, h, channel, msgStatus, w, r)
+
 	case "message":
 		sender := payload.Sender.ID
 		if sender == "" {
@@ -312,7 +321,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 				if err != nil {
 					return nil, err
 				}
-				rr, err := utils.MakeHTTPRequest(req)
+				rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 				if err != nil {
 					return nil, err
 				}
@@ -326,7 +335,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 				if err != nil {
 					return nil, err
 				}
-				rr, err := utils.MakeHTTPRequest(req)
+				rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 				if err != nil {
 					return nil, err
 				}
@@ -365,7 +374,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		req, _ := http.NewRequest(http.MethodPost, sendURL, requestBody)
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("Accept", "application/json")
-		rr, err := utils.MakeHTTPRequest(req)
+		rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 		// record log
 		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
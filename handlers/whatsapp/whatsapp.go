@@ -17,8 +17,12 @@ import (
 	"github.com/nyaruka/courier/utils"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
+// WhatsApp only keeps uploaded media around for 30 days, we reuse media ids for a bit less than that
+const mediaIDExpiry = time.Hour * 24 * 25
+
 func init() {
 	courier.RegisterHandler(newHandler())
 }
@@ -183,13 +187,17 @@ func (h *handler) receiveEvent(ctx context.Context, channel courier.Channel, w h
 			event.WithAttachment(mediaURL)
 		}
 
-		err = h.Backend().WriteMsg(ctx, event)
+		written, err := handlers.WriteMsg(ctx, h, event)
 		if err != nil {
 			return nil, err
 		}
 
-		events = append(events, event)
-		data = append(data, courier.NewMsgReceiveData(event))
+		events = append(events, written)
+		if stop, isStop := written.(courier.ChannelEvent); isStop {
+			data = append(data, courier.NewEventReceiveData(stop))
+		} else {
+			data = append(data, courier.NewMsgReceiveData(event))
+		}
 	}
 
 	// now with any status updates
@@ -200,6 +208,7 @@ func (h *handler) receiveEvent(ctx context.Context, channel courier.Channel, w h
 		}
 
 		event := h.Backend().NewMsgStatusForExternalID(channel, status.ID, msgStatus)
+		event.SetRawStatus(status.Status)
 		err := h.Backend().WriteMsgStatus(ctx, event)
 
 		// we don't know about this message, just tell them we ignored it
@@ -252,7 +261,7 @@ var waStatusMapping = map[string]courier.MsgStatusValue{
 	"sending":   courier.MsgWired,
 	"sent":      courier.MsgSent,
 	"delivered": courier.MsgDelivered,
-	"read":      courier.MsgDelivered,
+	"read":      courier.MsgRead,
 	"failed":    courier.MsgFailed,
 }
 
@@ -313,6 +322,19 @@ type mtImagePayload struct {
 // whatsapp only allows messages up to 4096 chars
 const maxMsgLength = 4096
 
+// whatsapp only accepts attachments up to 64MB
+const maxAttachmentSize = 64 * 1024 * 1024
+
+// MaxMediaSize returns the largest media we will transfer for WhatsApp channels
+func (h *handler) MaxMediaSize() int64 {
+	return maxAttachmentSize
+}
+
+// MediaConstraints returns the limits WhatsApp places on images
+func (h *handler) MediaConstraints(channel courier.Channel) courier.MediaConstraints {
+	return courier.MediaConstraints{MaxImageBytes: 5 * 1024 * 1024}
+}
+
 // SendMsg sends the passed in message, returning any error
 func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
 	start := time.Now()
@@ -336,89 +358,95 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
 
 	if len(msg.Attachments()) > 0 {
+		maxMediaSize := courier.MaxMediaSize(h.Server().Config(), msg.Channel())
 		for attachmentCount, attachment := range msg.Attachments() {
 
 			mimeType, s3url := handlers.SplitAttachment(attachment)
-			mediaID, err := uploadMediaToWhatsApp(mediaURL, token, mimeType, s3url)
+
+			// reuse any media id we already have for this attachment, otherwise upload it
+			mediaID, err := handlers.GetCachedMediaID(h.Backend(), msg.Channel(), s3url)
 			if err != nil {
-				duration := time.Now().Sub(start)
-				log := courier.NewChannelLogFromError("Unable to upload media to WhatsApp server", msg.Channel(), msg.ID(), duration, err)
-				status.AddLog(log)
-				return status, err
+				logrus.WithField("channel_uuid", msg.Channel().UUID().String()).WithError(err).Error("error looking up cached media id")
 			}
+			cachedMediaID := mediaID != ""
 
-			externalID := ""
-			if strings.HasPrefix(mimeType, "audio") {
-				payload := mtAudioPayload{
-					To:   msg.URN().Path(),
-					Type: "audio",
+			if !cachedMediaID {
+				mediaID, err = uploadMediaToWhatsApp(ctx, msg, status, mediaURL, token, mimeType, s3url, maxMediaSize)
+				if err != nil {
+					return status, err
 				}
-				payload.Audio = &mediaObject{ID: mediaID}
-				externalID, err = sendWhatsAppMsg(sendURL, token, payload)
 
-			} else if strings.HasPrefix(mimeType, "application") {
-				payload := mtDocumentPayload{
-					To:   msg.URN().Path(),
-					Type: "document",
+				err = handlers.SetCachedMediaID(h.Backend(), msg.Channel(), s3url, mediaID, mediaIDExpiry)
+				if err != nil {
+					logrus.WithField("channel_uuid", msg.Channel().UUID().String()).WithError(err).Error("error caching media id")
 				}
+			}
 
-				if attachmentCount == 0 {
-					payload.Document = &captionedMediaObject{ID: mediaID, Caption: msg.Text()}
-				} else {
-					payload.Document = &captionedMediaObject{ID: mediaID}
-				}
-				externalID, err = sendWhatsAppMsg(sendURL, token, payload)
+			externalID, err := sendWhatsAppMedia(ctx, msg, sendURL, token, mimeType, mediaID, attachmentCount == 0)
 
-			} else if strings.HasPrefix(mimeType, "image") {
-				payload := mtImagePayload{
-					To:   msg.URN().Path(),
-					Type: "image",
+			// WhatsApp may have expired our cached media id, in which case upload our media again and retry once
+			if err != nil && cachedMediaID && isInvalidMediaError(err) {
+				status.AddLog(courier.NewChannelLogFromError("Cached Media Error", msg.Channel(), msg.ID(), time.Now().Sub(start), err))
+				handlers.ClearCachedMediaID(h.Backend(), msg.Channel(), s3url)
+				cachedMediaID = false
+
+				mediaID, err = uploadMediaToWhatsApp(ctx, msg, status, mediaURL, token, mimeType, s3url, maxMediaSize)
+				if err != nil {
+					return status, err
 				}
-				if attachmentCount == 0 {
-					payload.Image = &captionedMediaObject{ID: mediaID, Caption: msg.Text()}
-				} else {
-					payload.Image = &captionedMediaObject{ID: mediaID}
+
+				err = handlers.SetCachedMediaID(h.Backend(), msg.Channel(), s3url, mediaID, mediaIDExpiry)
+				if err != nil {
+					logrus.WithField("channel_uuid", msg.Channel().UUID().String()).WithError(err).Error("error caching media id")
 				}
-				externalID, err = sendWhatsAppMsg(sendURL, token, payload)
 
-			} else {
-				err = fmt.Errorf("unknown attachment mime type: %s", mimeType)
+				externalID, err = sendWhatsAppMedia(ctx, msg, sendURL, token, mimeType, mediaID, attachmentCount == 0)
 			}
 
 			if err != nil {
+				// our cached media id may no longer be valid, make sure we upload again next time
+				if cachedMediaID {
+					handlers.ClearCachedMediaID(h.Backend(), msg.Channel(), s3url)
+				}
+
 				// record our status and log
 				duration := time.Now().Sub(start)
 				log := courier.NewChannelLogFromError("Error sending message", msg.Channel(), msg.ID(), duration, err)
 				status.AddLog(log)
+				setStatusError(status, err)
+				if rateLimitErr := rateLimitedError(status, err); rateLimitErr != nil {
+					return status, rateLimitErr
+				}
 				return status, err
 			}
 
-			status.SetExternalID(externalID)
-
+			status.AddExternalID(externalID)
 		}
 
 	} else {
 		parts := handlers.SplitMsg(msg.Text(), maxMsgLength)
-		for i, part := range parts {
+		for _, part := range parts {
 			payload := mtTextPayload{
 				To:   msg.URN().Path(),
 				Type: "text",
 			}
 			payload.Text.Body = part
 
-			externalID, err := sendWhatsAppMsg(sendURL, token, payload)
+			externalID, err := sendWhatsAppMsg(ctx, sendURL, token, payload)
 			if err != nil {
 				// record our status and log
 				duration := time.Now().Sub(start)
 				log := courier.NewChannelLogFromError("Error sending message", msg.Channel(), msg.ID(), duration, err)
 				status.AddLog(log)
+				setStatusError(status, err)
+				if rateLimitErr := rateLimitedError(status, err); rateLimitErr != nil {
+					return status, rateLimitErr
+				}
 				return status, err
 			}
 
-			// if this is our first message, record the external id
-			if i == 0 {
-				status.SetExternalID(externalID)
-			}
+			// record the external id of each part we send
+			status.AddExternalID(externalID)
 		}
 
 	}
@@ -427,21 +455,64 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	return status, nil
 }
 
-func uploadMediaToWhatsApp(url string, token string, attachmentMimeType string, attachmentURL string) (string, error) {
+// sendWhatsAppMedia sends the media with the passed in id to the URN of the passed in msg, captioned with its text if
+// it is the first attachment of the msg
+func sendWhatsAppMedia(ctx context.Context, msg courier.Msg, sendURL string, token string, mimeType string, mediaID string, caption bool) (string, error) {
+	if strings.HasPrefix(mimeType, "audio") {
+		payload := mtAudioPayload{
+			To:   msg.URN().Path(),
+			Type: "audio",
+		}
+		payload.Audio = &mediaObject{ID: mediaID}
+		return sendWhatsAppMsg(ctx, sendURL, token, payload)
+
+	} else if strings.HasPrefix(mimeType, "application") {
+		payload := mtDocumentPayload{
+			To:   msg.URN().Path(),
+			Type: "document",
+		}
+
+		if caption {
+			payload.Document = &captionedMediaObject{ID: mediaID, Caption: msg.Text()}
+		} else {
+			payload.Document = &captionedMediaObject{ID: mediaID}
+		}
+		return sendWhatsAppMsg(ctx, sendURL, token, payload)
 
-	// retrieve the media to be sent from S3
+	} else if strings.HasPrefix(mimeType, "image") {
+		payload := mtImagePayload{
+			To:   msg.URN().Path(),
+			Type: "image",
+		}
+		if caption {
+			payload.Image = &captionedMediaObject{ID: mediaID, Caption: msg.Text()}
+		} else {
+			payload.Image = &captionedMediaObject{ID: mediaID}
+		}
+		return sendWhatsAppMsg(ctx, sendURL, token, payload)
+	}
+
+	return "", fmt.Errorf("unknown attachment mime type: %s", mimeType)
+}
+
+func uploadMediaToWhatsApp(ctx context.Context, msg courier.Msg, status courier.MsgStatus, url string, token string, attachmentMimeType string, attachmentURL string, maxSize int64) (string, error) {
+	// open a stream to the media to be sent from S3
 	req, _ := http.NewRequest(http.MethodGet, attachmentURL, nil)
-	s3rr, err := utils.MakeHTTPRequest(req)
+	s3rr, stream, err := utils.OpenMediaStream(req.WithContext(ctx), maxSize)
+	status.AddLog(courier.NewChannelLogFromRR("Media Fetched", msg.Channel(), msg.ID(), s3rr).WithError("Media Fetch Error", err))
 	if err != nil {
 		return "", err
 	}
+	defer stream.Close()
 
-	// upload it to WhatsApp in exchange for a media id
-	waReq, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(s3rr.Body))
+	// and pipe it to WhatsApp in exchange for a media id
+	waReq, _ := http.NewRequest(http.MethodPost, url, stream)
+	waReq.ContentLength = stream.ContentLength
 	waReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	waReq.Header.Set("Content-Type", attachmentMimeType)
 	waReq.Header.Set("User-Agent", utils.HTTPUserAgent)
-	wArr, err := utils.MakeHTTPRequest(waReq)
+	wArr, err := utils.MakeHTTPRequestWithMediaBody(waReq.WithContext(ctx))
+	status.AddLog(courier.NewChannelLogFromRR("Media Uploaded", msg.Channel(), msg.ID(), wArr).WithError("Media Upload Error", err))
 	if err != nil {
 		return "", err
 	}
@@ -454,7 +525,69 @@ func uploadMediaToWhatsApp(url string, token string, attachmentMimeType string,
 	return mediaID, nil
 }
 
-func sendWhatsAppMsg(url string, token string, payload interface{}) (string, error) {
+// the error codes WhatsApp returns which we can categorize
+var errorCategories = map[int64]courier.MsgErrorCategory{
+	470:  courier.MsgErrorContentRejected,
+	1005: courier.MsgErrorAuthFailure,
+	1013: courier.MsgErrorInvalidURN,
+	1015: courier.MsgErrorRateLimited,
+	1026: courier.MsgErrorInvalidURN,
+}
+
+// the error code WhatsApp returns when a media id doesn't exist, e.g. because the media expired
+const errorCodeResourceNotFound = 1006
+
+// isInvalidMediaError returns whether the passed in error is WhatsApp telling us the media id we sent doesn't exist
+func isInvalidMediaError(err error) bool {
+	sendErr, isSendErr := err.(*sendError)
+	return isSendErr && (sendErr.code == errorCodeResourceNotFound || sendErr.statusCode == http.StatusNotFound)
+}
+
+// sendError is an error returned by the WhatsApp API when sending a message
+type sendError struct {
+	code       int64
+	title      string
+	statusCode int
+	retryAfter time.Duration
+}
+
+func (e *sendError) Error() string {
+	return fmt.Sprintf("received error from send endpoint: %s", e.title)
+}
+
+// setStatusError records the category and code of the passed in error on our status if it came from the WhatsApp API
+func setStatusError(status courier.MsgStatus, err error) {
+	sendErr, isSendErr := err.(*sendError)
+	if !isSendErr {
+		return
+	}
+
+	category, found := errorCategories[sendErr.code]
+	if !found {
+		category = handlers.ErrorCategoryForHTTPStatus(sendErr.statusCode)
+	}
+
+	code := ""
+	if sendErr.code != 0 {
+		code = strconv.FormatInt(sendErr.code, 10)
+	}
+	status.SetError(category, code)
+}
+
+// rateLimitedError returns a rate limited error if the passed in error is WhatsApp telling us we are sending too fast
+// before any part of our msg was sent, so the whole msg can be retried later, otherwise nil
+func rateLimitedError(status courier.MsgStatus, err error) error {
+	sendErr, isSendErr := err.(*sendError)
+	if !isSendErr || len(status.ExternalIDs()) > 0 {
+		return nil
+	}
+	if errorCategories[sendErr.code] != courier.MsgErrorRateLimited && sendErr.statusCode != http.StatusTooManyRequests {
+		return nil
+	}
+	return &courier.RateLimitedError{RetryAfter: sendErr.retryAfter}
+}
+
+func sendWhatsAppMsg(ctx context.Context, url string, token string, payload interface{}) (string, error) {
 
 	jsonBody, err := json.Marshal(payload)
 	if err != nil {
@@ -466,12 +599,12 @@ func sendWhatsAppMsg(url string, token string, payload interface{}) (string, err
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	req.Header.Set("User-Agent", utils.HTTPUserAgent)
-	rr, err := utils.MakeHTTPRequest(req)
+	rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 
 	errorTitle, err := jsonparser.GetString(rr.Body, "errors", "[0]", "title")
 	if errorTitle != "" {
-		err = errors.Errorf("received error from send endpoint: %s", errorTitle)
-		return "", err
+		errorCode, _ := jsonparser.GetInt(rr.Body, "errors", "[0]", "code")
+		return "", &sendError{code: errorCode, title: errorTitle, statusCode: rr.StatusCode, retryAfter: rr.RetryAfter}
 	}
 
 	// grab the id
@@ -174,6 +174,17 @@ var validStatus = `
 }
 `
 
+var readStatus = `
+{
+  "statuses": [{
+    "id": "9712A34B4A8B6AD50F",
+    "recipient_id": "16315555555",
+    "status": "read",
+    "timestamp": "1518694700"
+  }]
+}
+`
+
 var invalidStatus = `
 {
   "statuses": [{
@@ -205,6 +216,8 @@ var testCases = []ChannelHandleTestCase{
 
 	{Label: "Receive Valid Status", URL: "/c/wa/8eb23e93-5ecb-45ba-b726-3b064e0c568c/receive", Data: validStatus, Status: 200, Response: `"type":"status"`,
 		MsgStatus: Sp("S"), ExternalID: Sp("9712A34B4A8B6AD50F")},
+	{Label: "Receive Read Status", URL: "/c/wa/8eb23e93-5ecb-45ba-b726-3b064e0c568c/receive", Data: readStatus, Status: 200, Response: `"type":"status"`,
+		MsgStatus: Sp("R"), ExternalID: Sp("9712A34B4A8B6AD50F")},
 	{Label: "Receive Invalid JSON", URL: "/c/wa/8eb23e93-5ecb-45ba-b726-3b064e0c568c/receive", Data: "not json", Status: 400, Response: "unable to parse"},
 	{Label: "Receive Invalid Status", URL: "/c/wa/8eb23e93-5ecb-45ba-b726-3b064e0c568c/receive", Data: invalidStatus, Status: 400, Response: `"invalid status: in_orbit"`},
 }
@@ -222,6 +235,20 @@ func TestHandler(t *testing.T) {
 	RunChannelTestCases(t, testChannels, newHandler(), testCases)
 }
 
+func TestOptOut(t *testing.T) {
+	optOutChannels := []courier.Channel{
+		courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c568c", "WA", "250788383383", "RW",
+			map[string]interface{}{"auth_token": "the-auth-token", "base_url": "https://foo.bar/", courier.ConfigOptOutLanguages: "eng"}),
+	}
+
+	RunChannelTestCases(t, optOutChannels, newHandler(), []ChannelHandleTestCase{
+		{Label: "Receive Valid Message", URL: "/c/wa/8eb23e93-5ecb-45ba-b726-3b064e0c568c/receive", Data: helloMsg, Status: 200, Response: `"type":"msg"`,
+			Text: Sp("hello world"), URN: Sp("whatsapp:250788123123")},
+		{Label: "Receive Opt Out", URL: "/c/wa/8eb23e93-5ecb-45ba-b726-3b064e0c568c/receive", Data: strings.Replace(helloMsg, "hello world", "STOP", 1),
+			Status: 200, Response: `"type":"event"`, URN: Sp("whatsapp:250788123123"), ChannelEvent: Sp(courier.StopContact)},
+	})
+}
+
 func BenchmarkHandler(b *testing.B) {
 	RunChannelBenchmarks(b, testChannels, newHandler(), testCases)
 }
@@ -231,6 +258,16 @@ func setSendURL(s *httptest.Server, h courier.ChannelHandler, c courier.Channel,
 	c.(*courier.MockChannel).SetConfig("base_url", s.URL)
 }
 
+// setCachedMediaID returns a send prep which sets our base_url and caches the passed in media id for the attachment
+// of the msg, as if it had already been uploaded
+func setCachedMediaID(mediaID string) SendPrepFunc {
+	return func(s *httptest.Server, h courier.ChannelHandler, c courier.Channel, m courier.Msg) {
+		setSendURL(s, h, c, m)
+		_, attachmentURL := SplitAttachment(m.Attachments()[0])
+		SetCachedMediaID(h.(*handler).Backend(), c, attachmentURL, mediaID, time.Hour)
+	}
+}
+
 func mockAttachmentURLs(mediaServer *httptest.Server, testCases []ChannelSendTestCase) []ChannelSendTestCase {
 	casesWithMockedUrls := make([]ChannelSendTestCase, len(testCases))
 	for i, testCase := range testCases {
@@ -264,9 +301,37 @@ var defaultSendTestCases = []ChannelSendTestCase{
 		Text: "Error", URN: "whatsapp:250788123123",
 		Status:       "E",
 		ResponseBody: `{ "errors": [{ "title": "Error Sending" }] }`, ResponseStatus: 403,
-		RequestBody: `{"to":"250788123123","type":"text","text":{"body":"Error"}}`,
-		Error:       "received error from send endpoint: Error Sending",
-		SendPrep:    setSendURL},
+		RequestBody:   `{"to":"250788123123","type":"text","text":{"body":"Error"}}`,
+		Error:         "received error from send endpoint: Error Sending",
+		ErrorCategory: courier.MsgErrorAuthFailure,
+		SendPrep:      setSendURL},
+	{Label: "Invalid Contact",
+		Text: "Error", URN: "whatsapp:250788123123",
+		Status:       "E",
+		ResponseBody: `{ "errors": [{"code": 1013, "title": "User is not valid"}] }`, ResponseStatus: 400,
+		RequestBody:   `{"to":"250788123123","type":"text","text":{"body":"Error"}}`,
+		Error:         "received error from send endpoint: User is not valid",
+		ErrorCategory: courier.MsgErrorInvalidURN,
+		ErrorCode:     "1013",
+		SendPrep:      setSendURL},
+	{Label: "Rate Limited",
+		Text: "Error", URN: "whatsapp:250788123123",
+		Status:       "E",
+		ResponseBody: `{ "errors": [{"code": 1015, "title": "Too many requests"}] }`, ResponseStatus: 429,
+		RequestBody:   `{"to":"250788123123","type":"text","text":{"body":"Error"}}`,
+		Error:         "rate limited by provider",
+		ErrorCategory: courier.MsgErrorRateLimited,
+		ErrorCode:     "1015",
+		SendPrep:      setSendURL},
+	{Label: "Unknown Error Code",
+		Text: "Error", URN: "whatsapp:250788123123",
+		Status:       "E",
+		ResponseBody: `{ "errors": [{"code": 1000, "title": "Generic error"}] }`, ResponseStatus: 500,
+		RequestBody:   `{"to":"250788123123","type":"text","text":{"body":"Error"}}`,
+		Error:         "received error from send endpoint: Generic error",
+		ErrorCategory: courier.MsgErrorProvider,
+		ErrorCode:     "1000",
+		SendPrep:      setSendURL},
 	{Label: "No Message ID",
 		Text: "Error", URN: "whatsapp:250788123123",
 		Status:       "E",
@@ -356,6 +421,56 @@ var defaultSendTestCases = []ChannelSendTestCase{
 		},
 		SendPrep: setSendURL,
 	},
+	{Label: "Cached Image Send",
+		Text:   "document caption",
+		URN:    "whatsapp:250788123123",
+		Status: "W", ExternalID: "157b5e14568e8",
+		Attachments: []string{"image/jpeg:https://foo.bar/image.jpg"},
+		Responses: map[MockedRequest]MockedResponse{
+			MockedRequest{
+				Method: "POST",
+				Path:   "/v1/messages",
+				Body:   `{"to":"250788123123","type":"image","image":{"id":"media-id","caption":"document caption"}}`,
+			}: MockedResponse{
+				Status: 201,
+				Body:   `{ "messages": [{"id": "157b5e14568e8"}] }`,
+			},
+		},
+		SendPrep: setCachedMediaID("media-id"),
+	},
+	{Label: "Expired Cached Image Send",
+		Text:   "document caption",
+		URN:    "whatsapp:250788123123",
+		Status: "W", ExternalID: "157b5e14568e8",
+		Attachments: []string{"image/jpeg:https://foo.bar/image.jpg"},
+		Responses: map[MockedRequest]MockedResponse{
+			MockedRequest{
+				Method: "POST",
+				Path:   "/v1/messages",
+				Body:   `{"to":"250788123123","type":"image","image":{"id":"expired-media-id","caption":"document caption"}}`,
+			}: MockedResponse{
+				Status: 404,
+				Body:   `{ "errors": [{"code": 1006, "title": "Resource not found"}] }`,
+			},
+			MockedRequest{
+				Method: "POST",
+				Path:   "/v1/media",
+				Body:   "media body",
+			}: MockedResponse{
+				Status: 201,
+				Body:   `{"media": [{"id": "media-id"}]}`,
+			},
+			MockedRequest{
+				Method: "POST",
+				Path:   "/v1/messages",
+				Body:   `{"to":"250788123123","type":"image","image":{"id":"media-id","caption":"document caption"}}`,
+			}: MockedResponse{
+				Status: 201,
+				Body:   `{ "messages": [{"id": "157b5e14568e8"}] }`,
+			},
+		},
+		SendPrep: setCachedMediaID("expired-media-id"),
+	},
 }
 
 func TestSending(t *testing.T) {
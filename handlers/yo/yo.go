@@ -112,10 +112,12 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
 	var err error
 
-	for _, part := range handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxMsgLength) {
+	parts := handlers.SplitSMS(handlers.GetTextAndAttachments(msg), maxMsgLength)
+	status.SetMsgCount(handlers.CountSMSSegments(parts))
+	for _, part := range parts {
 		form := url.Values{
 			"origin":       []string{strings.TrimPrefix(msg.Channel().Address(), "+")},
-			"sms_content":  []string{part},
+			"sms_content":  []string{part.Text},
 			"destinations": []string{strings.TrimPrefix(msg.URN().Path(), "+")},
 			"ybsacctno":    []string{username},
 			"password":     []string{password},
@@ -128,7 +130,7 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 			req, _ := http.NewRequest(http.MethodGet, sendURL.String(), nil)
 			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-			rr, err := utils.MakeHTTPRequest(req)
+			rr, err := utils.MakeHTTPRequest(req.WithContext(ctx))
 			log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
 			status.AddLog(log)
 
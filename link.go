@@ -0,0 +1,136 @@
+package courier
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/nyaruka/courier/librato"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrShortLinkNotFound is returned when looking up a short link which doesn't exist or has expired
+var ErrShortLinkNotFound = errors.New("short link not found")
+
+// ShortLink is a link in an outgoing message which we replaced with a shorter link to us, so we can record who clicks it
+type ShortLink struct {
+	Key         string      `json:"key"`
+	URL         string      `json:"url"`
+	ChannelUUID ChannelUUID `json:"channel_uuid"`
+	ChannelType ChannelType `json:"channel_type"`
+	URN         urns.URN    `json:"urn"`
+	MsgID       MsgID       `json:"msg_id"`
+}
+
+// the length of the keys of our short links
+const shortLinkKeyLength = 8
+
+const shortLinkKeyChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+var linkRegex = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// shortenLinks replaces any links in the text of the passed in msg with short links to us, if its channel is configured
+// to shorten them. Links which are already shorter than their short link would be are left as they are.
+func shortenLinks(ctx context.Context, server Server, msg Msg) (Msg, error) {
+	if fmt.Sprintf("%v", msg.Channel().ConfigForKey(ConfigShortenLinks, false)) != "true" {
+		return msg, nil
+	}
+
+	domain := msg.Channel().CallbackDomain(server.Config().Domain)
+	linkPrefix := fmt.Sprintf("https://%s/l/", domain)
+
+	var err error
+	text := linkRegex.ReplaceAllStringFunc(msg.Text(), func(link string) string {
+		// punctuation at the end of a link is more likely to be the end of a sentence
+		trimmed := strings.TrimRight(link, ".,;:!?)'")
+		if err != nil || len(trimmed) <= len(linkPrefix)+shortLinkKeyLength || strings.HasPrefix(trimmed, linkPrefix) {
+			return link
+		}
+
+		// links to other sites on our domain aren't ones we need to shorten either
+		parsed, parseErr := url.Parse(trimmed)
+		if parseErr != nil || parsed.Host == domain {
+			return link
+		}
+
+		shortLink := &ShortLink{
+			Key:         newShortLinkKey(),
+			URL:         trimmed,
+			ChannelUUID: msg.Channel().UUID(),
+			ChannelType: msg.Channel().ChannelType(),
+			URN:         msg.URN(),
+			MsgID:       msg.ID(),
+		}
+		err = server.Backend().SaveShortLink(ctx, shortLink)
+		if err != nil {
+			return link
+		}
+
+		return linkPrefix + shortLink.Key + link[len(trimmed):]
+	})
+	if err != nil {
+		return msg, err
+	}
+
+	return msg.WithText(text), nil
+}
+
+// newShortLinkKey returns a new random key for a short link
+func newShortLinkKey() string {
+	key := make([]byte, shortLinkKeyLength)
+	max := big.NewInt(int64(len(shortLinkKeyChars)))
+	for i := range key {
+		n, _ := rand.Int(rand.Reader, max)
+		key[i] = shortLinkKeyChars[n.Int64()]
+	}
+	return string(key)
+}
+
+// handleShortLink redirects a contact who clicked a short link to where it goes, recording their click as a channel event
+func (s *server) handleShortLink(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	key := chi.URLParam(r, "key")
+
+	link, err := s.backend.GetShortLink(ctx, key)
+	if err == ErrShortLinkNotFound {
+		s.handle404(w, r)
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("key", key).Error("error looking up short link")
+		WriteDataResponse(ctx, w, http.StatusInternalServerError, "Error", []interface{}{NewErrorData(err.Error())})
+		return
+	}
+
+	// failing to record a click shouldn't stop our contact getting where they are going
+	err = s.writeLinkClicked(ctx, link)
+	if err != nil {
+		logrus.WithError(err).WithField("key", key).WithField("channel_uuid", link.ChannelUUID).Error("error recording short link click")
+	}
+
+	http.Redirect(w, r, link.URL, http.StatusFound)
+}
+
+// writeLinkClicked writes a channel event for a click on the passed in short link
+func (s *server) writeLinkClicked(ctx context.Context, link *ShortLink) error {
+	channel, err := s.backend.GetChannel(ctx, link.ChannelType, link.ChannelUUID)
+	if err != nil {
+		return err
+	}
+
+	event := s.backend.NewChannelEvent(channel, LinkClicked, link.URN).WithExtra(map[string]interface{}{
+		"msg_id": link.MsgID.String(),
+		"url":    link.URL,
+	})
+
+	librato.Default.AddGauge(fmt.Sprintf("courier.link_clicked_%s", channel.ChannelType()), 1)
+	return s.backend.WriteChannelEvent(ctx, event)
+}
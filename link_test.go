@@ -0,0 +1,98 @@
+package courier
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShortenLinks(t *testing.T) {
+	mb := NewMockBackend()
+	s := NewServer(testConfig(), mb)
+	ctx := context.Background()
+
+	channel := NewMockChannel("e4bb1578-29da-4fa5-a214-9da19dd24230", "DM", "2020", "US", map[string]interface{}{ConfigShortenLinks: true})
+	plainChannel := NewMockChannel("53e5aafa-8155-449d-9009-fcb30d54bd26", "DM", "2021", "US", map[string]interface{}{})
+
+	tcs := []struct {
+		channel  Channel
+		text     string
+		expected string
+	}{
+		{channel, "Hi there!", "Hi there!"},
+		{channel, "Read more at https://example.com/news/2019/a-very-long-article-title?utm_source=sms.", "Read more at https://localhost/l/*."},
+		{channel, "Short http://x.co and long (https://example.com/a/really/long/path/to/somewhere)", "Short http://x.co and long (https://localhost/l/*)"},
+		{channel, "Ours https://localhost/c/dm/e4bb1578-29da-4fa5-a214-9da19dd24230/receive", "Ours https://localhost/c/dm/e4bb1578-29da-4fa5-a214-9da19dd24230/receive"},
+		{plainChannel, "Read more at https://example.com/news/2019/a-very-long-article-title", "Read more at https://example.com/news/2019/a-very-long-article-title"},
+	}
+
+	for i, tc := range tcs {
+		msg := &mockMsg{channel: tc.channel, id: NewMsgID(int64(800 + i)), text: tc.text, urn: "tel:+250788383383"}
+		shortened, err := shortenLinks(ctx, s, msg)
+		assert.NoError(t, err)
+
+		// keys are random so expected texts have a * in place of them
+		expected := strings.Replace(regexp.QuoteMeta(tc.expected), `\*`, "[0-9a-zA-Z]{8}", -1)
+		assert.Regexp(t, "^"+expected+"$", shortened.Text(), "unexpected text for '%s'", tc.text)
+	}
+
+	// check the link we saved for one of our messages
+	msg := &mockMsg{channel: channel, id: NewMsgID(810), text: "See https://example.com/news/2019/a-very-long-article-title", urn: "tel:+250788383383"}
+	shortened, err := shortenLinks(ctx, s, msg)
+	assert.NoError(t, err)
+
+	link, err := mb.GetShortLink(ctx, strings.TrimPrefix(shortened.Text(), "See https://localhost/l/"))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/news/2019/a-very-long-article-title", link.URL)
+	assert.Equal(t, channel.UUID(), link.ChannelUUID)
+	assert.Equal(t, NewMsgID(810), link.MsgID)
+	assert.Equal(t, msg.URN(), link.URN)
+}
+
+func TestShortLinkClicks(t *testing.T) {
+	mb := NewMockBackend()
+	s := NewServer(testConfig(), mb)
+	s.Start()
+	defer s.Stop()
+
+	// wait for server to come up
+	time.Sleep(100 * time.Millisecond)
+
+	channel := NewMockChannel("e4bb1578-29da-4fa5-a214-9da19dd24230", "DM", "2020", "US", map[string]interface{}{})
+	mb.AddChannel(channel)
+	mb.SaveShortLink(context.Background(), &ShortLink{
+		Key:         "Ab3dE6gH",
+		URL:         "https://example.com/news",
+		ChannelUUID: channel.UUID(),
+		ChannelType: channel.ChannelType(),
+		URN:         "tel:+250788383383",
+		MsgID:       NewMsgID(901),
+	})
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+
+	// clicking our link redirects to where it goes and records the click
+	resp, err := client.Get("http://localhost:8080/l/Ab3dE6gH")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "https://example.com/news", resp.Header.Get("Location"))
+
+	event, err := mb.GetLastChannelEvent()
+	assert.NoError(t, err)
+	assert.Equal(t, LinkClicked, event.EventType())
+	assert.Equal(t, channel.UUID(), event.ChannelUUID())
+	assert.Equal(t, "tel:+250788383383", event.URN().String())
+	assert.Equal(t, map[string]interface{}{"msg_id": "901", "url": "https://example.com/news"}, event.Extra())
+
+	// clicking a link which doesn't exist is a 404
+	resp, err = client.Get("http://localhost:8080/l/notthere")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
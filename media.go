@@ -0,0 +1,115 @@
+package courier
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/nyaruka/courier/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// derived attachments are cached by original attachment and constraints so broadcasts only download an image once, images
+// which already fit are cached as themselves
+const derivedMediaKey = "derived_media:%s"
+const derivedMediaTTL = 60 * 60 * 24
+
+func derivedMediaCacheKey(constraints MediaConstraints, attachment string) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d:%d:%d:%s", constraints.MaxImageBytes, constraints.MaxImageWidth, constraints.MaxImageHeight, attachment)))
+	return fmt.Sprintf(derivedMediaKey, hex.EncodeToString(hash[:]))
+}
+
+// constrainAttachments replaces any image attachments on the passed in msg which break the passed in constraints with
+// resized or recompressed versions saved by our backend, returning logs describing what was done
+func constrainAttachments(ctx context.Context, s Server, constraints MediaConstraints, msg Msg) []*ChannelLog {
+	logs := make([]*ChannelLog, 0)
+
+	// copy our attachments as we may replace them as we go
+	attachments := append([]string(nil), msg.Attachments()...)
+
+	for _, attachment := range attachments {
+		parts := strings.SplitN(attachment, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "image/") {
+			continue
+		}
+
+		log := constrainAttachment(ctx, s, constraints, msg, attachment, parts[1])
+		if log != nil {
+			logs = append(logs, log)
+		}
+	}
+
+	return logs
+}
+
+// constrainAttachment constrains a single image attachment, returning a log if we transformed it or failed trying
+func constrainAttachment(ctx context.Context, s Server, constraints MediaConstraints, msg Msg, attachment string, mediaURL string) *ChannelLog {
+	start := time.Now()
+	channel := msg.Channel()
+
+	rc := s.Backend().RedisPool().Get()
+	defer rc.Close()
+
+	// have we already derived an attachment for this one?
+	cacheKey := derivedMediaCacheKey(constraints, attachment)
+	derived, err := redis.String(rc.Do("get", cacheKey))
+	if err != nil && err != redis.ErrNil {
+		logrus.WithField("channel_uuid", channel.UUID()).WithError(err).Error("error looking up derived media")
+	}
+	if derived == attachment {
+		return nil
+	}
+	if derived != "" {
+		msg.ReplaceAttachment(attachment, derived)
+		return NewChannelLog("Media Constrained", channel, msg.ID(), "", mediaURL, NilStatusCode, "",
+			fmt.Sprintf("using previously derived attachment %s", derived), time.Now().Sub(start), nil)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, mediaURL, nil)
+	rr, stream, err := utils.OpenMediaStream(req.WithContext(ctx), MaxMediaSize(s.Config(), channel))
+	if err != nil {
+		return NewChannelLogFromRR("Media Constrain Error", channel, msg.ID(), rr).WithError("Media Constrain Error", err)
+	}
+	defer stream.Close()
+
+	data, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return NewChannelLogFromRR("Media Constrain Error", channel, msg.ID(), rr).WithError("Media Constrain Error", err)
+	}
+
+	transform, err := utils.ConstrainImage(data, constraints.MaxImageBytes, constraints.MaxImageWidth, constraints.MaxImageHeight)
+	if err != nil {
+		return NewChannelLogFromRR("Media Constrain Error", channel, msg.ID(), rr).WithError("Media Constrain Error", err)
+	}
+
+	// image already fits, remember that so we don't download it again
+	if transform == nil {
+		cacheDerivedMedia(rc, channel, cacheKey, attachment)
+		return nil
+	}
+
+	derived, err = s.Backend().SaveMedia(ctx, channel, transform.ContentType, transform.Data)
+	if err != nil {
+		return NewChannelLogFromRR("Media Constrain Error", channel, msg.ID(), rr).WithError("Media Constrain Error", err)
+	}
+	cacheDerivedMedia(rc, channel, cacheKey, derived)
+
+	msg.ReplaceAttachment(attachment, derived)
+
+	return NewChannelLog("Media Constrained", channel, msg.ID(), rr.Method, rr.URL, rr.StatusCode, rr.Request,
+		fmt.Sprintf("%s\n\n%s\nderived attachment: %s", rr.Response, transform, derived), time.Now().Sub(start), nil)
+}
+
+// cacheDerivedMedia caches the attachment derived from the one with the passed in cache key
+func cacheDerivedMedia(rc redis.Conn, channel Channel, cacheKey string, derived string) {
+	_, err := rc.Do("setex", cacheKey, derivedMediaTTL, derived)
+	if err != nil {
+		logrus.WithField("channel_uuid", channel.UUID()).WithError(err).Error("error caching derived media")
+	}
+}
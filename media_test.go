@@ -0,0 +1,90 @@
+package courier
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConstrainAttachments(t *testing.T) {
+	bigPNG := &bytes.Buffer{}
+	png.Encode(bigPNG, image.NewRGBA(image.Rect(0, 0, 400, 300)))
+	smallPNG := &bytes.Buffer{}
+	png.Encode(smallPNG, image.NewRGBA(image.Rect(0, 0, 10, 10)))
+
+	downloads := make(map[string]int)
+	mediaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads[r.URL.Path]++
+		switch r.URL.Path {
+		case "/big.png":
+			w.Write(bigPNG.Bytes())
+		case "/small.png":
+			w.Write(smallPNG.Bytes())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mediaServer.Close()
+
+	mb := NewMockBackend()
+	s := NewServer(testConfig(), mb)
+	channel := NewMockChannel("53e5aafa-8155-449d-9009-fcb30d54bd26", "XX", "2020", "US", map[string]interface{}{})
+	constraints := MediaConstraints{MaxImageWidth: 200}
+
+	msg := mb.NewTestOutgoingMsg(channel, NewMsgID(10), urns.URN("tel:+250788383383"), "images", false, nil, 0, "")
+	msg.WithAttachment("image/png:" + mediaServer.URL + "/big.png")
+	msg.WithAttachment("image/png:" + mediaServer.URL + "/small.png")
+	msg.WithAttachment("video/mp4:" + mediaServer.URL + "/video.mp4")
+
+	logs := constrainAttachments(context.Background(), s, constraints, msg)
+
+	// only our big image is replaced
+	assert.Equal(t, []string{
+		"image/png:https://backend.com/media/1",
+		"image/png:" + mediaServer.URL + "/small.png",
+		"video/mp4:" + mediaServer.URL + "/video.mp4",
+	}, msg.Attachments())
+
+	if assert.Equal(t, 1, len(logs)) {
+		assert.Equal(t, "Media Constrained", logs[0].Description)
+		assert.Contains(t, logs[0].Response, "png 400x300")
+		assert.Contains(t, logs[0].Response, "-> image/png 200x150")
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(mb.GetSavedMedia("https://backend.com/media/1")))
+	assert.NoError(t, err)
+	assert.Equal(t, 200, config.Width)
+	assert.Equal(t, 150, config.Height)
+
+	// the same images again use our derived attachment without saving it again, and neither is downloaded again
+	msg = mb.NewTestOutgoingMsg(channel, NewMsgID(11), urns.URN("tel:+250788383383"), "images", false, nil, 0, "")
+	msg.WithAttachment("image/png:" + mediaServer.URL + "/big.png")
+	msg.WithAttachment("image/png:" + mediaServer.URL + "/small.png")
+
+	logs = constrainAttachments(context.Background(), s, constraints, msg)
+	assert.Equal(t, []string{"image/png:https://backend.com/media/1", "image/png:" + mediaServer.URL + "/small.png"}, msg.Attachments())
+	assert.Equal(t, map[string]int{"/big.png": 1, "/small.png": 1}, downloads)
+	assert.Nil(t, mb.GetSavedMedia("https://backend.com/media/2"))
+	if assert.Equal(t, 1, len(logs)) {
+		assert.True(t, strings.HasPrefix(logs[0].Response, "using previously derived attachment"))
+	}
+
+	// images we can't fetch are left alone, but logged
+	msg = mb.NewTestOutgoingMsg(channel, NewMsgID(12), urns.URN("tel:+250788383383"), "images", false, nil, 0, "")
+	msg.WithAttachment("image/png:" + mediaServer.URL + "/missing.png")
+
+	logs = constrainAttachments(context.Background(), s, constraints, msg)
+	assert.Equal(t, []string{"image/png:" + mediaServer.URL + "/missing.png"}, msg.Attachments())
+	if assert.Equal(t, 1, len(logs)) {
+		assert.Equal(t, "Media Constrain Error", logs[0].Description)
+		assert.Equal(t, "received non 200 status: 404", logs[0].Error)
+	}
+}
@@ -81,13 +81,16 @@ type Msg interface {
 	SentOn() *time.Time
 
 	HighPriority() bool
+	ExpiresOn() *time.Time
 
 	WithContactName(name string) Msg
 	WithReceivedOn(date time.Time) Msg
 	WithExternalID(id string) Msg
 	WithID(id MsgID) Msg
 	WithUUID(uuid MsgUUID) Msg
+	WithText(text string) Msg
 	WithAttachment(url string) Msg
+	ReplaceAttachment(original string, replacement string) Msg
 	WithURNAuth(auth string) Msg
 
 	EventID() int64
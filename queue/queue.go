@@ -1,7 +1,9 @@
 package queue
 
 import (
+	"math"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,16 +14,38 @@ import (
 // Priority represents the priority of an item in a queue
 type Priority int64
 
+// Clamp returns this priority limited to the passed in number of priority levels, as values queued with priorities
+// outside of them would never be popped
+func (p Priority) Clamp(levels int) Priority {
+	if levels <= 0 {
+		levels = DefaultPriorityLevels
+	}
+	if p >= Priority(levels) {
+		return Priority(levels - 1)
+	}
+	if p < LowPriority {
+		return LowPriority
+	}
+	return p
+}
+
 // WorkerToken represents a token that a worker should return when a task is complete
 type WorkerToken string
 
 const (
+	// TransactionalPriority is typically used for time critical messages such as one time passwords, which
+	// shouldn't wait behind replies.
+	TransactionalPriority = 2
+
 	// HighPriority is typically used for replies to ensure they sent as soon as possible.
 	HighPriority = 1
 
 	// LowPriority is typically used for bulk messages (sent in batches). These will only be
 	// processed after all high priority messages are dealt with.
 	LowPriority = 0
+
+	// DefaultPriorityLevels is the number of priority levels we pop from by default, from 0 up to TransactionalPriority
+	DefaultPriorityLevels = 3
 )
 
 const (
@@ -63,12 +87,30 @@ var luaPush = redis.NewScript(6, `-- KEYS: [EpochMS, QueueType, QueueName, TPS,
 // specified transactions per second are popped off at a time. A tps value of 0 means there is no
 // limit to the rate that messages can be consumed
 func PushOntoQueue(conn redis.Conn, qType string, queue string, tps int, value string, priority Priority) error {
+	return PushOntoPriorityQueue(conn, qType, queue, tps, value, priority, DefaultPriorityLevels)
+}
+
+// PushOntoPriorityQueue pushes the passed in value to the passed in queue like PushOntoQueue, for queues popped with
+// the passed in number of priority levels. Priorities outside of those levels are clamped to them.
+func PushOntoPriorityQueue(conn redis.Conn, qType string, queue string, tps int, value string, priority Priority, levels int) error {
 	epochMS := strconv.FormatFloat(float64(time.Now().UnixNano()/int64(time.Microsecond))/float64(1000000), 'f', 6, 64)
-	_, err := redis.Int(luaPush.Do(conn, epochMS, qType, queue, tps, priority, value))
+	_, err := redis.Int(luaPush.Do(conn, epochMS, qType, queue, tps, priority.Clamp(levels), value))
 	return err
 }
 
-var luaPop = redis.NewScript(2, `-- KEYS: [EpochMS QueueType]
+// DefaultURNLockTTL is how long a URN stays locked for by default if the worker sending to it never marks its task as
+// complete. It should be longer than a worker ever takes to complete a task.
+const DefaultURNLockTTL = time.Minute * 2
+
+// how many values at the front of a queue we look at to find one whose URN isn't locked
+const urnScanLimit = 25
+
+var luaPop = redis.NewScript(6, `-- KEYS: [EpochMS QueueType URNLockTTL URNScanLimit PriorityLevels PriorityAging]
+	local now = tonumber(KEYS[1])
+	local scanLimit = tonumber(KEYS[4])
+	local levels = tonumber(KEYS[5])
+	local aging = tonumber(KEYS[6])
+
 	-- get the first key off our active list
 	local result = redis.call("zrange", KEYS[2] .. ":active", 0, 0, "WITHSCORES")
 	local queue = result[1]
@@ -76,7 +118,7 @@ var luaPop = redis.NewScript(2, `-- KEYS: [EpochMS QueueType]
 
 	-- nothing? return nothing
 	if not queue then
-		return {"empty", ""}
+		return {"empty", "", ""}
 	end
 
 	-- figure out our max transaction per second
@@ -87,6 +129,19 @@ var luaPop = redis.NewScript(2, `-- KEYS: [EpochMS QueueType]
 	    tps = tonumber(string.sub(queue, delim+1))
 	end
 
+	-- if our provider told us to stop sending for a while, wait in our throttled queue until it lets us send again
+	if redis.call("exists", queue .. ":paused") == 1 then
+		redis.call("zincrby", KEYS[2] .. ":throttled", workers, queue)
+		redis.call("zrem", KEYS[2] .. ":active", queue)
+		return {"retry", "", ""}
+	end
+
+	-- if our provider rate limited us, send at our reduced rate until it has recovered
+	local rate = redis.call("hget", KEYS[2] .. ":rates", queue)
+	if rate and tps > 0 then
+		tps = math.min(tps, tonumber(rate))
+	end
+
 	-- if we have a tps, then check whether we exceed it
 	if tps > 0 then
 	    tpsKey = queue .. ":tps:" .. math.floor(KEYS[1])
@@ -96,48 +151,109 @@ var luaPop = redis.NewScript(2, `-- KEYS: [EpochMS QueueType]
 		if curr and tonumber(curr) >= tps then 
 			redis.call("zincrby", KEYS[2] .. ":throttled", workers, queue)
 			redis.call("zrem", KEYS[2] .. ":active", queue)
-			return {"retry", ""}
+			return {"retry", "", ""}
   	    end
 	end
 
-	-- pop our next value out, first from our default queue
-	local resultQueue = queue .. "/1"
-	local result = redis.call("zrangebyscore", resultQueue, 0, "+inf", "WITHSCORES", "LIMIT", 0, 1)
-	
-	-- keep track as to whether this result is in the future (and therefore ineligible)
-	local isFutureResult = result[1] and tonumber(result[2]) > tonumber(KEYS[1])
-
-	-- if we didn't find one, try again from our bulk queue
-	if not result[1] or isFutureResult then
-		local bulkQueue = queue .. "/0"
-		local bulkResult = redis.call("zrangebyscore", bulkQueue, 0, "+inf", "WITHSCORES", "LIMIT", 0, 1)
-
-		-- if we got a result
-		if bulkResult[1] then
-			-- if it is in the future, set ourselves as in the future
-			if tonumber(bulkResult[2]) > tonumber(KEYS[1]) then
-				isFutureResult = true
-			
-			-- otherwise, this is a valid result
-			else 
-				redis.call("echo", "found result")
-				isFutureResult = false
-				result = bulkResult
-				resultQueue = bulkQueue
+	-- if our queue shares a rate limit with other queues, check whether together they exceed it, in which case we are
+	-- throttled just like when we exceed our own tps
+	local bucketTPSKey = ""
+	local bucketTPS = 0
+	local bucket = redis.call("hget", KEYS[2] .. ":buckets", queue)
+	if bucket then
+		local bucketDelim = string.find(bucket, "|")
+		if bucketDelim then
+			bucketTPS = tonumber(string.sub(bucket, bucketDelim+1))
+		end
+
+		if bucketTPS > 0 then
+			bucketTPSKey = KEYS[2] .. ":bucket:" .. bucket .. ":tps:" .. math.floor(KEYS[1])
+			local curr = redis.call("get", bucketTPSKey)
+
+			if curr and tonumber(curr) >= bucketTPS then
+				redis.call("zincrby", KEYS[2] .. ":throttled", workers, queue)
+				redis.call("zrem", KEYS[2] .. ":active", queue)
+				return {"retry", "", ""}
+			end
+		end
+	end
+
+	-- returns the URN of the first element of the passed in value, or an empty string if it doesn't have one
+	local function valueURN(value)
+		local ok, valueList = pcall(cjson.decode, value)
+		if ok and type(valueList) == "table" and type(valueList[1]) == "table" and type(valueList[1]["urn"]) == "string" then
+			return valueList[1]["urn"]
+		end
+		return ""
+	end
+
+	-- finds the first value in the passed in queue which can be sent now and isn't for a URN which is locked because a
+	-- previous message to it is still being sent, returns that value, its score and URN along with whether any values were
+	-- skipped because they are in the future and whether any were skipped because their URN is locked
+	local function firstEligible(priorityQueue)
+		local values = redis.call("zrangebyscore", priorityQueue, 0, "+inf", "WITHSCORES", "LIMIT", 0, scanLimit)
+		local locked = false
+		for i=1,#values,2 do
+			-- values are sorted by score so everything from here on is in the future
+			if tonumber(values[i+1]) > now then
+				return nil, nil, nil, true, locked
+			end
+
+			local urn = valueURN(values[i])
+			if urn == "" or redis.call("exists", queue .. ":urn:" .. urn) == 0 then
+				return values[i], values[i+1], urn, false, locked
+			end
+			locked = true
+		end
+		return nil, nil, nil, false, locked
+	end
+
+	-- pop our next value out, starting from our highest priority queue. Without aging we take the first value we find,
+	-- with aging a value is bumped up a priority level for every aging period it has waited, so we look at every level
+	-- and take the value with the highest effective priority, the highest actual priority winning ties.
+	local value, score, urn, resultQueue
+	local bestPriority = -1
+	local isFutureResult, isLocked = false, false
+
+	for priority=levels-1,0,-1 do
+		local priorityQueue = queue .. "/" .. priority
+		local pValue, pScore, pURN, pFuture, pLocked = firstEligible(priorityQueue)
+
+		isFutureResult = isFutureResult or pFuture
+		isLocked = isLocked or pLocked
+
+		if pValue then
+			local effective = priority
+			if aging > 0 then
+				effective = math.min(levels-1, priority + math.floor((now - tonumber(pScore)) / aging))
+			end
+
+			if effective > bestPriority then
+				value, score, urn, resultQueue = pValue, pScore, pURN, priorityQueue
+				bestPriority = effective
+			end
+
+			if aging <= 0 or bestPriority >= levels-1 then
+				break
 			end
 		end
 	end
 
 	-- if we found one
-	if result[1] and not isFutureResult then
+	if value then
 		-- then remove it from the queue
-		redis.call('zremrangebyrank', resultQueue, 0, 0)
+		redis.call("zrem", resultQueue, value)
 
 		-- and add a worker to this queue
 		redis.call("zincrby", KEYS[2] .. ":active", 1, queue)
 
+		-- lock its URN so no other worker sends to it until this one is complete
+		if urn ~= "" then
+			redis.call("set", queue .. ":urn:" .. urn, "1", "EX", KEYS[3])
+		end
+
 		-- parse it as JSON to get the first element out
-		local valueList = cjson.decode(result[1])
+		local valueList = cjson.decode(value)
 		local popValue = cjson.encode(valueList[1])
 		table.remove(valueList, 1)
 
@@ -147,27 +263,39 @@ var luaPop = redis.NewScript(2, `-- KEYS: [EpochMS QueueType]
 		    redis.call("expire", tpsKey, 10)
 		end 
 
+		-- and for our shared bucket
+		if bucketTPS > 0 then
+			redis.call("incrby", bucketTPSKey, 1)
+			redis.call("expire", bucketTPSKey, 10)
+		end
+
 		-- encode it back if there is anything left
 		if table.getn(valueList) > 0 then
 		    local remaining = cjson.encode(valueList)
-	        
-            -- schedule it in the future 3 seconds on our main queue
-            redis.call("zadd", queue .. "/1", tonumber(KEYS[1]) + 3, remaining)
-            redis.call("zincrby", KEYS[2] .. ":future", 0, queue)
+
+			-- if we have a URN the lock keeps the rest in order, so put them back where they were, otherwise schedule them
+			-- in the future 3 seconds on our main queue
+			if urn ~= "" then
+				redis.call("zadd", resultQueue, score, remaining)
+			else
+				redis.call("zadd", queue .. "/1", now + 3, remaining)
+				redis.call("zincrby", KEYS[2] .. ":future", 0, queue)
+			end
 		end
 
-		return {queue, popValue}
+		return {queue, popValue, urn}
 
-	-- otherwise, the queue only contains future results, remove from active and add to future, have the caller retry
-	elseif isFutureResult then
+	-- otherwise, the queue only contains future results or results for locked URNs, remove from active and add to future,
+	-- have the caller retry. Completing the tasks holding the locks will make the queue active again.
+	elseif isFutureResult or isLocked then
 	    redis.call("zincrby", KEYS[2] .. ":future", 0, queue)
 	    redis.call("zrem", KEYS[2] .. ":active", queue)
-		return {"retry", ""}
+		return {"retry", "", ""}
 	
 	-- otherwise, the queue is empty, remove it from active
 	else
 		redis.call("zrem", KEYS[2] .. ":active", queue)
-		return {"retry", ""}
+		return {"retry", "", ""}
 	end
 `)
 
@@ -175,17 +303,76 @@ var luaPop = redis.NewScript(2, `-- KEYS: [EpochMS QueueType]
 // is returned the caller should immediately make another call to get the next value. A
 // worker token of EmptyQueue will be returned if there are no more items to retrive.
 // Otherwise the WorkerToken should be saved in order to mark the task as complete later.
+//
+// Messages with a URN are sent in order, no message for a URN will be popped from a queue while
+// the task for a previous message to that URN hasn't been marked complete. If a worker dies without
+// marking its task complete, messages to its URN stall until the lock expires after DefaultURNLockTTL.
 func PopFromQueue(conn redis.Conn, qType string) (WorkerToken, string, error) {
+	return PopFromPriorityQueue(conn, qType, DefaultPriorityLevels, 0, DefaultURNLockTTL)
+}
+
+// PopFromPriorityQueue pops the next available message from the passed in queue like PopFromQueue, considering the
+// passed in number of priority levels. If aging is non-zero, messages are treated as one priority level higher for
+// every aging period they have been waiting, so lower priority messages are never starved forever. The URN of the
+// popped message stays locked for at most urnLockTTL, which should be longer than the worker can take to complete its
+// task, as a message to the URN popped after that can be sent before the previous one.
+func PopFromPriorityQueue(conn redis.Conn, qType string, levels int, aging time.Duration, urnLockTTL time.Duration) (WorkerToken, string, error) {
 	epochMS := strconv.FormatFloat(float64(time.Now().UnixNano()/int64(time.Microsecond))/float64(1000000), 'f', 6, 64)
-	values, err := redis.Strings(luaPop.Do(conn, epochMS, qType))
+	lockSeconds := int64(math.Ceil(urnLockTTL.Seconds()))
+	values, err := redis.Strings(luaPop.Do(conn, epochMS, qType, lockSeconds, urnScanLimit, levels, aging.Seconds()))
 	if err != nil {
 		logrus.Error(err)
 		return "", "", err
 	}
-	return WorkerToken(values[0]), values[1], nil
+	return newWorkerToken(values[0], values[2]), values[1], nil
 }
 
-var luaComplete = redis.NewScript(2, `-- KEYS: [QueueType, Queue]
+// the separator between the queue name and the locked URN in a worker token
+const tokenURNSeparator = "\t"
+
+// newWorkerToken creates the worker token for a task popped from the passed in queue, including the URN it locked
+func newWorkerToken(queue string, urn string) WorkerToken {
+	if urn == "" {
+		return WorkerToken(queue)
+	}
+	return WorkerToken(queue + tokenURNSeparator + urn)
+}
+
+// split returns the queue and locked URN of this token
+func (t WorkerToken) split() (string, string) {
+	parts := strings.SplitN(string(t), tokenURNSeparator, 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// SetQueueBucket sets the shared rate limit bucket of the queue the passed in token was popped from, so that together
+// all the queues in a bucket are popped at no more than its tps. An empty bucket name removes the queue from its bucket.
+// Queues throttled because of their bucket are dethrottled every second along with all other throttled queues.
+func SetQueueBucket(conn redis.Conn, qType string, token WorkerToken, bucket string, tps int) error {
+	queue, _ := token.split()
+	return setBucket(conn, qType, queue, bucket, tps)
+}
+
+// SetBucket sets the shared rate limit bucket of the passed in queue like SetQueueBucket, for callers which push onto
+// a queue rather than pop from it. Setting the bucket before pushing means the first pop from the queue is checked
+// against its bucket.
+func SetBucket(conn redis.Conn, qType string, queue string, queueTPS int, bucket string, tps int) error {
+	return setBucket(conn, qType, qType+":"+queue+"|"+strconv.Itoa(queueTPS), bucket, tps)
+}
+
+func setBucket(conn redis.Conn, qType string, queue string, bucket string, tps int) error {
+	var err error
+	if bucket == "" || tps <= 0 {
+		_, err = conn.Do("hdel", qType+":buckets", queue)
+	} else {
+		_, err = conn.Do("hset", qType+":buckets", queue, bucket+"|"+strconv.Itoa(tps))
+	}
+	return err
+}
+
+var luaComplete = redis.NewScript(3, `-- KEYS: [QueueType, Queue, URN]
 	-- decrement throttled if present
 	local throttled = tonumber(redis.call("zadd", KEYS[1] .. ":throttled", "XX", "CH", "INCR", -1, KEYS[2]))
 
@@ -198,13 +385,104 @@ var luaComplete = redis.NewScript(2, `-- KEYS: [QueueType, Queue]
 			redis.call("zadd", KEYS[1] .. ":active", 0, KEYS[2])
 		end
 	end
+
+	-- release the lock on our URN so the next message to it can be sent
+	if KEYS[3] ~= "" then
+		redis.call("del", KEYS[2] .. ":urn:" .. KEYS[3])
+	end
 `)
 
 // MarkComplete marks a task as complete for the passed in queue and queue result. It is
 // important for callers to call this so that workers are evenly spread across all
-// queues with jobs in them
+// queues with jobs in them, and so that the next message to the same URN can be sent
 func MarkComplete(conn redis.Conn, qType string, token WorkerToken) error {
-	_, err := luaComplete.Do(conn, qType, token)
+	queue, urn := token.split()
+	_, err := luaComplete.Do(conn, qType, queue, urn)
+	return err
+}
+
+var luaDefer = redis.NewScript(6, `-- KEYS: [EpochMS, QueueType, Queue, Priority, Until, Value]
+	-- put our value back on its queue, scored at the time it can next be sent. Values deferred until the same time are
+	-- offset by a counter of how many were deferred before them, which is the order they were queued in, so they are
+	-- popped in that order and messages to the same URN stay in order.
+	local priorityQueue = KEYS[3] .. "/" .. KEYS[4]
+	local deferUntil = tonumber(KEYS[5])
+	local counterKey = priorityQueue .. ":deferred:" .. KEYS[5]
+	local deferred = redis.call("incr", counterKey)
+	redis.call("expireat", counterKey, math.ceil(deferUntil) + 60)
+	redis.call("zadd", priorityQueue, string.format("%.6f", deferUntil + (deferred - 1) * 0.000001), KEYS[6])
+	redis.call("zincrby", KEYS[2] .. ":future", 0, KEYS[3])
+
+	-- give back the transaction our pop used up, we didn't send anything with it
+	local tpsKeys = {KEYS[3] .. ":tps:" .. math.floor(KEYS[1])}
+	local bucket = redis.call("hget", KEYS[2] .. ":buckets", KEYS[3])
+	if bucket then
+		table.insert(tpsKeys, KEYS[2] .. ":bucket:" .. bucket .. ":tps:" .. math.floor(KEYS[1]))
+	end
+
+	for _, tpsKey in ipairs(tpsKeys) do
+		local curr = tonumber(redis.call("get", tpsKey))
+		if curr and curr > 0 then
+			redis.call("decr", tpsKey)
+		end
+	end
+`)
+
+// DeferToQueue puts a value popped with the passed in token back on its queue, to be popped again no earlier than
+// the passed in time, and returns the transaction its pop counted against the queue's TPS. Values deferred until the
+// same time are popped in the order they were deferred. The priority is clamped to the passed in number of priority
+// levels. Callers should still mark the task as complete.
+func DeferToQueue(conn redis.Conn, qType string, token WorkerToken, value string, priority Priority, levels int, until time.Time) error {
+	queue, _ := token.split()
+	epochMS := strconv.FormatFloat(float64(time.Now().UnixNano()/int64(time.Microsecond))/float64(1000000), 'f', 6, 64)
+	untilMS := strconv.FormatFloat(float64(until.UnixNano()/int64(time.Microsecond))/float64(1000000), 'f', 6, 64)
+	_, err := luaDefer.Do(conn, epochMS, qType, queue, priority.Clamp(levels), untilMS, value)
+	return err
+}
+
+// how long we pause a queue for when its provider rate limits us without saying for how long
+const defaultRateLimitPause = time.Second * 5
+
+var luaRateLimit = redis.NewScript(6, `-- KEYS: [EpochMS, QueueType, Queue, Priority, Value, PauseMS]
+	local queue = KEYS[3]
+
+	-- put our value back at the front of its queue so it is the next one sent
+	local priorityQueue = queue .. "/" .. KEYS[4]
+	local score = tonumber(KEYS[1])
+	local first = redis.call("zrange", priorityQueue, 0, 0, "WITHSCORES")
+	if first[2] and tonumber(first[2]) < score then
+		score = tonumber(first[2])
+	end
+	redis.call("zadd", priorityQueue, score, KEYS[5])
+
+	-- pause our queue for as long as we were told to
+	redis.call("set", queue .. ":paused", "1", "PX", KEYS[6])
+
+	-- and halve the rate we send at, the dethrottler will recover it gradually
+	local delim = string.find(queue, "|")
+	local tps = 0
+	if delim then
+		tps = tonumber(string.sub(queue, delim+1))
+	end
+	if tps > 0 then
+		local rate = tonumber(redis.call("hget", KEYS[2] .. ":rates", queue)) or tps
+		redis.call("hset", KEYS[2] .. ":rates", queue, math.max(1, math.floor(rate / 2)))
+	end
+
+	redis.call("zincrby", KEYS[2] .. ":future", 0, queue)
+`)
+
+// RateLimitQueue puts a value popped with the passed in token back at the front of its queue because the provider
+// told us we are sending too fast. The queue is paused for the passed in duration, or a few seconds if that is zero,
+// and then sends at a reduced rate which recovers gradually. The priority is clamped to the passed in number of
+// priority levels. Callers should still mark the task as complete.
+func RateLimitQueue(conn redis.Conn, qType string, token WorkerToken, value string, priority Priority, levels int, retryAfter time.Duration) error {
+	queue, _ := token.split()
+	if retryAfter <= 0 {
+		retryAfter = defaultRateLimitPause
+	}
+	epochMS := strconv.FormatFloat(float64(time.Now().UnixNano()/int64(time.Microsecond))/float64(1000000), 'f', 6, 64)
+	_, err := luaRateLimit.Do(conn, epochMS, qType, queue, priority.Clamp(levels), value, int64(retryAfter/time.Millisecond))
 	return err
 }
 
@@ -232,6 +510,21 @@ var luaDethrottle = redis.NewScript(1, `-- KEYS: [QueueType]
 		end
 		redis.call("del", KEYS[1] .. ":future")
 	end
+
+	-- step the rate of any rate limited queues which are no longer paused back up towards their tps, over about 20 seconds
+	local rates = redis.call("hgetall", KEYS[1] .. ":rates")
+	for i=1,#rates,2 do
+		local queue = rates[i]
+		if redis.call("exists", queue .. ":paused") == 0 then
+			local tps = tonumber(string.sub(queue, string.find(queue, "|")+1))
+			local rate = tonumber(rates[i+1]) + math.max(1, math.floor(tps / 20))
+			if rate >= tps then
+				redis.call("hdel", KEYS[1] .. ":rates", queue)
+			else
+				redis.call("hset", KEYS[1] .. ":rates", queue, rate)
+			end
+		end
+	end
 `)
 
 // StartDethrottler starts a goroutine responsible for dethrottling any queues that were
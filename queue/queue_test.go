@@ -168,6 +168,327 @@ func TestLua(t *testing.T) {
 	assert.Empty(value)
 }
 
+func TestURNOrdering(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	// pops the next value, retrying as needed
+	pop := func() (WorkerToken, string) {
+		token, value, err := PopFromQueue(conn, "msgs")
+		for token == Retry {
+			token, value, err = PopFromQueue(conn, "msgs")
+		}
+		assert.NoError(err)
+		return token, value
+	}
+
+	// two msgs to the same contact and one to another
+	PushOntoQueue(conn, "msgs", "chan1", 0, `[{"id":1,"urn":"tel:+250788000001"}]`, HighPriority)
+	time.Sleep(time.Millisecond)
+	PushOntoQueue(conn, "msgs", "chan1", 0, `[{"id":2,"urn":"tel:+250788000001"}]`, HighPriority)
+	time.Sleep(time.Millisecond)
+	PushOntoQueue(conn, "msgs", "chan1", 0, `[{"id":3,"urn":"tel:+250788000002"}]`, HighPriority)
+
+	token1, value := pop()
+	assert.Equal(WorkerToken("msgs:chan1|0\ttel:+250788000001"), token1)
+	assert.Contains(value, `"id":1`)
+
+	// its URN is locked until it is complete, or our lock expires if its worker never completes it
+	ttl, err := redis.Int(conn.Do("ttl", "msgs:chan1|0:urn:tel:+250788000001"))
+	assert.NoError(err)
+	assert.Equal(int(DefaultURNLockTTL/time.Second), ttl)
+
+	// our second msg has to wait for the first to complete, but the msg to the other contact can be sent in parallel
+	token3, value := pop()
+	assert.Contains(value, `"id":3`)
+
+	token, value := pop()
+	assert.Equal(EmptyQueue, token)
+	assert.Equal("", value)
+
+	// completing the msg to the other contact doesn't help
+	assert.NoError(MarkComplete(conn, "msgs", token3))
+	token, value = pop()
+	assert.Equal(EmptyQueue, token)
+
+	// but completing our first msg does
+	assert.NoError(MarkComplete(conn, "msgs", token1))
+	token2, value := pop()
+	assert.Contains(value, `"id":2`)
+	assert.NoError(MarkComplete(conn, "msgs", token2))
+
+	// the msgs of a compound value are sent one at a time in order, without a delay between them
+	PushOntoQueue(conn, "msgs", "chan1", 0, `[{"id":4,"urn":"tel:+250788000003"},{"id":5,"urn":"tel:+250788000003"}]`, HighPriority)
+
+	token4, value := pop()
+	assert.Contains(value, `"id":4`)
+
+	token, value = pop()
+	assert.Equal(EmptyQueue, token)
+
+	assert.NoError(MarkComplete(conn, "msgs", token4))
+	token5, value := pop()
+	assert.Contains(value, `"id":5`)
+	assert.NoError(MarkComplete(conn, "msgs", token5))
+
+	token, value = pop()
+	assert.Equal(EmptyQueue, token)
+}
+
+func TestPriorities(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	// pops the next value, retrying as needed
+	pop := func(aging time.Duration) string {
+		token, value, err := PopFromPriorityQueue(conn, "msgs", DefaultPriorityLevels, aging, DefaultURNLockTTL)
+		for token == Retry {
+			token, value, err = PopFromPriorityQueue(conn, "msgs", DefaultPriorityLevels, aging, DefaultURNLockTTL)
+		}
+		assert.NoError(err)
+		if token != EmptyQueue {
+			MarkComplete(conn, "msgs", token)
+		}
+		return value
+	}
+
+	PushOntoQueue(conn, "msgs", "chan1", 0, `[{"id":1}]`, LowPriority)
+	PushOntoQueue(conn, "msgs", "chan1", 0, `[{"id":2}]`, HighPriority)
+	PushOntoQueue(conn, "msgs", "chan1", 0, `[{"id":3}]`, TransactionalPriority)
+
+	// without aging, msgs are popped from the highest priority first
+	assert.Equal(`{"id":3}`, pop(0))
+	assert.Equal(`{"id":2}`, pop(0))
+	assert.Equal(`{"id":1}`, pop(0))
+	assert.Equal("", pop(0))
+
+	// with aging, a bulk msg which has waited long enough goes ahead of a newer high priority one
+	PushOntoQueue(conn, "msgs", "chan1", 0, `[{"id":4}]`, LowPriority)
+	time.Sleep(time.Millisecond * 1100)
+	PushOntoQueue(conn, "msgs", "chan1", 0, `[{"id":5}]`, HighPriority)
+
+	assert.Equal(`{"id":4}`, pop(time.Millisecond*500))
+	assert.Equal(`{"id":5}`, pop(time.Millisecond*500))
+
+	// but not one that hasn't waited long enough to be bumped above it
+	PushOntoQueue(conn, "msgs", "chan1", 0, `[{"id":6}]`, LowPriority)
+	PushOntoQueue(conn, "msgs", "chan1", 0, `[{"id":7}]`, HighPriority)
+
+	assert.Equal(`{"id":7}`, pop(time.Second*5))
+	assert.Equal(`{"id":6}`, pop(time.Second*5))
+}
+
+func TestRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	quitter := make(chan bool)
+	wg := &sync.WaitGroup{}
+	StartDethrottler(pool, quitter, wg, "msgs")
+	defer close(quitter)
+
+	// pops the next value, retrying as needed
+	pop := func() (WorkerToken, string) {
+		token, value, err := PopFromQueue(conn, "msgs")
+		for token == Retry {
+			token, value, err = PopFromQueue(conn, "msgs")
+		}
+		assert.NoError(err)
+		return token, value
+	}
+
+	PushOntoQueue(conn, "msgs", "chan1", 10, `[{"id":1}]`, HighPriority)
+	time.Sleep(time.Millisecond)
+	PushOntoQueue(conn, "msgs", "chan1", 10, `[{"id":2}]`, HighPriority)
+
+	// our provider tells us to slow down when we send our first msg
+	token, value := pop()
+	assert.Equal(`{"id":1}`, value)
+	assert.NoError(RateLimitQueue(conn, "msgs", token, "["+value+"]", HighPriority, DefaultPriorityLevels, time.Second))
+	assert.NoError(MarkComplete(conn, "msgs", token))
+
+	// so our queue is paused
+	token, value = pop()
+	assert.Equal(EmptyQueue, token)
+
+	// and will send at half our rate once it resumes
+	rate, err := redis.Int(conn.Do("hget", "msgs:rates", "msgs:chan1|10"))
+	assert.NoError(err)
+	assert.Equal(5, rate)
+
+	// once the pause is over our msg is sent first, and our rate starts recovering
+	time.Sleep(time.Millisecond * 2100)
+	token, value = pop()
+	assert.Equal(`{"id":1}`, value)
+	assert.NoError(MarkComplete(conn, "msgs", token))
+
+	rate, err = redis.Int(conn.Do("hget", "msgs:rates", "msgs:chan1|10"))
+	assert.NoError(err)
+	assert.True(rate > 5 && rate < 10)
+
+	token, value = pop()
+	assert.Equal(`{"id":2}`, value)
+	assert.NoError(MarkComplete(conn, "msgs", token))
+}
+
+func TestBuckets(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	// pops the next value, retrying as needed
+	pop := func() (WorkerToken, string) {
+		token, value, err := PopFromQueue(conn, "msgs")
+		for token == Retry {
+			token, value, err = PopFromQueue(conn, "msgs")
+		}
+		assert.NoError(err)
+		if token != EmptyQueue {
+			MarkComplete(conn, "msgs", token)
+		}
+		return token, value
+	}
+
+	// two channels on the same account, each allowed 10 tps but together only 3
+	for i := 0; i < 5; i++ {
+		PushOntoQueue(conn, "msgs", "chan1", 10, fmt.Sprintf(`[{"id":%d}]`, i), HighPriority)
+		PushOntoQueue(conn, "msgs", "chan2", 10, fmt.Sprintf(`[{"id":%d}]`, 10+i), HighPriority)
+	}
+
+	// buckets can be set when pushing, before our queues have been popped from, or from a popped token
+	token1 := WorkerToken("msgs:chan1|10")
+	assert.NoError(SetBucket(conn, "msgs", "chan1", 10, "account1", 3))
+	assert.NoError(SetQueueBucket(conn, "msgs", WorkerToken("msgs:chan2|10"), "account1", 3))
+
+	// get ourselves aligned with a second boundary
+	time.Sleep(time.Second - time.Duration(time.Now().UnixNano()%int64(time.Second)))
+
+	// only 3 can be popped from across both queues this second
+	popped := 0
+	for token, _ := pop(); token != EmptyQueue; token, _ = pop() {
+		popped++
+	}
+	assert.Equal(3, popped)
+
+	throttled, err := redis.Strings(conn.Do("zrange", "msgs:throttled", 0, -1))
+	assert.NoError(err)
+	assert.Equal(2, len(throttled))
+
+	// removing a queue from its bucket lets it use its own tps again
+	assert.NoError(SetQueueBucket(conn, "msgs", token1, "", 0))
+	buckets, err := redis.StringMap(conn.Do("hgetall", "msgs:buckets"))
+	assert.NoError(err)
+	assert.Equal(map[string]string{"msgs:chan2|10": "account1|3"}, buckets)
+}
+
+func TestPriorityClamp(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(Priority(LowPriority), Priority(-1).Clamp(3))
+	assert.Equal(Priority(HighPriority), Priority(HighPriority).Clamp(3))
+	assert.Equal(Priority(TransactionalPriority), Priority(5).Clamp(3))
+	assert.Equal(Priority(4), Priority(5).Clamp(5))
+	assert.Equal(Priority(TransactionalPriority), Priority(5).Clamp(0))
+
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	// values pushed with priorities we don't pop from are still popped
+	assert.NoError(PushOntoQueue(conn, "msgs", "chan1", 0, `[{"id":1}]`, Priority(7)))
+	assert.NoError(PushOntoPriorityQueue(conn, "msgs", "chan1", 0, `[{"id":2}]`, Priority(7), 5))
+
+	count, err := redis.Int(conn.Do("zcard", "msgs:chan1|0/2"))
+	assert.NoError(err)
+	assert.Equal(1, count)
+	count, err = redis.Int(conn.Do("zcard", "msgs:chan1|0/4"))
+	assert.NoError(err)
+	assert.Equal(1, count)
+
+	token, value, err := PopFromQueue(conn, "msgs")
+	assert.NoError(err)
+	assert.Equal(WorkerToken("msgs:chan1|0"), token)
+	assert.Equal(`{"id":1}`, value)
+}
+
+func TestDefer(t *testing.T) {
+	assert := assert.New(t)
+	pool := getPool()
+	conn := pool.Get()
+	defer conn.Close()
+
+	PushOntoQueue(conn, "msgs", "chan1", 10, `[{"id":1,"urn":"tel:+250788000001"}]`, LowPriority)
+
+	token, value, err := PopFromQueue(conn, "msgs")
+	assert.NoError(err)
+	assert.Equal(`{"id":1,"urn":"tel:+250788000001"}`, value)
+
+	// defer it a couple of seconds
+	until := time.Now().Add(time.Second * 2)
+	assert.NoError(DeferToQueue(conn, "msgs", token, "["+value+"]", LowPriority, DefaultPriorityLevels, until))
+	assert.NoError(MarkComplete(conn, "msgs", token))
+
+	// it's back on its queue at the time it was deferred until
+	score, err := redis.Float64(conn.Do("zscore", "msgs:chan1|10/0", "["+value+"]"))
+	assert.NoError(err)
+	assert.InDelta(float64(until.UnixNano())/float64(time.Second), score, 0.01)
+
+	// and the transaction it used isn't counted against our tps
+	tpsKeys, err := redis.Strings(conn.Do("keys", "msgs:chan1|10:tps:*"))
+	assert.NoError(err)
+	for _, key := range tpsKeys {
+		count, _ := redis.Int(conn.Do("get", key))
+		assert.Equal(0, count)
+	}
+
+	// so it can't be popped yet
+	token, value, err = PopFromQueue(conn, "msgs")
+	for token == Retry {
+		token, value, err = PopFromQueue(conn, "msgs")
+	}
+	assert.Equal(EmptyQueue, token)
+
+	// the dethrottler will make it active again once it is ready
+	futures, err := redis.Strings(conn.Do("zrange", "msgs:future", 0, -1))
+	assert.NoError(err)
+	assert.Equal([]string{"msgs:chan1|10"}, futures)
+
+	// msgs to the same URN deferred until the same time stay in the order they were queued in
+	PushOntoQueue(conn, "msgs", "chan2", 10, `[{"id":9,"urn":"tel:+250788000002"},{"id":10,"urn":"tel:+250788000002"},{"id":11,"urn":"tel:+250788000002"}]`, LowPriority)
+
+	until = time.Now().Add(time.Millisecond * 500)
+	for i := 0; i < 3; i++ {
+		token, value, err = PopFromQueue(conn, "msgs")
+		for token == Retry {
+			token, value, err = PopFromQueue(conn, "msgs")
+		}
+		assert.NoError(err)
+		assert.NoError(DeferToQueue(conn, "msgs", token, "["+value+"]", LowPriority, DefaultPriorityLevels, until))
+		assert.NoError(MarkComplete(conn, "msgs", token))
+	}
+
+	deferred, err := redis.Strings(conn.Do("zrange", "msgs:chan2|10/0", 0, -1))
+	assert.NoError(err)
+	assert.Equal([]string{
+		`[{"id":9,"urn":"tel:+250788000002"}]`,
+		`[{"id":10,"urn":"tel:+250788000002"}]`,
+		`[{"id":11,"urn":"tel:+250788000002"}]`,
+	}, deferred)
+
+	// each offset by how many were deferred until that time before them, however many that is
+	first, err := redis.Float64(conn.Do("zscore", "msgs:chan2|10/0", `[{"id":9,"urn":"tel:+250788000002"}]`))
+	assert.NoError(err)
+	last, err := redis.Float64(conn.Do("zscore", "msgs:chan2|10/0", `[{"id":11,"urn":"tel:+250788000002"}]`))
+	assert.NoError(err)
+	assert.InDelta(0.000002, last-first, 0.0000005)
+}
+
 func nTestThrottle(t *testing.T) {
 	assert := assert.New(t)
 	pool := getPool()
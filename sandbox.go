@@ -0,0 +1,142 @@
+package courier
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/courier/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// the response our sandbox gives to every request a handler makes
+const sandboxResponseBody = `{}`
+
+// isSandboxed returns whether msgs to the passed in channel are sandboxed, either because it is configured to be or
+// because we are running in sandbox mode
+func isSandboxed(config *Config, channel Channel) bool {
+	return config.Sandbox || fmt.Sprintf("%v", channel.ConfigForKey(ConfigSandbox, false)) == "true"
+}
+
+// sandboxSend sends the passed in msg through its channel's handler, but with every request the handler makes to its
+// provider stubbed instead of sent. The requests are recorded in the handler's channel logs as usual, so they can be
+// checked against what the provider expects. If the handler made any requests the msg is wired, as our stubbed
+// responses aren't what providers reply with, otherwise the handler's status is returned as it failed before sending.
+func sandboxSend(ctx context.Context, s *server, msg Msg) (MsgStatus, error) {
+	start := time.Now()
+	transport := &sandboxTransport{msg: msg}
+
+	status, err := s.sendMsg(utils.WithRequestStub(ctx, transport), msg)
+	stubbed := transport.Stubbed()
+	if stubbed == 0 {
+		return status, err
+	}
+
+	description := fmt.Sprintf("%d request(s) stubbed, each given a 200 response of %s", stubbed, sandboxResponseBody)
+	if err != nil {
+		description += fmt.Sprintf("\nhandler reported: %s", err)
+	}
+
+	sandboxed := s.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), MsgWired)
+	sandboxed.SetExternalID(fmt.Sprintf("sandbox-%s", msg.ID().String()))
+	if status != nil {
+		for _, log := range status.Logs() {
+			sandboxed.AddLog(log)
+		}
+	}
+	sandboxed.AddLog(NewChannelLog("Message Sandboxed", msg.Channel(), msg.ID(), "", "", NilStatusCode, "", description, time.Now().Sub(start), nil))
+
+	return sandboxed, nil
+}
+
+// sandboxTransport stands in for the network for the requests made while sending a sandboxed msg. Downloads of the msg's
+// own attachments are made for real, so that media can be constrained and uploaded as normal, but every other request
+// is given a stubbed response without being sent.
+type sandboxTransport struct {
+	msg     Msg
+	mutex   sync.Mutex
+	stubbed int
+}
+
+// RoundTrip satisfies the http.RoundTripper interface
+func (t *sandboxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && t.isAttachment(req.URL.String()) {
+		return utils.GetHTTPClient().Transport.RoundTrip(req)
+	}
+
+	t.mutex.Lock()
+	t.stubbed++
+	t.mutex.Unlock()
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(strings.NewReader(sandboxResponseBody)),
+		ContentLength: int64(len(sandboxResponseBody)),
+		Request:       req,
+	}, nil
+}
+
+// Stubbed returns the number of requests we have stubbed
+func (t *sandboxTransport) Stubbed() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.stubbed
+}
+
+// isAttachment returns whether the passed in URL is one of our msg's attachments, which may have been replaced by
+// constrained versions during sending
+func (t *sandboxTransport) isAttachment(url string) bool {
+	for _, attachment := range t.msg.Attachments() {
+		parts := strings.SplitN(attachment, ":", 2)
+		if len(parts) == 2 && parts[1] == url {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleSandboxStatuses schedules the sent and delivered statuses of the passed in sandboxed msg according to our config
+func scheduleSandboxStatuses(server Server, msg Msg) {
+	scheduleSandboxStatus(server, msg, MsgSent, server.Config().SandboxSentDelay)
+	scheduleSandboxStatus(server, msg, MsgDelivered, server.Config().SandboxDeliveredDelay)
+}
+
+// scheduleSandboxStatus writes a status for the passed in sandboxed msg after the passed in number of seconds, as if
+// reported by the channel. A negative delay means we never write it, and statuses which are still waiting when we stop
+// are never written.
+func scheduleSandboxStatus(server Server, msg Msg, statusValue MsgStatusValue, delay int) {
+	if delay < 0 {
+		return
+	}
+
+	server.WaitGroup().Add(1)
+	go func() {
+		defer server.WaitGroup().Done()
+
+		select {
+		case <-time.After(time.Duration(delay) * time.Second):
+		case <-server.StopChan():
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		status := server.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), statusValue)
+		status.SetRawStatus("sandbox")
+		err := server.Backend().WriteMsgStatus(ctx, status)
+		if err != nil {
+			logrus.WithError(err).WithField("msg_id", msg.ID().String()).Error("error writing sandbox status")
+		}
+	}()
+}
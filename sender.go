@@ -3,17 +3,32 @@ package courier
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/nyaruka/courier/librato"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// sendTimeout is the longest we spend sending a msg, including failing over to a fallback channel
+	sendTimeout = time.Second * 35
+
+	// statusTimeout is the longest we spend writing the status and logs of a msg once we have tried to send it
+	statusTimeout = time.Second * 10
+
+	// MaxSendDuration is the longest a sender spends on a msg, from being given it to marking it as complete
+	MaxSendDuration = sendTimeout + statusTimeout
+)
+
 // Foreman takes care of managing our set of sending workers and assigns msgs for each to send
 type Foreman struct {
 	server           Server
 	senders          []*Sender
 	availableSenders chan *Sender
+	circuits         *circuitBreaker
 	quit             chan bool
 }
 
@@ -23,6 +38,7 @@ func NewForeman(server Server, maxSenders int) *Foreman {
 		server:           server,
 		senders:          make([]*Sender, maxSenders),
 		availableSenders: make(chan *Sender, maxSenders),
+		circuits:         newCircuitBreaker(),
 		quit:             make(chan bool),
 	}
 
@@ -155,11 +171,13 @@ func (w *Sender) sendMessage(msg Msg) {
 	log := logrus.WithField("comp", "sender").WithField("sender_id", w.id).WithField("channel_uuid", msg.Channel().UUID())
 
 	var status MsgStatus
+	sentMsg := msg
+	sandboxed := false
 	server := w.foreman.server
 	backend := server.Backend()
 
 	// we don't want any individual send taking more than 35s
-	sendCTX, cancel := context.WithTimeout(context.Background(), time.Second*35)
+	sendCTX, cancel := context.WithTimeout(context.Background(), sendTimeout)
 	defer cancel()
 
 	msgLog := log.WithField("msg_id", msg.ID().String()).WithField("msg_text", msg.Text()).WithField("msg_urn", msg.URN().Identity())
@@ -184,34 +202,50 @@ func (w *Sender) sendMessage(msg Msg) {
 		// if this message was already sent, create a wired status for it
 		status = backend.NewMsgStatusForID(msg.Channel(), msg.ID(), MsgWired)
 		msgLog.Warning("duplicate send, marking as wired")
+	} else if msg.ExpiresOn() != nil && start.After(*msg.ExpiresOn()) {
+		// if this message expired while it was queued, fail it instead of sending it
+		status = backend.NewMsgStatusForID(msg.Channel(), msg.ID(), MsgFailed)
+		status.SetError(MsgErrorExpired, "")
+		status.AddLog(NewChannelLogFromError("Message Expired", msg.Channel(), msg.ID(), time.Duration(0), fmt.Errorf("message expired on %s", msg.ExpiresOn().Format(time.RFC3339))))
+		msgLog.WithField("expires_on", *msg.ExpiresOn()).Warning("msg expired, marking as failed")
+		librato.Default.AddGauge(fmt.Sprintf("courier.msg_expired_%s", msg.Channel().ChannelType()), 1)
 	} else {
-		// send our message
-		status, err = server.SendMsg(sendCTX, msg)
+		// send our message, through our fallback channel if our channel is failing
+		sentMsg, status, err = w.sendWithFailover(sendCTX, msg, msgLog)
 		duration := time.Now().Sub(start)
 		secondDuration := float64(duration) / float64(time.Second)
 
+		// if our provider told us we're sending too fast, put this msg back on our queue instead of recording an error
+		if rateLimitErr, isRateLimited := err.(*RateLimitedError); isRateLimited && sentMsg == msg {
+			w.requeueRateLimitedMsg(msg, status, rateLimitErr, msgLog.WithField("elapsed", duration))
+			return
+		}
+
 		if err != nil {
 			msgLog.WithError(err).WithField("elapsed", duration).Error("error sending message")
-			if status == nil {
-				status = backend.NewMsgStatusForID(msg.Channel(), msg.ID(), MsgErrored)
-				status.AddLog(NewChannelLogFromError("Sending Error", msg.Channel(), msg.ID(), duration, err))
-			}
 		}
 
+		// msgs sent through sandboxed channels are wired without having been sent to their provider
+		sandboxed = status.Status() == MsgWired && isSandboxed(server.Config(), sentMsg.Channel())
+
 		// report to librato and log locally
 		if status.Status() == MsgErrored || status.Status() == MsgFailed {
 			msgLog.WithField("elapsed", duration).Warning("msg errored")
-			librato.Default.AddGauge(fmt.Sprintf("courier.msg_send_error_%s", msg.Channel().ChannelType()), secondDuration)
+			librato.Default.AddGauge(fmt.Sprintf("courier.msg_send_error_%s", sentMsg.Channel().ChannelType()), secondDuration)
+		} else if sandboxed {
+			msgLog.WithField("elapsed", duration).Info("msg sandboxed")
 		} else {
 			msgLog.WithField("elapsed", duration).Info("msg sent")
-			librato.Default.AddGauge(fmt.Sprintf("courier.msg_send_%s", msg.Channel().ChannelType()), secondDuration)
+			librato.Default.AddGauge(fmt.Sprintf("courier.msg_send_%s", sentMsg.Channel().ChannelType()), secondDuration)
 		}
 	}
 
 	// we allot 10 seconds to write our status to the db
-	writeCTX, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	writeCTX, cancel := context.WithTimeout(context.Background(), statusTimeout)
 	defer cancel()
 
+	status.SetSource(MsgStatusSourceSend)
+
 	err = backend.WriteMsgStatus(writeCTX, status)
 	if err != nil {
 		msgLog.WithError(err).Info("error writing msg status")
@@ -225,4 +259,222 @@ func (w *Sender) sendMessage(msg Msg) {
 
 	// mark our send task as complete
 	backend.MarkOutgoingMsgComplete(writeCTX, msg, status)
+
+	// sandboxed msgs go on to be sent and delivered without any callbacks from the channel
+	if sandboxed {
+		scheduleSandboxStatuses(server, sentMsg)
+	}
+}
+
+// prepareText replaces the links in the passed in msg with short links and adds compliance text to it, if its channel
+// wants them. Links are shortened first so the compliance text is sent exactly as configured. If we can't shorten links
+// we send the original links.
+func (w *Sender) prepareText(ctx context.Context, msg Msg, msgLog *logrus.Entry) Msg {
+	msg, err := shortenLinks(ctx, w.foreman.server, msg)
+	if err != nil {
+		msgLog.WithError(err).Error("error shortening links")
+	}
+
+	msg, err = addComplianceText(ctx, w.foreman.server, msg)
+	if err != nil {
+		msgLog.WithError(err).Error("error adding compliance text")
+	}
+	return msg
+}
+
+// requeueRateLimitedMsg puts the passed in msg back on its queue because our provider rate limited us, writing the logs of
+// the send attempt but no status, so it isn't counted as an error. The msg isn't marked as complete as it hasn't been sent.
+func (w *Sender) requeueRateLimitedMsg(msg Msg, status MsgStatus, rateLimitErr *RateLimitedError, msgLog *logrus.Entry) {
+	backend := w.foreman.server.Backend()
+
+	writeCTX, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	msgLog.WithField("retry_after", rateLimitErr.RetryAfter).Warning("rate limited, requeuing msg")
+	librato.Default.AddGauge(fmt.Sprintf("courier.msg_rate_limited_%s", msg.Channel().ChannelType()), 1)
+
+	err := backend.RequeueRateLimitedMsg(writeCTX, msg, rateLimitErr.RetryAfter)
+	if err != nil {
+		msgLog.WithError(err).Error("error requeuing rate limited msg")
+	}
+
+	if status != nil {
+		err = backend.WriteChannelLogs(writeCTX, status.Logs())
+		if err != nil {
+			msgLog.WithError(err).Info("error writing msg logs")
+		}
+	}
+}
+
+// sendWithFailover sends the passed in msg through its channel, unless that channel's circuit is open, falling back to
+// the channel's fallback channel if it has one and the send fails definitively. The text of the msg is prepared for
+// whichever channel sends it. Returns the msg as sent, which is on the
+// fallback channel if we failed over, its status and any error. If the fallback channel can't send it either, the msg is
+// moved back to its own channel.
+func (w *Sender) sendWithFailover(ctx context.Context, msg Msg, msgLog *logrus.Entry) (Msg, MsgStatus, error) {
+	backend := w.foreman.server.Backend()
+	circuits := w.foreman.circuits
+	fallback := w.fallbackChannel(ctx, msg, msgLog)
+
+	// our own channel's links, compliance text and encoding policy may change our text, so remember what it was for our
+	// fallback channel
+	text := msg.Text()
+	msg = w.prepareText(ctx, msg, msgLog)
+
+	var status MsgStatus
+	var err error
+	var reason string
+
+	if fallback != nil && circuits.IsOpen(msg.Channel().UUID()) {
+		reason = "channel circuit is open"
+	} else {
+		status, err = w.sendThrough(ctx, msg)
+
+		failed := isChannelFailure(status)
+		if _, isRateLimited := err.(*RateLimitedError); !isRateLimited {
+			circuits.RecordSend(msg.Channel().UUID(), failed)
+		}
+		if fallback == nil || !isDefinitiveFailure(status) {
+			return msg, status, err
+		}
+
+		reason = "send failed"
+		msgLog.WithError(err).Warning("msg send failed, failing over to fallback channel")
+
+		// write the logs of our failed attempt, the status will be for the fallback channel
+		logErr := backend.WriteChannelLogs(ctx, status.Logs())
+		if logErr != nil {
+			msgLog.WithError(logErr).Info("error writing msg logs")
+		}
+	}
+
+	rerouted, rerouteErr := backend.RerouteOutgoingMsg(ctx, msg, fallback)
+	if rerouteErr != nil {
+		msgLog.WithError(rerouteErr).Error("error rerouting msg to fallback channel")
+		if status == nil {
+			status, err = w.sendThrough(ctx, msg)
+		}
+		return msg, status, err
+	}
+
+	// our fallback channel gets our text as it was before our own channel changed it, prepared for itself instead
+	rerouted = w.prepareText(ctx, rerouted.WithText(text), msgLog)
+
+	rerouteLog := NewChannelLog(fmt.Sprintf("Message Rerouted from %s because %s", msg.Channel().UUID(), reason), fallback,
+		msg.ID(), "", "", NilStatusCode, "", "", time.Duration(0), nil)
+	librato.Default.AddGauge(fmt.Sprintf("courier.msg_failover_%s", msg.Channel().ChannelType()), 1)
+
+	fallbackStatus, fallbackErr := w.sendThrough(ctx, rerouted)
+	circuits.RecordSend(fallback.UUID(), isChannelFailure(fallbackStatus))
+
+	if fallbackStatus.Status() != MsgErrored && fallbackStatus.Status() != MsgFailed {
+		fallbackStatus.AddLog(rerouteLog)
+		return rerouted, fallbackStatus, fallbackErr
+	}
+
+	// our fallback channel couldn't send it either, so move our msg back to its own channel where it will be retried
+	_, rerouteErr = backend.RerouteOutgoingMsg(ctx, rerouted, msg.Channel())
+	if rerouteErr != nil {
+		msgLog.WithError(rerouteErr).Error("error moving msg back from fallback channel")
+		fallbackStatus.AddLog(rerouteLog)
+		return rerouted, fallbackStatus, fallbackErr
+	}
+
+	status = backend.NewMsgStatusForID(msg.Channel(), msg.ID(), fallbackStatus.Status())
+	status.SetError(fallbackStatus.ErrorCategory(), fallbackStatus.ErrorCode())
+	for _, log := range fallbackStatus.Logs() {
+		status.AddLog(log)
+	}
+	status.AddLog(rerouteLog)
+
+	return msg, status, fallbackErr
+}
+
+// sendThrough sends the passed in msg through its channel, always returning a status
+func (w *Sender) sendThrough(ctx context.Context, msg Msg) (MsgStatus, error) {
+	start := time.Now()
+	status, err := w.foreman.server.SendMsg(ctx, msg)
+	if err != nil && status == nil {
+		status = w.foreman.server.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), MsgErrored)
+		status.AddLog(NewChannelLogFromError("Sending Error", msg.Channel(), msg.ID(), time.Now().Sub(start), err))
+	}
+
+	// handlers which don't report rate limiting themselves still get requeued if their provider rate limited them
+	if err == nil {
+		if rateLimitErr := rateLimitErrorForStatus(status); rateLimitErr != nil {
+			err = rateLimitErr
+		}
+	}
+	return status, err
+}
+
+// matches the Retry-After header of a response when it is a number of seconds
+var retryAfterRegex = regexp.MustCompile(`(?im)^Retry-After:\s*(\d+)\s*$`)
+
+// rateLimitErrorForStatus returns a rate limited error if the passed in status of a failed send is rate limited, either
+// because of its error category or because the last request it logs got a 429 response, otherwise nil. The time to
+// retry after comes from the Retry-After header of that response if it has one.
+func rateLimitErrorForStatus(status MsgStatus) *RateLimitedError {
+	if status == nil || (status.Status() != MsgErrored && status.Status() != MsgFailed) || len(status.Logs()) == 0 {
+		return nil
+	}
+
+	last := status.Logs()[len(status.Logs())-1]
+	if status.ErrorCategory() != MsgErrorRateLimited && last.StatusCode != http.StatusTooManyRequests {
+		return nil
+	}
+
+	rateLimitErr := &RateLimitedError{}
+	if match := retryAfterRegex.FindStringSubmatch(last.Response); match != nil {
+		seconds, _ := strconv.Atoi(match[1])
+		rateLimitErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return rateLimitErr
+}
+
+// fallbackChannel returns the fallback channel of the passed in msg's channel, or nil if it doesn't have one which can
+// send to the msg's URN
+func (w *Sender) fallbackChannel(ctx context.Context, msg Msg, msgLog *logrus.Entry) Channel {
+	uuid := msg.Channel().StringConfigForKey(ConfigFallbackChannelUUID, "")
+	if uuid == "" {
+		return nil
+	}
+
+	channelUUID, err := NewChannelUUID(uuid)
+	if err != nil || channelUUID == msg.Channel().UUID() {
+		msgLog.WithField("fallback_channel_uuid", uuid).Error("invalid fallback channel")
+		return nil
+	}
+
+	fallback, err := w.foreman.server.Backend().GetChannel(ctx, AnyChannelType, channelUUID)
+	if err != nil {
+		msgLog.WithError(err).WithField("fallback_channel_uuid", uuid).Error("error getting fallback channel")
+		return nil
+	}
+
+	for _, scheme := range fallback.Schemes() {
+		if scheme == msg.URN().Scheme() {
+			return fallback
+		}
+	}
+	return nil
+}
+
+// isChannelFailure returns whether the passed in status is a failure of the channel, rather than one caused by the
+// contact or content of the msg
+func isChannelFailure(status MsgStatus) bool {
+	if status.Status() != MsgErrored && status.Status() != MsgFailed {
+		return false
+	}
+
+	switch status.ErrorCategory() {
+	case MsgErrorInvalidURN, MsgErrorOptedOut, MsgErrorContentRejected, MsgErrorRateLimited:
+		return false
+	}
+	return true
+}
+
+// isDefinitiveFailure returns whether the passed in status is a channel failure that retrying won't fix
+func isDefinitiveFailure(status MsgStatus) bool {
+	return isChannelFailure(status) && (status.Status() == MsgFailed || status.ErrorCategory() == MsgErrorAuthFailure)
 }
@@ -1,6 +1,9 @@
 package courier
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -79,3 +82,322 @@ func TestSending(t *testing.T) {
 	assert.Equal(msg.ID(), mb.msgStatuses[0].ID())
 	assert.Equal(MsgWired, mb.msgStatuses[0].Status())
 }
+
+func TestSendingInOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	// create our backend and server
+	mb := NewMockBackend()
+	s := NewServer(testConfig(), mb)
+
+	// start everything
+	s.Start()
+	defer s.Stop()
+
+	dmChannel := NewMockChannel("e4bb1578-29da-4fa5-a214-9da19dd24230", "DM", "2020", "US", map[string]interface{}{})
+
+	// queue up several msgs to the same contact, and one to another
+	for i := 0; i < 5; i++ {
+		mb.PushOutgoingMsg(&mockMsg{channel: dmChannel, id: NewMsgID(int64(200 + i)), text: "in order", urn: "tel:+250788383383"})
+	}
+	mb.PushOutgoingMsg(&mockMsg{channel: dmChannel, id: NewMsgID(300), text: "other contact", urn: "tel:+250788383384"})
+
+	time.Sleep(time.Second)
+
+	// all should have been sent, those to our first contact in the order they were queued
+	assert.Equal(6, len(mb.msgStatuses))
+
+	ids := make([]MsgID, 0)
+	for _, status := range mb.msgStatuses {
+		if status.ID() != NewMsgID(300) {
+			ids = append(ids, status.ID())
+		}
+	}
+	assert.Equal([]MsgID{NewMsgID(200), NewMsgID(201), NewMsgID(202), NewMsgID(203), NewMsgID(204)}, ids)
+}
+
+func TestSendingExpired(t *testing.T) {
+	assert := assert.New(t)
+
+	// create our backend and server
+	mb := NewMockBackend()
+	s := NewServer(testConfig(), mb)
+
+	// start everything
+	s.Start()
+	defer s.Stop()
+
+	dmChannel := NewMockChannel("e4bb1578-29da-4fa5-a214-9da19dd24230", "DM", "2020", "US", map[string]interface{}{})
+
+	// one msg which expired while queued, one which hasn't expired yet
+	expired := time.Now().Add(-time.Minute)
+	notExpired := time.Now().Add(time.Minute)
+	mb.PushOutgoingMsg(&mockMsg{channel: dmChannel, id: NewMsgID(401), text: "your code is 1234", urn: "tel:+250788383383", expiresOn: &expired})
+	mb.PushOutgoingMsg(&mockMsg{channel: dmChannel, id: NewMsgID(402), text: "your code is 5678", urn: "tel:+250788383384", expiresOn: &notExpired})
+
+	time.Sleep(time.Second)
+
+	assert.Equal(2, len(mb.msgStatuses))
+	for _, status := range mb.msgStatuses {
+		if status.ID() == NewMsgID(401) {
+			assert.Equal(MsgFailed, status.Status())
+			assert.Equal(MsgErrorExpired, status.ErrorCategory())
+			assert.Equal(1, len(status.Logs()))
+		} else {
+			assert.Equal(MsgSent, status.Status())
+		}
+	}
+}
+
+func TestSendingRateLimited(t *testing.T) {
+	assert := assert.New(t)
+
+	// create our backend and server
+	mb := NewMockBackend()
+	s := NewServer(testConfig(), mb)
+
+	// start everything
+	s.Start()
+	defer s.Stop()
+
+	dmChannel := NewMockChannel("e4bb1578-29da-4fa5-a214-9da19dd24230", "DM", "2020", "US", map[string]interface{}{})
+	msg := &mockMsg{channel: dmChannel, id: NewMsgID(501), text: "rate limit me", urn: "tel:+250788383383"}
+	mb.PushOutgoingMsg(msg)
+
+	time.Sleep(time.Second)
+
+	// our msg is requeued rather than getting an errored status, and isn't marked as sent
+	mb.mutex.RLock()
+	assert.Equal(0, len(mb.msgStatuses))
+	assert.Equal([]Msg{msg}, mb.rateLimitedMsgs)
+	assert.False(mb.sentMsgs[msg.ID()])
+	assert.Equal(0, len(mb.sendingURNs))
+	mb.mutex.RUnlock()
+
+	// handlers which don't report rate limiting themselves are rate limited by a 429 from their provider
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer provider.Close()
+
+	urlChannel := NewMockChannel("53e5aafa-8155-449d-9009-fcb30d54bd26", "DM", "2021", "US", map[string]interface{}{ConfigSendURL: provider.URL})
+	msg = &mockMsg{channel: urlChannel, id: NewMsgID(502), text: "hello", urn: "tel:+250788383383"}
+	mb.PushOutgoingMsg(msg)
+
+	time.Sleep(time.Second)
+
+	mb.mutex.RLock()
+	assert.Equal(0, len(mb.msgStatuses))
+	assert.Equal(msg, mb.rateLimitedMsgs[1])
+	mb.mutex.RUnlock()
+}
+
+func TestRateLimitErrorForStatus(t *testing.T) {
+	mb := NewMockBackend()
+	channel := NewMockChannel("e4bb1578-29da-4fa5-a214-9da19dd24230", "DM", "2020", "US", map[string]interface{}{})
+
+	newStatus := func(value MsgStatusValue, statusCode int, response string) MsgStatus {
+		status := mb.NewMsgStatusForID(channel, NewMsgID(501), value)
+		status.AddLog(&ChannelLog{Description: "Message Sent", StatusCode: statusCode, Response: response})
+		return status
+	}
+
+	assert.Nil(t, rateLimitErrorForStatus(nil))
+	assert.Nil(t, rateLimitErrorForStatus(newStatus(MsgErrored, 500, "HTTP/1.1 500 Internal Server Error\r\n\r\n")))
+	assert.Nil(t, rateLimitErrorForStatus(newStatus(MsgWired, 429, "HTTP/1.1 429 Too Many Requests\r\n\r\n")))
+	assert.Equal(t, &RateLimitedError{}, rateLimitErrorForStatus(newStatus(MsgErrored, 429, "HTTP/1.1 429 Too Many Requests\r\n\r\n")))
+	assert.Equal(t, &RateLimitedError{RetryAfter: 30 * time.Second}, rateLimitErrorForStatus(newStatus(MsgErrored, 429, "HTTP/1.1 429 Too Many Requests\r\nRetry-After: 30\r\n\r\n")))
+
+	categorized := newStatus(MsgErrored, 400, "HTTP/1.1 400 Bad Request\r\n\r\n")
+	categorized.SetError(MsgErrorRateLimited, "")
+	assert.Equal(t, &RateLimitedError{}, rateLimitErrorForStatus(categorized))
+}
+
+func TestSendingFailover(t *testing.T) {
+	assert := assert.New(t)
+
+	// create our backend and server
+	mb := NewMockBackend()
+	s := NewServer(testConfig(), mb)
+
+	// start everything
+	s.Start()
+	defer s.Stop()
+
+	fallback := NewMockChannel("b0c4e8f6-cd8b-4a53-9d7d-3b8ee2c8b6c1", "DM", "2021", "US", map[string]interface{}{})
+	primary := NewMockChannel("e4bb1578-29da-4fa5-a214-9da19dd24230", "DM", "down", "US", map[string]interface{}{
+		ConfigFallbackChannelUUID: "b0c4e8f6-cd8b-4a53-9d7d-3b8ee2c8b6c1",
+	})
+	mb.AddChannel(fallback)
+	mb.AddChannel(primary)
+
+	// our msg fails on its own channel so is sent through the fallback
+	mb.PushOutgoingMsg(&mockMsg{channel: primary, id: NewMsgID(601), text: "hello", urn: "tel:+250788383383"})
+	time.Sleep(time.Second)
+
+	assert.Equal(1, len(mb.msgStatuses))
+	assert.Equal(MsgSent, mb.msgStatuses[0].Status())
+	assert.Equal(fallback.UUID(), mb.msgStatuses[0].ChannelUUID())
+	assert.Equal("Message Rerouted from e4bb1578-29da-4fa5-a214-9da19dd24230 because send failed", mb.msgStatuses[0].Logs()[0].Description)
+
+	// URNs the fallback channel can't send to aren't rerouted
+	mb.msgStatuses = nil
+	mb.PushOutgoingMsg(&mockMsg{channel: primary, id: NewMsgID(602), text: "hello", urn: "telegram:12345"})
+	time.Sleep(time.Second)
+
+	assert.Equal(1, len(mb.msgStatuses))
+	assert.Equal(MsgFailed, mb.msgStatuses[0].Status())
+	assert.Equal(primary.UUID(), mb.msgStatuses[0].ChannelUUID())
+
+	// our fallback channel gets our text as it was before the encoding policy of our own channel changed it
+	sentTexts := make(chan string, 1)
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		sentTexts <- string(body)
+		w.Write([]byte("id:1234"))
+	}))
+	defer provider.Close()
+
+	urlFallback := NewMockChannel("0cd4e5e2-6f0e-4b43-9f0b-1f2a6a1e7a3c", "DM", "2022", "US", map[string]interface{}{ConfigSendURL: provider.URL})
+	smartPrimary := NewMockChannel("6a7d8c3b-3b8a-4c7e-8b0e-2a5f0a4c9d11", "DM", "down", "US", map[string]interface{}{
+		ConfigFallbackChannelUUID: "0cd4e5e2-6f0e-4b43-9f0b-1f2a6a1e7a3c",
+		ConfigEncodingPolicy:      EncodingPolicySmart,
+	})
+	mb.AddChannel(urlFallback)
+	mb.AddChannel(smartPrimary)
+
+	mb.msgStatuses = nil
+	mb.PushOutgoingMsg(&mockMsg{channel: smartPrimary, id: NewMsgID(603), text: "“hello”", urn: "tel:+250788383383"})
+	time.Sleep(time.Second)
+
+	assert.Equal("“hello”", <-sentTexts)
+	assert.Equal(1, len(mb.msgStatuses))
+	assert.Equal(MsgWired, mb.msgStatuses[0].Status())
+	assert.Equal(urlFallback.UUID(), mb.msgStatuses[0].ChannelUUID())
+
+	// our fallback channel gets its own compliance text instead of that of our own channel
+	compliantFallback := NewMockChannel("5d1e2f3a-4b5c-4d6e-8f7a-9b0c1d2e3f4a", "DM", "2023", "US", map[string]interface{}{
+		ConfigSendURL:          provider.URL,
+		ConfigComplianceSuffix: "Reply STOP to opt out",
+	})
+	compliantPrimary := NewMockChannel("7e8f9a0b-1c2d-4e3f-a4b5-c6d7e8f9a0b1", "DM", "down", "US", map[string]interface{}{
+		ConfigFallbackChannelUUID: "5d1e2f3a-4b5c-4d6e-8f7a-9b0c1d2e3f4a",
+		ConfigCompliancePrefix:    "{{channel_address}}:",
+	})
+	mb.AddChannel(compliantFallback)
+	mb.AddChannel(compliantPrimary)
+
+	mb.msgStatuses = nil
+	mb.PushOutgoingMsg(&mockMsg{channel: compliantPrimary, id: NewMsgID(605), text: "Big sale!", urn: "tel:+250788383383"})
+	time.Sleep(time.Second)
+
+	assert.Equal("Big sale!\nReply STOP to opt out", <-sentTexts)
+	assert.Equal(1, len(mb.msgStatuses))
+	assert.Equal(MsgWired, mb.msgStatuses[0].Status())
+	assert.Equal(compliantFallback.UUID(), mb.msgStatuses[0].ChannelUUID())
+
+	// if our fallback channel can't send it either, our msg is moved back to its own channel
+	downFallback := NewMockChannel("9f3b1c2d-5e6f-4a7b-8c9d-0e1f2a3b4c5d", "DM", "down", "US", map[string]interface{}{})
+	doublyDown := NewMockChannel("2c4e6a8b-1d3f-4b5a-9c7e-8f0a1b2c3d4e", "DM", "down", "US", map[string]interface{}{
+		ConfigFallbackChannelUUID: "9f3b1c2d-5e6f-4a7b-8c9d-0e1f2a3b4c5d",
+	})
+	mb.AddChannel(downFallback)
+	mb.AddChannel(doublyDown)
+
+	mb.msgStatuses = nil
+	mb.PushOutgoingMsg(&mockMsg{channel: doublyDown, id: NewMsgID(604), text: "hello", urn: "tel:+250788383383"})
+	time.Sleep(time.Second)
+
+	assert.Equal(1, len(mb.msgStatuses))
+	assert.Equal(MsgFailed, mb.msgStatuses[0].Status())
+	assert.Equal(doublyDown.UUID(), mb.msgStatuses[0].ChannelUUID())
+	assert.Equal("Message Rerouted from 2c4e6a8b-1d3f-4b5a-9c7e-8f0a1b2c3d4e because send failed", mb.msgStatuses[0].Logs()[0].Description)
+}
+
+func TestSendingSandbox(t *testing.T) {
+	assert := assert.New(t)
+
+	// create our backend and server, with sandboxed msgs sent immediately and delivered a second later
+	mb := NewMockBackend()
+	config := testConfig()
+	config.SandboxSentDelay = 0
+	config.SandboxDeliveredDelay = 1
+	s := NewServer(config, mb)
+
+	// start everything
+	s.Start()
+	defer s.Stop()
+
+	// the send URL of our channel doesn't exist, so sends to it would fail if they were really made
+	dmChannel := NewMockChannel("e4bb1578-29da-4fa5-a214-9da19dd24230", "DM", "2020", "US", map[string]interface{}{
+		ConfigSandbox: true,
+		ConfigSendURL: "http://sandbox.invalid/send",
+	})
+	mb.PushOutgoingMsg(&mockMsg{channel: dmChannel, id: NewMsgID(701), text: "hello world", urn: "tel:+250788383383"})
+
+	// sandboxed channels still fail msgs their handler can't send without making any requests
+	downChannel := NewMockChannel("53e5aafa-8155-449d-9009-fcb30d54bd26", "DM", "down", "US", map[string]interface{}{ConfigSandbox: true})
+	mb.PushOutgoingMsg(&mockMsg{channel: downChannel, id: NewMsgID(702), text: "hello world", urn: "tel:+250788383384"})
+
+	// msgs rerouted to a sandboxed fallback channel are sandboxed too, even if their own channel isn't
+	requests := 0
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("id:1234"))
+	}))
+	defer provider.Close()
+
+	fallback := NewMockChannel("0cd4e5e2-6f0e-4b43-9f0b-1f2a6a1e7a3c", "DM", "2022", "US", map[string]interface{}{
+		ConfigSandbox: true,
+		ConfigSendURL: provider.URL,
+	})
+	primary := NewMockChannel("6a7d8c3b-3b8a-4c7e-8b0e-2a5f0a4c9d11", "DM", "down", "US", map[string]interface{}{
+		ConfigFallbackChannelUUID: "0cd4e5e2-6f0e-4b43-9f0b-1f2a6a1e7a3c",
+	})
+	mb.AddChannel(fallback)
+	mb.AddChannel(primary)
+	mb.PushOutgoingMsg(&mockMsg{channel: primary, id: NewMsgID(703), text: "hello world", urn: "tel:+250788383385"})
+
+	time.Sleep(time.Millisecond * 1500)
+
+	mb.mutex.RLock()
+	statuses := make(map[MsgID][]MsgStatus)
+	for _, status := range mb.msgStatuses {
+		statuses[status.ID()] = append(statuses[status.ID()], status)
+	}
+	mb.mutex.RUnlock()
+
+	// our handler's request is logged but not made, and its stubbed response gives it no external id
+	if assert.Equal(3, len(statuses[NewMsgID(701)])) {
+		wired := statuses[NewMsgID(701)][0]
+		assert.Equal(MsgWired, wired.Status())
+		assert.Equal("sandbox-701", wired.ExternalID())
+		if assert.Equal(2, len(wired.Logs())) {
+			assert.Equal("http://sandbox.invalid/send", wired.Logs()[0].URL)
+			assert.Contains(wired.Logs()[0].Request, "POST /send HTTP/1.1")
+			assert.Contains(wired.Logs()[0].Request, "hello world")
+			assert.Equal(200, wired.Logs()[0].StatusCode)
+			assert.Equal("Message Sandboxed", wired.Logs()[1].Description)
+			assert.Contains(wired.Logs()[1].Response, "handler reported: no id in response")
+		}
+
+		// followed by synthetic sent and delivered statuses
+		assert.Equal(MsgSent, statuses[NewMsgID(701)][1].Status())
+		assert.Equal(MsgDelivered, statuses[NewMsgID(701)][2].Status())
+	}
+
+	if assert.Equal(1, len(statuses[NewMsgID(702)])) {
+		assert.Equal(MsgFailed, statuses[NewMsgID(702)][0].Status())
+	}
+
+	assert.Equal(0, requests)
+	if assert.Equal(3, len(statuses[NewMsgID(703)])) {
+		wired := statuses[NewMsgID(703)][0]
+		assert.Equal(MsgWired, wired.Status())
+		assert.Equal(fallback.UUID(), wired.ChannelUUID())
+		assert.Equal("sandbox-703", wired.ExternalID())
+		assert.Equal(MsgSent, statuses[NewMsgID(703)][1].Status())
+		assert.Equal(MsgDelivered, statuses[NewMsgID(703)][2].Status())
+	}
+}
@@ -0,0 +1,143 @@
+package courier
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SendWindow is the hours and weekdays a channel is allowed to send messages in, in the channel's timezone
+type SendWindow struct {
+	location *time.Location
+
+	// minutes since midnight the window opens and closes, a window which closes before it opens runs past midnight
+	start int
+	end   int
+
+	// the weekdays the window opens on
+	days map[time.Weekday]bool
+
+	// whether the window applies to high priority messages as well as bulk ones
+	allPriorities bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// SendWindowForChannel returns the send window configured for the passed in channel, or nil if it doesn't have one. Hours
+// are configured like 08:00-20:00 and days as a list or comma separated string of days like mon,tue,wed.
+func SendWindowForChannel(channel Channel) (*SendWindow, error) {
+	hours := channel.StringConfigForKey(ConfigSendWindowHours, "")
+	days := ConfigStringsForKey(channel, ConfigSendWindowDays)
+	if hours == "" && len(days) == 0 {
+		return nil, nil
+	}
+
+	window := &SendWindow{start: 0, end: 24 * 60, days: make(map[time.Weekday]bool)}
+
+	location, err := time.LoadLocation(channel.StringConfigForKey(ConfigSendWindowTimezone, "UTC"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid send window timezone: %s", err)
+	}
+	window.location = location
+
+	if hours != "" {
+		parts := strings.Split(hours, "-")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid send window hours: %s", hours)
+		}
+		window.start, err = parseMinutes(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		window.end, err = parseMinutes(parts[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, day := range days {
+		day = strings.ToLower(day)
+		if len(day) > 3 {
+			day = day[:3]
+		}
+		weekday, found := weekdays[day]
+		if !found {
+			return nil, fmt.Errorf("invalid send window day: %s", day)
+		}
+		window.days[weekday] = true
+	}
+	if len(window.days) == 0 {
+		for _, weekday := range weekdays {
+			window.days[weekday] = true
+		}
+	}
+
+	window.allPriorities = fmt.Sprintf("%v", channel.ConfigForKey(ConfigSendWindowAllPriorities, false)) == "true"
+
+	return window, nil
+}
+
+// parseMinutes parses a time of day like 08:30 or 8 into the number of minutes since midnight
+func parseMinutes(value string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) > 2 {
+		return 0, fmt.Errorf("invalid send window time: %s", value)
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("invalid send window time: %s", value)
+	}
+
+	minutes := 0
+	if len(parts) == 2 {
+		minutes, err = strconv.Atoi(parts[1])
+		if err != nil || minutes < 0 || minutes > 59 {
+			return 0, fmt.Errorf("invalid send window time: %s", value)
+		}
+	}
+	return hours*60 + minutes, nil
+}
+
+// AppliesTo returns whether this window applies to messages of the passed in priority, windows only apply to bulk messages
+// unless configured to apply to all priorities
+func (w *SendWindow) AppliesTo(highPriority bool) bool {
+	return w.allPriorities || !highPriority
+}
+
+// NextOpen returns the passed in time if the window is open then, otherwise the next time it opens
+func (w *SendWindow) NextOpen(t time.Time) time.Time {
+	local := t.In(w.location)
+
+	// start the day before as that day's window may run past midnight into today
+	for d := -1; d <= 7; d++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()+d, 0, 0, 0, 0, w.location)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+
+		end := w.end
+		if end <= w.start {
+			end += 24 * 60
+		}
+		opens := time.Date(day.Year(), day.Month(), day.Day(), 0, w.start, 0, 0, w.location)
+		closes := time.Date(day.Year(), day.Month(), day.Day(), 0, end, 0, 0, w.location)
+
+		if !t.Before(opens) && t.Before(closes) {
+			return t
+		}
+		if opens.After(t) {
+			return opens
+		}
+	}
+	return t
+}
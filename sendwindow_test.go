@@ -0,0 +1,75 @@
+package courier
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendWindow(t *testing.T) {
+	noWindow := NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "EX", "2020", "US", nil)
+	window, err := SendWindowForChannel(noWindow)
+	assert.NoError(t, err)
+	assert.Nil(t, window)
+
+	_, err = SendWindowForChannel(NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "EX", "2020", "US",
+		map[string]interface{}{ConfigSendWindowHours: "8am-8pm"}))
+	assert.Error(t, err)
+
+	_, err = SendWindowForChannel(NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "EX", "2020", "US",
+		map[string]interface{}{ConfigSendWindowDays: "mon,funday"}))
+	assert.Error(t, err)
+
+	_, err = SendWindowForChannel(NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "EX", "2020", "US",
+		map[string]interface{}{ConfigSendWindowHours: "08:00-20:00", ConfigSendWindowTimezone: "Mars/Olympus"}))
+	assert.Error(t, err)
+
+	kigali, _ := time.LoadLocation("Africa/Kigali")
+
+	weekdays := NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "EX", "2020", "RW", map[string]interface{}{
+		ConfigSendWindowHours:    "08:00-20:00",
+		ConfigSendWindowDays:     []interface{}{"mon", "tue", "wed", "thu", "fri"},
+		ConfigSendWindowTimezone: "Africa/Kigali",
+	})
+	overnight := NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "EX", "2020", "US", map[string]interface{}{
+		ConfigSendWindowHours:         "22:00-06:30",
+		ConfigSendWindowAllPriorities: true,
+	})
+
+	tcs := []struct {
+		channel  Channel
+		now      time.Time
+		expected time.Time
+	}{
+		// Wednesday 10am in Kigali is open
+		{weekdays, time.Date(2018, 3, 7, 10, 0, 0, 0, kigali), time.Date(2018, 3, 7, 10, 0, 0, 0, kigali)},
+
+		// Wednesday 7am in Kigali opens at 8am
+		{weekdays, time.Date(2018, 3, 7, 7, 0, 0, 0, kigali), time.Date(2018, 3, 7, 8, 0, 0, 0, kigali)},
+
+		// Wednesday 8pm in Kigali opens Thursday at 8am
+		{weekdays, time.Date(2018, 3, 7, 20, 0, 0, 0, kigali), time.Date(2018, 3, 8, 8, 0, 0, 0, kigali)},
+
+		// Friday night in Kigali opens Monday at 8am, here given in UTC
+		{weekdays, time.Date(2018, 3, 9, 21, 0, 0, 0, time.UTC), time.Date(2018, 3, 12, 8, 0, 0, 0, kigali)},
+
+		// overnight windows are open either side of midnight
+		{overnight, time.Date(2018, 3, 7, 23, 0, 0, 0, time.UTC), time.Date(2018, 3, 7, 23, 0, 0, 0, time.UTC)},
+		{overnight, time.Date(2018, 3, 8, 6, 0, 0, 0, time.UTC), time.Date(2018, 3, 8, 6, 0, 0, 0, time.UTC)},
+		{overnight, time.Date(2018, 3, 8, 6, 30, 0, 0, time.UTC), time.Date(2018, 3, 8, 22, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range tcs {
+		window, err := SendWindowForChannel(tc.channel)
+		assert.NoError(t, err)
+		assert.True(t, tc.expected.Equal(window.NextOpen(tc.now)), "unexpected next open for %s: %s", tc.now, window.NextOpen(tc.now))
+	}
+
+	window, _ = SendWindowForChannel(weekdays)
+	assert.True(t, window.AppliesTo(false))
+	assert.False(t, window.AppliesTo(true))
+
+	window, _ = SendWindowForChannel(overnight)
+	assert.True(t, window.AppliesTo(true))
+}
@@ -105,6 +105,7 @@ func (s *server) Start() error {
 	s.router.MethodNotAllowed(s.handle405)
 	s.router.Get("/", s.handleIndex)
 	s.router.Get("/status", s.handleStatus)
+	s.router.Get("/l/{key}", s.handleShortLink)
 
 	// initialize our handlers
 	s.initializeChannelHandlers()
@@ -181,15 +182,44 @@ func (s *server) Stop() error {
 	return nil
 }
 
+// SendMsg sends the passed in msg through the handler of its channel. Every send goes through here, so msgs to sandboxed
+// channels are sent without any of the requests to their provider actually being made.
 func (s *server) SendMsg(ctx context.Context, msg Msg) (MsgStatus, error) {
+	if isSandboxed(s.config, msg.Channel()) {
+		return sandboxSend(ctx, s, msg)
+	}
+	return s.sendMsg(ctx, msg)
+}
+
+// sendMsg prepares the passed in msg for its channel and has its handler send it
+func (s *server) sendMsg(ctx context.Context, msg Msg) (MsgStatus, error) {
 	// find the handler for this message type
 	handler, found := activeHandlers[msg.Channel().ChannelType()]
 	if !found {
 		return nil, fmt.Errorf("unable to find handler for channel type: %s", msg.Channel().ChannelType())
 	}
 
+	// change our text according to the encoding policy of our channel
+	var prepLogs []*ChannelLog
+	if log := applyEncodingPolicy(handler, msg); log != nil {
+		prepLogs = append(prepLogs, log)
+	}
+
+	// resize or recompress any images which break the constraints of this channel type
+	if constrainer, isConstrainer := handler.(MediaConstrainer); isConstrainer && len(msg.Attachments()) > 0 {
+		prepLogs = append(prepLogs, constrainAttachments(ctx, s, constrainer.MediaConstraints(msg.Channel()), msg)...)
+	}
+
 	// have the handler send it
-	return handler.SendMsg(ctx, msg)
+	status, err := handler.SendMsg(ctx, msg)
+
+	if status != nil {
+		for _, log := range prepLogs {
+			status.AddLog(log)
+		}
+	}
+
+	return status, err
 }
 
 func (s *server) WaitGroup() *sync.WaitGroup { return s.waitGroup }
@@ -1,5 +1,10 @@
 package courier
 
+import (
+	"fmt"
+	"time"
+)
+
 // MsgStatusValue is the status of a message
 type MsgStatusValue string
 
@@ -11,10 +16,49 @@ const (
 	MsgWired     MsgStatusValue = "W"
 	MsgErrored   MsgStatusValue = "E"
 	MsgDelivered MsgStatusValue = "D"
+	MsgRead      MsgStatusValue = "R"
 	MsgFailed    MsgStatusValue = "F"
 	NilMsgStatus MsgStatusValue = ""
 )
 
+// MsgErrorCategory is a normalized reason for a message failing to send, so failures can be compared across channel types
+type MsgErrorCategory string
+
+// Possible values for MsgErrorCategory
+const (
+	MsgErrorInvalidURN      MsgErrorCategory = "invalid_urn"
+	MsgErrorOptedOut        MsgErrorCategory = "opted_out"
+	MsgErrorAuthFailure     MsgErrorCategory = "auth_failure"
+	MsgErrorRateLimited     MsgErrorCategory = "rate_limited"
+	MsgErrorContentRejected MsgErrorCategory = "content_rejected"
+	MsgErrorProvider        MsgErrorCategory = "provider_error"
+	MsgErrorExpired         MsgErrorCategory = "expired"
+	NilMsgErrorCategory     MsgErrorCategory = ""
+)
+
+// RateLimitedError is returned by handlers when sending a message because the channel's provider told us we are sending
+// too fast. Messages which fail with it are requeued rather than errored, and the channel slowed down.
+type RateLimitedError struct {
+	// how long the provider asked us to wait before sending again, zero if it didn't say
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited by provider, retry after %s", e.RetryAfter)
+	}
+	return "rate limited by provider"
+}
+
+// MsgStatusSource is where a status update came from
+type MsgStatusSource string
+
+// Possible values for MsgStatusSource
+const (
+	MsgStatusSourceSend     MsgStatusSource = "send"
+	MsgStatusSourceCallback MsgStatusSource = "callback"
+)
+
 //-----------------------------------------------------------------------------
 // MsgStatusUpdate Interface
 //-----------------------------------------------------------------------------
@@ -29,9 +73,30 @@ type MsgStatus interface {
 	ExternalID() string
 	SetExternalID(string)
 
+	// ExternalIDs returns the external ids of all the parts a message was sent as, the first being our external id
+	ExternalIDs() []string
+	AddExternalID(string)
+
+	// MsgCount returns the number of SMS segments a message was sent as, 0 if unknown
+	MsgCount() int
+	SetMsgCount(int)
+
 	Status() MsgStatusValue
 	SetStatus(MsgStatusValue)
 
+	// Source returns whether this status came from sending a message or from a provider callback, defaults to callback
+	Source() MsgStatusSource
+	SetSource(MsgStatusSource)
+
+	// RawStatus returns the status exactly as the provider reported it, if any
+	RawStatus() string
+	SetRawStatus(string)
+
+	// ErrorCategory and ErrorCode describe why a message failed to send, the code being the raw code from the provider
+	ErrorCategory() MsgErrorCategory
+	ErrorCode() string
+	SetError(category MsgErrorCategory, code string)
+
 	Logs() []*ChannelLog
 	AddLog(log *ChannelLog)
 }
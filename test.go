@@ -31,11 +31,17 @@ type MockBackend struct {
 	mutex           sync.RWMutex
 	outgoingMsgs    []Msg
 	msgStatuses     []MsgStatus
+	readWatermarks  map[urns.URN]time.Time
 	channelEvents   []ChannelEvent
 	lastContactName string
 
 	stoppedMsgContacts []Msg
+	rateLimitedMsgs    []Msg
+	shortLinks         map[string]*ShortLink
+	conversations      map[string]mockConversation
 	sentMsgs           map[MsgID]bool
+	sendingURNs        map[string]bool
+	savedMedia         map[string][]byte
 	redisPool          *redis.Pool
 }
 
@@ -64,10 +70,15 @@ func NewMockBackend() *MockBackend {
 	}
 
 	return &MockBackend{
-		channels:  make(map[ChannelUUID]Channel),
-		contacts:  make(map[urns.URN]Contact),
-		sentMsgs:  make(map[MsgID]bool),
-		redisPool: redisPool,
+		channels:       make(map[ChannelUUID]Channel),
+		contacts:       make(map[urns.URN]Contact),
+		readWatermarks: make(map[urns.URN]time.Time),
+		sentMsgs:       make(map[MsgID]bool),
+		sendingURNs:    make(map[string]bool),
+		savedMedia:     make(map[string][]byte),
+		shortLinks:     make(map[string]*ShortLink),
+		conversations:  make(map[string]mockConversation),
+		redisPool:      redisPool,
 	}
 }
 
@@ -106,7 +117,12 @@ func (mb *MockBackend) NewIncomingMsg(channel Channel, urn urns.URN, text string
 }
 
 // NewOutgoingMsg creates a new outgoing message from the given params
-func (mb *MockBackend) NewOutgoingMsg(channel Channel, id MsgID, urn urns.URN, text string, highPriority bool, replies []string, responseToID int64, responseToExternalID string) Msg {
+func (mb *MockBackend) NewOutgoingMsg(channel Channel, urn urns.URN, text string) Msg {
+	return &mockMsg{channel: channel, urn: urn, text: text}
+}
+
+// NewTestOutgoingMsg creates a new outgoing message with the passed in id and options, for testing sending
+func (mb *MockBackend) NewTestOutgoingMsg(channel Channel, id MsgID, urn urns.URN, text string, highPriority bool, replies []string, responseToID int64, responseToExternalID string) Msg {
 	msgResponseToID := NilMsgID
 	if responseToID != 0 {
 		msgResponseToID = NewMsgID(responseToID)
@@ -123,20 +139,36 @@ func (mb *MockBackend) PushOutgoingMsg(msg Msg) {
 	mb.outgoingMsgs = append(mb.outgoingMsgs, msg)
 }
 
+// QueueOutgoingMsg adds the passed in msg to our queue of messages to send
+func (mb *MockBackend) QueueOutgoingMsg(ctx context.Context, msg Msg) error {
+	mb.PushOutgoingMsg(msg)
+	return nil
+}
+
 // PopNextOutgoingMsg returns the next message that should be sent, or nil if there are none to send
 func (mb *MockBackend) PopNextOutgoingMsg(ctx context.Context) (Msg, error) {
 	mb.mutex.Lock()
 	defer mb.mutex.Unlock()
 
-	if len(mb.outgoingMsgs) > 0 {
-		msg, rest := mb.outgoingMsgs[0], mb.outgoingMsgs[1:]
-		mb.outgoingMsgs = rest
+	// like a real backend, we don't pop a msg to a URN while a previous msg to it is still being sent
+	for i, msg := range mb.outgoingMsgs {
+		key := sendingURNKey(msg)
+		if mb.sendingURNs[key] {
+			continue
+		}
+
+		mb.sendingURNs[key] = true
+		mb.outgoingMsgs = append(mb.outgoingMsgs[:i], mb.outgoingMsgs[i+1:]...)
 		return msg, nil
 	}
 
 	return nil, nil
 }
 
+func sendingURNKey(msg Msg) string {
+	return fmt.Sprintf("%s:%s", msg.Channel().UUID(), msg.URN().Identity())
+}
+
 // WasMsgSent returns whether the passed in msg was already sent
 func (mb *MockBackend) WasMsgSent(ctx context.Context, msg Msg) (bool, error) {
 	mb.mutex.Lock()
@@ -145,6 +177,64 @@ func (mb *MockBackend) WasMsgSent(ctx context.Context, msg Msg) (bool, error) {
 	return mb.sentMsgs[msg.ID()], nil
 }
 
+// RequeueRateLimitedMsg records that the passed in msg was rate limited and releases its URN
+func (mb *MockBackend) RequeueRateLimitedMsg(ctx context.Context, msg Msg, retryAfter time.Duration) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	mb.rateLimitedMsgs = append(mb.rateLimitedMsgs, msg)
+	delete(mb.sendingURNs, sendingURNKey(msg))
+	return nil
+}
+
+// RerouteOutgoingMsg returns a copy of the passed in msg on the passed in channel
+func (mb *MockBackend) RerouteOutgoingMsg(ctx context.Context, msg Msg, channel Channel) (Msg, error) {
+	rerouted := *msg.(*mockMsg)
+	rerouted.channel = channel
+	return &rerouted, nil
+}
+
+type mockConversation struct {
+	msgID MsgID
+	until time.Time
+}
+
+// StartsConversation returns whether the passed in msg starts a new conversation with its contact
+func (mb *MockBackend) StartsConversation(ctx context.Context, msg Msg, window time.Duration) (bool, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	key := sendingURNKey(msg)
+	conversation, found := mb.conversations[key]
+	if found && time.Now().Before(conversation.until) {
+		return conversation.msgID == msg.ID(), nil
+	}
+
+	mb.conversations[key] = mockConversation{msgID: msg.ID(), until: time.Now().Add(window)}
+	return true, nil
+}
+
+// SaveShortLink saves the passed in short link
+func (mb *MockBackend) SaveShortLink(ctx context.Context, link *ShortLink) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	mb.shortLinks[link.Key] = link
+	return nil
+}
+
+// GetShortLink returns the short link with the passed in key
+func (mb *MockBackend) GetShortLink(ctx context.Context, key string) (*ShortLink, error) {
+	mb.mutex.RLock()
+	defer mb.mutex.RUnlock()
+
+	link, found := mb.shortLinks[key]
+	if !found {
+		return nil, ErrShortLinkNotFound
+	}
+	return link, nil
+}
+
 // StopMsgContact stops the contact for the passed in msg
 func (mb *MockBackend) StopMsgContact(ctx context.Context, msg Msg) {
 	mb.stoppedMsgContacts = append(mb.stoppedMsgContacts, msg)
@@ -164,6 +254,7 @@ func (mb *MockBackend) MarkOutgoingMsgComplete(ctx context.Context, msg Msg, s M
 	defer mb.mutex.Unlock()
 
 	mb.sentMsgs[msg.ID()] = true
+	delete(mb.sendingURNs, sendingURNKey(msg))
 }
 
 // WriteChannelLogs writes the passed in channel logs to the DB
@@ -171,6 +262,24 @@ func (mb *MockBackend) WriteChannelLogs(ctx context.Context, logs []*ChannelLog)
 	return nil
 }
 
+// SaveMedia saves the passed in media, returning an attachment with a fake URL for it
+func (mb *MockBackend) SaveMedia(ctx context.Context, channel Channel, contentType string, data []byte) (string, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	url := fmt.Sprintf("https://backend.com/media/%d", len(mb.savedMedia)+1)
+	mb.savedMedia[url] = data
+	return fmt.Sprintf("%s:%s", contentType, url), nil
+}
+
+// GetSavedMedia returns the media saved at the passed in URL
+func (mb *MockBackend) GetSavedMedia(url string) []byte {
+	mb.mutex.RLock()
+	defer mb.mutex.RUnlock()
+
+	return mb.savedMedia[url]
+}
+
 // SetErrorOnQueue is a mock method which makes the QueueMsg call throw the passed in error on next call
 func (mb *MockBackend) SetErrorOnQueue(shouldError bool) {
 	mb.errorOnQueue = shouldError
@@ -193,6 +302,7 @@ func (mb *MockBackend) NewMsgStatusForID(channel Channel, id MsgID, status MsgSt
 		channel:   channel,
 		id:        id,
 		status:    status,
+		source:    MsgStatusSourceCallback,
 		createdOn: time.Now().In(time.UTC),
 	}
 }
@@ -203,6 +313,7 @@ func (mb *MockBackend) NewMsgStatusForExternalID(channel Channel, externalID str
 		channel:    channel,
 		externalID: externalID,
 		status:     status,
+		source:     MsgStatusSourceCallback,
 		createdOn:  time.Now().In(time.UTC),
 	}
 }
@@ -216,6 +327,23 @@ func (mb *MockBackend) WriteMsgStatus(ctx context.Context, status MsgStatus) err
 	return nil
 }
 
+// WriteMsgReadWatermark writes the read watermark for the passed in URN
+func (mb *MockBackend) WriteMsgReadWatermark(ctx context.Context, channel Channel, urn urns.URN, watermark time.Time) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	mb.readWatermarks[urn] = watermark
+	return nil
+}
+
+// GetReadWatermark returns the last read watermark written for the passed in URN
+func (mb *MockBackend) GetReadWatermark(urn urns.URN) time.Time {
+	mb.mutex.RLock()
+	defer mb.mutex.RUnlock()
+
+	return mb.readWatermarks[urn]
+}
+
 // NewChannelEvent creates a new channel event with the passed in parameters
 func (mb *MockBackend) NewChannelEvent(channel Channel, eventType ChannelEventType, urn urns.URN) ChannelEvent {
 	return &mockChannelEvent{
@@ -446,6 +574,7 @@ type mockMsg struct {
 	receivedOn *time.Time
 	sentOn     *time.Time
 	wiredOn    *time.Time
+	expiresOn  *time.Time
 }
 
 func (m *mockMsg) Channel() Channel             { return m.channel }
@@ -466,6 +595,7 @@ func (m *mockMsg) ResponseToExternalID() string { return m.responseToExternalID
 func (m *mockMsg) ReceivedOn() *time.Time { return m.receivedOn }
 func (m *mockMsg) SentOn() *time.Time     { return m.sentOn }
 func (m *mockMsg) WiredOn() *time.Time    { return m.wiredOn }
+func (m *mockMsg) ExpiresOn() *time.Time  { return m.expiresOn }
 
 func (m *mockMsg) WithContactName(name string) Msg   { m.contactName = name; return m }
 func (m *mockMsg) WithURNAuth(auth string) Msg       { m.urnAuth = auth; return m }
@@ -473,18 +603,34 @@ func (m *mockMsg) WithReceivedOn(date time.Time) Msg { m.receivedOn = &date; ret
 func (m *mockMsg) WithExternalID(id string) Msg      { m.externalID = id; return m }
 func (m *mockMsg) WithID(id MsgID) Msg               { m.id = id; return m }
 func (m *mockMsg) WithUUID(uuid MsgUUID) Msg         { m.uuid = uuid; return m }
+func (m *mockMsg) WithText(text string) Msg          { m.text = text; return m }
 func (m *mockMsg) WithAttachment(url string) Msg     { m.attachments = append(m.attachments, url); return m }
 
+func (m *mockMsg) ReplaceAttachment(original string, replacement string) Msg {
+	for i := range m.attachments {
+		if m.attachments[i] == original {
+			m.attachments[i] = replacement
+		}
+	}
+	return m
+}
+
 //-----------------------------------------------------------------------------
 // Mock status implementation
 //-----------------------------------------------------------------------------
 
 type mockMsgStatus struct {
-	channel    Channel
-	id         MsgID
-	externalID string
-	status     MsgStatusValue
-	createdOn  time.Time
+	channel     Channel
+	id          MsgID
+	externalID  string
+	externalIDs []string
+	msgCount    int
+	errCategory MsgErrorCategory
+	errCode     string
+	status      MsgStatusValue
+	source      MsgStatusSource
+	rawStatus   string
+	createdOn   time.Time
 
 	logs []*ChannelLog
 }
@@ -496,9 +642,33 @@ func (m *mockMsgStatus) EventID() int64           { return m.id.Int64 }
 func (m *mockMsgStatus) ExternalID() string      { return m.externalID }
 func (m *mockMsgStatus) SetExternalID(id string) { m.externalID = id }
 
+func (m *mockMsgStatus) ExternalIDs() []string { return m.externalIDs }
+func (m *mockMsgStatus) AddExternalID(id string) {
+	if m.externalID == "" {
+		m.externalID = id
+	}
+	m.externalIDs = append(m.externalIDs, id)
+}
+
+func (m *mockMsgStatus) MsgCount() int         { return m.msgCount }
+func (m *mockMsgStatus) SetMsgCount(count int) { m.msgCount = count }
+
 func (m *mockMsgStatus) Status() MsgStatusValue          { return m.status }
 func (m *mockMsgStatus) SetStatus(status MsgStatusValue) { m.status = status }
 
+func (m *mockMsgStatus) Source() MsgStatusSource          { return m.source }
+func (m *mockMsgStatus) SetSource(source MsgStatusSource) { m.source = source }
+
+func (m *mockMsgStatus) RawStatus() string          { return m.rawStatus }
+func (m *mockMsgStatus) SetRawStatus(status string) { m.rawStatus = status }
+
+func (m *mockMsgStatus) ErrorCategory() MsgErrorCategory { return m.errCategory }
+func (m *mockMsgStatus) ErrorCode() string               { return m.errCode }
+func (m *mockMsgStatus) SetError(category MsgErrorCategory, code string) {
+	m.errCategory = category
+	m.errCode = code
+}
+
 func (m *mockMsgStatus) Logs() []*ChannelLog    { return m.logs }
 func (m *mockMsgStatus) AddLog(log *ChannelLog) { m.logs = append(m.logs, log) }
 
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
@@ -25,6 +26,7 @@ type RequestResponse struct {
 	Response      string
 	Body          []byte
 	ContentLength int
+	RetryAfter    time.Duration
 	Elapsed       time.Duration
 }
 
@@ -63,7 +65,7 @@ func MakeHTTPRequestWithClient(req *http.Request, client *http.Client) (*Request
 		return rr, err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := clientForRequest(req, client).Do(req)
 	if err != nil {
 		rr, _ := newRRFromRequestAndError(req, string(requestTrace), err)
 		return rr, err
@@ -75,6 +77,24 @@ func MakeHTTPRequestWithClient(req *http.Request, client *http.Client) (*Request
 	return rr, err
 }
 
+type requestStubKey struct{}
+
+// WithRequestStub returns a copy of the passed in context which makes requests made with it through our functions go to
+// the passed in stub instead of the network, so we can see what would be sent without sending it
+func WithRequestStub(ctx context.Context, stub http.RoundTripper) context.Context {
+	return context.WithValue(ctx, requestStubKey{}, stub)
+}
+
+// clientForRequest returns the client the passed in request should be made with, which is the passed in client unless
+// the request's context has a stub
+func clientForRequest(req *http.Request, client *http.Client) *http.Client {
+	stub, hasStub := req.Context().Value(requestStubKey{}).(http.RoundTripper)
+	if !hasStub {
+		return client
+	}
+	return &http.Client{Transport: stub, Timeout: client.Timeout}
+}
+
 // newRRFromResponse creates a new RequestResponse based on the passed in http request and error (when we received no response)
 func newRRFromRequestAndError(r *http.Request, requestTrace string, requestError error) (*RequestResponse, error) {
 	rr := RequestResponse{ContentLength: -1}
@@ -105,6 +125,9 @@ func newRRFromResponse(method string, requestTrace string, r *http.Response) (*R
 		}
 	}
 
+	// set how long we were asked to wait before retrying if we have its header
+	rr.RetryAfter = parseRetryAfter(r.Header.Get("Retry-After"))
+
 	// set our status based on our status code
 	if rr.StatusCode/100 == 2 {
 		rr.Status = RRStatusSuccess
@@ -193,3 +216,22 @@ var (
 
 	HTTPUserAgent = "Courier/vDev"
 )
+
+// parseRetryAfter parses the value of a Retry-After header, which can be a number of seconds or a date, returning zero if
+// it isn't set or valid
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	date, err := http.ParseTime(value)
+	if err == nil && date.After(time.Now()) {
+		return date.Sub(time.Now())
+	}
+	return 0
+}
@@ -1,6 +1,14 @@
 package utils
 
-import "testing"
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestClient(t *testing.T) {
 	client := GetHTTPClient()
@@ -22,3 +30,72 @@ func TestClient(t *testing.T) {
 		t.Error("GetHTTPClient should always return same client")
 	}
 }
+
+func TestRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", r.URL.Query().Get("retry_after"))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	tcs := []struct {
+		retryAfter string
+		expected   time.Duration
+	}{
+		{"", 0},
+		{"30", time.Second * 30},
+		{"soon", 0},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", 0},
+	}
+
+	for _, tc := range tcs {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"?retry_after="+tc.retryAfter, nil)
+		rr, _ := MakeHTTPRequest(req)
+		if rr.RetryAfter != tc.expected {
+			t.Errorf("expected retry after of %s for '%s', got %s", tc.expected, tc.retryAfter, rr.RetryAfter)
+		}
+	}
+
+	// dates in the future are how long until then
+	if retryAfter := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); retryAfter < time.Second*55 || retryAfter > time.Minute {
+		t.Errorf("unexpected retry after for date: %s", retryAfter)
+	}
+}
+
+type stubTransport struct {
+	requests []*http.Request
+}
+
+func (t *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req)
+	return &http.Response{StatusCode: 200, Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1, Body: ioutil.NopCloser(strings.NewReader("stubbed")), Request: req}, nil
+}
+
+func TestRequestStub(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("real"))
+	}))
+	defer server.Close()
+
+	stub := &stubTransport{}
+	ctx := WithRequestStub(context.Background(), stub)
+
+	// requests made with our stub's context never reach the server
+	req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("hello"))
+	rr, err := MakeHTTPRequest(req.WithContext(ctx))
+	if err != nil || string(rr.Body) != "stubbed" || len(stub.requests) != 1 || calls != 0 {
+		t.Errorf("expected stubbed request, got body '%s', err %v, %d stubbed, %d calls", rr.Body, err, len(stub.requests), calls)
+	}
+	if !strings.Contains(rr.Request, "hello") {
+		t.Errorf("expected stubbed request to be traced, got: %s", rr.Request)
+	}
+
+	// other requests do
+	req, _ = http.NewRequest(http.MethodPost, server.URL, strings.NewReader("hello"))
+	rr, err = MakeHTTPRequest(req)
+	if err != nil || string(rr.Body) != "real" || len(stub.requests) != 1 || calls != 1 {
+		t.Errorf("expected real request, got body '%s', err %v, %d stubbed, %d calls", rr.Body, err, len(stub.requests), calls)
+	}
+}
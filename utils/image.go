@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	// we also want to be able to decode gifs
+	_ "image/gif"
+)
+
+// ErrImageUnconstrainable is returned when we can't get an image within the constraints asked of us
+var ErrImageUnconstrainable = errors.New("unable to fit image within constraints")
+
+// the JPEG qualities we try, in order, when recompressing an image
+var jpegQualities = []int{85, 70, 55}
+
+// the most times we'll scale an image down trying to get it under a byte limit
+const maxScaleAttempts = 8
+
+// ImageTransform describes an image which was resized or recompressed to fit some constraints
+type ImageTransform struct {
+	OriginalFormat string
+	OriginalWidth  int
+	OriginalHeight int
+	OriginalBytes  int
+
+	ContentType string
+	Width       int
+	Height      int
+	Quality     int
+	Data        []byte
+}
+
+// String returns a description of our transform suitable for channel logs
+func (t *ImageTransform) String() string {
+	quality := ""
+	if t.Quality > 0 {
+		quality = fmt.Sprintf(" quality %d", t.Quality)
+	}
+	return fmt.Sprintf("%s %dx%d (%d bytes) -> %s %dx%d%s (%d bytes)",
+		t.OriginalFormat, t.OriginalWidth, t.OriginalHeight, t.OriginalBytes, t.ContentType, t.Width, t.Height, quality, len(t.Data))
+}
+
+// ConstrainImage resizes and recompresses the passed in image so that it is no larger than the passed in number of
+// bytes and dimensions, zero values meaning no limit. If the image already fits, nil is returned.
+func ConstrainImage(data []byte, maxBytes int64, maxWidth int, maxHeight int) (*ImageTransform, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	width, height := fitDimensions(config.Width, config.Height, maxWidth, maxHeight)
+	if width == config.Width && height == config.Height && (maxBytes <= 0 || int64(len(data)) <= maxBytes) {
+		return nil, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	transform := &ImageTransform{
+		OriginalFormat: format,
+		OriginalWidth:  config.Width,
+		OriginalHeight: config.Height,
+		OriginalBytes:  len(data),
+	}
+
+	src := toRGBA(img)
+	for attempt := 0; attempt < maxScaleAttempts; attempt++ {
+		resized := src
+		if width != src.Bounds().Dx() || height != src.Bounds().Dy() {
+			resized = resizeImage(src, width, height)
+		}
+		transform.Width, transform.Height = width, height
+
+		// images which weren't JPEGs to begin with may have transparency, so try to keep them as PNGs
+		if format != "jpeg" {
+			buf := &bytes.Buffer{}
+			if err := png.Encode(buf, resized); err != nil {
+				return nil, err
+			}
+			if maxBytes <= 0 || int64(buf.Len()) <= maxBytes {
+				transform.ContentType, transform.Quality, transform.Data = "image/png", 0, buf.Bytes()
+				return transform, nil
+			}
+		}
+
+		flattened := flattenImage(resized)
+		for _, quality := range jpegQualities {
+			buf := &bytes.Buffer{}
+			if err := jpeg.Encode(buf, flattened, &jpeg.Options{Quality: quality}); err != nil {
+				return nil, err
+			}
+			if maxBytes <= 0 || int64(buf.Len()) <= maxBytes {
+				transform.ContentType, transform.Quality, transform.Data = "image/jpeg", quality, buf.Bytes()
+				return transform, nil
+			}
+		}
+
+		// still too big, scale down and try again
+		if width == 1 && height == 1 {
+			break
+		}
+		width, height = maxInt(width*3/4, 1), maxInt(height*3/4, 1)
+	}
+
+	return nil, ErrImageUnconstrainable
+}
+
+// fitDimensions returns the largest dimensions with the same aspect ratio as those passed in which fit within our maximums
+func fitDimensions(width int, height int, maxWidth int, maxHeight int) (int, int) {
+	if maxWidth > 0 && width > maxWidth {
+		height = maxInt(height*maxWidth/width, 1)
+		width = maxWidth
+	}
+	if maxHeight > 0 && height > maxHeight {
+		width = maxInt(width*maxHeight/height, 1)
+		height = maxHeight
+	}
+	return width, height
+}
+
+// toRGBA returns the passed in image as an RGBA image with bounds starting at 0,0
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// flattenImage draws the passed in image onto a white background, as JPEGs have no transparency
+func flattenImage(img *image.RGBA) *image.RGBA {
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), &image.Uniform{color.White}, image.ZP, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, image.ZP, draw.Over)
+	return flat
+}
+
+// resizeImage scales the passed in image to the passed in dimensions, each destination pixel being the average of
+// the source pixels it covers
+func resizeImage(src *image.RGBA, width int, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+
+	for dy := 0; dy < height; dy++ {
+		y0 := dy * srcHeight / height
+		y1 := maxInt((dy+1)*srcHeight/height, y0+1)
+
+		for dx := 0; dx < width; dx++ {
+			x0 := dx * srcWidth / width
+			x1 := maxInt((dx+1)*srcWidth/width, x0+1)
+
+			var r, g, b, a, count int
+			for sy := y0; sy < y1; sy++ {
+				offset := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(src.Pix[offset])
+					g += int(src.Pix[offset+1])
+					b += int(src.Pix[offset+2])
+					a += int(src.Pix[offset+3])
+					offset += 4
+					count++
+				}
+			}
+
+			offset := dst.PixOffset(dx, dy)
+			dst.Pix[offset] = uint8(r / count)
+			dst.Pix[offset+1] = uint8(g / count)
+			dst.Pix[offset+2] = uint8(b / count)
+			dst.Pix[offset+3] = uint8(a / count)
+		}
+	}
+
+	return dst
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
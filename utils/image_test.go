@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// noisyImage returns an image of random pixels, which compresses poorly
+func noisyImage(width int, height int) image.Image {
+	random := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(random.Intn(256)), uint8(random.Intn(256)), uint8(random.Intn(256)), 255})
+		}
+	}
+	return img
+}
+
+func TestConstrainImage(t *testing.T) {
+	pngBuf := &bytes.Buffer{}
+	png.Encode(pngBuf, noisyImage(400, 300))
+	jpegBuf := &bytes.Buffer{}
+	jpeg.Encode(jpegBuf, noisyImage(400, 300), &jpeg.Options{Quality: 100})
+
+	// images which already fit are left alone
+	transform, err := ConstrainImage(pngBuf.Bytes(), 0, 400, 300)
+	assert.NoError(t, err)
+	assert.Nil(t, transform)
+
+	// too wide, scaled down keeping our aspect ratio and format
+	transform, err = ConstrainImage(pngBuf.Bytes(), 0, 200, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", transform.ContentType)
+	assert.Equal(t, 200, transform.Width)
+	assert.Equal(t, 150, transform.Height)
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(transform.Data))
+	assert.NoError(t, err)
+	assert.Equal(t, "png", format)
+	assert.Equal(t, 200, config.Width)
+	assert.Equal(t, 150, config.Height)
+	assert.Contains(t, transform.String(), "png 400x300")
+	assert.Contains(t, transform.String(), "-> image/png 200x150")
+
+	// too tall
+	transform, err = ConstrainImage(jpegBuf.Bytes(), 0, 0, 150)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", transform.ContentType)
+	assert.Equal(t, 200, transform.Width)
+	assert.Equal(t, 150, transform.Height)
+
+	// too many bytes, recompressed and scaled down until it fits
+	transform, err = ConstrainImage(jpegBuf.Bytes(), 20000, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", transform.ContentType)
+	assert.True(t, len(transform.Data) <= 20000)
+	assert.True(t, transform.Width < 400)
+	assert.True(t, transform.Quality > 0)
+
+	// pngs that can't fit as pngs become jpegs
+	transform, err = ConstrainImage(pngBuf.Bytes(), 100000, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", transform.ContentType)
+	assert.True(t, len(transform.Data) <= 100000)
+
+	// not an image
+	_, err = ConstrainImage([]byte("not an image"), 100, 0, 0)
+	assert.Error(t, err)
+}
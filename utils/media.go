@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"time"
+
+	filetype "gopkg.in/h2non/filetype.v1"
+)
+
+// MediaSniffLength is the number of bytes at the start of a media body we look at to figure out its type
+const MediaSniffLength = 512
+
+// ErrMediaTooLarge is returned when a media body exceeds the maximum size allowed for it
+var ErrMediaTooLarge = errors.New("media exceeds maximum allowed size")
+
+// MediaStream is a streamed media body. The first bytes of the body are sniffed to determine the
+// content type of the media, the rest is only read as the stream is consumed, and never more than
+// MaxSize bytes will be read.
+type MediaStream struct {
+	// ContentType is the sniffed content type of the media, falling back to the Content-Type header
+	ContentType string
+
+	// Extension is the file extension for the sniffed content type, if known
+	Extension string
+
+	// ContentLength is the length of the media as reported by the server, -1 if unknown
+	ContentLength int64
+
+	// MaxSize is the maximum number of bytes we will read from the body
+	MaxSize int64
+
+	// Header is the header of the response we are streaming
+	Header http.Header
+
+	head   []byte
+	reader *bufio.Reader
+	body   io.ReadCloser
+	read   int64
+	hash   hash.Hash
+}
+
+// Head returns the first bytes of the stream, those used for sniffing the content type
+func (s *MediaStream) Head() []byte { return s.head }
+
+// BytesRead returns the number of bytes read from the stream so far
+func (s *MediaStream) BytesRead() int64 { return s.read }
+
+// SHA256 returns the hex encoded SHA256 hash of the bytes read from the stream so far
+func (s *MediaStream) SHA256() string { return hex.EncodeToString(s.hash.Sum(nil)) }
+
+// Read satisfies io.Reader, returning ErrMediaTooLarge if the body exceeds our max size
+func (s *MediaStream) Read(p []byte) (int, error) {
+	if s.MaxSize > 0 && s.read >= s.MaxSize {
+		// peek to see if there's anything left, if so we are too large
+		if _, err := s.reader.Peek(1); err == nil {
+			return 0, ErrMediaTooLarge
+		}
+		return 0, io.EOF
+	}
+
+	if s.MaxSize > 0 && int64(len(p)) > s.MaxSize-s.read {
+		p = p[:s.MaxSize-s.read]
+	}
+
+	n, err := s.reader.Read(p)
+	s.read += int64(n)
+	s.hash.Write(p[:n])
+	return n, err
+}
+
+// Close closes the underlying body of our stream
+func (s *MediaStream) Close() error {
+	return s.body.Close()
+}
+
+// String returns a description of our stream suitable for channel logs in place of the body
+func (s *MediaStream) String() string {
+	return fmt.Sprintf("[media body omitted, content-type: %s, content-length: %d, max-size: %d]", s.ContentType, s.ContentLength, s.MaxSize)
+}
+
+// NewMediaStream creates a new media stream from the passed in response, sniffing its content type. Callers
+// are responsible for closing the returned stream.
+func NewMediaStream(resp *http.Response, maxSize int64) (*MediaStream, error) {
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		resp.Body.Close()
+		return nil, ErrMediaTooLarge
+	}
+
+	stream := &MediaStream{
+		ContentLength: resp.ContentLength,
+		MaxSize:       maxSize,
+		Header:        resp.Header,
+		reader:        bufio.NewReaderSize(resp.Body, MediaSniffLength),
+		body:          resp.Body,
+		hash:          sha256.New(),
+	}
+
+	// peek at our first bytes, it's ok to get less than we ask for
+	head, err := stream.reader.Peek(MediaSniffLength)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		resp.Body.Close()
+		return nil, err
+	}
+	stream.head = head
+
+	// first try getting our type from the first bytes of our body
+	fileType, _ := filetype.Match(head)
+	if fileType != filetype.Unknown {
+		stream.ContentType = fileType.MIME.Value
+		stream.Extension = fileType.Extension
+	} else {
+		// otherwise fall back to our content type header
+		stream.ContentType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	}
+
+	return stream, nil
+}
+
+// OpenMediaStream fires the passed in request and returns the body of the response as a MediaStream. The
+// RequestResponse returned only records the headers of the request and response, never the body. Callers
+// are responsible for closing the returned stream.
+func OpenMediaStream(req *http.Request, maxSize int64) (*RequestResponse, *MediaStream, error) {
+	req.Header.Set("User-Agent", HTTPUserAgent)
+
+	start := time.Now()
+	requestTrace, err := httputil.DumpRequestOut(req, false)
+	if err != nil {
+		rr, _ := newRRFromRequestAndError(req, string(requestTrace), err)
+		return rr, nil, err
+	}
+
+	resp, err := clientForRequest(req, GetHTTPClient()).Do(req)
+	if err != nil {
+		rr, _ := newRRFromRequestAndError(req, string(requestTrace), err)
+		return rr, nil, err
+	}
+
+	rr := &RequestResponse{
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		StatusCode:    resp.StatusCode,
+		Request:       string(requestTrace),
+		ContentLength: int(resp.ContentLength),
+		Elapsed:       time.Now().Sub(start),
+	}
+
+	// non 200s we read as regular text responses so they can be logged
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		rr.Status = RRStatusFailure
+		response, _ := httputil.DumpResponse(resp, false)
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 10000))
+		rr.Response = string(response) + string(body)
+		rr.Body = body
+		return rr, nil, fmt.Errorf("received non 200 status: %d", rr.StatusCode)
+	}
+
+	rr.Status = RRStatusSuccess
+	stream, err := NewMediaStream(resp, maxSize)
+	response, _ := httputil.DumpResponse(resp, false)
+	rr.Response = string(response)
+	if err != nil {
+		return rr, nil, err
+	}
+	rr.Response += stream.String()
+
+	return rr, stream, nil
+}
+
+// SpoolMediaStream copies the passed in stream to a temporary file, returning it rewound and ready to be read
+// from. This lets us hand media to APIs which need to seek in the body without buffering it in memory. Callers
+// are responsible for closing and removing the returned file.
+func SpoolMediaStream(stream *MediaStream) (*os.File, error) {
+	file, err := ioutil.TempFile("", "courier-media-")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(file, stream)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// MakeHTTPRequestWithMediaBody fires the passed in request, which is expected to have a media body. It acts like
+// MakeHTTPRequest but the request body is never read in order to be logged.
+func MakeHTTPRequestWithMediaBody(req *http.Request) (*RequestResponse, error) {
+	req.Header.Set("User-Agent", HTTPUserAgent)
+
+	start := time.Now()
+	requestTrace, err := httputil.DumpRequestOut(req, false)
+	if err != nil {
+		rr, _ := newRRFromRequestAndError(req, string(requestTrace), err)
+		return rr, err
+	}
+	requestTrace = append(requestTrace, []byte(fmt.Sprintf("[media body omitted, content-type: %s, content-length: %d]", req.Header.Get("Content-Type"), req.ContentLength))...)
+
+	resp, err := clientForRequest(req, GetHTTPClient()).Do(req)
+	if err != nil {
+		rr, _ := newRRFromRequestAndError(req, string(requestTrace), err)
+		return rr, err
+	}
+	defer resp.Body.Close()
+
+	rr, err := newRRFromResponse(req.Method, string(requestTrace), resp)
+	rr.Elapsed = time.Now().Sub(start)
+	return rr, err
+}
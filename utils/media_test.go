@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMediaStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/giffy":
+			w.Write([]byte("GIF87aandstuff"))
+		case "/header":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("nothingbody"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("not found"))
+		}
+	}))
+	defer server.Close()
+
+	// type sniffed from the body
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/giffy", nil)
+	rr, stream, err := OpenMediaStream(req, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/gif", stream.ContentType)
+	assert.Equal(t, "gif", stream.Extension)
+	assert.Equal(t, int64(14), stream.ContentLength)
+	assert.Contains(t, rr.Response, "[media body omitted, content-type: image/gif, content-length: 14, max-size: 100]")
+	assert.NotContains(t, rr.Response, "andstuff")
+
+	body, err := ioutil.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, "GIF87aandstuff", string(body))
+	assert.Equal(t, int64(14), stream.BytesRead())
+	assert.Equal(t, "8d6e5d16375222bcfbfb06f41c92e8e0a062ebe52e395da56caa6f5d3a5f010c", stream.SHA256())
+	stream.Close()
+
+	// type from our header
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/header", nil)
+	_, stream, err = OpenMediaStream(req, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", stream.ContentType)
+	assert.Equal(t, "", stream.Extension)
+
+	// spool it to a file
+	file, err := SpoolMediaStream(stream)
+	assert.NoError(t, err)
+	body, _ = ioutil.ReadAll(file)
+	assert.Equal(t, "nothingbody", string(body))
+	file.Close()
+	os.Remove(file.Name())
+	stream.Close()
+
+	// too large according to our content length
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/giffy", nil)
+	_, _, err = OpenMediaStream(req, 10)
+	assert.Equal(t, ErrMediaTooLarge, err)
+
+	// non 200s are errors and have their body logged
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/missing", nil)
+	rr, _, err = OpenMediaStream(req, 10)
+	assert.EqualError(t, err, "received non 200 status: 404")
+	assert.Contains(t, rr.Response, "not found")
+}
+
+func TestMediaStreamMaxSize(t *testing.T) {
+	// no content length so we only find out we are too large while reading
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.(http.Flusher).Flush()
+		for i := 0; i < 100; i++ {
+			w.Write([]byte("0123456789"))
+		}
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	_, stream, err := OpenMediaStream(req, 500)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), stream.ContentLength)
+
+	_, err = ioutil.ReadAll(stream)
+	assert.Equal(t, ErrMediaTooLarge, err)
+	assert.Equal(t, int64(500), stream.BytesRead())
+	stream.Close()
+
+	// exactly our max size is fine
+	req, _ = http.NewRequest(http.MethodGet, server.URL, nil)
+	_, stream, err = OpenMediaStream(req, 1000)
+	assert.NoError(t, err)
+
+	body, err := ioutil.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, len(body))
+	stream.Close()
+}
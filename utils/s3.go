@@ -3,6 +3,7 @@ package utils
 import (
 	"bytes"
 	"fmt"
+	"io"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -26,9 +27,14 @@ func TestS3(s3Client s3iface.S3API, bucket string) error {
 
 // PutS3File writes the passed in file to the bucket with the passed in content type
 func PutS3File(s3Client s3iface.S3API, bucket string, path string, contentType string, contents []byte) (string, error) {
+	return PutS3Stream(s3Client, bucket, path, contentType, bytes.NewReader(contents))
+}
+
+// PutS3Stream writes the contents of the passed in reader to the bucket with the passed in content type
+func PutS3Stream(s3Client s3iface.S3API, bucket string, path string, contentType string, body io.ReadSeeker) (string, error) {
 	params := &s3.PutObjectInput{
 		Bucket:      aws.String(bucket),
-		Body:        bytes.NewReader(contents),
+		Body:        body,
 		Key:         aws.String(path),
 		ContentType: aws.String(contentType),
 		ACL:         aws.String(s3.BucketCannedACLPublicRead),
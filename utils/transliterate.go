@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"bytes"
+	"unicode"
+)
+
+// Script is a writing system we know how to transliterate to Latin
+type Script string
+
+// the scripts we can transliterate
+const (
+	ScriptArabic   Script = "arabic"
+	ScriptCyrillic Script = "cyrillic"
+	ScriptGreek    Script = "greek"
+)
+
+// AllScripts is all the scripts we can transliterate
+var AllScripts = []Script{ScriptArabic, ScriptCyrillic, ScriptGreek}
+
+// lowercase mappings, uppercase letters are mapped from their lowercase versions and capitalized
+var cyrillicToLatin = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh", 'з': "z", 'и': "i",
+	'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t",
+	'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "",
+	'э': "e", 'ю': "yu", 'я': "ya",
+
+	// ukrainian, belarusian, serbian and macedonian
+	'є': "ye", 'і': "i", 'ї': "yi", 'ґ': "g", 'ў': "u", 'ђ': "dj", 'ј': "j", 'љ': "lj", 'њ': "nj", 'ћ': "c",
+	'џ': "dz", 'ѓ': "gj", 'ќ': "kj", 'ѕ': "dz",
+}
+
+var greekToLatin = map[rune]string{
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th", 'ι': "i", 'κ': "k",
+	'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p", 'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t",
+	'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o",
+	'ά': "a", 'έ': "e", 'ή': "i", 'ί': "i", 'ό': "o", 'ύ': "y", 'ώ': "o", 'ϊ': "i", 'ϋ': "y", 'ΐ': "i", 'ΰ': "y",
+}
+
+var arabicToLatin = map[rune]string{
+	'ا': "a", 'أ': "a", 'إ': "i", 'آ': "aa", 'ء': "'", 'ؤ': "'", 'ئ': "'", 'ب': "b", 'ت': "t", 'ث': "th",
+	'ج': "j", 'ح': "h", 'خ': "kh", 'د': "d", 'ذ': "dh", 'ر': "r", 'ز': "z", 'س': "s", 'ش': "sh", 'ص': "s",
+	'ض': "d", 'ط': "t", 'ظ': "z", 'ع': "'", 'غ': "gh", 'ف': "f", 'ق': "q", 'ك': "k", 'ل': "l", 'م': "m",
+	'ن': "n", 'ه': "h", 'ة': "a", 'و': "w", 'ي': "y", 'ى': "a", 'پ': "p", 'چ': "ch", 'ژ': "zh", 'گ': "g",
+	'ک': "k", 'ی': "y",
+
+	// short vowel marks
+	'َ': "a", 'ُ': "u", 'ِ': "i", 'ً': "an", 'ٌ': "un", 'ٍ': "in", 'ْ': "", 'ّ': "",
+
+	// punctuation and digits
+	'،': ",", '؛': ";", '؟': "?", '٪': "%",
+	'٠': "0", '١': "1", '٢': "2", '٣': "3", '٤': "4", '٥': "5", '٦': "6", '٧': "7", '٨': "8", '٩': "9",
+}
+
+var scriptTables = map[Script]map[rune]string{
+	ScriptArabic:   arabicToLatin,
+	ScriptCyrillic: cyrillicToLatin,
+	ScriptGreek:    greekToLatin,
+}
+
+// Transliterate replaces any characters in the passed in text which are in one of the passed in scripts with their
+// Latin equivalents, characters in other scripts are left unchanged
+func Transliterate(text string, scripts []Script) string {
+	tables := make([]map[rune]string, 0, len(scripts))
+	for _, script := range scripts {
+		if table, found := scriptTables[script]; found {
+			tables = append(tables, table)
+		}
+	}
+
+	output := bytes.Buffer{}
+	for _, r := range text {
+		latin, found := transliterateRune(r, tables)
+		if found {
+			output.WriteString(latin)
+		} else {
+			output.WriteRune(r)
+		}
+	}
+	return output.String()
+}
+
+func transliterateRune(r rune, tables []map[rune]string) (string, bool) {
+	lower := unicode.ToLower(r)
+	for _, table := range tables {
+		latin, found := table[lower]
+		if !found {
+			continue
+		}
+
+		// capitalize the first letter of uppercase letters, so Ж becomes Zh
+		if lower != r && len(latin) > 0 {
+			latin = string(unicode.ToUpper(rune(latin[0]))) + latin[1:]
+		}
+		return latin, true
+	}
+	return "", false
+}
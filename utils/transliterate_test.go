@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransliterate(t *testing.T) {
+	tcs := []struct {
+		text    string
+		scripts []Script
+		latin   string
+	}{
+		{"hello", AllScripts, "hello"},
+		{"Привет, Жанна!", AllScripts, "Privet, Zhanna!"},
+		{"Щука и ёж", []Script{ScriptCyrillic}, "Shchuka i yozh"},
+		{"Καλημέρα Θεσσαλονίκη", AllScripts, "Kalimera Thessaloniki"},
+		{"مرحبا ١٢٣", AllScripts, "mrhba 123"},
+		{"Привет Καλημέρα", []Script{ScriptGreek}, "Привет Kalimera"},
+		{"Привет", nil, "Привет"},
+	}
+	for _, tc := range tcs {
+		assert.Equal(t, tc.latin, Transliterate(tc.text, tc.scripts), tc.text)
+	}
+}